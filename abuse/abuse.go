@@ -0,0 +1,263 @@
+package abuse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anomaly signals reported for a fingerprint
+const (
+	SignalRepeatedPrompt = "REPEATED_PROMPT"
+	SignalRetryRate      = "EXTREME_RETRY_RATE"
+)
+
+const (
+	// promptWindow is the period over which identical prompts are counted
+	promptWindow = time.Minute
+	// idleExpiry forgets fingerprints not seen for this long
+	idleExpiry = time.Hour
+	// maxFingerprints bounds memory use before idle fingerprints are pruned
+	maxFingerprints = 10000
+	// reportLimit caps the number of fingerprints in a report
+	reportLimit = 50
+)
+
+// Fingerprint identifies a request without retaining its content: hashes of the
+// normalized prompt and client credential, and the client's network prefix
+type Fingerprint struct {
+	ID         string `json:"id"`
+	PromptHash string `json:"prompt_hash"`
+	TokenHash  string `json:"token_hash"`
+	IPPrefix   string `json:"ip_prefix"`
+}
+
+// Compute builds the fingerprint of a request body from a client credential and IP
+func Compute(body map[string]interface{}, credential, clientIP string) Fingerprint {
+	fp := Fingerprint{
+		PromptHash: shortHash(normalizePrompt(body)),
+		TokenHash:  shortHash(credential),
+		IPPrefix:   ipPrefix(clientIP),
+	}
+	fp.ID = shortHash(fp.PromptHash + "|" + fp.TokenHash + "|" + fp.IPPrefix)
+	return fp
+}
+
+// Thresholds decide when activity is flagged as anomalous
+type Thresholds struct {
+	// PromptsPerMinute flags identical prompts seen at least this often in the last minute
+	PromptsPerMinute int
+	// RetriesPerSession flags fingerprints averaging at least this many retries per session
+	RetriesPerSession float64
+}
+
+// Entry is one fingerprint's activity in a report
+type Entry struct {
+	Fingerprint
+	FirstSeen        time.Time `json:"first_seen"`
+	LastSeen         time.Time `json:"last_seen"`
+	Requests         int64     `json:"requests"`
+	Sessions         int64     `json:"sessions"`
+	Retries          int64     `json:"retries"`
+	PromptsPerMinute int       `json:"identical_prompts_last_minute"`
+	Signals          []string  `json:"signals"`
+}
+
+// Report lists the most active fingerprints, flagged ones first
+type Report struct {
+	GeneratedAt  time.Time `json:"generated_at"`
+	Fingerprints []Entry   `json:"fingerprints"`
+}
+
+type stats struct {
+	fingerprint Fingerprint
+	firstSeen   time.Time
+	lastSeen    time.Time
+	requests    int64
+	sessions    int64
+	retries     int64
+}
+
+// Tracker accumulates per-fingerprint activity
+type Tracker struct {
+	mu      sync.Mutex
+	entries map[string]*stats
+	prompts map[string][]time.Time
+}
+
+var (
+	globalTracker *Tracker
+	once          sync.Once
+)
+
+// GetGlobalTracker returns the process-wide tracker
+func GetGlobalTracker() *Tracker {
+	once.Do(func() {
+		globalTracker = NewTracker()
+	})
+	return globalTracker
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		entries: make(map[string]*stats),
+		prompts: make(map[string][]time.Time),
+	}
+}
+
+// Observe records a request with the given fingerprint
+func (t *Tracker) Observe(fp Fingerprint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if len(t.entries) >= maxFingerprints {
+		t.pruneLocked(now)
+	}
+
+	entry, ok := t.entries[fp.ID]
+	if !ok {
+		entry = &stats{fingerprint: fp, firstSeen: now}
+		t.entries[fp.ID] = entry
+	}
+	entry.lastSeen = now
+	entry.requests++
+
+	t.prompts[fp.PromptHash] = append(recentOnly(t.prompts[fp.PromptHash], now), now)
+}
+
+// RecordSession records the retries a finished streaming session needed
+func (t *Tracker) RecordSession(fp Fingerprint, retries int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.entries[fp.ID]; ok {
+		entry.sessions++
+		entry.retries += int64(retries)
+	}
+}
+
+// Report returns the most active fingerprints with anomaly signals evaluated against thresholds
+func (t *Tracker) Report(thresholds Thresholds) Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.pruneLocked(now)
+
+	entries := make([]Entry, 0, len(t.entries))
+	for _, s := range t.entries {
+		entry := Entry{
+			Fingerprint:      s.fingerprint,
+			FirstSeen:        s.firstSeen,
+			LastSeen:         s.lastSeen,
+			Requests:         s.requests,
+			Sessions:         s.sessions,
+			Retries:          s.retries,
+			PromptsPerMinute: len(recentOnly(t.prompts[s.fingerprint.PromptHash], now)),
+			Signals:          []string{},
+		}
+		if thresholds.PromptsPerMinute > 0 && entry.PromptsPerMinute >= thresholds.PromptsPerMinute {
+			entry.Signals = append(entry.Signals, SignalRepeatedPrompt)
+		}
+		if thresholds.RetriesPerSession > 0 && s.sessions > 0 && float64(s.retries)/float64(s.sessions) >= thresholds.RetriesPerSession {
+			entry.Signals = append(entry.Signals, SignalRetryRate)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if len(entries[i].Signals) != len(entries[j].Signals) {
+			return len(entries[i].Signals) > len(entries[j].Signals)
+		}
+		return entries[i].Requests > entries[j].Requests
+	})
+	if len(entries) > reportLimit {
+		entries = entries[:reportLimit]
+	}
+
+	return Report{GeneratedAt: now.UTC(), Fingerprints: entries}
+}
+
+// pruneLocked forgets idle fingerprints and prompt timestamps outside the window
+func (t *Tracker) pruneLocked(now time.Time) {
+	for id, entry := range t.entries {
+		if now.Sub(entry.lastSeen) > idleExpiry {
+			delete(t.entries, id)
+		}
+	}
+	for hash, times := range t.prompts {
+		if times = recentOnly(times, now); len(times) == 0 {
+			delete(t.prompts, hash)
+		} else {
+			t.prompts[hash] = times
+		}
+	}
+}
+
+// recentOnly drops timestamps older than the prompt window from a time-ordered slice
+func recentOnly(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-promptWindow)
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// normalizePrompt reduces a request to its roles, part types and
+// case/whitespace-normalized text, so trivially varied copies hash the same
+func normalizePrompt(body map[string]interface{}) string {
+	var b strings.Builder
+	contents, _ := body["contents"].([]interface{})
+	for _, c := range contents {
+		content, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := content["role"].(string)
+		b.WriteString(role)
+		b.WriteString(":")
+
+		parts, _ := content["parts"].([]interface{})
+		for _, p := range parts {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if text, ok := part["text"].(string); ok {
+				b.WriteString(strings.Join(strings.Fields(strings.ToLower(text)), " "))
+			} else {
+				for kind := range part {
+					b.WriteString("<" + kind + ">")
+				}
+			}
+			b.WriteString("|")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ipPrefix truncates an address to its /24 (IPv4) or /48 (IPv6) network
+func ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "unknown"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%s/24", v4.Mask(net.CIDRMask(24, 32)))
+	}
+	return fmt.Sprintf("%s/48", parsed.Mask(net.CIDRMask(48, 128)))
+}
+
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
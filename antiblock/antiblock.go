@@ -0,0 +1,129 @@
+// Package antiblock embeds the Gemini antiblock proxy in an existing HTTP
+// server. The returned handler proxies Gemini API paths such as
+// /v1beta/models/{model}:streamGenerateContent; mount it under a prefix with
+// http.StripPrefix:
+//
+//	cfg := config.LoadConfig()
+//	handler, err := antiblock.NewHandler(cfg)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	router.PathPrefix("/gemini/").Handler(
+//		http.StripPrefix("/gemini", handler))
+package antiblock
+
+import (
+	"net/http"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/engine"
+	"gemini-antiblock/handlers"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/upstream"
+)
+
+type options struct {
+	client    *http.Client
+	upstreams *upstream.Upstreams
+	live      *config.Live
+	keys      *upstream.KeyPool
+	keyMap    *upstream.KeyMap
+	logger    engine.Logger
+	observer  engine.Observer
+}
+
+// Option configures the handler returned by NewHandler
+type Option func(*options)
+
+// WithClient sends upstream requests through client instead of one built from the configuration
+func WithClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithUpstreams lets speculative retries race a different one of the
+// upstream base URLs tracked by upstreams, which should be those the client
+// given to WithClient fails over between
+func WithUpstreams(upstreams *upstream.Upstreams) Option {
+	return func(o *options) {
+		o.upstreams = upstreams
+	}
+}
+
+// WithKeyPool authenticates requests that bring no API key with keys from
+// pool instead of a pool built from the configuration
+func WithKeyPool(pool *upstream.KeyPool) Option {
+	return func(o *options) {
+		o.keys = pool
+	}
+}
+
+// WithKeyMap admits only the client keys in m and serves them with the
+// upstream keys they map to, instead of a map built from the configuration
+func WithKeyMap(m *upstream.KeyMap) Option {
+	return func(o *options) {
+		o.keyMap = m
+	}
+}
+
+// WithLiveConfig reads per-request settings from live, so that replacing its
+// configuration changes the handler's behaviour without a restart
+func WithLiveConfig(live *config.Live) Option {
+	return func(o *options) {
+		o.live = live
+	}
+}
+
+// WithLogger routes the proxy's log output to l. Logging is process-wide,
+// so this affects every handler in the process.
+func WithLogger(l engine.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithMetricsSink forwards stream interruptions, retries, network errors and
+// upstream response times to observer, in addition to the built-in metrics
+func WithMetricsSink(observer engine.Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// NewHandler returns an http.Handler that proxies Gemini API requests with
+// the antiblock retry logic. It fails if no client is given and one cannot be
+// built from the configuration.
+func NewHandler(cfg *config.Config, opts ...Option) (http.Handler, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.logger != nil {
+		logger.SetSink(o.logger)
+	}
+	if o.client == nil {
+		upstreams := upstream.NewUpstreams(cfg.UpstreamURLBases, cfg.UpstreamBreakerThreshold, cfg.UpstreamBreakerCooldown)
+		client, err := upstream.NewClientWithUpstreams(cfg, upstreams)
+		if err != nil {
+			return nil, err
+		}
+		o.client = client
+		if o.upstreams == nil && cfg.UpstreamMode != upstream.UpstreamModeVertex {
+			o.upstreams = upstreams
+		}
+	}
+
+	h := handlers.NewProxyHandler(cfg, o.client)
+	h.Observer = o.observer
+	h.Live = o.live
+	h.Upstreams = o.upstreams
+	if o.keys != nil {
+		h.Keys = o.keys
+	}
+	if o.keyMap != nil {
+		h.KeyMap = o.keyMap
+	}
+	return h.Pipeline(), nil
+}
@@ -0,0 +1,203 @@
+// Package client calls the Gemini REST API through the antiblock proxy and
+// exposes the proxy's own request options and error details as Go types.
+//
+//	c := client.New("http://localhost:8080", os.Getenv("GEMINI_API_KEY"))
+//	stream, err := c.StreamGenerateContent(ctx, "gemini-2.5-flash", request,
+//		client.WithPriority(client.PriorityBatch))
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//	for {
+//		chunk, err := stream.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Print(chunk.Text())
+//	}
+//
+// Requests may be any value that marshals to a generateContent request body.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Request priorities understood by the proxy's concurrency limiter
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// Client sends Gemini API requests through the proxy
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends requests through httpClient instead of http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// New creates a client for the proxy at baseURL. An empty apiKey leaves
+// authentication to the proxy's key pool.
+func New(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// RequestOption sets a proxy-specific option on one request
+type RequestOption func(*http.Request)
+
+// WithPriority sets the request's priority for the proxy's stream limiter.
+// Batch requests are shed when no stream slot frees up in time.
+func WithPriority(priority string) RequestOption {
+	return func(r *http.Request) {
+		r.Header.Set("X-Proxy-Priority", priority)
+	}
+}
+
+// WithFakeStream makes the proxy serve a streaming request from
+// non-streaming upstream calls, or not, regardless of its configuration
+func WithFakeStream(enabled bool) RequestOption {
+	return func(r *http.Request) {
+		r.Header.Set("X-Proxy-Fake-Stream", strconv.FormatBool(enabled))
+	}
+}
+
+// WithAggregate makes the proxy serve a generateContent request from a
+// stream with mid-stream retries, or not, regardless of its configuration
+func WithAggregate(enabled bool) RequestOption {
+	return func(r *http.Request) {
+		r.Header.Set("X-Proxy-Aggregate", strconv.FormatBool(enabled))
+	}
+}
+
+// WithHeader sets an arbitrary request header
+func WithHeader(key, value string) RequestOption {
+	return func(r *http.Request) {
+		r.Header.Set(key, value)
+	}
+}
+
+// Part is one part of a content turn
+type Part struct {
+	Text         string                 `json:"text,omitempty"`
+	Thought      bool                   `json:"thought,omitempty"`
+	FunctionCall map[string]interface{} `json:"functionCall,omitempty"`
+}
+
+// Content is one turn of a conversation
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+// Candidate is one generated answer
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
+	Index        int     `json:"index"`
+}
+
+// GenerateContentResponse is a generateContent response or one streamed chunk of it
+type GenerateContentResponse struct {
+	Candidates     []Candidate            `json:"candidates"`
+	PromptFeedback map[string]interface{} `json:"promptFeedback,omitempty"`
+	UsageMetadata  map[string]interface{} `json:"usageMetadata,omitempty"`
+	ModelVersion   string                 `json:"modelVersion,omitempty"`
+}
+
+// Text returns the non-thought text of the first candidate
+func (r *GenerateContentResponse) Text() string {
+	if len(r.Candidates) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	for _, part := range r.Candidates[0].Content.Parts {
+		if !part.Thought {
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String()
+}
+
+// GenerateContent sends a non-streaming generateContent request
+func (c *Client) GenerateContent(ctx context.Context, model string, request interface{}, opts ...RequestOption) (*GenerateContentResponse, error) {
+	resp, err := c.post(ctx, model+":generateContent", request, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result GenerateContentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid generateContent response: %w", err)
+	}
+	return &result, nil
+}
+
+// StreamGenerateContent sends a streaming request; read the answer with Stream.Next
+func (c *Client) StreamGenerateContent(ctx context.Context, model string, request interface{}, opts ...RequestOption) (*Stream, error) {
+	resp, err := c.post(ctx, model+":streamGenerateContent?alt=sse", request, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newStream(resp), nil
+}
+
+// post sends request to the model method and returns the response if it succeeded
+func (c *Client) post(ctx context.Context, method string, request interface{}, opts []RequestOption) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	url := c.baseURL + "/v1beta/models/" + strings.TrimPrefix(method, "models/")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-Goog-Api-Key", c.apiKey)
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errorBody, _ := io.ReadAll(resp.Body)
+		return nil, parseError(resp.StatusCode, resp.Header.Get("X-Request-ID"), errorBody)
+	}
+	return resp, nil
+}
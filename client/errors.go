@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// proxyDomain is the ErrorInfo domain of errors raised by the proxy itself
+const proxyDomain = "gemini-antiblock"
+
+// Error is a Gemini API error, raised either by the upstream API or by the proxy
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	// Reason is the proxy's machine-readable error code, such as
+	// "PROXY_AT_CAPACITY" or "RETRY_LIMIT_EXCEEDED"; empty for upstream errors
+	Reason string `json:"-"`
+	// RequestID identifies the request in the proxy's logs
+	RequestID string                   `json:"-"`
+	Details   []map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("gemini proxy error %d %s (%s): %s", e.Code, e.Status, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("gemini error %d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// FromProxy reports whether the proxy raised the error rather than the upstream API
+func (e *Error) FromProxy() bool {
+	return e.Reason != ""
+}
+
+// parseError decodes a Google-style error body, falling back to the raw text
+func parseError(code int, requestID string, body []byte) error {
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		return &Error{Code: code, Message: string(body), RequestID: requestID}
+	}
+
+	e := envelope.Error
+	if e.Code == 0 {
+		e.Code = code
+	}
+	e.RequestID = requestID
+	for _, detail := range e.Details {
+		if domain, _ := detail["domain"].(string); domain == proxyDomain {
+			e.Reason, _ = detail["reason"].(string)
+		}
+	}
+	return e
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Stream reads the chunks of a streaming response
+type Stream struct {
+	// RequestID identifies the request in the proxy's logs
+	RequestID string
+
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+func newStream(resp *http.Response) *Stream {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Stream{
+		RequestID: resp.Header.Get("X-Request-ID"),
+		body:      resp.Body,
+		scanner:   scanner,
+	}
+}
+
+// Next returns the next chunk, io.EOF at the end of the stream, or an *Error
+// if the stream ended with an error event (for example when the proxy ran
+// out of retries)
+func (s *Stream) Next() (*GenerateContentResponse, error) {
+	event, data, err := s.nextEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	if event == "error" || strings.HasPrefix(data, `{"error"`) {
+		return nil, parseError(0, s.RequestID, []byte(data))
+	}
+
+	var chunk GenerateContentResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return nil, fmt.Errorf("invalid stream chunk: %w", err)
+	}
+	return &chunk, nil
+}
+
+// Close releases the connection
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// nextEvent reads SSE lines up to the next event that carries data
+func (s *Stream) nextEvent() (string, string, error) {
+	event := ""
+	var data []string
+	for s.scanner.Scan() {
+		line := strings.TrimRight(s.scanner.Text(), "\r")
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				return event, strings.Join(data, "\n"), nil
+			}
+			event = ""
+		case strings.HasPrefix(line, ":"):
+			// Comment, e.g. a keepalive
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if len(data) > 0 {
+		return event, strings.Join(data, "\n"), nil
+	}
+	return "", "", io.EOF
+}
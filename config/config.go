@@ -1,31 +1,330 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Config holds all configuration values
+// Config holds all configuration values. The env tag names the setting in
+// the environment and in the effective configuration dump.
 type Config struct {
-	UpstreamURLBase           string
-	MaxConsecutiveRetries     int
-	DebugMode                 bool
-	RetryDelayMs              time.Duration
-	SwallowThoughtsAfterRetry bool
-	Port                      string
+	// UpstreamURLBase is the first of UpstreamURLBases, which requests are built against
+	UpstreamURLBase string
+	// UpstreamURLBases are tried in order when an upstream is unreachable or fails with a 5xx
+	UpstreamURLBases           []string           `env:"UPSTREAM_URL_BASE"`
+	MaxConsecutiveRetries      int                `env:"MAX_CONSECUTIVE_RETRIES"`
+	DebugMode                  bool               `env:"DEBUG_MODE"`
+	LogFormat                  string             `env:"LOG_FORMAT"`
+	LogLevel                   string             `env:"LOG_LEVEL"`
+	OTLPEndpoint               string             `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPHeaders                map[string]string  `env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	OTelServiceName            string             `env:"OTEL_SERVICE_NAME"`
+	RetryDelayMs               time.Duration      `env:"RETRY_DELAY_MS"`
+	RetryMaxDelay              time.Duration      `env:"RETRY_MAX_DELAY_MS"`
+	RetryJitter                float64            `env:"RETRY_JITTER"`
+	RateLimitRetries           int                `env:"RATE_LIMIT_RETRIES"`
+	RateLimitDelay             time.Duration      `env:"RATE_LIMIT_RETRY_DELAY_MS"`
+	MaxRateLimitDelay          time.Duration      `env:"RATE_LIMIT_MAX_DELAY_MS"`
+	SwallowThoughtsAfterRetry  bool               `env:"SWALLOW_THOUGHTS_AFTER_RETRY"`
+	DoneToken                  string             `env:"DONE_TOKEN"`
+	ContinuationPrompt         string             `env:"RETRY_CONTINUATION_PROMPT"`
+	ContinuationPromptFile     string             `env:"RETRY_CONTINUATION_PROMPT_FILE"`
+	RetryDedupWindow           int                `env:"RETRY_DEDUP_WINDOW"`
+	MaxRetryContextChars       int                `env:"MAX_RETRY_CONTEXT_CHARS"`
+	RetryContextOverflow       string             `env:"RETRY_CONTEXT_OVERFLOW"`
+	DebugRecordDir             string             `env:"DEBUG_RECORD_DIR"`
+	Port                       string             `env:"PORT"`
+	SlowConsumerThreshold      time.Duration      `env:"SLOW_CONSUMER_THRESHOLD_MS"`
+	SlowConsumerBufferBytes    int                `env:"SLOW_CONSUMER_BUFFER_BYTES"`
+	SlowConsumerPolicy         string             `env:"SLOW_CONSUMER_POLICY"`
+	TrustedProxies             []string           `env:"TRUSTED_PROXIES"`
+	AdminToken                 string             `env:"ADMIN_TOKEN"`
+	AdminTokenFile             string             `env:"ADMIN_TOKEN_FILE"`
+	WarmupConnections          int                `env:"UPSTREAM_WARMUP_CONNECTIONS"`
+	UpstreamProxy              string             `env:"UPSTREAM_PROXY"`
+	MaxRequestBodyBytes        int                `env:"MAX_REQUEST_BODY_BYTES"`
+	UpstreamBreakerThreshold   int                `env:"UPSTREAM_BREAKER_THRESHOLD"`
+	UpstreamBreakerCooldown    time.Duration      `env:"UPSTREAM_BREAKER_COOLDOWN_MS"`
+	UpstreamHealthInterval     time.Duration      `env:"UPSTREAM_HEALTH_INTERVAL_MS"`
+	WarmupInterval             time.Duration      `env:"UPSTREAM_WARMUP_INTERVAL_MS"`
+	SpeculativeRetryAfter      int                `env:"SPECULATIVE_RETRY_AFTER"`
+	NetworkErrorBackoff        map[string]float64 `env:"NETWORK_ERROR_BACKOFF"`
+	RetryOnBlock               bool               `env:"RETRY_ON_BLOCK"`
+	RetryOnDrop                bool               `env:"RETRY_ON_DROP"`
+	RetryOnFinishDuringThought bool               `env:"RETRY_ON_FINISH_DURING_THOUGHT"`
+	RetryOnIncomplete          bool               `env:"RETRY_ON_INCOMPLETE"`
+	RetryOnEmpty               bool               `env:"RETRY_ON_EMPTY"`
+	FinishReasonPolicy         map[string]string  `env:"FINISH_REASON_POLICY"`
+	RefusalPhrases             []string           `env:"REFUSAL_PHRASES"`
+	MiddlewareDisabled         []string           `env:"MIDDLEWARE_DISABLED"`
+	ModelStatsFile             string             `env:"MODEL_STATS_FILE"`
+	AdaptiveRetry              bool               `env:"ADAPTIVE_RETRY"`
+	AdaptiveMinSamples         int                `env:"ADAPTIVE_MIN_SAMPLES"`
+	AdaptiveMinRetries         int                `env:"ADAPTIVE_MIN_RETRIES"`
+	AdaptiveMaxRetries         int                `env:"ADAPTIVE_MAX_RETRIES"`
+	AdaptiveMinRetryDelay      time.Duration      `env:"ADAPTIVE_MIN_RETRY_DELAY_MS"`
+	AdaptiveMaxRetryDelay      time.Duration      `env:"ADAPTIVE_MAX_RETRY_DELAY_MS"`
+	MaxConcurrentStreams       int                `env:"MAX_CONCURRENT_STREAMS"`
+	BatchQueueTimeout          time.Duration      `env:"BATCH_QUEUE_TIMEOUT_MS"`
+	ClientRateLimit            int                `env:"CLIENT_RATE_LIMIT"`
+	ClientMaxStreams           int                `env:"CLIENT_MAX_STREAMS"`
+	QuotaPerMinute             int                `env:"QUOTA_REQUESTS_PER_MINUTE"`
+	QuotaPerDay                int                `env:"QUOTA_REQUESTS_PER_DAY"`
+	QuotaMaxStreams            int                `env:"QUOTA_MAX_STREAMS"`
+	QuotaKeyLimits             map[string]string  `env:"QUOTA_KEY_LIMITS"`
+	UsageQuotaPerDay           int                `env:"USAGE_QUOTA_PER_DAY"`
+	UsageQuotaPerMonth         int                `env:"USAGE_QUOTA_PER_MONTH"`
+	UsageQuotaKeyLimits        map[string]string  `env:"USAGE_QUOTA_KEY_LIMITS"`
+	ExpvarEnabled              bool               `env:"EXPVAR_ENABLED"`
+	PrometheusEnabled          bool               `env:"PROMETHEUS_ENABLED"`
+	DrainTimeout               time.Duration      `env:"DRAIN_TIMEOUT_MS"`
+	UpgradeReadyTimeout        time.Duration      `env:"UPGRADE_READY_TIMEOUT_MS"`
+	RetryStormThreshold        int                `env:"RETRY_STORM_THRESHOLD"`
+	MaxAttemptDuration         time.Duration      `env:"MAX_ATTEMPT_DURATION_MS"`
+	MaxSessionDuration         time.Duration      `env:"MAX_SESSION_DURATION_MS"`
+	MaskUpstreamErrors         bool               `env:"MASK_UPSTREAM_ERRORS"`
+	ErrorStatusMap             map[string]string  `env:"ERROR_STATUS_MAP"`
+	AutoCacheEnabled           bool               `env:"AUTO_CACHE_ENABLED"`
+	AutoCacheMinChars          int                `env:"AUTO_CACHE_MIN_CHARS"`
+	AutoCacheTTL               time.Duration      `env:"AUTO_CACHE_TTL_MS"`
+	StorageBackend             string             `env:"STORAGE_BACKEND"`
+	StorageDSN                 string             `env:"STORAGE_DSN"`
+	AbuseDetection             bool               `env:"ABUSE_DETECTION"`
+	AbusePromptRate            int                `env:"ABUSE_PROMPT_RATE"`
+	AbuseRetryRate             float64            `env:"ABUSE_RETRY_RATE"`
+	HoneypotMode               bool               `env:"HONEYPOT_MODE"`
+	HoneypotRateLimit          int                `env:"HONEYPOT_RATE_LIMIT"`
+	ReportWebhookURL           string             `env:"REPORT_WEBHOOK_URL"`
+	ReportWebhookFormat        string             `env:"REPORT_WEBHOOK_FORMAT"`
+	SSEOutputMode              string             `env:"SSE_OUTPUT_MODE"`
+	SSEKeepaliveInterval       time.Duration      `env:"SSE_KEEPALIVE_INTERVAL_MS"`
+	SSEBufferSize              int                `env:"SSE_BUFFER_SIZE"`
+	SSEMaxLineSize             int                `env:"SSE_MAX_LINE_BYTES"`
+	FakeStreaming              bool               `env:"FAKE_STREAMING"`
+	StreamAggregation          bool               `env:"STREAM_AGGREGATION"`
+	ManagementPrefix           string             `env:"MANAGEMENT_PREFIX"`
+	TLSDomains                 []string           `env:"TLS_DOMAINS"`
+	ACMECacheDir               string             `env:"ACME_CACHE_DIR"`
+	ACMEEmail                  string             `env:"ACME_EMAIL"`
+	ACMEHTTPPort               string             `env:"ACME_HTTP_PORT"`
+	ACMEDirectoryURL           string             `env:"ACME_DIRECTORY_URL"`
+	TLSCertFile                string             `env:"TLS_CERT_FILE"`
+	TLSKeyFile                 string             `env:"TLS_KEY_FILE"`
+	TLSClientCAFile            string             `env:"TLS_CLIENT_CA_FILE"`
+	UpstreamAPIKeys            []string           `env:"UPSTREAM_API_KEYS"`
+	UpstreamAPIKeysFile        string             `env:"UPSTREAM_API_KEYS_FILE"`
+	ClientKeyMap               map[string]string  `env:"CLIENT_KEY_MAP"`
+	ClientKeyMapFile           string             `env:"CLIENT_KEY_MAP_FILE"`
+	SecretRefreshInterval      time.Duration      `env:"SECRET_REFRESH_INTERVAL_MS"`
+	KeyCooldown                time.Duration      `env:"KEY_COOLDOWN_MS"`
+	ModelCatalogRefresh        time.Duration      `env:"MODEL_CATALOG_REFRESH_MS"`
+	ModelsCacheTTL             time.Duration      `env:"MODELS_CACHE_TTL_MS"`
+	ResponseCacheTTL           time.Duration      `env:"RESPONSE_CACHE_TTL_MS"`
+	ResponseCacheMaxEntries    int                `env:"RESPONSE_CACHE_MAX_ENTRIES"`
+	EmbedBatchSize             int                `env:"EMBED_BATCH_SIZE"`
+	EmbedConcurrency           int                `env:"EMBED_CONCURRENCY"`
+	EmbedMaxRetries            int                `env:"EMBED_MAX_RETRIES"`
+	CountTokensFallback        bool               `env:"COUNT_TOKENS_FALLBACK"`
+	UpstreamMode               string             `env:"UPSTREAM_MODE"`
+	VertexProject              string             `env:"VERTEX_PROJECT"`
+	VertexLocation             string             `env:"VERTEX_LOCATION"`
+	VertexCredentialsFile      string             `env:"VERTEX_CREDENTIALS_FILE"`
+	VertexURLBase              string             `env:"VERTEX_URL_BASE"`
+	ModelAliases               map[string]string  `env:"MODEL_ALIASES"`
+	SanitizeRequests           bool               `env:"SANITIZE_REQUESTS"`
+	StreamResumeTTL            time.Duration      `env:"STREAM_RESUME_TTL_MS"`
+	StreamResumeBufferBytes    int                `env:"STREAM_RESUME_BUFFER_BYTES"`
+	MetricsPush                string             `env:"METRICS_PUSH"`
+	MetricsStatsDAddr          string             `env:"METRICS_STATSD_ADDR"`
+	MetricsPushInterval        time.Duration      `env:"METRICS_PUSH_INTERVAL_MS"`
+	Profiles                   []string           `env:"PROFILES"`
+	// ProfileSettings holds the PROFILE_<NAME>_<SETTING> variables of each profile
+	ProfileSettings map[string]map[string]string
 }
 
 // LoadConfig loads configuration from environment variables
 func LoadConfig() *Config {
+	upstreamBases := getEnvList("UPSTREAM_URL_BASE")
+	if len(upstreamBases) == 0 {
+		upstreamBases = []string{"https://generativelanguage.googleapis.com"}
+	}
+	for i, base := range upstreamBases {
+		upstreamBases[i] = strings.TrimSuffix(base, "/")
+	}
+	profiles := getEnvList("PROFILES")
+
 	return &Config{
-		UpstreamURLBase:           getEnvString("UPSTREAM_URL_BASE", "https://generativelanguage.googleapis.com"),
+		UpstreamURLBase:           upstreamBases[0],
+		UpstreamURLBases:          upstreamBases,
 		MaxConsecutiveRetries:     getEnvInt("MAX_CONSECUTIVE_RETRIES", 100),
 		DebugMode:                 getEnvBool("DEBUG_MODE", true),
+		LogFormat:                 getEnvString("LOG_FORMAT", "text"),
+		LogLevel:                  getEnvString("LOG_LEVEL", ""),
+		OTLPEndpoint:              getEnvString("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		OTLPHeaders:               getEnvStringMap("OTEL_EXPORTER_OTLP_HEADERS"),
+		OTelServiceName:           getEnvString("OTEL_SERVICE_NAME", "gemini-antiblock"),
 		RetryDelayMs:              time.Duration(getEnvInt("RETRY_DELAY_MS", 750)) * time.Millisecond,
+		RetryMaxDelay:             time.Duration(getEnvInt("RETRY_MAX_DELAY_MS", 8000)) * time.Millisecond,
+		RetryJitter:               getEnvFloat("RETRY_JITTER", 0.2),
+		RateLimitRetries:          getEnvInt("RATE_LIMIT_RETRIES", 3),
+		RateLimitDelay:            time.Duration(getEnvInt("RATE_LIMIT_RETRY_DELAY_MS", 5000)) * time.Millisecond,
+		MaxRateLimitDelay:         time.Duration(getEnvInt("RATE_LIMIT_MAX_DELAY_MS", 60000)) * time.Millisecond,
 		SwallowThoughtsAfterRetry: getEnvBool("SWALLOW_THOUGHTS_AFTER_RETRY", true),
+		DoneToken:                 getEnvString("DONE_TOKEN", "[done]"),
+		ContinuationPrompt:        getEnvString("RETRY_CONTINUATION_PROMPT", ""),
+		ContinuationPromptFile:    getEnvString("RETRY_CONTINUATION_PROMPT_FILE", ""),
+		RetryDedupWindow:          getEnvInt("RETRY_DEDUP_WINDOW", 0),
+		MaxRetryContextChars:      getEnvInt("MAX_RETRY_CONTEXT_CHARS", 0),
+		RetryContextOverflow:      strings.ToLower(getEnvString("RETRY_CONTEXT_OVERFLOW", "truncate")),
+		DebugRecordDir:            getEnvString("DEBUG_RECORD_DIR", ""),
 		Port:                      getEnvString("PORT", "8080"),
+		SlowConsumerThreshold:     time.Duration(getEnvInt("SLOW_CONSUMER_THRESHOLD_MS", 5000)) * time.Millisecond,
+		SlowConsumerBufferBytes:   getEnvInt("SLOW_CONSUMER_BUFFER_BYTES", 1<<20),
+		SlowConsumerPolicy:        strings.ToLower(getEnvString("SLOW_CONSUMER_POLICY", "pause")),
+		TrustedProxies:            getEnvList("TRUSTED_PROXIES"),
+		AdminToken:                getEnvString("ADMIN_TOKEN", ""),
+		AdminTokenFile:            getEnvString("ADMIN_TOKEN_FILE", ""),
+		WarmupConnections:         getEnvInt("UPSTREAM_WARMUP_CONNECTIONS", 0),
+		UpstreamProxy:             getEnvString("UPSTREAM_PROXY", ""),
+		MaxRequestBodyBytes:       getEnvInt("MAX_REQUEST_BODY_BYTES", 32<<20),
+		UpstreamBreakerThreshold:  getEnvInt("UPSTREAM_BREAKER_THRESHOLD", 0),
+		UpstreamBreakerCooldown:   time.Duration(getEnvInt("UPSTREAM_BREAKER_COOLDOWN_MS", 30000)) * time.Millisecond,
+		UpstreamHealthInterval:    time.Duration(getEnvInt("UPSTREAM_HEALTH_INTERVAL_MS", 0)) * time.Millisecond,
+		WarmupInterval:            time.Duration(getEnvInt("UPSTREAM_WARMUP_INTERVAL_MS", 60000)) * time.Millisecond,
+		SpeculativeRetryAfter:     getEnvInt("SPECULATIVE_RETRY_AFTER", 0),
+		NetworkErrorBackoff: getEnvFloatMap("NETWORK_ERROR_BACKOFF", map[string]float64{
+			"NET_TIMEOUT":      1,
+			"NET_DNS":          4,
+			"NET_TLS":          4,
+			"NET_CONN_REFUSED": 2,
+			"NET_CONN_RESET":   0.5,
+			"NET_OTHER":        1,
+		}),
+		RetryOnBlock:               getEnvBool("RETRY_ON_BLOCK", true),
+		RetryOnDrop:                getEnvBool("RETRY_ON_DROP", true),
+		RetryOnFinishDuringThought: getEnvBool("RETRY_ON_FINISH_DURING_THOUGHT", true),
+		RetryOnIncomplete:          getEnvBool("RETRY_ON_INCOMPLETE", true),
+		RetryOnEmpty:               getEnvBool("RETRY_ON_EMPTY", true),
+		FinishReasonPolicy:         getEnvStringMap("FINISH_REASON_POLICY"),
+		RefusalPhrases:             getEnvList("REFUSAL_PHRASES"),
+		MiddlewareDisabled:         getEnvList("MIDDLEWARE_DISABLED"),
+		ModelStatsFile:             getEnvString("MODEL_STATS_FILE", ""),
+		AdaptiveRetry:              getEnvBool("ADAPTIVE_RETRY", false),
+		AdaptiveMinSamples:         getEnvInt("ADAPTIVE_MIN_SAMPLES", 20),
+		AdaptiveMinRetries:         getEnvInt("ADAPTIVE_MIN_RETRIES", 5),
+		AdaptiveMaxRetries:         getEnvInt("ADAPTIVE_MAX_RETRIES", 100),
+		AdaptiveMinRetryDelay:      time.Duration(getEnvInt("ADAPTIVE_MIN_RETRY_DELAY_MS", 250)) * time.Millisecond,
+		AdaptiveMaxRetryDelay:      time.Duration(getEnvInt("ADAPTIVE_MAX_RETRY_DELAY_MS", 5000)) * time.Millisecond,
+		MaxConcurrentStreams:       getEnvInt("MAX_CONCURRENT_STREAMS", 0),
+		BatchQueueTimeout:          time.Duration(getEnvInt("BATCH_QUEUE_TIMEOUT_MS", 30000)) * time.Millisecond,
+		ClientRateLimit:            getEnvInt("CLIENT_RATE_LIMIT", 0),
+		ClientMaxStreams:           getEnvInt("CLIENT_MAX_STREAMS", 0),
+		QuotaPerMinute:             getEnvInt("QUOTA_REQUESTS_PER_MINUTE", 0),
+		QuotaPerDay:                getEnvInt("QUOTA_REQUESTS_PER_DAY", 0),
+		QuotaMaxStreams:            getEnvInt("QUOTA_MAX_STREAMS", 0),
+		QuotaKeyLimits:             getEnvStringMap("QUOTA_KEY_LIMITS"),
+		UsageQuotaPerDay:           getEnvInt("USAGE_QUOTA_PER_DAY", 0),
+		UsageQuotaPerMonth:         getEnvInt("USAGE_QUOTA_PER_MONTH", 0),
+		UsageQuotaKeyLimits:        getEnvStringMap("USAGE_QUOTA_KEY_LIMITS"),
+		ExpvarEnabled:              getEnvBool("EXPVAR_ENABLED", false),
+		PrometheusEnabled:          getEnvBool("PROMETHEUS_ENABLED", false),
+		DrainTimeout:               time.Duration(getEnvInt("DRAIN_TIMEOUT_MS", 600000)) * time.Millisecond,
+		UpgradeReadyTimeout:        time.Duration(getEnvInt("UPGRADE_READY_TIMEOUT_MS", 30000)) * time.Millisecond,
+		RetryStormThreshold:        getEnvInt("RETRY_STORM_THRESHOLD", 60),
+		MaxAttemptDuration:         time.Duration(getEnvInt("MAX_ATTEMPT_DURATION_MS", 600000)) * time.Millisecond,
+		MaxSessionDuration:         time.Duration(getEnvInt("MAX_SESSION_DURATION_MS", 3600000)) * time.Millisecond,
+		MaskUpstreamErrors:         getEnvBool("MASK_UPSTREAM_ERRORS", false),
+		ErrorStatusMap:             getEnvStringMap("ERROR_STATUS_MAP"),
+		AutoCacheEnabled:           getEnvBool("AUTO_CACHE_ENABLED", false),
+		AutoCacheMinChars:          getEnvInt("AUTO_CACHE_MIN_CHARS", 32768),
+		AutoCacheTTL:               time.Duration(getEnvInt("AUTO_CACHE_TTL_MS", 3600000)) * time.Millisecond,
+		StorageBackend:             strings.ToLower(getEnvString("STORAGE_BACKEND", "memory")),
+		StorageDSN:                 getEnvString("STORAGE_DSN", ""),
+		AbuseDetection:             getEnvBool("ABUSE_DETECTION", false),
+		AbusePromptRate:            getEnvInt("ABUSE_PROMPT_RATE", 30),
+		AbuseRetryRate:             getEnvFloat("ABUSE_RETRY_RATE", 10),
+		HoneypotMode:               getEnvBool("HONEYPOT_MODE", false),
+		HoneypotRateLimit:          getEnvInt("HONEYPOT_RATE_LIMIT", 10),
+		ReportWebhookURL:           getEnvString("REPORT_WEBHOOK_URL", ""),
+		ReportWebhookFormat:        strings.ToLower(getEnvString("REPORT_WEBHOOK_FORMAT", "json")),
+		SSEOutputMode:              strings.ToLower(getEnvString("SSE_OUTPUT_MODE", "lenient")),
+		SSEKeepaliveInterval:       time.Duration(getEnvInt("SSE_KEEPALIVE_INTERVAL_MS", 15000)) * time.Millisecond,
+		SSEBufferSize:              getEnvInt("SSE_BUFFER_SIZE", 64*1024),
+		SSEMaxLineSize:             getEnvInt("SSE_MAX_LINE_BYTES", 64*1024*1024),
+		FakeStreaming:              getEnvBool("FAKE_STREAMING", false),
+		StreamAggregation:          getEnvBool("STREAM_AGGREGATION", false),
+		ManagementPrefix:           normalizePrefix(getEnvString("MANAGEMENT_PREFIX", "")),
+		TLSDomains:                 getEnvList("TLS_DOMAINS"),
+		ACMECacheDir:               getEnvString("ACME_CACHE_DIR", "acme-cache"),
+		ACMEEmail:                  getEnvString("ACME_EMAIL", ""),
+		ACMEHTTPPort:               getEnvString("ACME_HTTP_PORT", "80"),
+		ACMEDirectoryURL:           getEnvString("ACME_DIRECTORY_URL", ""),
+		TLSCertFile:                getEnvString("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 getEnvString("TLS_KEY_FILE", ""),
+		TLSClientCAFile:            getEnvString("TLS_CLIENT_CA_FILE", ""),
+		UpstreamAPIKeys:            getEnvList("UPSTREAM_API_KEYS"),
+		UpstreamAPIKeysFile:        getEnvString("UPSTREAM_API_KEYS_FILE", ""),
+		ClientKeyMap:               getEnvStringMap("CLIENT_KEY_MAP"),
+		ClientKeyMapFile:           getEnvString("CLIENT_KEY_MAP_FILE", ""),
+		SecretRefreshInterval:      time.Duration(getEnvInt("SECRET_REFRESH_INTERVAL_MS", 30000)) * time.Millisecond,
+		KeyCooldown:                time.Duration(getEnvInt("KEY_COOLDOWN_MS", 60000)) * time.Millisecond,
+		ModelCatalogRefresh:        time.Duration(getEnvInt("MODEL_CATALOG_REFRESH_MS", 3600000)) * time.Millisecond,
+		ModelsCacheTTL:             time.Duration(getEnvInt("MODELS_CACHE_TTL_MS", 60000)) * time.Millisecond,
+		ResponseCacheTTL:           time.Duration(getEnvInt("RESPONSE_CACHE_TTL_MS", 0)) * time.Millisecond,
+		ResponseCacheMaxEntries:    getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 1000),
+		EmbedBatchSize:             getEnvInt("EMBED_BATCH_SIZE", 100),
+		EmbedConcurrency:           getEnvInt("EMBED_CONCURRENCY", 4),
+		EmbedMaxRetries:            getEnvInt("EMBED_MAX_RETRIES", 3),
+		CountTokensFallback:        getEnvBool("COUNT_TOKENS_FALLBACK", true),
+		UpstreamMode:               strings.ToLower(getEnvString("UPSTREAM_MODE", "gemini")),
+		VertexProject:              getEnvString("VERTEX_PROJECT", ""),
+		VertexLocation:             getEnvString("VERTEX_LOCATION", "us-central1"),
+		VertexCredentialsFile:      getEnvString("VERTEX_CREDENTIALS_FILE", ""),
+		VertexURLBase:              getEnvString("VERTEX_URL_BASE", ""),
+		ModelAliases:               getEnvStringMap("MODEL_ALIASES"),
+		SanitizeRequests:           getEnvBool("SANITIZE_REQUESTS", false),
+		StreamResumeTTL:            time.Duration(getEnvInt("STREAM_RESUME_TTL_MS", 0)) * time.Millisecond,
+		StreamResumeBufferBytes:    getEnvInt("STREAM_RESUME_BUFFER_BYTES", 1<<20),
+		MetricsPush:                strings.ToLower(getEnvString("METRICS_PUSH", "")),
+		MetricsStatsDAddr:          getEnvString("METRICS_STATSD_ADDR", ""),
+		MetricsPushInterval:        time.Duration(getEnvInt("METRICS_PUSH_INTERVAL_MS", 10000)) * time.Millisecond,
+		Profiles:                   profiles,
+		ProfileSettings:            loadProfileSettings(profiles),
+	}
+}
+
+// Validate checks settings that only accept a fixed set of values, so a typo
+// is reported instead of silently falling back to a default behavior
+func (c *Config) Validate() error {
+	enums := []struct {
+		key, value string
+		allowed    []string
+	}{
+		{"LOG_FORMAT", c.LogFormat, []string{"text", "json"}},
+		{"RETRY_CONTEXT_OVERFLOW", c.RetryContextOverflow, []string{"truncate", "abort"}},
+		{"SLOW_CONSUMER_POLICY", c.SlowConsumerPolicy, []string{"pause", "drop"}},
+		{"SSE_OUTPUT_MODE", c.SSEOutputMode, []string{"lenient", "strict"}},
+		{"REPORT_WEBHOOK_FORMAT", c.ReportWebhookFormat, []string{"json", "slack"}},
+	}
+	for _, e := range enums {
+		if !slices.Contains(e.allowed, e.value) {
+			return fmt.Errorf("unknown %s %q, use %s", e.key, e.value, strings.Join(e.allowed, " or "))
+		}
 	}
+	return nil
+}
+
+// normalizePrefix turns a path prefix into the form "/name" with no trailing slash, or "" for none
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
 }
 
 func getEnvString(key, defaultValue string) string {
@@ -44,6 +343,58 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvList parses a comma-separated list, skipping empty items
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvFloatMap parses KEY=VALUE pairs separated by commas, overriding the defaults per key
+func getEnvFloatMap(key string, defaultValue map[string]float64) map[string]float64 {
+	result := make(map[string]float64, len(defaultValue))
+	for k, v := range defaultValue {
+		result[k] = v
+	}
+
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		name, value, found := strings.Cut(pair, "=")
+		if !found {
+			continue
+		}
+		if floatValue, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			result[strings.TrimSpace(name)] = floatValue
+		}
+	}
+	return result
+}
+
+// getEnvStringMap parses "name=value" pairs separated by commas
+func getEnvStringMap(key string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		name, value, found := strings.Cut(pair, "=")
+		if !found {
+			continue
+		}
+		result[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return result
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
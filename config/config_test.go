@@ -0,0 +1,43 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig() *Config {
+	return &Config{
+		LogFormat:            "text",
+		RetryContextOverflow: "truncate",
+		SlowConsumerPolicy:   "pause",
+		SSEOutputMode:        "lenient",
+		ReportWebhookFormat:  "json",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+
+	tests := []struct {
+		key    string
+		modify func(c *Config)
+	}{
+		{"LOG_FORMAT", func(c *Config) { c.LogFormat = "jsn" }},
+		{"RETRY_CONTEXT_OVERFLOW", func(c *Config) { c.RetryContextOverflow = "trunc" }},
+		{"SLOW_CONSUMER_POLICY", func(c *Config) { c.SlowConsumerPolicy = "wait" }},
+		{"SSE_OUTPUT_MODE", func(c *Config) { c.SSEOutputMode = "strcit" }},
+		{"REPORT_WEBHOOK_FORMAT", func(c *Config) { c.ReportWebhookFormat = "discord" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			c := validConfig()
+			tt.modify(c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("Validate() = %v, want an error naming %s", err, tt.key)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Entry is a single effective configuration value, keyed by its environment variable name
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+var secretMarkers = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "DSN", "WEBHOOK", "HEADERS"}
+
+// notSecret lists settings whose names contain a secret marker but whose
+// values operators need to see
+var notSecret = map[string]bool{
+	"DONE_TOKEN":            true,
+	"COUNT_TOKENS_FALLBACK": true,
+	"REPORT_WEBHOOK_FORMAT": true,
+}
+
+// Entries returns every effective configuration value sorted by key, with secrets masked
+func (c *Config) Entries() []Entry {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	entries := make([]Entry, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		entries = append(entries, Entry{Key: key, Value: maskValue(key, formatValue(v.Field(i)))})
+	}
+	entries = append(entries, c.profileEntries()...)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// EntryMap returns Entries as a map, suitable for JSON output
+func (c *Config) EntryMap() map[string]string {
+	m := make(map[string]string)
+	for _, entry := range c.Entries() {
+		m[entry.Key] = entry.Value
+	}
+	return m
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Map {
+		items := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			items = append(items, fmt.Sprintf("%v=%v", iter.Key().Interface(), iter.Value().Interface()))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// maskValue hides the secrets in the value of the setting key
+func maskValue(key, value string) string {
+	if isSecretKey(key) {
+		return maskSecret(value)
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		// Credentials embedded in a URL, such as a proxy login
+		return u.Redacted()
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	// Secret file settings hold a path and durations are never secret
+	if strings.HasSuffix(key, "_FILE") || strings.HasSuffix(key, "_MS") || notSecret[key] {
+		return false
+	}
+	for _, marker := range secretMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecret hides every comma-separated secret, keeping only the last four characters of long values
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		if len(item) > 8 {
+			items[i] = "****" + item[len(item)-4:]
+		} else {
+			items[i] = "****"
+		}
+	}
+	return strings.Join(items, ",")
+}
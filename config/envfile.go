@@ -0,0 +1,56 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+var (
+	envFileMu   sync.Mutex
+	processEnv  map[string]bool
+	envFileKeys map[string]bool
+)
+
+// LoadEnvFile sets environment variables from the env file at path. Variables that
+// were already set when the process started take precedence. Calling it again
+// picks up edits to the file, which a configuration reload relies on. A
+// missing file is reported with an error wrapping fs.ErrNotExist.
+func LoadEnvFile(path string) error {
+	envFileMu.Lock()
+	defer envFileMu.Unlock()
+
+	if processEnv == nil {
+		processEnv = make(map[string]bool)
+		for _, kv := range os.Environ() {
+			key, _, _ := strings.Cut(kv, "=")
+			processEnv[key] = true
+		}
+	}
+
+	// A missing file still clears the variables it set before
+	values, err := godotenv.Read(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Variables deleted from the file fall back to their defaults
+	for key := range envFileKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+	envFileKeys = make(map[string]bool)
+	for key, value := range values {
+		if processEnv[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		envFileKeys[key] = true
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reloadable lists the settings a reload applies to the running proxy. The
+// others size long-lived components at startup and need a restart to change.
+var reloadable = map[string]bool{
+	"MAX_CONSECUTIVE_RETRIES":        true,
+	"DEBUG_MODE":                     true,
+	"LOG_LEVEL":                      true,
+	"RETRY_DELAY_MS":                 true,
+	"RETRY_MAX_DELAY_MS":             true,
+	"RETRY_JITTER":                   true,
+	"RATE_LIMIT_RETRIES":             true,
+	"RATE_LIMIT_RETRY_DELAY_MS":      true,
+	"RATE_LIMIT_MAX_DELAY_MS":        true,
+	"SWALLOW_THOUGHTS_AFTER_RETRY":   true,
+	"DONE_TOKEN":                     true,
+	"RETRY_CONTINUATION_PROMPT":      true,
+	"RETRY_CONTINUATION_PROMPT_FILE": true,
+	"RETRY_DEDUP_WINDOW":             true,
+	"MAX_RETRY_CONTEXT_CHARS":        true,
+	"RETRY_CONTEXT_OVERFLOW":         true,
+	"DEBUG_RECORD_DIR":               true,
+	"SLOW_CONSUMER_THRESHOLD_MS":     true,
+	"SLOW_CONSUMER_BUFFER_BYTES":     true,
+	"SLOW_CONSUMER_POLICY":           true,
+	"SPECULATIVE_RETRY_AFTER":        true,
+	"NETWORK_ERROR_BACKOFF":          true,
+	"RETRY_ON_BLOCK":                 true,
+	"RETRY_ON_DROP":                  true,
+	"RETRY_ON_FINISH_DURING_THOUGHT": true,
+	"RETRY_ON_INCOMPLETE":            true,
+	"RETRY_ON_EMPTY":                 true,
+	"FINISH_REASON_POLICY":           true,
+	"REFUSAL_PHRASES":                true,
+	"MIDDLEWARE_DISABLED":            true,
+	"ADAPTIVE_RETRY":                 true,
+	"ADAPTIVE_MIN_SAMPLES":           true,
+	"ADAPTIVE_MIN_RETRIES":           true,
+	"ADAPTIVE_MAX_RETRIES":           true,
+	"ADAPTIVE_MIN_RETRY_DELAY_MS":    true,
+	"ADAPTIVE_MAX_RETRY_DELAY_MS":    true,
+	"BATCH_QUEUE_TIMEOUT_MS":         true,
+	"RETRY_STORM_THRESHOLD":          true,
+	"MAX_ATTEMPT_DURATION_MS":        true,
+	"MAX_SESSION_DURATION_MS":        true,
+	"MASK_UPSTREAM_ERRORS":           true,
+	"ABUSE_PROMPT_RATE":              true,
+	"ABUSE_RETRY_RATE":               true,
+	"SSE_OUTPUT_MODE":                true,
+	"SSE_KEEPALIVE_INTERVAL_MS":      true,
+	"FAKE_STREAMING":                 true,
+	"STREAM_AGGREGATION":             true,
+	"UPSTREAM_API_KEYS":              true,
+	"CLIENT_KEY_MAP":                 true,
+	"ADMIN_TOKEN":                    true,
+	"MAX_REQUEST_BODY_BYTES":         true,
+	"MODELS_CACHE_TTL_MS":            true,
+	"EMBED_BATCH_SIZE":               true,
+	"EMBED_CONCURRENCY":              true,
+	"EMBED_MAX_RETRIES":              true,
+	"COUNT_TOKENS_FALLBACK":          true,
+	"MODEL_ALIASES":                  true,
+	"SANITIZE_REQUESTS":              true,
+}
+
+// tunable lists the reloadable settings the admin API may change directly
+var tunable = map[string]bool{
+	"MAX_CONSECUTIVE_RETRIES":        true,
+	"DEBUG_MODE":                     true,
+	"LOG_LEVEL":                      true,
+	"RETRY_DELAY_MS":                 true,
+	"RETRY_MAX_DELAY_MS":             true,
+	"RETRY_JITTER":                   true,
+	"RATE_LIMIT_RETRIES":             true,
+	"RATE_LIMIT_RETRY_DELAY_MS":      true,
+	"RATE_LIMIT_MAX_DELAY_MS":        true,
+	"SWALLOW_THOUGHTS_AFTER_RETRY":   true,
+	"RETRY_DEDUP_WINDOW":             true,
+	"MAX_ATTEMPT_DURATION_MS":        true,
+	"MAX_SESSION_DURATION_MS":        true,
+	"RETRY_ON_BLOCK":                 true,
+	"RETRY_ON_DROP":                  true,
+	"RETRY_ON_FINISH_DURING_THOUGHT": true,
+	"RETRY_ON_INCOMPLETE":            true,
+	"RETRY_ON_EMPTY":                 true,
+	"ADAPTIVE_RETRY":                 true,
+	"RETRY_STORM_THRESHOLD":          true,
+	"MAX_REQUEST_BODY_BYTES":         true,
+	"MODELS_CACHE_TTL_MS":            true,
+	"COUNT_TOKENS_FALLBACK":          true,
+	"SANITIZE_REQUESTS":              true,
+}
+
+// Changes lists the settings that differ between two configurations
+type Changes struct {
+	// Applied were taken over by the running proxy
+	Applied []string `json:"applied"`
+	// RestartRequired changed but only take effect after a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Merge returns a copy of c with the reloadable settings taken from fresh,
+// along with the settings that changed
+func (c *Config) Merge(fresh *Config) (*Config, Changes) {
+	merged := *c
+	changes := Changes{Applied: []string{}, RestartRequired: []string{}}
+
+	dst := reflect.ValueOf(&merged).Elem()
+	src := reflect.ValueOf(fresh).Elem()
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("env")
+		if key == "" || reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+			continue
+		}
+		if !reloadable[key] {
+			changes.RestartRequired = append(changes.RestartRequired, key)
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+		changes.Applied = append(changes.Applied, key)
+	}
+
+	sort.Strings(changes.Applied)
+	sort.Strings(changes.RestartRequired)
+	return &merged, changes
+}
+
+// Override returns a copy of c with settings, keyed by environment variable
+// name, parsed the way LoadConfig parses them. Only tunable settings may be
+// set; durations are given in milliseconds.
+func (c *Config) Override(values map[string]string) (*Config, Changes, error) {
+	merged := *c
+	changes := Changes{Applied: []string{}, RestartRequired: []string{}}
+
+	dst := reflect.ValueOf(&merged).Elem()
+	fields := make(map[string]int)
+	for i := 0; i < dst.NumField(); i++ {
+		if key := dst.Type().Field(i).Tag.Get("env"); key != "" {
+			fields[key] = i
+		}
+	}
+
+	for key, raw := range values {
+		i, ok := fields[key]
+		if !ok || !tunable[key] {
+			return nil, Changes{}, fmt.Errorf("%s cannot be changed at runtime", key)
+		}
+		field := dst.Field(i)
+		value, err := parseValue(field.Type(), raw)
+		if err != nil {
+			return nil, Changes{}, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		if reflect.DeepEqual(field.Interface(), value.Interface()) {
+			continue
+		}
+		field.Set(value)
+		changes.Applied = append(changes.Applied, key)
+	}
+
+	sort.Strings(changes.Applied)
+	return &merged, changes, nil
+}
+
+// parseValue parses raw into a value of type t
+func parseValue(t reflect.Type, raw string) (reflect.Value, error) {
+	raw = strings.TrimSpace(raw)
+	if t == reflect.TypeOf(time.Duration(0)) {
+		ms, err := strconv.Atoi(raw)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if ms < 0 {
+			return reflect.Value{}, fmt.Errorf("%d is negative", ms)
+		}
+		return reflect.ValueOf(time.Duration(ms) * time.Millisecond), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		return reflect.ValueOf(b), err
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("%d is negative", n)
+		}
+		return reflect.ValueOf(n), err
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		return reflect.ValueOf(f), err
+	case reflect.String:
+		return reflect.ValueOf(raw), nil
+	}
+	return reflect.Value{}, fmt.Errorf("unsupported setting type %s", t)
+}
+
+// Live holds the configuration in effect, which a reload may replace while
+// requests are being served. Readers get an immutable snapshot.
+type Live struct {
+	current atomic.Pointer[Config]
+}
+
+// NewLive creates a live configuration starting at cfg
+func NewLive(cfg *Config) *Live {
+	l := &Live{}
+	l.current.Store(cfg)
+	return l
+}
+
+// Get returns the configuration in effect
+func (l *Live) Get() *Config {
+	return l.current.Load()
+}
+
+// Set replaces the configuration in effect
+func (l *Live) Set(cfg *Config) {
+	l.current.Store(cfg)
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// profileNamePattern restricts profile names to what fits in a URL path and an environment variable name
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ProfileEnvPrefix returns the prefix of the environment variables setting a
+// profile: PROFILE_WORK_ for the profile work
+func ProfileEnvPrefix(name string) string {
+	return "PROFILE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// loadProfileSettings collects the PROFILE_<NAME>_<SETTING> variables of each
+// named profile, keyed by profile and then by setting
+func loadProfileSettings(names []string) map[string]map[string]string {
+	settings := make(map[string]map[string]string, len(names))
+	for _, name := range names {
+		prefix := ProfileEnvPrefix(name)
+		values := make(map[string]string)
+		for _, kv := range os.Environ() {
+			key, value, _ := strings.Cut(kv, "=")
+			if setting := strings.TrimPrefix(key, prefix); setting != key && setting != "" && value != "" {
+				values[setting] = value
+			}
+		}
+		settings[name] = values
+	}
+	return settings
+}
+
+// ValidateProfiles checks every profile name and setting, so a mistake in the
+// configuration is reported at startup rather than on the first request
+func (c *Config) ValidateProfiles() error {
+	for _, name := range c.Profiles {
+		if !profileNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid profile name %q, use letters, digits, - and _", name)
+		}
+		if _, err := c.Profile(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Profile returns a copy of c with the settings of the named profile applied.
+// A profile may set UPSTREAM_URL_BASE, UPSTREAM_API_KEYS and the settings the
+// admin API may change.
+func (c *Config) Profile(name string) (*Config, error) {
+	values, ok := c.ProfileSettings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+
+	tunables := make(map[string]string, len(values))
+	for key, value := range values {
+		if key != "UPSTREAM_URL_BASE" && key != "UPSTREAM_API_KEYS" {
+			if !tunable[key] {
+				return nil, fmt.Errorf("profile %s: %s cannot be set per profile", name, key)
+			}
+			tunables[key] = value
+		}
+	}
+	profile, _, err := c.Override(tunables)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+
+	if base := strings.TrimSuffix(strings.TrimSpace(values["UPSTREAM_URL_BASE"]), "/"); base != "" {
+		if strings.Contains(base, ",") {
+			return nil, fmt.Errorf("profile %s: UPSTREAM_URL_BASE takes a single address", name)
+		}
+		profile.UpstreamURLBase = base
+		profile.UpstreamURLBases = []string{base}
+	}
+	if raw, ok := values["UPSTREAM_API_KEYS"]; ok {
+		profile.UpstreamAPIKeys = nil
+		for _, key := range strings.Split(raw, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				profile.UpstreamAPIKeys = append(profile.UpstreamAPIKeys, key)
+			}
+		}
+	}
+	return profile, nil
+}
+
+// profileEntries lists the settings of every profile under their environment variable names
+func (c *Config) profileEntries() []Entry {
+	var entries []Entry
+	for name, values := range c.ProfileSettings {
+		prefix := ProfileEnvPrefix(name)
+		for setting, value := range values {
+			entries = append(entries, Entry{Key: prefix + setting, Value: maskValue(setting, value)})
+		}
+	}
+	return entries
+}
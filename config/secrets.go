@@ -0,0 +1,39 @@
+package config
+
+import "gemini-antiblock/secrets"
+
+// LoadSecretFiles replaces secrets with the contents of their *_FILE
+// counterparts, for credentials mounted as Docker or Kubernetes secrets.
+// The retry continuation prompt, which may be too long for an environment
+// variable, is read from its file the same way.
+func (c *Config) LoadSecretFiles() error {
+	if c.AdminTokenFile != "" {
+		token, err := secrets.ReadFile(c.AdminTokenFile)
+		if err != nil {
+			return err
+		}
+		c.AdminToken = token
+	}
+	if c.UpstreamAPIKeysFile != "" {
+		keys, err := secrets.ReadFile(c.UpstreamAPIKeysFile)
+		if err != nil {
+			return err
+		}
+		c.UpstreamAPIKeys = secrets.SplitList(keys)
+	}
+	if c.ClientKeyMapFile != "" {
+		entries, err := secrets.ReadFile(c.ClientKeyMapFile)
+		if err != nil {
+			return err
+		}
+		c.ClientKeyMap = secrets.SplitMap(entries)
+	}
+	if c.ContinuationPromptFile != "" {
+		prompt, err := secrets.ReadFile(c.ContinuationPromptFile)
+		if err != nil {
+			return err
+		}
+		c.ContinuationPrompt = prompt
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package contextcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/streaming"
+)
+
+// cachedFields are moved into the cache entry; Gemini rejects them next to a cachedContent reference
+var cachedFields = []string{"systemInstruction", "tools", "toolConfig"}
+
+// maxPrefixesPerScope bounds how many recent conversation prefixes are remembered per tenant and model
+const maxPrefixesPerScope = 8
+
+// expiryMargin stops using a cache entry shortly before Gemini expires it
+const expiryMargin = time.Minute
+
+type prefixRecord struct {
+	length int
+	hash   string
+}
+
+type cacheEntry struct {
+	name    string
+	expires time.Time
+	pending bool
+}
+
+// Manager detects large conversation prefixes repeated across requests from
+// the same tenant, creates Gemini cachedContent entries for them and rewrites
+// later requests to reference the cache
+type Manager struct {
+	client   *http.Client
+	baseURL  string
+	minChars int
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	prefixes map[string][]prefixRecord
+	caches   map[string]*cacheEntry
+}
+
+// NewManager creates a manager that creates caches through client against baseURL
+func NewManager(client *http.Client, baseURL string, minChars int, ttl time.Duration) *Manager {
+	return &Manager{
+		client:   client,
+		baseURL:  baseURL,
+		minChars: minChars,
+		ttl:      ttl,
+		prefixes: make(map[string][]prefixRecord),
+		caches:   make(map[string]*cacheEntry),
+	}
+}
+
+// Rewrite replaces a repeated conversation prefix in body with a reference to
+// its cache entry, if one is ready, and returns the cache name. Otherwise it
+// records the prefix and, once the prefix has been seen twice, starts creating
+// a cache in the background. Requests that already reference a cache are left alone.
+func (m *Manager) Rewrite(body map[string]interface{}, model string, headers http.Header, query url.Values) string {
+	if model == "" || streaming.CachedContentName(body) != "" {
+		return ""
+	}
+	contents, ok := body["contents"].([]interface{})
+	if !ok || len(contents) == 0 {
+		return ""
+	}
+
+	scope := tenantKey(headers, query) + "|" + model
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Among the remembered prefixes this request repeats, find the longest one
+	// and the longest one that already has a usable cache. A prefix of no
+	// messages holds only the system instruction and tools.
+	var longest, cached prefixRecord
+	var cachedEntry *cacheEntry
+	now := time.Now()
+	for _, record := range m.prefixes[scope] {
+		if record.length >= len(contents) {
+			continue
+		}
+		if hash, _ := prefixHash(model, body, contents[:record.length]); hash != record.hash {
+			continue
+		}
+		if longer(record, longest) {
+			longest = record
+		}
+		entry := m.caches[record.hash]
+		if entry != nil && !entry.pending && now.After(entry.expires) {
+			streaming.UnregisterDoneTokenCache(entry.name)
+			delete(m.caches, record.hash)
+			entry = nil
+		}
+		if entry != nil && !entry.pending && longer(record, cached) {
+			cached, cachedEntry = record, entry
+		}
+	}
+
+	m.remember(scope, model, body, contents)
+
+	// Create a new cache once the repeated part not yet covered by a cache is large enough
+	if longer(longest, cached) && m.caches[longest.hash] == nil {
+		_, longestSize := prefixHash(model, body, contents[:longest.length])
+		cachedSize := 0
+		if cached.hash != "" {
+			_, cachedSize = prefixHash(model, body, contents[:cached.length])
+		}
+		if longestSize-cachedSize >= m.minChars {
+			m.caches[longest.hash] = &cacheEntry{pending: true}
+			// Build the request now; body is rewritten below while creation runs in the background
+			go m.create(longest.hash, m.cacheRequest(model, body, contents[:longest.length]), headers, query)
+		}
+	}
+
+	if cachedEntry == nil {
+		return ""
+	}
+
+	for _, field := range cachedFields {
+		delete(body, field)
+	}
+	body["contents"] = append([]interface{}{}, contents[cached.length:]...)
+	body["cachedContent"] = cachedEntry.name
+	return cachedEntry.name
+}
+
+// longer reports whether a is set and covers more messages than b, which may be unset
+func longer(a, b prefixRecord) bool {
+	return a.hash != "" && (b.hash == "" || a.length > b.length)
+}
+
+// Invalidate forgets a cache entry that upstream rejected
+func (m *Manager) Invalidate(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, entry := range m.caches {
+		if entry.name == name {
+			delete(m.caches, hash)
+		}
+	}
+	streaming.UnregisterDoneTokenCache(name)
+}
+
+// remember records the history of this request (everything but the last turn)
+// as a prefix candidate; for a single turn that is the system instruction and tools
+func (m *Manager) remember(scope, model string, body map[string]interface{}, contents []interface{}) {
+	length := len(contents) - 1
+	hash, _ := prefixHash(model, body, contents[:length])
+
+	records := m.prefixes[scope]
+	for _, record := range records {
+		if record.hash == hash {
+			return
+		}
+	}
+	records = append(records, prefixRecord{length: length, hash: hash})
+	if len(records) > maxPrefixesPerScope {
+		records = records[len(records)-maxPrefixesPerScope:]
+	}
+	m.prefixes[scope] = records
+}
+
+// cacheRequest builds the cachedContents creation request for a prefix
+func (m *Manager) cacheRequest(model string, body map[string]interface{}, contents []interface{}) map[string]interface{} {
+	request := map[string]interface{}{
+		"model": "models/" + model,
+		"ttl":   fmt.Sprintf("%ds", int(m.ttl.Seconds())),
+	}
+	if len(contents) > 0 {
+		request["contents"] = contents
+	}
+	for _, field := range cachedFields {
+		if value, ok := body[field]; ok {
+			request[field] = value
+		}
+	}
+	return request
+}
+
+func (m *Manager) create(hash string, request map[string]interface{}, headers http.Header, query url.Values) {
+	name, err := m.post(request, headers, query)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		logger.LogError("Failed to create context cache:", err)
+		delete(m.caches, hash)
+		return
+	}
+
+	messages, _ := request["contents"].([]interface{})
+	logger.LogInfo(fmt.Sprintf("Created context cache %s for %d repeated messages of %s", name, len(messages), request["model"]))
+	m.caches[hash] = &cacheEntry{name: name, expires: time.Now().Add(m.ttl - expiryMargin)}
+	// The cached system instruction carries the injected [done] prompt
+	streaming.RegisterDoneTokenCache(name)
+}
+
+func (m *Manager) post(request map[string]interface{}, headers http.Header, query url.Values) (string, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	target := m.baseURL + "/v1beta/cachedContents"
+	if key := query.Get("key"); key != "" {
+		target += "?key=" + url.QueryEscape(key)
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header = streaming.BuildUpstreamHeaders(headers, false)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var created struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(respBody, &created); err != nil || created.Name == "" {
+		return "", fmt.Errorf("unexpected cache creation response: %s", respBody)
+	}
+	return created.Name, nil
+}
+
+// prefixHash identifies a cacheable prefix: the model, the fields moved into
+// the cache and the leading contents. It also returns the prefix size in bytes.
+func prefixHash(model string, body map[string]interface{}, contents []interface{}) (string, int) {
+	key := map[string]interface{}{
+		"model":    model,
+		"contents": contents,
+	}
+	for _, field := range cachedFields {
+		if value, ok := body[field]; ok {
+			key[field] = value
+		}
+	}
+
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), len(data)
+}
+
+// tenantKey identifies the caller by a hash of its API credentials, since caches belong to the caller's project
+func tenantKey(headers http.Header, query url.Values) string {
+	credential := headers.Get("X-Goog-Api-Key")
+	if credential == "" {
+		credential = headers.Get("Authorization")
+	}
+	if credential == "" {
+		credential = query.Get("key")
+	}
+
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
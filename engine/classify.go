@@ -0,0 +1,138 @@
+package engine
+
+import "strings"
+
+// lineVerdict is the engine's decision about one upstream line
+type lineVerdict struct {
+	// text is the formal text the line carries
+	text string
+	// functionCall is set when the line carries a functionCall part
+	functionCall bool
+	// finishReason is the line's finish reason, empty mid-response
+	finishReason string
+	// skip drops the line, a thought swallowed after a retry
+	skip bool
+	// interruption, if set, abandons the attempt to retry for this reason
+	interruption string
+	// blockedFinal forwards a block as the end of the response
+	blockedFinal bool
+	// fatal forwards the line, then ends the session with an error
+	fatal bool
+}
+
+// classifyLine decides what to do with an upstream line, updating the session
+// state it carries: token usage, function calls and the thought filter
+func (e *Engine) classifyLine(s *session, line string) lineVerdict {
+	var v lineVerdict
+	var isThought bool
+	if IsDataLine(line) {
+		s.usage.observe(line)
+		content := ParseLineContent(line)
+		v.text = content.Text
+		isThought = content.IsThought
+		v.functionCall = content.HasFunctionCall
+		if v.functionCall {
+			s.functionCallEmitted = true
+		}
+		s.attemptText += v.text
+	}
+	v.finishReason = ExtractFinishReason(line)
+
+	// Thought swallowing logic
+	if s.swallowThoughts {
+		if isThought {
+			if v.finishReason == "" {
+				e.logger.Debugf("Swallowing thought chunk due to post-retry filter: %s", line)
+				v.skip = true
+				return v
+			}
+			if e.settings.RetryOnFinishDuringThought {
+				e.warnf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", v.finishReason)
+				v.interruption = "FINISH_DURING_THOUGHT"
+				return v
+			}
+			e.logger.Infof("Stream stopped with reason '%s' while swallowing a 'thought' chunk. FINISH_DURING_THOUGHT retries disabled, forwarding it.", v.finishReason)
+		} else {
+			e.logger.Infof("First formal text chunk received after swallowing. Resuming normal stream.")
+			s.swallowThoughts = false
+		}
+	}
+
+	// Retry decision logic
+	switch {
+	case v.finishReason != "" && isThought && e.settings.RetryOnFinishDuringThought:
+		e.warnf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", v.finishReason)
+		v.interruption = "FINISH_DURING_THOUGHT"
+	case IsBlockedLine(line):
+		if e.settings.RetryOnBlock {
+			e.warnf("Content blocked detected in line: %s", line)
+			v.interruption = "BLOCK"
+		} else {
+			e.logger.Infof("Content blocked, but BLOCK retries are disabled. Forwarding block as final.")
+			v.blockedFinal = true
+		}
+	case v.finishReason == "STOP":
+		v.interruption = e.stopInterruption(s, v.text)
+	case v.finishReason != "":
+		switch e.finishPolicy(v.finishReason) {
+		case FinishRetry:
+			e.warnf("Abnormal finish reason: %s. Triggering retry.", v.finishReason)
+			v.interruption = "FINISH_ABNORMAL"
+		case FinishFatal:
+			e.logger.Errorf("Finish reason '%s' is configured as fatal. Forwarding it and ending the session.", v.finishReason)
+			v.fatal = true
+		}
+	}
+
+	if v.interruption == "" && len(e.detectors) > 0 {
+		v.interruption = e.detect(LineInfo{
+			Line:            line,
+			Text:            v.text,
+			Thought:         isThought,
+			FinishReason:    v.finishReason,
+			AttemptText:     s.attemptText,
+			AccumulatedText: s.accumulatedText + s.seam.heldText.String() + v.text,
+		})
+		if v.interruption != "" {
+			v.blockedFinal, v.fatal = false, false
+		}
+	}
+	return v
+}
+
+// detect runs the custom detectors on a line the built-in checks let through
+func (e *Engine) detect(info LineInfo) string {
+	for _, detector := range e.detectors {
+		if reason := detector.Detect(info); reason != "" {
+			e.warnf("Detector reported %s on line: %s. Triggering retry.", reason, truncate(info.Line, 200))
+			return reason
+		}
+	}
+	return ""
+}
+
+// stopInterruption returns the reason a STOP finish carrying textChunk must be
+// retried, or "" if it completes the response
+func (e *Engine) stopInterruption(s *session, textChunk string) string {
+	tempAccumulatedText := s.accumulatedText + s.seam.heldText.String() + textChunk
+	trimmedText := strings.TrimSpace(tempAccumulatedText)
+
+	switch {
+	case s.functionCallEmitted:
+		// A response that called a tool is complete even without text or the [done] token
+		e.logger.Infof("Finish reason 'STOP' after a functionCall. Skipping empty/incomplete checks.")
+	case len(trimmedText) == 0:
+		// Empty response - if we have STOP but no accumulated text at all, it's incomplete
+		if !e.settings.RetryOnEmpty {
+			e.logger.Infof("Finish reason 'STOP' with no text content, accepted because FINISH_EMPTY_RESPONSE retries are disabled.")
+			return ""
+		}
+		e.warnf("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
+		return "FINISH_EMPTY_RESPONSE"
+	case s.req.ExpectDoneToken && !strings.HasSuffix(trimmedText, s.doneToken) && e.settings.RetryOnIncomplete:
+		lastChar := trimmedText[len(trimmedText)-1:]
+		e.warnf("Finish reason 'STOP' treated as incomplete because text ends with '%s'. Triggering retry.", lastChar)
+		return "FINISH_INCOMPLETE"
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClassifyLine(t *testing.T) {
+	functionCall := map[string]interface{}{"functionCall": map[string]interface{}{"name": "lookup"}}
+
+	tests := []struct {
+		name     string
+		settings func(*Settings)
+		// accumulated is the text delivered before the line
+		accumulated string
+		swallow     bool
+		detector    Detector
+		line        string
+		want        lineVerdict
+	}{
+		{
+			name: "text chunk",
+			line: dataLine("", textPart("Hello")),
+			want: lineVerdict{text: "Hello"},
+		},
+		{
+			name: "non-data line",
+			line: ": keepalive",
+			want: lineVerdict{},
+		},
+		{
+			name:        "stop with done token",
+			accumulated: "The answer is 42.",
+			line:        dataLine("STOP", textPart(" [done]")),
+			want:        lineVerdict{text: " [done]", finishReason: "STOP"},
+		},
+		{
+			name:        "stop without done token",
+			accumulated: "The answer is",
+			line:        dataLine("STOP", textPart(" 4")),
+			want:        lineVerdict{text: " 4", finishReason: "STOP", interruption: "FINISH_INCOMPLETE"},
+		},
+		{
+			name:        "stop without done token, incomplete retries disabled",
+			settings:    func(s *Settings) { s.RetryOnIncomplete = false },
+			accumulated: "The answer is",
+			line:        dataLine("STOP", textPart(" 4")),
+			want:        lineVerdict{text: " 4", finishReason: "STOP"},
+		},
+		{
+			name: "empty stop",
+			line: dataLine("STOP"),
+			want: lineVerdict{finishReason: "STOP", interruption: "FINISH_EMPTY_RESPONSE"},
+		},
+		{
+			name:     "empty stop, empty retries disabled",
+			settings: func(s *Settings) { s.RetryOnEmpty = false },
+			line:     dataLine("STOP"),
+			want:     lineVerdict{finishReason: "STOP"},
+		},
+		{
+			name: "stop after function call",
+			line: dataLine("STOP", functionCall),
+			want: lineVerdict{functionCall: true, finishReason: "STOP"},
+		},
+		{
+			name: "blocked prompt",
+			line: `data: {"promptFeedback":{"blockReason":"OTHER"}}`,
+			want: lineVerdict{interruption: "BLOCK"},
+		},
+		{
+			name:     "blocked prompt, block retries disabled",
+			settings: func(s *Settings) { s.RetryOnBlock = false },
+			line:     `data: {"promptFeedback":{"blockReason":"OTHER"}}`,
+			want:     lineVerdict{blockedFinal: true},
+		},
+		{
+			name: "abnormal finish",
+			line: dataLine("SAFETY", textPart("Hmm")),
+			want: lineVerdict{text: "Hmm", finishReason: "SAFETY", interruption: "FINISH_ABNORMAL"},
+		},
+		{
+			name: "max tokens accepted by default",
+			line: dataLine("MAX_TOKENS", textPart("long")),
+			want: lineVerdict{text: "long", finishReason: "MAX_TOKENS"},
+		},
+		{
+			name:     "finish reason configured as fatal",
+			settings: func(s *Settings) { s.FinishReasonPolicy = map[string]string{"RECITATION": "Fatal"} },
+			line:     dataLine("RECITATION"),
+			want:     lineVerdict{finishReason: "RECITATION", fatal: true},
+		},
+		{
+			name:     "wildcard finish policy",
+			settings: func(s *Settings) { s.FinishReasonPolicy = map[string]string{"*": "accept"} },
+			line:     dataLine("SAFETY"),
+			want:     lineVerdict{finishReason: "SAFETY"},
+		},
+		{
+			name: "finish during thought",
+			line: dataLine("STOP", thoughtPart("thinking")),
+			want: lineVerdict{finishReason: "STOP", interruption: "FINISH_DURING_THOUGHT"},
+		},
+		{
+			name:    "thought swallowed after retry",
+			swallow: true,
+			line:    dataLine("", thoughtPart("thinking again")),
+			want:    lineVerdict{skip: true},
+		},
+		{
+			name:    "formal text ends swallowing",
+			swallow: true,
+			line:    dataLine("", textPart("resumed")),
+			want:    lineVerdict{text: "resumed"},
+		},
+		{
+			name:     "detector interruption",
+			detector: PhraseDetector{Phrases: []string{"I can't help"}},
+			line:     dataLine("", textPart("I can't help with that")),
+			want:     lineVerdict{text: "I can't help with that", interruption: "REFUSAL"},
+		},
+		{
+			name:     "detector overrides block forwarded as final",
+			settings: func(s *Settings) { s.RetryOnBlock = false },
+			detector: DetectorFunc(func(LineInfo) string { return "CUSTOM" }),
+			line:     `data: {"promptFeedback":{"blockReason":"OTHER"}}`,
+			want:     lineVerdict{interruption: "CUSTOM"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := testSettings()
+			if tt.settings != nil {
+				tt.settings(&settings)
+			}
+			var opts []Option
+			if tt.detector != nil {
+				opts = append(opts, WithDetector(tt.detector))
+			}
+			eng := New(http.DefaultClient, settings, opts...)
+			s := &session{
+				req:             Request{ExpectDoneToken: true},
+				doneToken:       DoneToken,
+				accumulatedText: tt.accumulated,
+				swallowThoughts: tt.swallow,
+			}
+
+			if got := eng.classifyLine(s, tt.line); got != tt.want {
+				t.Errorf("classifyLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyLineTracksSession(t *testing.T) {
+	eng := New(http.DefaultClient, testSettings())
+	s := &session{doneToken: DoneToken, swallowThoughts: true}
+
+	eng.classifyLine(s, dataLine("", textPart("one ")))
+	eng.classifyLine(s, dataLine("", textPart("two"), map[string]interface{}{"functionCall": map[string]interface{}{"name": "f"}}))
+
+	if s.attemptText != "one two" {
+		t.Errorf("attemptText = %q, want %q", s.attemptText, "one two")
+	}
+	if !s.functionCallEmitted {
+		t.Error("functionCallEmitted not set")
+	}
+	if s.swallowThoughts {
+		t.Error("swallowThoughts still set after formal text")
+	}
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the engine the time and waits between retries. Replacing it
+// lets a caller run retry delays instantly; the attempt and session deadlines
+// are context timeouts and always follow the system clock.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning false early if ctx is cancelled
+	Sleep(ctx context.Context, d time.Duration) bool
+}
+
+// systemClock is the Clock of the real world
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// since returns the time passed since t on the engine's clock
+func (e *Engine) since(t time.Time) time.Duration {
+	return e.clock.Now().Sub(t)
+}
@@ -0,0 +1,63 @@
+package engine
+
+import "strings"
+
+// LineInfo is what a Detector sees of an upstream line
+type LineInfo struct {
+	// Line is the raw SSE line
+	Line string
+	// Text is the formal text the line carries
+	Text string
+	// Thought is set when the line carries thoughts and no formal text
+	Thought bool
+	// FinishReason is the line's finish reason, empty mid-response
+	FinishReason string
+	// AttemptText is the formal text of the current attempt, this line's included
+	AttemptText string
+	// AccumulatedText is the formal text of the session, this line's included
+	AccumulatedText string
+}
+
+// Detector recognizes interruptions the built-in checks do not know about.
+// Detectors see every line the built-in checks for blocks, finish reasons and
+// empty or incomplete answers let through, in the order they were added.
+type Detector interface {
+	// Detect returns an interruption reason to drop the line and retry the
+	// response, or "" to let the line through
+	Detect(line LineInfo) string
+}
+
+// DetectorFunc adapts a function to a Detector
+type DetectorFunc func(line LineInfo) string
+
+// Detect calls f
+func (f DetectorFunc) Detect(line LineInfo) string {
+	return f(line)
+}
+
+// PhraseDetector retries an attempt whose text contains one of Phrases,
+// compared case-insensitively, such as the opening of a canned refusal. The
+// line completing a phrase is dropped, but lines before it were already
+// delivered, so phrases are best kept to what the model says first.
+type PhraseDetector struct {
+	Phrases []string
+	// Reason is the interruption reason; empty means "REFUSAL"
+	Reason string
+}
+
+// Detect implements Detector
+func (d PhraseDetector) Detect(line LineInfo) string {
+	if line.Text == "" {
+		return ""
+	}
+	text := strings.ToLower(line.AttemptText)
+	for _, phrase := range d.Phrases {
+		if phrase != "" && strings.Contains(text, strings.ToLower(phrase)) {
+			if d.Reason == "" {
+				return "REFUSAL"
+			}
+			return d.Reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+// Package engine is the antiblock stream engine: it relays a Gemini
+// streamGenerateContent SSE stream and, when the stream is blocked, cut off
+// or finishes incomplete, transparently re-requests the rest of the answer
+// and splices it into the same output.
+//
+// The package has no global state, imports only the standard library and
+// does not log or record metrics on its own; callers inject a Logger and an
+// Observer. The HTTP proxy in this
+// module is one such caller, but any Go program can drive it directly:
+//
+//	eng := engine.New(http.DefaultClient, engine.DefaultSettings(),
+//		engine.WithLogger(myLogger))
+//
+//	resp, _ := http.DefaultClient.Do(initialRequest)
+//	defer resp.Body.Close()
+//
+//	result, err := eng.Stream(resp.Body, myWriter, engine.Request{
+//		URL:             upstreamURL,
+//		Header:          upstreamHeader,
+//		Body:            requestBody,
+//		ExpectDoneToken: true,
+//		Context:         ctx, // cancelling it stops the session and its retries
+//	})
+//
+// The engine decides a response is complete when the model ends its text
+// with the done token (DoneToken unless Settings.DoneToken overrides it), which the caller asks for in the
+// system instruction. Output is delivered through a StreamWriter, one
+// upstream data line at a time, with the token removed.
+package engine
@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Settings control when and how the engine retries
+type Settings struct {
+	// MaxRetries is the number of consecutive retries before giving up
+	MaxRetries int
+	// RetryDelay is the pause after the first failed retry request
+	RetryDelay time.Duration
+	// MaxRetryDelay caps the delay, which doubles with every further retry;
+	// a value no larger than RetryDelay keeps the delay fixed
+	MaxRetryDelay time.Duration
+	// RetryJitter randomizes each delay by up to this fraction in either direction
+	RetryJitter float64
+	// RateLimitRetries is the number of 429 responses to retries that are
+	// waited out, on top of MaxRetries; zero ends the session on the first one
+	RateLimitRetries int
+	// RateLimitDelay is the wait after a 429 that carries no retry hint; it
+	// doubles with every further 429 up to MaxRateLimitDelay
+	RateLimitDelay time.Duration
+	// MaxRateLimitDelay caps the wait; a 429 asking for longer ends the session
+	MaxRateLimitDelay time.Duration
+	// SwallowThoughtsAfterRetry drops thought chunks after a retry once formal text was sent
+	SwallowThoughtsAfterRetry bool
+	// MaxAttemptDuration bounds a single upstream attempt; zero disables the bound
+	MaxAttemptDuration time.Duration
+	// MaxSessionDuration bounds a whole session, retries and the waits between
+	// them included; zero disables the bound
+	MaxSessionDuration time.Duration
+	// SpeculativeRetryAfter races a second retry on an alternative route, when the
+	// request's Failover offers one, after this many consecutive failures; zero disables racing
+	SpeculativeRetryAfter int
+	// NetworkErrorBackoff multiplies RetryDelay per network error class
+	NetworkErrorBackoff map[string]float64
+	// MaskUpstreamErrors replaces upstream error bodies with generic messages
+	MaskUpstreamErrors bool
+	// DoneToken is the completion marker the model was asked to end with; empty means the package DoneToken
+	DoneToken string
+	// ContinuationPrompt is the user message sent with a retry to ask the model to
+	// continue; {chars} is replaced with the number of characters already sent.
+	// Empty means DefaultContinuationPrompt.
+	ContinuationPrompt string
+	// MaxRetryContext caps the characters of output sent back to the model on a
+	// retry; zero means no cap. What happens to longer output depends on
+	// RetryContextOverflow.
+	MaxRetryContext int
+	// RetryContextOverflow is ContextTruncate to send only the end of longer
+	// output, or ContextAbort to end the session instead of retrying
+	RetryContextOverflow string
+	// DedupWindow is the number of characters at the start of a retry compared
+	// with the end of the text already sent; a repeated prefix is removed.
+	// Zero disables deduplication.
+	DedupWindow int
+	// LineBufferSize is the initial buffer for reading upstream SSE lines; longer lines grow it.
+	// Zero means DefaultLineBufferSize.
+	LineBufferSize int
+	// MaxLineSize caps a single SSE line; a longer line interrupts the attempt.
+	// Zero means DefaultMaxLineSize.
+	MaxLineSize int
+
+	// FinishReasonPolicy maps finish reasons other than STOP, or "*" for all
+	// others, to FinishRetry, FinishAccept or FinishFatal. By default MAX_TOKENS
+	// is accepted and every other reason retried.
+	FinishReasonPolicy map[string]string
+
+	// Per-reason retry switches
+	RetryOnBlock               bool
+	RetryOnDrop                bool
+	RetryOnFinishDuringThought bool
+	RetryOnIncomplete          bool
+	RetryOnEmpty               bool
+}
+
+// Policies for a finish reason in Settings.FinishReasonPolicy
+const (
+	// FinishRetry retries the response as interrupted
+	FinishRetry = "retry"
+	// FinishAccept forwards the response as complete
+	FinishAccept = "accept"
+	// FinishFatal forwards the response, then ends the session with an error
+	FinishFatal = "fatal"
+)
+
+// Values of Settings.RetryContextOverflow
+const (
+	ContextTruncate = "truncate"
+	ContextAbort    = "abort"
+)
+
+// DefaultSettings returns the settings the proxy uses out of the box
+func DefaultSettings() Settings {
+	return Settings{
+		MaxRetries:                 100,
+		RetryDelay:                 750 * time.Millisecond,
+		MaxRetryDelay:              8 * time.Second,
+		RetryJitter:                0.2,
+		RateLimitRetries:           3,
+		RateLimitDelay:             5 * time.Second,
+		MaxRateLimitDelay:          time.Minute,
+		SwallowThoughtsAfterRetry:  true,
+		MaxAttemptDuration:         10 * time.Minute,
+		MaxSessionDuration:         time.Hour,
+		DoneToken:                  DoneToken,
+		ContinuationPrompt:         DefaultContinuationPrompt,
+		RetryContextOverflow:       ContextTruncate,
+		LineBufferSize:             DefaultLineBufferSize,
+		MaxLineSize:                DefaultMaxLineSize,
+		RetryOnBlock:               true,
+		RetryOnDrop:                true,
+		RetryOnFinishDuringThought: true,
+		RetryOnIncomplete:          true,
+		RetryOnEmpty:               true,
+	}
+}
+
+// Logger receives the engine's diagnostic output
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LevelLogger is a Logger with two more levels. If the engine's logger
+// implements it, recoverable stream problems are logged with Warnf and every
+// upstream SSE line with Tracef; otherwise they go to Errorf and Debugf.
+type LevelLogger interface {
+	Logger
+	Warnf(format string, args ...interface{})
+	Tracef(format string, args ...interface{})
+}
+
+// Observer receives the engine's measurements
+type Observer interface {
+	// Interruption is called for every interrupted attempt with its reason
+	Interruption(reason string)
+	// Retry is called when a retry is started
+	Retry()
+	// NetworkError is called when a retry request fails with a network error of class
+	NetworkError(class string)
+	// ResponseTime is called with the time a retry request took to return headers
+	ResponseTime(d time.Duration)
+}
+
+// ProgressObserver is an Observer that also follows a session's output. If
+// the engine's observer implements it, Progress is called with the amount of
+// formal text delivered so far whenever it grows.
+type ProgressObserver interface {
+	Observer
+	Progress(chars int)
+}
+
+// Engine relays and repairs Gemini streams. It is safe for concurrent use.
+type Engine struct {
+	client    *http.Client
+	settings  Settings
+	logger    Logger
+	observer  Observer
+	clock     Clock
+	strategy  RetryStrategy
+	detectors []Detector
+}
+
+// Option configures an Engine
+type Option func(*Engine)
+
+// WithLogger sets the engine's logger; by default nothing is logged
+func WithLogger(logger Logger) Option {
+	return func(e *Engine) {
+		e.logger = logger
+	}
+}
+
+// WithObserver sets the engine's observer; by default nothing is recorded
+func WithObserver(observer Observer) Option {
+	return func(e *Engine) {
+		e.observer = observer
+	}
+}
+
+// WithClock sets the clock the engine waits with; by default the system clock
+func WithClock(clock Clock) Option {
+	return func(e *Engine) {
+		e.clock = clock
+	}
+}
+
+// WithRetryStrategy replaces the engine's retry decisions; by default a
+// DefaultRetryStrategy following the settings
+func WithRetryStrategy(strategy RetryStrategy) Option {
+	return func(e *Engine) {
+		e.strategy = strategy
+	}
+}
+
+// WithDetector adds a detector for interruptions the built-in checks miss;
+// it may be given several times
+func WithDetector(detector Detector) Option {
+	return func(e *Engine) {
+		e.detectors = append(e.detectors, detector)
+	}
+}
+
+// New creates an engine sending retries with client
+func New(client *http.Client, settings Settings, opts ...Option) *Engine {
+	e := &Engine{
+		client:   client,
+		settings: settings,
+		logger:   nopLogger{},
+		observer: nopObserver{},
+		clock:    systemClock{},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.strategy == nil {
+		e.strategy = e.defaultStrategy()
+	}
+	return e
+}
+
+// Request describes the upstream request behind a stream
+type Request struct {
+	// URL is the upstream streamGenerateContent URL retries are sent to
+	URL string
+	// Header is sent with every retry request
+	Header http.Header
+	// Body is the original request body; retries extend its contents
+	Body map[string]interface{}
+	// ExpectDoneToken means the model was told to end with the done token, so a
+	// STOP without it is treated as incomplete
+	ExpectDoneToken bool
+	// Failover, if set, may switch credentials when a retry is rejected
+	Failover Failover
+	// Context, if set, ends the session when cancelled, typically when the
+	// client disconnects: the upstream request is aborted, no further retries
+	// are made, and Stream returns a ClientWriteError
+	Context context.Context
+}
+
+// Failover switches upstream credentials when a request is rejected, for
+// example because the API key ran out of quota
+type Failover interface {
+	// Next returns header with the next credentials to try after a response
+	// with status, or false if the status is not a credential problem or no
+	// other credentials are available
+	Next(header http.Header, status int) (http.Header, bool)
+}
+
+// Alternates is a Failover that can also route a request away from the
+// credentials and upstream in use. If a Request's Failover implements it, a
+// speculative retry races the usual request against an alternative one;
+// without an alternative the retry is sent once.
+type Alternates interface {
+	Failover
+	// Alternate returns the context and header of a request that avoids the
+	// upstream or credentials of header, or false if there is no alternative
+	Alternate(ctx context.Context, header http.Header) (context.Context, http.Header, bool)
+}
+
+// Result describes a finished stream
+type Result struct {
+	// Attempts counts the upstream attempts, including the initial one
+	Attempts int
+	// Reasons lists the interruption reasons, in order
+	Reasons []string
+	// Chars is the amount of formal text delivered
+	Chars int
+	// Usage is the usageMetadata of every attempt added up, or nil if upstream reported none
+	Usage map[string]interface{}
+}
+
+// defaultStrategy returns the DefaultRetryStrategy for the engine's settings
+func (e *Engine) defaultStrategy() DefaultRetryStrategy {
+	return DefaultRetryStrategy{Settings: e.settings, Logger: e.logger}
+}
+
+// warnf logs a problem the engine recovers from, such as an interrupted stream
+func (e *Engine) warnf(format string, args ...interface{}) {
+	if l, ok := e.logger.(LevelLogger); ok {
+		l.Warnf(format, args...)
+		return
+	}
+	e.logger.Errorf(format, args...)
+}
+
+// progress reports the formal text delivered so far
+func (e *Engine) progress(chars int) {
+	if o, ok := e.observer.(ProgressObserver); ok {
+		o.Progress(chars)
+	}
+}
+
+// tracef logs per-line detail
+func (e *Engine) tracef(format string, args ...interface{}) {
+	if l, ok := e.logger.(LevelLogger); ok {
+		l.Tracef(format, args...)
+		return
+	}
+	e.logger.Debugf(format, args...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+type nopObserver struct{}
+
+func (nopObserver) Interruption(string)        {}
+func (nopObserver) Retry()                     {}
+func (nopObserver) NetworkError(string)        {}
+func (nopObserver) ResponseTime(time.Duration) {}
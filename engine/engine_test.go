@@ -0,0 +1,293 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock returns immediately from Sleep and records the delays asked for
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return ctx.Err() == nil
+}
+
+// recordingWriter collects the engine's output
+type recordingWriter struct {
+	lines  []string
+	errors []string
+	// failAfter, if positive, fails every write after that many lines
+	failAfter int
+}
+
+func (w *recordingWriter) WriteData(line string) error {
+	if w.failAfter > 0 && len(w.lines) >= w.failAfter {
+		return io.ErrClosedPipe
+	}
+	w.lines = append(w.lines, line)
+	return nil
+}
+
+func (w *recordingWriter) WriteError(payload []byte) error {
+	w.errors = append(w.errors, string(payload))
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	return nil
+}
+
+// text returns the formal text delivered to the client
+func (w *recordingWriter) text() string {
+	var text strings.Builder
+	for _, line := range w.lines {
+		text.WriteString(ParseLineContent(line).Text)
+	}
+	return text.String()
+}
+
+// dataLine builds an SSE data line carrying parts and an optional finish reason
+func dataLine(finishReason string, parts ...map[string]interface{}) string {
+	candidate := map[string]interface{}{
+		"content": map[string]interface{}{"role": "model", "parts": parts},
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	data, _ := json.Marshal(map[string]interface{}{"candidates": []interface{}{candidate}})
+	return "data: " + string(data)
+}
+
+func textPart(text string) map[string]interface{} {
+	return map[string]interface{}{"text": text}
+}
+
+func thoughtPart(text string) map[string]interface{} {
+	return map[string]interface{}{"text": text, "thought": true}
+}
+
+// sse joins lines into an SSE stream body
+func sse(lines ...string) string {
+	return strings.Join(lines, "\n\n") + "\n\n"
+}
+
+// testSettings are the default settings without delays or jitter
+func testSettings() Settings {
+	settings := DefaultSettings()
+	settings.RetryJitter = 0
+	settings.MaxRetries = 3
+	return settings
+}
+
+// upstreamServer serves the given SSE bodies to successive retry requests,
+// repeating the last one, and records the decoded request bodies
+type upstreamServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func newUpstreamServer(t *testing.T, responses ...string) *upstreamServer {
+	t.Helper()
+	u := &upstreamServer{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("retry request body is not JSON: %v", err)
+		}
+		u.mu.Lock()
+		u.bodies = append(u.bodies, body)
+		response := responses[min(len(u.bodies), len(responses))-1]
+		u.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstreamServer) requests() []map[string]interface{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bodies
+}
+
+func originalBody() map[string]interface{} {
+	return map[string]interface{}{
+		"contents": []interface{}{
+			map[string]interface{}{"role": "user", "parts": []interface{}{map[string]interface{}{"text": "Tell me a story."}}},
+		},
+	}
+}
+
+func TestStreamRetriesUntilComplete(t *testing.T) {
+	server := newUpstreamServer(t,
+		sse(dataLine("", textPart(" and then")), dataLine("SAFETY")),
+		sse(dataLine("", textPart(" they lived ")), dataLine("STOP", textPart("happily.[done]"))),
+	)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	eng := New(server.Client(), testSettings(), WithClock(clock))
+	writer := &recordingWriter{}
+
+	initial := strings.NewReader(sse(dataLine("", textPart("Once upon a time"))))
+	result, err := eng.Stream(initial, writer, Request{
+		URL:             server.URL,
+		Header:          http.Header{"Content-Type": {"application/json"}},
+		Body:            originalBody(),
+		ExpectDoneToken: true,
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+
+	if want := "Once upon a time and then they lived happily."; writer.text() != want {
+		t.Errorf("delivered text = %q, want %q", writer.text(), want)
+	}
+	if len(writer.errors) != 0 {
+		t.Errorf("unexpected error events: %v", writer.errors)
+	}
+	if result.Attempts != 3 {
+		t.Errorf("Attempts = %d, want 3", result.Attempts)
+	}
+	if want := []string{"DROP", "FINISH_ABNORMAL"}; strings.Join(result.Reasons, ",") != strings.Join(want, ",") {
+		t.Errorf("Reasons = %v, want %v", result.Reasons, want)
+	}
+	if len(clock.sleeps) != 0 {
+		t.Errorf("successful retries slept %v", clock.sleeps)
+	}
+
+	// Each retry sends the text delivered so far back as the model's turn
+	requests := server.requests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream received %d retries, want 2", len(requests))
+	}
+	for i, want := range []string{"Once upon a time", "Once upon a time and then"} {
+		contents := requests[i]["contents"].([]interface{})
+		if len(contents) != 3 {
+			t.Fatalf("retry %d has %d messages, want 3", i+1, len(contents))
+		}
+		model := contents[1].(map[string]interface{})
+		text := model["parts"].([]interface{})[0].(map[string]interface{})["text"]
+		if model["role"] != "model" || text != want {
+			t.Errorf("retry %d model turn = %v %q, want model %q", i+1, model["role"], text, want)
+		}
+	}
+}
+
+func TestStreamGivesUpAfterMaxRetries(t *testing.T) {
+	server := newUpstreamServer(t, sse(dataLine("", textPart(" more"))))
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	settings := testSettings()
+	settings.MaxRetries = 2
+	eng := New(server.Client(), settings, WithClock(clock))
+	writer := &recordingWriter{}
+
+	result, err := eng.Stream(strings.NewReader(sse(dataLine("", textPart("Start")))), writer, Request{
+		URL:  server.URL,
+		Body: originalBody(),
+	})
+	if err == nil {
+		t.Fatal("Stream succeeded, want retry limit error")
+	}
+	if result.Attempts != 3 {
+		t.Errorf("Attempts = %d, want 3", result.Attempts)
+	}
+	if len(writer.errors) != 1 || !strings.Contains(writer.errors[0], "RETRY_LIMIT_EXCEEDED") {
+		t.Errorf("error events = %v, want one RETRY_LIMIT_EXCEEDED", writer.errors)
+	}
+	if writer.text() != "Start more more" {
+		t.Errorf("delivered text = %q", writer.text())
+	}
+}
+
+func TestStreamReportsDropWhenRetriesDisabled(t *testing.T) {
+	settings := testSettings()
+	settings.RetryOnDrop = false
+	eng := New(http.DefaultClient, settings, WithClock(&fakeClock{}))
+	writer := &recordingWriter{}
+
+	result, err := eng.Stream(strings.NewReader(sse(dataLine("", textPart("Cut")))), writer, Request{Body: originalBody()})
+	if err == nil {
+		t.Fatal("Stream succeeded, want drop error")
+	}
+	if result.Attempts != 1 {
+		t.Errorf("Attempts = %d, want 1", result.Attempts)
+	}
+	if len(writer.errors) != 1 || !strings.Contains(writer.errors[0], "STREAM_DROPPED") {
+		t.Errorf("error events = %v, want one STREAM_DROPPED", writer.errors)
+	}
+}
+
+func TestStreamWaitsAfterFailedRetryRequest(t *testing.T) {
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, sse(dataLine("STOP", textPart("done.[done]"))))
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	settings := testSettings()
+	settings.RetryDelay = 100 * time.Millisecond
+	settings.MaxRetryDelay = time.Second
+	eng := New(server.Client(), settings, WithClock(clock))
+	writer := &recordingWriter{}
+
+	result, err := eng.Stream(strings.NewReader(sse(dataLine("", textPart("Almost ")))), writer, Request{
+		URL:             server.URL,
+		Body:            originalBody(),
+		ExpectDoneToken: true,
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+	if writer.text() != "Almost done." {
+		t.Errorf("delivered text = %q", writer.text())
+	}
+	if result.Attempts != 4 {
+		t.Errorf("Attempts = %d, want 4", result.Attempts)
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	if len(clock.sleeps) != len(want) || clock.sleeps[0] != want[0] || clock.sleeps[1] != want[1] {
+		t.Errorf("sleeps = %v, want %v", clock.sleeps, want)
+	}
+}
+
+func TestStreamEndsOnClientWriteFailure(t *testing.T) {
+	eng := New(http.DefaultClient, testSettings(), WithClock(&fakeClock{}))
+	writer := &recordingWriter{failAfter: 1}
+
+	_, err := eng.Stream(strings.NewReader(sse(
+		dataLine("", textPart("one")),
+		dataLine("", textPart("two")),
+	)), writer, Request{Body: originalBody()})
+	if !IsClientWriteError(err) {
+		t.Fatalf("err = %v, want a ClientWriteError", err)
+	}
+}
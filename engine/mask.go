@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MaskErrorBody replaces an upstream error body with a generic one that keeps
+// only the numeric code and Google status, so messages that mention project
+// IDs or key hints are not relayed to clients
+func MaskErrorBody(body []byte, statusCode int) []byte {
+	var parsed struct {
+		Error struct {
+			Code   int    `json:"code"`
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+
+	code := parsed.Error.Code
+	if code == 0 {
+		code = statusCode
+	}
+
+	errorObj := map[string]interface{}{
+		"code":    code,
+		"message": fmt.Sprintf("Upstream request failed with status %d.", code),
+	}
+	if parsed.Error.Status != "" {
+		errorObj["status"] = parsed.Error.Status
+	}
+
+	masked, _ := json.Marshal(map[string]interface{}{"error": errorObj})
+	return masked
+}
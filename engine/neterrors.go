@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Network error classes, used as interruption reasons and metric labels
+const (
+	ErrorClassTimeout     = "NET_TIMEOUT"
+	ErrorClassDNS         = "NET_DNS"
+	ErrorClassTLS         = "NET_TLS"
+	ErrorClassConnRefused = "NET_CONN_REFUSED"
+	ErrorClassConnReset   = "NET_CONN_RESET"
+	ErrorClassCanceled    = "NET_CANCELED"
+	ErrorClassOther       = "NET_OTHER"
+)
+
+// Transport-level stream resets, used as interruption reasons and metric labels
+const (
+	StreamResetGoAway    = "GOAWAY"
+	StreamResetRstStream = "RST_STREAM"
+)
+
+// ClassifyError maps an error returned by http.Client.Do to a network error class
+func ClassifyError(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorClassTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassConnRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassConnReset
+	default:
+		return ErrorClassOther
+	}
+}
+
+// ClassifyStreamError detects HTTP/2 GOAWAY and RST_STREAM conditions in an
+// error returned while reading a response body. It returns an empty string
+// for any other error. The http2 error types are unexported by net/http, so
+// this matches on their messages.
+func ClassifyStreamError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "GOAWAY"):
+		return StreamResetGoAway
+	case strings.Contains(msg, "stream error:"), strings.Contains(msg, "RST_STREAM"):
+		return StreamResetRstStream
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// minOverlap is the shortest repeat removed at a retry seam; shorter matches
+// are as likely to be a coincidence, such as a repeated space or word
+const minOverlap = 8
+
+type heldLine struct {
+	line string
+	text string
+}
+
+// seamDedup removes the text a model repeats when asked to continue. After a
+// retry it holds back the first window characters of formal text, then drops
+// the longest prefix of them that the text already sent ends with.
+type seamDedup struct {
+	window   int
+	sent     string
+	active   bool
+	held     []heldLine
+	heldText strings.Builder
+}
+
+// begin starts watching a retry that continues after accumulatedText. Lines
+// still held from an interrupted attempt are dropped, as they were never sent.
+func (s *seamDedup) begin(accumulatedText string) {
+	s.held = nil
+	s.heldText.Reset()
+	s.active = s.window > 0 && accumulatedText != ""
+	s.sent = accumulatedText
+}
+
+// holds reports whether a line, carrying formal text or not, must be held back
+func (s *seamDedup) holds(formal bool) bool {
+	return s.active && (formal || len(s.held) > 0)
+}
+
+// hold keeps a line back until release
+func (s *seamDedup) hold(line, text string) {
+	s.held = append(s.held, heldLine{line: line, text: text})
+	s.heldText.WriteString(text)
+}
+
+// ready reports whether enough text is held to decide on the overlap
+func (s *seamDedup) ready() bool {
+	return utf8.RuneCountInString(s.heldText.String()) >= s.window
+}
+
+// release ends the watch and returns the held lines with the repeated text
+// removed, along with the number of characters removed
+func (s *seamDedup) release() ([]heldLine, int) {
+	held := s.held
+	n := overlap(s.sent, s.heldText.String())
+	s.active = false
+	s.held = nil
+	s.heldText.Reset()
+
+	remaining := n
+	for i := range held {
+		if remaining == 0 {
+			break
+		}
+		var removed int
+		held[i].line, removed = TrimLeadingText(held[i].line, remaining)
+		held[i].text = string([]rune(held[i].text)[removed:])
+		remaining -= removed
+	}
+	return held, n
+}
+
+// overlap returns the length in characters of the longest prefix of text,
+// at least minOverlap long, that sent ends with
+func overlap(sent, text string) int {
+	best, count := 0, 0
+	for i := range text {
+		if count >= minOverlap && strings.HasSuffix(sent, text[:i]) {
+			best = count
+		}
+		count++
+	}
+	if count >= minOverlap && strings.HasSuffix(sent, text) {
+		best = count
+	}
+	return best
+}
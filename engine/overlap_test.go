@@ -0,0 +1,76 @@
+package engine
+
+import "testing"
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		text string
+		want int
+	}{
+		{"no overlap", "The quick brown fox", " jumps over", 0},
+		{"repeated tail", "The quick brown fox", "brown fox jumps", 9},
+		{"whole text repeated", "The quick brown fox", "quick brown fox", 15},
+		{"too short to count", "The quick brown fox", "fox jumps", 0},
+		{"longest match wins", "abcdefgh abcdefgh", "abcdefgh abcdefgh more", 17},
+		{"multibyte", "我们继续讲这个故事吧", "继续讲这个故事吧，然后", 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overlap(tt.sent, tt.text); got != tt.want {
+				t.Errorf("overlap(%q, %q) = %d, want %d", tt.sent, tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeamDedup(t *testing.T) {
+	var seam seamDedup
+	seam.window = 12
+
+	seam.begin("")
+	if seam.holds(true) {
+		t.Fatal("seam holds lines without text already sent")
+	}
+
+	seam.begin("Once upon a time there was")
+	if !seam.holds(true) {
+		t.Fatal("seam does not hold the first formal text after a retry")
+	}
+	if seam.holds(false) {
+		t.Fatal("seam holds a line without text before any text is held")
+	}
+
+	first := `data: {"candidates":[{"content":{"parts":[{"text":"time there"}],"role":"model"}}]}`
+	second := `data: {"candidates":[{"content":{"parts":[{"text":" was a fox"}],"role":"model"}}]}`
+	seam.hold(first, "time there")
+	if seam.ready() {
+		t.Fatal("seam ready before the window is filled")
+	}
+	if !seam.holds(false) {
+		t.Fatal("seam lets a line overtake held lines")
+	}
+	seam.hold(second, " was a fox")
+	if !seam.ready() {
+		t.Fatal("seam not ready after the window is filled")
+	}
+
+	held, removed := seam.release()
+	if removed != len("time there was") {
+		t.Errorf("removed %d characters, want %d", removed, len("time there was"))
+	}
+	if len(held) != 2 {
+		t.Fatalf("released %d lines, want 2", len(held))
+	}
+	if held[0].text != "" || held[1].text != " a fox" {
+		t.Errorf("released texts %q, %q, want \"\", \" a fox\"", held[0].text, held[1].text)
+	}
+	if got := ParseLineContent(held[1].line).Text; got != " a fox" {
+		t.Errorf("released line text = %q, want %q", got, " a fox")
+	}
+	if seam.holds(true) {
+		t.Error("seam still active after release")
+	}
+}
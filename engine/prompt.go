@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultContinuationPrompt is the user message that asks the model to
+// continue its interrupted answer on a retry
+const DefaultContinuationPrompt = "Continue exactly where you left off without any preamble or repetition."
+
+// ContinuationPresets are translations of DefaultContinuationPrompt, keyed by
+// language code. Answering in the conversation's language makes the model
+// less likely to switch languages after a retry.
+var ContinuationPresets = map[string]string{
+	"en": DefaultContinuationPrompt,
+	"zh": "请从中断处原样继续，不要添加任何开场白，也不要重复已输出的内容。",
+	"ja": "前置きや繰り返しをせず、中断したところから正確に続けてください。",
+	"ko": "서두나 반복 없이 중단된 지점부터 정확히 이어서 작성하세요.",
+	"es": "Continúa exactamente donde lo dejaste, sin preámbulos ni repeticiones.",
+	"fr": "Reprends exactement là où tu t'es arrêté, sans préambule ni répétition.",
+	"de": "Fahre genau dort fort, wo du aufgehört hast, ohne Einleitung oder Wiederholung.",
+	"ru": "Продолжи ровно с того места, где остановился, без вступления и повторов.",
+}
+
+// ContinuationPrompt returns the preset named value, or value itself when it
+// names no preset. An empty value gives DefaultContinuationPrompt.
+func ContinuationPrompt(value string) string {
+	if value == "" {
+		return DefaultContinuationPrompt
+	}
+	if preset, ok := ContinuationPresets[strings.ToLower(strings.TrimSpace(value))]; ok {
+		return preset
+	}
+	return value
+}
+
+// renderContinuationPrompt fills the {chars} placeholder with the number of
+// characters already delivered
+func renderContinuationPrompt(prompt, accumulatedText string) string {
+	if prompt == "" {
+		prompt = DefaultContinuationPrompt
+	}
+	return strings.ReplaceAll(prompt, "{chars}", strconv.Itoa(utf8.RuneCountInString(accumulatedText)))
+}
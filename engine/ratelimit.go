@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimitDelay returns how long to wait before rate-limit retry number
+// retry. A wait requested by upstream, through a Retry-After header or a
+// google.rpc.RetryInfo detail, takes precedence over the configured backoff.
+// It returns false if upstream asked for more than MaxRateLimitDelay, as
+// happens when a daily quota is used up.
+func (e *Engine) rateLimitDelay(header http.Header, body []byte, retry int) (time.Duration, bool) {
+	if hint, ok := retryHint(header, body); ok {
+		if e.settings.MaxRateLimitDelay > 0 && hint > e.settings.MaxRateLimitDelay {
+			return hint, false
+		}
+		return hint, true
+	}
+
+	delay := e.settings.RateLimitDelay
+	for i := 1; i < retry && delay < e.settings.MaxRateLimitDelay; i++ {
+		delay *= 2
+	}
+	if e.settings.MaxRateLimitDelay > 0 && delay > e.settings.MaxRateLimitDelay {
+		delay = e.settings.MaxRateLimitDelay
+	}
+	if e.settings.RetryJitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + e.settings.RetryJitter*(2*rand.Float64()-1)))
+	}
+	return delay, true
+}
+
+// retryHint extracts the wait upstream asked for from a 429 response
+func retryHint(header http.Header, body []byte) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(time.Until(at), 0), true
+		}
+	}
+
+	var payload struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return 0, false
+	}
+	for _, detail := range payload.Error.Details {
+		if detail.Type != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay >= 0 {
+			return delay, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,602 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var nonRetryableStatuses = map[int]bool{
+	400: true, 401: true, 403: true, 404: true, 429: true,
+}
+
+// BuildRetryRequestBody builds a new request body for retry with accumulated context
+func (e *Engine) BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText string) map[string]interface{} {
+	return e.defaultStrategy().buildRetryBody(originalBody, accumulatedText)
+}
+
+// retryContextTooLarge reports whether accumulatedText exceeds MaxRetryContext
+// with the session configured to end rather than truncate
+func (e *Engine) retryContextTooLarge(accumulatedText string) bool {
+	return e.settings.MaxRetryContext > 0 && e.settings.RetryContextOverflow == ContextAbort &&
+		utf8.RuneCountInString(accumulatedText) > e.settings.MaxRetryContext
+}
+
+// networkRetryDelay scales the retry delay by the backoff multiplier configured for a network error class
+func (e *Engine) networkRetryDelay(baseDelay time.Duration, errorClass string) time.Duration {
+	multiplier, ok := e.settings.NetworkErrorBackoff[errorClass]
+	if !ok {
+		multiplier = 1
+	}
+	return time.Duration(float64(baseDelay) * multiplier)
+}
+
+// newSessionContext returns the context bounding a whole session, retries included
+func (e *Engine) newSessionContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if e.settings.MaxSessionDuration > 0 {
+		return context.WithTimeout(parent, e.settings.MaxSessionDuration)
+	}
+	return context.WithCancel(parent)
+}
+
+// newAttemptContext returns the context bounding a single upstream attempt
+func (e *Engine) newAttemptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if e.settings.MaxAttemptDuration > 0 {
+		return context.WithTimeout(parent, e.settings.MaxAttemptDuration)
+	}
+	return context.WithCancel(parent)
+}
+
+// cancelled is the error a session ends with when its context is cancelled:
+// the client is gone, so the output can no longer be delivered
+func cancelled(ctx context.Context) error {
+	return &ClientWriteError{Err: fmt.Errorf("session cancelled: %w", ctx.Err())}
+}
+
+// giveUp ends a session that cannot be completed with an error event
+// carrying reason and the last interruption
+func (e *Engine) giveUp(writer StreamWriter, code int, status, reason, message, interruptionReason string, chars int) {
+	errorPayload := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"status":  status,
+			"message": message,
+			"details": []interface{}{
+				map[string]interface{}{
+					"@type":  "type.googleapis.com/google.rpc.ErrorInfo",
+					"reason": reason,
+					"domain": "gemini-antiblock",
+					"metadata": map[string]interface{}{
+						"last_interruption": interruptionReason,
+					},
+				},
+				map[string]interface{}{
+					"@type":                  "proxy.debug",
+					"accumulated_text_chars": chars,
+				},
+			},
+		},
+	}
+
+	errorBytes, _ := json.Marshal(errorPayload)
+	writer.WriteError(errorBytes)
+}
+
+// sessionEnded returns the error for a session whose context ended while
+// waiting: the client left, or the session deadline passed, which is reported
+// to the client
+func (e *Engine) sessionEnded(ctx context.Context, writer StreamWriter, interruptionReason string, chars int) error {
+	if ctx.Err() != nil {
+		return cancelled(ctx)
+	}
+	e.logger.Errorf("Session exceeded the maximum duration of %v. Giving up.", e.settings.MaxSessionDuration)
+	message := fmt.Sprintf("Session exceeded the maximum duration of %v. Last reason: %s.", e.settings.MaxSessionDuration, interruptionReason)
+	e.giveUp(writer, 504, "DEADLINE_EXCEEDED", "SESSION_DEADLINE_EXCEEDED", message, interruptionReason, chars)
+	return fmt.Errorf("session deadline exceeded")
+}
+
+// finishPolicy returns the policy for a finish reason other than STOP: the
+// configured one, else the one configured for "*", else accepting MAX_TOKENS
+// and retrying everything else
+func (e *Engine) finishPolicy(reason string) string {
+	policy, ok := e.settings.FinishReasonPolicy[reason]
+	if !ok {
+		policy, ok = e.settings.FinishReasonPolicy["*"]
+	}
+	policy = strings.ToLower(policy)
+	switch {
+	case ok && (policy == FinishAccept || policy == FinishFatal || policy == FinishRetry):
+		return policy
+	case reason == "MAX_TOKENS":
+		return FinishAccept
+	default:
+		return FinishRetry
+	}
+}
+
+// fatalFinish ends a session whose finish reason is configured as fatal
+func (e *Engine) fatalFinish(writer StreamWriter, finishReason string) error {
+	errorPayload := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    502,
+			"status":  "UNAVAILABLE",
+			"message": fmt.Sprintf("Upstream ended the response with finish reason %s, which is not retried.", finishReason),
+			"details": []interface{}{
+				map[string]interface{}{
+					"@type":  "type.googleapis.com/google.rpc.ErrorInfo",
+					"reason": "FINISH_REASON_FATAL",
+					"domain": "gemini-antiblock",
+					"metadata": map[string]interface{}{
+						"finish_reason": finishReason,
+					},
+				},
+			},
+		},
+	}
+	errorBytes, _ := json.Marshal(errorPayload)
+	writer.WriteError(errorBytes)
+	return fmt.Errorf("finish reason %s is fatal", finishReason)
+}
+
+// isDropReason reports whether an interruption reason means the stream ended without a finish reason
+func isDropReason(reason string) bool {
+	return reason == "DROP" || reason == StreamResetGoAway || reason == StreamResetRstStream
+}
+
+// session is the state a stream carries across its attempts
+type session struct {
+	req       Request
+	doneToken string
+	result    Result
+	start     time.Time
+
+	accumulatedText     string
+	attemptText         string
+	retries             int
+	rateLimitRetries    int
+	totalLines          int
+	formalTextSent      bool
+	functionCallEmitted bool
+	swallowThoughts     bool
+	usage               usageTally
+	seam                seamDedup
+}
+
+// retryState describes retry number retry after interruptionReason
+func (s *session) retryState(retry int, interruptionReason string) RetryState {
+	return RetryState{
+		Retry:           retry,
+		Reason:          interruptionReason,
+		AccumulatedText: s.accumulatedText,
+		Request:         s.req,
+	}
+}
+
+// Stream relays initialReader, the body of the already-sent initial request,
+// to writer. Whenever the stream is interrupted it re-requests the remainder
+// from req.URL until the answer completes or the retries run out. The result
+// is valid even when an error is returned.
+func (e *Engine) Stream(initialReader io.Reader, writer StreamWriter, req Request) (result Result, err error) {
+	if req.Context == nil {
+		req.Context = context.Background()
+	}
+	ctx := req.Context
+	s := &session{
+		req:       req,
+		doneToken: e.settings.DoneToken,
+		result:    Result{Attempts: 1, Reasons: []string{}},
+		start:     e.clock.Now(),
+		seam:      seamDedup{window: e.settings.DedupWindow},
+	}
+	if s.doneToken == "" {
+		s.doneToken = DoneToken
+	}
+	currentReader := initialReader
+	var currentBody io.Closer
+
+	e.logger.Infof("Starting stream processing session. Max retries: %d", e.settings.MaxRetries)
+	defer func() {
+		s.result.Chars = len(s.accumulatedText)
+		s.result.Usage = s.usage.total()
+		result = s.result
+		if currentBody != nil {
+			currentBody.Close()
+		}
+	}()
+
+	// The session deadline bounds all attempts and the waits between them
+	sessionCtx, cancelSession := e.newSessionContext(ctx)
+	defer cancelSession()
+
+	// Each upstream attempt runs under its own deadline; a wedged stream is closed and retried
+	attemptCtx, cancelAttempt := e.newAttemptContext(sessionCtx)
+	defer func() {
+		cancelAttempt()
+	}()
+
+	for {
+		e.logger.Debugf("=== Starting stream attempt %d/%d ===", s.retries+1, e.settings.MaxRetries+1)
+		interruptionReason, err := e.attempt(sessionCtx, attemptCtx, s, currentReader, writer)
+		if err != nil {
+			return s.result, err
+		}
+		if interruptionReason == "" {
+			e.logger.Infof("=== STREAM COMPLETED SUCCESSFULLY ===")
+			e.logger.Infof("Total session duration: %v", e.since(s.start))
+			e.logger.Infof("Total lines processed: %d", s.totalLines)
+			e.logger.Infof("Total text generated: %d characters", len(s.accumulatedText))
+			e.logger.Infof("Total retries needed: %d", s.retries)
+			return s.result, nil
+		}
+
+		// Interruption & Retry Activation
+		// Tokens used by the interrupted attempt are billed as well
+		s.usage.endAttempt()
+		e.warnf("=== STREAM INTERRUPTED ===")
+		e.warnf("Reason: %s", interruptionReason)
+		s.result.Reasons = append(s.result.Reasons, interruptionReason)
+		e.observer.Interruption(interruptionReason)
+
+		if err := e.retryRefused(sessionCtx, s, writer, interruptionReason); err != nil {
+			return s.result, err
+		}
+
+		if e.settings.SwallowThoughtsAfterRetry && s.formalTextSent {
+			e.logger.Infof("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
+			s.swallowThoughts = true
+		}
+		s.seam.begin(s.accumulatedText)
+
+		// Release the interrupted retry stream before opening a new one
+		if currentBody != nil {
+			currentBody.Close()
+			currentBody = nil
+		}
+
+		cancelAttempt()
+		attemptCtx, cancelAttempt = e.newAttemptContext(sessionCtx)
+
+		s.retries++
+		s.result.Attempts = s.retries + 1
+		e.observer.Retry()
+		e.logger.Infof("=== STARTING RETRY %d/%d ===", s.retries, e.settings.MaxRetries)
+
+		body, err := e.reconnect(sessionCtx, attemptCtx, s, writer, interruptionReason)
+		if err != nil {
+			return s.result, err
+		}
+		if body == nil {
+			continue
+		}
+		currentReader = body
+		currentBody = body
+	}
+}
+
+// attempt relays one upstream stream to writer. It returns the reason the
+// stream was interrupted, "" once the response is complete, or an error that
+// ends the session.
+func (e *Engine) attempt(sessionCtx, attemptCtx context.Context, s *session, reader io.Reader, writer StreamWriter) (string, error) {
+	ctx := s.req.Context
+	s.attemptText = ""
+	streamStartTime := e.clock.Now()
+	linesInThisStream := 0
+	textInThisStream := 0
+
+	// forward sends a line to the client and records the formal text it carries
+	forward := func(line, text string) error {
+		if err := writer.WriteData(line); err != nil {
+			return err
+		}
+		if text != "" {
+			s.formalTextSent = true
+			s.accumulatedText += text
+			textInThisStream += len(text)
+			e.progress(len(s.accumulatedText))
+		}
+		return nil
+	}
+
+	// Create channel for SSE lines
+	lineCh := make(chan string, 100)
+	readErrCh := make(chan error, 1)
+	go e.readLines(reader, lineCh, readErrCh)
+
+	// Let the line reader exit if the stream is abandoned mid-way
+	defer func() {
+		go func() {
+			for range lineCh {
+			}
+		}()
+	}()
+
+	stopAttemptWatch := context.AfterFunc(attemptCtx, func() {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+
+	interruptionReason := ""
+	cleanExit := false
+	for line := range lineCh {
+		s.totalLines++
+		linesInThisStream++
+
+		v := e.classifyLine(s, line)
+		if v.skip {
+			continue
+		}
+		if v.interruption != "" {
+			interruptionReason = v.interruption
+			break
+		}
+
+		// Line is good: forward and update state
+		isEndOfResponse := v.finishReason != ""
+		processedLine := RemoveDoneTokenFromLine(line, s.doneToken, isEndOfResponse)
+		processedLine = s.usage.rewrite(processedLine)
+
+		var writeErr error
+		if s.seam.holds(v.text != "") {
+			// Hold the start of a retry's text back until its overlap with the text already sent is known
+			s.seam.hold(processedLine, v.text)
+			if !s.seam.ready() && !isEndOfResponse && !v.blockedFinal && !v.functionCall {
+				continue
+			}
+			held, repeated := s.seam.release()
+			if repeated > 0 {
+				e.logger.Infof("Removed %d repeated characters at the retry seam", repeated)
+			}
+			for _, h := range held {
+				if writeErr = forward(h.line, h.text); writeErr != nil {
+					break
+				}
+			}
+		} else {
+			writeErr = forward(processedLine, v.text)
+		}
+		if writeErr != nil {
+			// The client is gone: retrying would only burn upstream quota
+			e.logger.Infof("Client write failed, cancelling upstream and ending session: %v", writeErr)
+			return "", &ClientWriteError{Err: writeErr}
+		}
+
+		if v.fatal {
+			return "", e.fatalFinish(writer, v.finishReason)
+		}
+		if isEndOfResponse {
+			e.logger.Infof("Finish reason '%s' accepted as final. Stream complete.", v.finishReason)
+			cleanExit = true
+			break
+		}
+		if v.blockedFinal {
+			cleanExit = true
+			break
+		}
+	}
+
+	attemptTimedOut := !stopAttemptWatch()
+
+	if !cleanExit && ctx.Err() != nil {
+		e.logger.Infof("Session cancelled, most likely because the client disconnected. Not retrying.")
+		return "", cancelled(ctx)
+	}
+	if !cleanExit && interruptionReason == "" {
+		interruptionReason = e.unfinishedReason(sessionCtx, readErrCh, attemptTimedOut)
+	}
+
+	e.logger.Debugf("Stream attempt summary:")
+	e.logger.Debugf("  Duration: %v", e.since(streamStartTime))
+	e.logger.Debugf("  Lines processed: %d", linesInThisStream)
+	e.logger.Debugf("  Text generated this stream: %d chars", textInThisStream)
+	e.logger.Debugf("  Total accumulated text: %d chars", len(s.accumulatedText))
+	return interruptionReason, nil
+}
+
+// unfinishedReason returns the interruption reason of a stream that ended
+// without a finish reason
+func (e *Engine) unfinishedReason(sessionCtx context.Context, readErrCh <-chan error, attemptTimedOut bool) string {
+	if sessionCtx.Err() != nil {
+		e.warnf("Session exceeded the maximum duration of %v.", e.settings.MaxSessionDuration)
+		return "SESSION_TIMEOUT"
+	}
+	if attemptTimedOut {
+		e.warnf("Upstream attempt exceeded the maximum duration of %v. Treating the stream as wedged.", e.settings.MaxAttemptDuration)
+		return "ATTEMPT_TIMEOUT"
+	}
+
+	// The line channel was closed, so any read error has already been sent
+	var readErr error
+	select {
+	case readErr = <-readErrCh:
+	default:
+	}
+
+	if reset := ClassifyStreamError(readErr); reset != "" {
+		e.warnf("Stream reset by upstream transport (%s): %v. Reconnecting on a fresh connection.", reset, readErr)
+		e.client.CloseIdleConnections()
+		return reset
+	}
+	if readErr != nil {
+		e.warnf("Stream read failed without finish reason - detected as DROP: %v", readErr)
+	} else {
+		e.warnf("Stream ended without finish reason - detected as DROP")
+	}
+	return "DROP"
+}
+
+// retryRefused returns the error ending a session that must not be retried
+// after interruptionReason, telling the client why; nil allows the retry
+func (e *Engine) retryRefused(sessionCtx context.Context, s *session, writer StreamWriter, interruptionReason string) error {
+	if !e.settings.RetryOnDrop && isDropReason(interruptionReason) {
+		e.logger.Errorf("DROP retries are disabled. Ending session without retry.")
+		message := fmt.Sprintf("Upstream stream ended without a finish reason (%s) and DROP retries are disabled.", interruptionReason)
+		e.giveUp(writer, 502, "UNAVAILABLE", "STREAM_DROPPED", message, interruptionReason, len(s.accumulatedText))
+		return fmt.Errorf("stream dropped (%s) and DROP retries are disabled", interruptionReason)
+	}
+
+	e.warnf("Current retry count: %d", s.retries)
+	e.warnf("Max retries allowed: %d", e.settings.MaxRetries)
+	e.warnf("Text accumulated so far: %d characters", len(s.accumulatedText))
+
+	if !e.strategy.ShouldRetry(s.retryState(s.retries+1, interruptionReason)) {
+		message := fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", e.settings.MaxRetries, interruptionReason)
+		if s.retries < e.settings.MaxRetries {
+			message = fmt.Sprintf("The retry strategy gave up after %d retries. Last reason: %s.", s.retries, interruptionReason)
+		}
+		e.giveUp(writer, 504, "DEADLINE_EXCEEDED", "RETRY_LIMIT_EXCEEDED", message, interruptionReason, len(s.accumulatedText))
+		return fmt.Errorf("retry limit exceeded")
+	}
+	if e.retryContextTooLarge(s.accumulatedText) {
+		e.logger.Errorf("Accumulated text exceeds the retry context limit of %d characters. Giving up.", e.settings.MaxRetryContext)
+		message := fmt.Sprintf("The output exceeds the retry context limit of %d characters and cannot be continued after interruption. Last reason: %s.", e.settings.MaxRetryContext, interruptionReason)
+		e.giveUp(writer, 502, "UNAVAILABLE", "RETRY_CONTEXT_TOO_LARGE", message, interruptionReason, len(s.accumulatedText))
+		return fmt.Errorf("retry context too large")
+	}
+	if sessionCtx.Err() != nil {
+		return e.sessionEnded(s.req.Context, writer, interruptionReason, len(s.accumulatedText))
+	}
+	return nil
+}
+
+// reconnect requests the remainder of the answer after an interruption. It
+// returns the new stream; nil when the request failed and, after waiting,
+// the next retry should begin; or an error that ends the session.
+func (e *Engine) reconnect(sessionCtx, attemptCtx context.Context, s *session, writer StreamWriter, interruptionReason string) (io.ReadCloser, error) {
+	ctx := s.req.Context
+	req := &s.req
+	state := s.retryState(s.retries, interruptionReason)
+
+	// Build retry request
+	e.logger.Debugf("Building retry request body. Accumulated text length: %d", len(s.accumulatedText))
+	e.logger.Debugf("Accumulated text preview: %s", truncate(s.accumulatedText, 200))
+	retryURL, retryBody := e.strategy.Continuation(state)
+	retryBodyBytes, err := json.Marshal(retryBody)
+	if err != nil {
+		e.logger.Errorf("Failed to marshal retry body: %v", err)
+		if !e.clock.Sleep(sessionCtx, e.strategy.Delay(state)) {
+			return nil, e.sessionEnded(ctx, writer, interruptionReason, len(s.accumulatedText))
+		}
+		return nil, nil
+	}
+
+	e.logger.Debugf("Making retry request to: %s", retryURL)
+	e.logger.Debugf("Retry request body size: %d bytes", len(retryBodyBytes))
+
+	// Make retry request, racing two in parallel once the session has failed repeatedly
+	var retryResponse *http.Response
+	attemptStart := e.clock.Now()
+	speculative := e.settings.SpeculativeRetryAfter > 0 && s.retries >= e.settings.SpeculativeRetryAfter
+	var alternate raceRoute
+	if speculative {
+		var ok bool
+		if alternate, ok = e.alternateRoute(attemptCtx, req); !ok {
+			e.logger.Debugf("%d consecutive failures, but no other upstream or credentials to race. Sending a single retry.", s.retries)
+			speculative = false
+		}
+	}
+	if speculative {
+		e.logger.Infof("%d consecutive failures. Launching speculative parallel retry on an alternative route.", s.retries)
+		var winner raceRoute
+		retryResponse, winner, err = e.raceRetryRequests([]raceRoute{{ctx: attemptCtx, header: req.Header}, alternate}, retryURL, retryBodyBytes)
+		if err == nil && retryResponse.StatusCode == http.StatusOK {
+			// Later retries keep the credentials that produced a healthy stream
+			req.Header = winner.header
+		}
+	} else {
+		retryResponse, err = e.sendRetryRequest(attemptCtx, retryURL, retryBodyBytes, req.Header)
+	}
+	// Rejected credentials are swapped and the request resent without counting another retry
+	for err == nil && req.Failover != nil && retryResponse.StatusCode != http.StatusOK {
+		header, ok := req.Failover.Next(req.Header, retryResponse.StatusCode)
+		if !ok {
+			break
+		}
+		e.logger.Infof("Retry attempt %d rejected with status %d. Resending with the next credentials.", s.retries, retryResponse.StatusCode)
+		retryResponse.Body.Close()
+		req.Header = header
+		retryResponse, err = e.sendRetryRequest(attemptCtx, retryURL, retryBodyBytes, req.Header)
+	}
+	// Rate limits are usually transient, so they are waited out on a budget of their own
+	for err == nil && retryResponse.StatusCode == http.StatusTooManyRequests && s.rateLimitRetries < e.settings.RateLimitRetries {
+		errorBytes, _ := io.ReadAll(retryResponse.Body)
+		retryResponse.Body.Close()
+		delay, ok := e.rateLimitDelay(retryResponse.Header, errorBytes, s.rateLimitRetries+1)
+		if !ok {
+			e.logger.Errorf("Upstream asked to wait %v, longer than the maximum rate-limit delay of %v", delay, e.settings.MaxRateLimitDelay)
+			retryResponse.Body = io.NopCloser(bytes.NewReader(errorBytes))
+			break
+		}
+		s.rateLimitRetries++
+		e.warnf("Retry attempt %d rate limited. Waiting %v before rate-limit retry %d/%d.", s.retries, delay, s.rateLimitRetries, e.settings.RateLimitRetries)
+		s.result.Reasons = append(s.result.Reasons, "RATE_LIMITED")
+		e.observer.Interruption("RATE_LIMITED")
+		if !e.clock.Sleep(sessionCtx, delay) {
+			return nil, e.sessionEnded(ctx, writer, interruptionReason, len(s.accumulatedText))
+		}
+		retryResponse, err = e.sendRetryRequest(attemptCtx, retryURL, retryBodyBytes, req.Header)
+	}
+	if err != nil && ctx.Err() != nil {
+		e.logger.Infof("Session cancelled during retry request. Not retrying.")
+		return nil, cancelled(ctx)
+	}
+	if err != nil && sessionCtx.Err() != nil {
+		return nil, e.sessionEnded(ctx, writer, interruptionReason, len(s.accumulatedText))
+	}
+	if err != nil {
+		errorClass := ClassifyError(err)
+		delay := e.networkRetryDelay(e.strategy.Delay(state), errorClass)
+		e.warnf("=== RETRY ATTEMPT %d FAILED ===", s.retries)
+		e.warnf("Network error during retry (%s): %v", errorClass, err)
+		e.warnf("Will wait %v before next attempt (if any)", delay)
+		s.result.Reasons = append(s.result.Reasons, errorClass)
+		e.observer.Interruption(errorClass)
+		e.observer.NetworkError(errorClass)
+		if !e.clock.Sleep(sessionCtx, delay) {
+			return nil, e.sessionEnded(ctx, writer, errorClass, len(s.accumulatedText))
+		}
+		return nil, nil
+	}
+	e.observer.ResponseTime(e.since(attemptStart))
+
+	e.logger.Infof("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status)
+
+	if nonRetryableStatuses[retryResponse.StatusCode] {
+		e.logger.Errorf("=== FATAL ERROR DURING RETRY ===")
+		e.logger.Errorf("Received non-retryable status %d during retry attempt %d", retryResponse.StatusCode, s.retries)
+
+		// Write SSE error from upstream
+		errorBytes, _ := io.ReadAll(retryResponse.Body)
+		retryResponse.Body.Close()
+		if e.settings.MaskUpstreamErrors {
+			e.logger.Debugf("Masking upstream error body: %s", errorBytes)
+			errorBytes = MaskErrorBody(errorBytes, retryResponse.StatusCode)
+		}
+
+		writer.WriteError(errorBytes)
+
+		return nil, fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
+	}
+
+	if retryResponse.StatusCode != http.StatusOK {
+		e.warnf("Retry attempt %d failed with status %d", s.retries, retryResponse.StatusCode)
+		e.warnf("This is considered a retryable error - will try again if retries remain")
+		retryResponse.Body.Close()
+		delay := e.strategy.Delay(state)
+		e.warnf("Will wait %v before next attempt (if any)", delay)
+		if !e.clock.Sleep(sessionCtx, delay) {
+			return nil, e.sessionEnded(ctx, writer, interruptionReason, len(s.accumulatedText))
+		}
+		return nil, nil
+	}
+
+	e.logger.Infof("✓ Retry attempt %d successful - got new stream", s.retries)
+	e.logger.Infof("Continuing with accumulated context (%d chars)", len(s.accumulatedText))
+	return retryResponse.Body, nil
+}
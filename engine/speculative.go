@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// cancelBody closes the underlying response body and releases its request context
+type cancelBody struct {
+	io.Reader
+	closer io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.closer.Close()
+	b.cancel()
+	return err
+}
+
+// sendRetryRequest posts a retry body upstream. The returned response body
+// cancels ctx when closed.
+func (e *Engine) sendRetryRequest(ctx context.Context, upstreamURL string, body []byte, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create retry request: %w", err)
+	}
+	req.Header = header.Clone()
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{Reader: resp.Body, closer: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// raceRoute is the context and header one racer sends its request with
+type raceRoute struct {
+	ctx    context.Context
+	header http.Header
+}
+
+// alternateRoute returns a route avoiding the upstream or credentials of
+// req, or false if its failover offers no alternative
+func (e *Engine) alternateRoute(ctx context.Context, req *Request) (raceRoute, bool) {
+	alternates, ok := req.Failover.(Alternates)
+	if !ok {
+		return raceRoute{}, false
+	}
+	ctx, header, ok := alternates.Alternate(ctx, req.Header)
+	if !ok {
+		return raceRoute{}, false
+	}
+	return raceRoute{ctx: ctx, header: header}, true
+}
+
+type raceResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// raceRetryRequests sends the same retry body along each route in parallel and
+// returns the first response that is 200 OK and has started streaming, with
+// the route that produced it, cancelling the others. If none is healthy, the
+// last result is returned for normal error handling.
+func (e *Engine) raceRetryRequests(routes []raceRoute, upstreamURL string, body []byte) (*http.Response, raceRoute, error) {
+	racers := len(routes)
+	cancels := make([]context.CancelFunc, racers)
+	results := make(chan raceResult, racers)
+
+	for i, route := range routes {
+		ctx, cancel := context.WithCancel(route.ctx)
+		cancels[i] = cancel
+		go func(index int, ctx context.Context, cancel context.CancelFunc, header http.Header) {
+			resp, err := e.sendRetryRequest(ctx, upstreamURL, body, header)
+			if err != nil {
+				cancel()
+				results <- raceResult{index: index, err: err}
+				return
+			}
+
+			var reader io.Reader = resp.Body
+			if resp.StatusCode == http.StatusOK {
+				// Wait for the first byte so a stalled stream doesn't win the race
+				buffered := bufio.NewReader(resp.Body)
+				if _, err := buffered.Peek(1); err != nil {
+					resp.Body.Close()
+					cancel()
+					results <- raceResult{index: index, err: err}
+					return
+				}
+				reader = buffered
+			}
+			resp.Body = &cancelBody{Reader: reader, closer: resp.Body, cancel: cancel}
+			results <- raceResult{index: index, resp: resp}
+		}(i, ctx, cancel, route.header)
+	}
+
+	var last raceResult
+	for received := 0; received < racers; received++ {
+		result := <-results
+
+		if result.err == nil && result.resp.StatusCode == http.StatusOK {
+			e.logger.Infof("Speculative retry racer %d won with a healthy stream", result.index+1)
+			for i, cancel := range cancels {
+				if i != result.index {
+					cancel()
+				}
+			}
+			// Release the losers' responses once they report back
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}
+			}(racers - received - 1)
+			return result.resp, routes[result.index], nil
+		}
+
+		if result.err != nil {
+			e.logger.Debugf("Speculative retry racer %d failed: %v", result.index+1, result.err)
+		} else {
+			e.logger.Debugf("Speculative retry racer %d returned status %d", result.index+1, result.resp.StatusCode)
+		}
+		if last.resp != nil {
+			last.resp.Body.Close()
+		}
+		last = result
+	}
+
+	return last.resp, routes[last.index], last.err
+}
@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DoneToken is the default marker the model is asked to end a complete answer with
+const DoneToken = "[done]"
+
+// Default SSE line buffer sizes, used when Settings leaves them at zero
+const (
+	DefaultLineBufferSize = 64 * 1024
+	DefaultMaxLineSize    = 64 * 1024 * 1024
+)
+
+// ErrLineTooLong is reported when an SSE line exceeds Settings.MaxLineSize
+var ErrLineTooLong = errors.New("SSE line too long")
+
+// readLines reads non-empty SSE lines from a reader. A read error, if any, is
+// sent on errCh (which must be buffered) before ch is closed.
+func (e *Engine) readLines(reader io.Reader, ch chan<- string, errCh chan<- error) {
+	defer close(ch)
+
+	bufferSize := e.settings.LineBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultLineBufferSize
+	}
+	maxLine := e.settings.MaxLineSize
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineSize
+	}
+	buffered := bufio.NewReaderSize(reader, bufferSize)
+	lineCount := 0
+
+	e.logger.Debugf("Starting SSE line iteration")
+
+	for {
+		line, err := readLine(buffered, maxLine)
+		if strings.TrimSpace(line) != "" {
+			lineCount++
+			e.tracef("SSE Line %d: %s", lineCount, truncate(line, 200))
+			ch <- line
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			e.logger.Debugf("Error reading SSE stream: %v", err)
+			errCh <- err
+			break
+		}
+	}
+
+	e.logger.Debugf("SSE stream ended. Total lines processed: %d", lineCount)
+}
+
+// readLine returns the next line without its line ending. Lines longer than
+// the reader's buffer, such as chunks carrying inline base64 images, are
+// assembled across several reads up to maxLine bytes.
+func readLine(reader *bufio.Reader, maxLine int) (string, error) {
+	var long []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if len(long)+len(chunk) > maxLine {
+				return "", fmt.Errorf("%w: more than %d bytes", ErrLineTooLong, maxLine)
+			}
+			long = append(long, chunk...)
+			continue
+		}
+		if long != nil {
+			chunk = append(long, chunk...)
+		}
+		if len(chunk) > maxLine {
+			return "", fmt.Errorf("%w: more than %d bytes", ErrLineTooLong, maxLine)
+		}
+		chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+		chunk = bytes.TrimSuffix(chunk, []byte("\r"))
+		return string(chunk), err
+	}
+}
+
+// truncate shortens s to at most n bytes for logging
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// IsDataLine checks if a line is a data line
+func IsDataLine(line string) bool {
+	return strings.HasPrefix(line, "data: ")
+}
+
+// IsBlockedLine checks if a line contains blocking information
+func IsBlockedLine(line string) bool {
+	return strings.Contains(line, "blockReason")
+}
+
+// ExtractFinishReason extracts finish reason from a line
+func ExtractFinishReason(line string) string {
+	if !strings.Contains(line, "finishReason") {
+		return ""
+	}
+
+	idx := strings.Index(line, "{")
+	if idx == -1 {
+		return ""
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
+		return ""
+	}
+
+	if candidates, ok := data["candidates"].([]interface{}); ok && len(candidates) > 0 {
+		if candidate, ok := candidates[0].(map[string]interface{}); ok {
+			if finishReason, ok := candidate["finishReason"].(string); ok {
+				return finishReason
+			}
+		}
+	}
+
+	return ""
+}
+
+// LineContent represents parsed content from a data line
+type LineContent struct {
+	// Text is the formal (non-thought) text of every part, in order
+	Text string
+	// IsThought is set when the chunk carries thought parts and no formal text
+	IsThought bool
+	// HasThought is set when any part is a thought
+	HasThought      bool
+	HasFunctionCall bool
+}
+
+// lineParts decodes a data line and returns the decoded event along with the
+// parts of its first candidate
+func lineParts(line string) (map[string]interface{}, []interface{}, bool) {
+	data, ok := decodeDataLine(line)
+	if !ok {
+		return nil, nil, false
+	}
+
+	candidates, ok := data["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return nil, nil, false
+	}
+
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return nil, nil, false
+	}
+
+	content, ok := candidate["content"].(map[string]interface{})
+	if !ok {
+		return nil, nil, false
+	}
+
+	parts, ok := content["parts"].([]interface{})
+	if !ok || len(parts) == 0 {
+		return nil, nil, false
+	}
+	return data, parts, true
+}
+
+// ParseLineContent parses a data line, collecting the text of every part and
+// whether the chunk is thinking or formal output
+func ParseLineContent(line string) LineContent {
+	_, parts, ok := lineParts(line)
+	if !ok {
+		return LineContent{}
+	}
+
+	var result LineContent
+	var text strings.Builder
+	for _, p := range parts {
+		part, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if part["functionCall"] != nil {
+			result.HasFunctionCall = true
+		}
+		if thought, _ := part["thought"].(bool); thought {
+			result.HasThought = true
+			continue
+		}
+		if partText, ok := part["text"].(string); ok {
+			text.WriteString(partText)
+		}
+	}
+
+	result.Text = text.String()
+	result.IsThought = result.HasThought && result.Text == ""
+	return result
+}
+
+// RemoveDoneTokenFromLine removes the done token from the last formal text
+// part of an SSE data line if present
+func RemoveDoneTokenFromLine(line, token string, shouldRemove bool) string {
+	if !shouldRemove {
+		return line
+	}
+
+	data, parts, ok := lineParts(line)
+	if !ok {
+		return line
+	}
+
+	// The token ends the answer, so it can only be in the last formal text part
+	var part map[string]interface{}
+	var text string
+	for i := len(parts) - 1; i >= 0; i-- {
+		candidate, ok := parts[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if thought, _ := candidate["thought"].(bool); thought {
+			continue
+		}
+		if partText, ok := candidate["text"].(string); ok {
+			part, text = candidate, partText
+			break
+		}
+	}
+	if part == nil {
+		return line
+	}
+
+	// Remove the longest suffix of the token from the text
+	// This handles cases where the token is split across chunks
+	originalText := strings.TrimSpace(text)
+	modifiedText := originalText
+
+	// Try to remove each possible suffix of the token
+	for i := len(token); i > 0; i-- {
+		suffix := token[len(token)-i:]
+		if strings.HasSuffix(originalText, suffix) {
+			modifiedText = strings.TrimSuffix(originalText, suffix)
+			break
+		}
+	}
+
+	if originalText != modifiedText {
+		part["text"] = modifiedText
+
+		modifiedData, err := json.Marshal(data)
+		if err != nil {
+			return line
+		}
+
+		return line[:strings.Index(line, "{")] + string(modifiedData)
+	}
+
+	return line
+}
+
+// TrimLeadingText removes up to n characters from the start of the formal text
+// parts of an SSE data line, returning the line and the number removed
+func TrimLeadingText(line string, n int) (string, int) {
+	data, parts, ok := lineParts(line)
+	if !ok || n <= 0 {
+		return line, 0
+	}
+
+	removed := 0
+	for _, p := range parts {
+		if removed == n {
+			break
+		}
+		part, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if thought, _ := part["thought"].(bool); thought {
+			continue
+		}
+		text, ok := part["text"].(string)
+		if !ok {
+			continue
+		}
+		runes := []rune(text)
+		cut := min(len(runes), n-removed)
+		part["text"] = string(runes[cut:])
+		removed += cut
+	}
+	if removed == 0 {
+		return line, 0
+	}
+
+	modifiedData, err := json.Marshal(data)
+	if err != nil {
+		return line, 0
+	}
+	return line[:strings.Index(line, "{")] + string(modifiedData), removed
+}
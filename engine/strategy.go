@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryState describes a session about to be retried
+type RetryState struct {
+	// Retry numbers the retry being decided on, starting at 1
+	Retry int
+	// Reason is the interruption that ended the last attempt
+	Reason string
+	// AccumulatedText is the formal text delivered so far
+	AccumulatedText string
+	// Request is the upstream request, with the credentials currently in use
+	Request Request
+}
+
+// RetryStrategy makes the engine's retry decisions. The engine detects
+// interruptions and relays the streams; the strategy decides whether to
+// retry, how long to wait first and what to send. A strategy that changes
+// only some decisions can embed DefaultRetryStrategy.
+type RetryStrategy interface {
+	// ShouldRetry reports whether to retry; returning false ends the session
+	// with a RETRY_LIMIT_EXCEEDED error
+	ShouldRetry(state RetryState) bool
+	// Delay returns the pause before a retry whose request failed. Network
+	// errors scale it by Settings.NetworkErrorBackoff; rate limits are waited
+	// out separately.
+	Delay(state RetryState) time.Duration
+	// Continuation returns the URL and body of the request that continues the answer
+	Continuation(state RetryState) (url string, body map[string]interface{})
+}
+
+// DefaultRetryStrategy retries as configured by Settings: up to MaxRetries
+// times with exponential backoff, sending the original request to the same
+// URL with the text delivered so far and the continuation prompt appended.
+type DefaultRetryStrategy struct {
+	Settings Settings
+	// Logger receives debug output; nil logs nothing
+	Logger Logger
+}
+
+func (d DefaultRetryStrategy) logger() Logger {
+	if d.Logger == nil {
+		return nopLogger{}
+	}
+	return d.Logger
+}
+
+// ShouldRetry allows MaxRetries consecutive retries
+func (d DefaultRetryStrategy) ShouldRetry(state RetryState) bool {
+	return state.Retry <= d.Settings.MaxRetries
+}
+
+// Delay returns RetryDelay doubled for every earlier retry up to
+// MaxRetryDelay, randomized by RetryJitter so concurrent sessions do not
+// retry in lockstep
+func (d DefaultRetryStrategy) Delay(state RetryState) time.Duration {
+	baseDelay := d.Settings.RetryDelay
+	delay := baseDelay
+	for i := 1; i < state.Retry && delay < d.Settings.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.Settings.MaxRetryDelay && d.Settings.MaxRetryDelay > baseDelay {
+		delay = d.Settings.MaxRetryDelay
+	}
+	if d.Settings.RetryJitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + d.Settings.RetryJitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+// Continuation resends the original request to its URL with the retry context appended
+func (d DefaultRetryStrategy) Continuation(state RetryState) (string, map[string]interface{}) {
+	return state.Request.URL, d.buildRetryBody(state.Request.Body, state.AccumulatedText)
+}
+
+// buildRetryBody builds a new request body for retry with accumulated context
+func (d DefaultRetryStrategy) buildRetryBody(originalBody map[string]interface{}, accumulatedText string) map[string]interface{} {
+	logger := d.logger()
+	logger.Debugf("Building retry request body. Accumulated text length: %d", len(accumulatedText))
+	logger.Debugf("Accumulated text preview: %s", truncate(accumulatedText, 200))
+
+	// Copying every field keeps a cachedContent reference, so retries hit the same cache
+	retryBody := make(map[string]interface{})
+	for k, v := range originalBody {
+		retryBody[k] = v
+	}
+	if cacheName, _ := retryBody["cachedContent"].(string); cacheName != "" {
+		logger.Debugf("Retry request reuses cachedContent %s", cacheName)
+	}
+
+	contents, ok := retryBody["contents"].([]interface{})
+	if !ok {
+		contents = []interface{}{}
+	}
+
+	// Find last user message index
+	lastUserIndex := -1
+	for i := len(contents) - 1; i >= 0; i-- {
+		if content, ok := contents[i].(map[string]interface{}); ok {
+			if role, ok := content["role"].(string); ok && role == "user" {
+				lastUserIndex = i
+				break
+			}
+		}
+	}
+
+	// Build retry context
+	history := []interface{}{
+		map[string]interface{}{
+			"role": "model",
+			"parts": []interface{}{
+				map[string]interface{}{"text": d.retryContext(accumulatedText)},
+			},
+		},
+		map[string]interface{}{
+			"role": "user",
+			"parts": []interface{}{
+				map[string]interface{}{"text": renderContinuationPrompt(d.Settings.ContinuationPrompt, accumulatedText)},
+			},
+		},
+	}
+
+	// Insert history after last user message
+	if lastUserIndex != -1 {
+		newContents := make([]interface{}, 0, len(contents)+2)
+		newContents = append(newContents, contents[:lastUserIndex+1]...)
+		newContents = append(newContents, history...)
+		newContents = append(newContents, contents[lastUserIndex+1:]...)
+		retryBody["contents"] = newContents
+		logger.Debugf("Inserted retry context after user message at index %d", lastUserIndex)
+	} else {
+		newContents := append(contents, history...)
+		retryBody["contents"] = newContents
+		logger.Debugf("Appended retry context to end of conversation")
+	}
+
+	logger.Debugf("Final retry request has %d messages", len(retryBody["contents"].([]interface{})))
+	return retryBody
+}
+
+// retryContext returns the part of accumulatedText sent back to the model on
+// a retry: all of it, or its end when it is longer than MaxRetryContext
+func (d DefaultRetryStrategy) retryContext(accumulatedText string) string {
+	if d.Settings.MaxRetryContext <= 0 || len(accumulatedText) <= d.Settings.MaxRetryContext {
+		return accumulatedText
+	}
+	runes := []rune(accumulatedText)
+	if len(runes) <= d.Settings.MaxRetryContext {
+		return accumulatedText
+	}
+	d.logger().Infof("Retry context truncated to the last %d of %d characters", d.Settings.MaxRetryContext, len(runes))
+	return string(runes[len(runes)-d.Settings.MaxRetryContext:])
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryStrategyShouldRetry(t *testing.T) {
+	strategy := DefaultRetryStrategy{Settings: Settings{MaxRetries: 2}}
+
+	for retry, want := range map[int]bool{1: true, 2: true, 3: false} {
+		if got := strategy.ShouldRetry(RetryState{Retry: retry}); got != want {
+			t.Errorf("ShouldRetry(retry %d) = %v, want %v", retry, got, want)
+		}
+	}
+}
+
+func TestDefaultRetryStrategyDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		retry    int
+		expected time.Duration
+	}{
+		{"first retry", 750 * time.Millisecond, 8 * time.Second, 1, 750 * time.Millisecond},
+		{"doubles", 750 * time.Millisecond, 8 * time.Second, 3, 3 * time.Second},
+		{"capped", 750 * time.Millisecond, 8 * time.Second, 10, 8 * time.Second},
+		{"fixed when max is not larger", time.Second, time.Second, 5, time.Second},
+		{"fixed when max is unset", time.Second, 0, 5, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := DefaultRetryStrategy{Settings: Settings{RetryDelay: tt.base, MaxRetryDelay: tt.max}}
+			if got := strategy.Delay(RetryState{Retry: tt.retry}); got != tt.expected {
+				t.Errorf("Delay(retry %d) = %v, want %v", tt.retry, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDefaultRetryStrategyDelayJitter(t *testing.T) {
+	strategy := DefaultRetryStrategy{Settings: Settings{RetryDelay: time.Second, MaxRetryDelay: time.Second, RetryJitter: 0.2}}
+
+	for i := 0; i < 100; i++ {
+		if got := strategy.Delay(RetryState{Retry: 1}); got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Fatalf("Delay with 20%% jitter = %v, want within 800ms..1.2s", got)
+		}
+	}
+}
+
+func TestDefaultRetryStrategyContinuation(t *testing.T) {
+	strategy := DefaultRetryStrategy{Settings: Settings{ContinuationPrompt: "Continue after {chars} characters."}}
+	body := map[string]interface{}{
+		"cachedContent": "cachedContents/abc",
+		"contents": []interface{}{
+			map[string]interface{}{"role": "user", "parts": []interface{}{map[string]interface{}{"text": "question"}}},
+			map[string]interface{}{"role": "model", "parts": []interface{}{map[string]interface{}{"text": "prefill"}}},
+		},
+	}
+
+	url, retryBody := strategy.Continuation(RetryState{
+		AccumulatedText: "partial",
+		Request:         Request{URL: "https://upstream/v1beta/models/m:streamGenerateContent", Body: body},
+	})
+
+	if url != "https://upstream/v1beta/models/m:streamGenerateContent" {
+		t.Errorf("url = %q", url)
+	}
+	if retryBody["cachedContent"] != "cachedContents/abc" {
+		t.Errorf("cachedContent = %v, want it kept", retryBody["cachedContent"])
+	}
+	if len(body["contents"].([]interface{})) != 2 {
+		t.Error("original body was modified")
+	}
+
+	contents := retryBody["contents"].([]interface{})
+	wantRoles := []string{"user", "model", "user", "model"}
+	wantTexts := []string{"question", "partial", "Continue after 7 characters.", "prefill"}
+	if len(contents) != len(wantRoles) {
+		t.Fatalf("retry body has %d messages, want %d", len(contents), len(wantRoles))
+	}
+	for i, c := range contents {
+		content := c.(map[string]interface{})
+		text := content["parts"].([]interface{})[0].(map[string]interface{})["text"]
+		if content["role"] != wantRoles[i] || text != wantTexts[i] {
+			t.Errorf("message %d = %v %q, want %s %q", i, content["role"], text, wantRoles[i], wantTexts[i])
+		}
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		text  string
+		want  string
+	}{
+		{"unlimited", 0, "abcdef", "abcdef"},
+		{"within limit", 10, "abcdef", "abcdef"},
+		{"truncated to the end", 3, "abcdef", "def"},
+		{"counts characters, not bytes", 2, "你好世界", "世界"},
+		{"multibyte within limit", 4, "你好世界", "你好世界"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := DefaultRetryStrategy{Settings: Settings{MaxRetryContext: tt.limit}}
+			if got := strategy.retryContext(tt.text); got != tt.want {
+				t.Errorf("retryContext(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
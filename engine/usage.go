@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// usageTally adds up the usageMetadata of every upstream attempt, so the
+// token counts the client sees cover the whole session rather than only the
+// last attempt. Within one attempt each chunk's usageMetadata is a running
+// total, so only the latest one of an attempt counts.
+type usageTally struct {
+	finished map[string]interface{}
+	current  map[string]interface{}
+}
+
+// observe records the usageMetadata of a data line from the current attempt
+func (u *usageTally) observe(line string) {
+	if !strings.Contains(line, `"usageMetadata"`) {
+		return
+	}
+	data, ok := decodeDataLine(line)
+	if !ok {
+		return
+	}
+	if usage, ok := data["usageMetadata"].(map[string]interface{}); ok {
+		u.current = usage
+	}
+}
+
+// endAttempt adds the current attempt's usage to the finished attempts
+func (u *usageTally) endAttempt() {
+	if u.current == nil {
+		return
+	}
+	u.finished = mergeUsage(u.finished, u.current)
+	u.current = nil
+}
+
+// rewrite replaces the usageMetadata of a line about to be forwarded with
+// the total including all finished attempts
+func (u *usageTally) rewrite(line string) string {
+	if u.finished == nil || !strings.Contains(line, `"usageMetadata"`) {
+		return line
+	}
+	data, ok := decodeDataLine(line)
+	if !ok {
+		return line
+	}
+	usage, ok := data["usageMetadata"].(map[string]interface{})
+	if !ok {
+		return line
+	}
+	data["usageMetadata"] = mergeUsage(u.finished, usage)
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return line
+	}
+	return line[:strings.Index(line, "{")] + string(encoded)
+}
+
+// total returns the usage of the whole session so far, or nil if upstream reported none
+func (u *usageTally) total() map[string]interface{} {
+	if u.current == nil {
+		return u.finished
+	}
+	return mergeUsage(u.finished, u.current)
+}
+
+func decodeDataLine(line string) (map[string]interface{}, bool) {
+	if !IsDataLine(line) {
+		return nil, false
+	}
+	idx := strings.Index(line, "{")
+	if idx == -1 {
+		return nil, false
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// mergeUsage adds two usageMetadata objects. Token counts are summed,
+// per-modality breakdowns such as promptTokensDetails are summed by modality,
+// and any other field is taken from b.
+func mergeUsage(a, b map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		switch bv := v.(type) {
+		case float64:
+			if av, ok := merged[k].(float64); ok {
+				merged[k] = av + bv
+				continue
+			}
+		case []interface{}:
+			if av, ok := merged[k].([]interface{}); ok {
+				merged[k] = mergeModalities(av, bv)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeModalities sums two lists of {"modality", "tokenCount"} entries
+func mergeModalities(a, b []interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(a)+len(b))
+	index := make(map[string]map[string]interface{})
+	for _, list := range [][]interface{}{a, b} {
+		for _, item := range list {
+			entry, ok := item.(map[string]interface{})
+			modality, named := entry["modality"].(string)
+			if !ok || !named {
+				merged = append(merged, item)
+				continue
+			}
+			count, _ := entry["tokenCount"].(float64)
+			if existing, seen := index[modality]; seen {
+				total, _ := existing["tokenCount"].(float64)
+				existing["tokenCount"] = total + count
+				continue
+			}
+			copied := map[string]interface{}{"modality": modality, "tokenCount": count}
+			index[modality] = copied
+			merged = append(merged, copied)
+		}
+	}
+	return merged
+}
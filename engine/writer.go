@@ -0,0 +1,35 @@
+package engine
+
+import "errors"
+
+// StreamWriter delivers the engine's output to the client in a specific
+// output protocol. The engine only ever hands it upstream Gemini SSE data
+// lines and terminal error payloads.
+type StreamWriter interface {
+	// WriteData forwards one Gemini SSE data line ("data: {...}")
+	WriteData(line string) error
+	// WriteError reports a terminal error as a Gemini error JSON payload
+	WriteError(payload []byte) error
+	// Close completes the response once the engine has finished
+	Close() error
+}
+
+// ClientWriteError reports that output could not be delivered to the
+// downstream client, as opposed to a failure of the upstream stream
+type ClientWriteError struct {
+	Err error
+}
+
+func (e *ClientWriteError) Error() string {
+	return "failed to write to client: " + e.Err.Error()
+}
+
+func (e *ClientWriteError) Unwrap() error {
+	return e.Err
+}
+
+// IsClientWriteError reports whether err is a downstream write failure
+func IsClientWriteError(err error) bool {
+	var writeErr *ClientWriteError
+	return errors.As(err, &writeErr)
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gemini-antiblock/abuse"
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/modelinfo"
+	"gemini-antiblock/modelstats"
+	"gemini-antiblock/report"
+	"gemini-antiblock/secrets"
+	"gemini-antiblock/storage"
+	"gemini-antiblock/streaming"
+	"gemini-antiblock/usage"
+)
+
+// AdminHandler serves the token-protected /admin management API
+type AdminHandler struct {
+	Config *config.Config
+	// Live, if set, supplies reloaded configuration in place of Config
+	Live *config.Live
+	// Honeypot, when set, answers requests without a valid token with decoy errors
+	Honeypot *Honeypot
+	// Reports serves stored daily reports
+	Reports *report.Reporter
+	// Token is the admin token, which may be rotated while the proxy runs
+	Token *secrets.Value
+	// Reload, if set, re-reads the configuration for the reload endpoint
+	Reload func() (config.Changes, error)
+	// Override, if set, changes settings for the config update endpoint
+	Override func(values map[string]string) (config.Changes, error)
+}
+
+// NewAdminHandler creates a new admin handler
+func NewAdminHandler(cfg *config.Config) *AdminHandler {
+	h := &AdminHandler{Config: cfg, Token: secrets.NewValue(cfg.AdminToken)}
+	if cfg.HoneypotMode {
+		h.Honeypot = NewHoneypot(cfg.HoneypotRateLimit)
+	}
+	return h
+}
+
+// current returns the configuration in effect
+func (h *AdminHandler) current() *config.Config {
+	if h.Live != nil {
+		return h.Live.Get()
+	}
+	return h.Config
+}
+
+// Authorize wraps an admin endpoint with bearer token authentication
+func (h *AdminHandler) Authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := h.Token.Get()
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			if h.Honeypot != nil {
+				h.Honeypot.Reject(w, r)
+				return
+			}
+			logger.LogError("Rejected admin request with invalid token from", ClientIP(r))
+			JSONError(w, 401, ReasonUnauthorized, "Invalid or missing admin token", "")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ModelStatsHandler returns rolling retry statistics per model
+func (h *AdminHandler) ModelStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(modelstats.GetGlobalStore().Snapshot()); err != nil {
+		logger.LogError("Failed to encode model stats response:", err)
+	}
+}
+
+// UsageHandler returns the requests, streamed characters, tokens and retries
+// of every client key, for today, this month and in total
+func (h *AdminHandler) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(usage.GetGlobalTracker().Snapshot()); err != nil {
+		logger.LogError("Failed to encode usage response:", err)
+	}
+}
+
+// TenantStatsHandler returns the usage of one client key, identified by the
+// ID it is listed under in /admin/usage and the Prometheus tenant label
+func (h *AdminHandler) TenantStatsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	stats, ok := usage.GetGlobalTracker().Find(id)
+	if !ok {
+		JSONError(w, 404, ReasonNotFound, "No usage recorded for tenant "+id, "")
+		return
+	}
+	response := struct {
+		ID string `json:"id"`
+		usage.KeyUsage
+	}{id, stats}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.LogError("Failed to encode tenant stats response:", err)
+	}
+}
+
+// ModelCapabilitiesHandler returns the cached upstream model metadata
+func (h *AdminHandler) ModelCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	models, updatedAt := modelinfo.GetGlobalCatalog().Snapshot()
+	response := struct {
+		UpdatedAt time.Time                `json:"updated_at"`
+		Models    []modelinfo.Capabilities `json:"models"`
+	}{updatedAt, models}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.LogError("Failed to encode model capabilities response:", err)
+	}
+}
+
+// ConfigHandler returns the effective configuration with secrets masked
+func (h *AdminHandler) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(h.current().EntryMap()); err != nil {
+		logger.LogError("Failed to encode admin config response:", err)
+	}
+}
+
+// ReloadHandler re-reads the configuration and reports which settings changed
+func (h *AdminHandler) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Reload == nil {
+		JSONError(w, 404, ReasonFeatureDisabled, "Configuration reload is not available", "")
+		return
+	}
+	changes, err := h.Reload()
+	if err != nil {
+		logger.LogError("Configuration reload failed:", err)
+		JSONError(w, 500, ReasonInternal, "Configuration reload failed", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
+		logger.LogError("Failed to encode config reload response:", err)
+	}
+}
+
+// UpdateConfigHandler changes select settings at runtime. The body is a JSON
+// object keyed by environment variable name, such as {"MAX_CONSECUTIVE_RETRIES": 5}.
+func (h *AdminHandler) UpdateConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Override == nil {
+		JSONError(w, 404, ReasonFeatureDisabled, "Runtime configuration changes are not available", "")
+		return
+	}
+
+	var body map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Request body must be a JSON object of settings", err.Error())
+		return
+	}
+	values := make(map[string]string, len(body))
+	for key, value := range body {
+		values[key] = fmt.Sprint(value)
+	}
+
+	changes, err := h.Override(values)
+	if err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Configuration change rejected", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
+		logger.LogError("Failed to encode config update response:", err)
+	}
+}
+
+// SessionsHandler lists the streaming sessions in progress with their retries and delivered text
+func (h *AdminHandler) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(streaming.ActiveSessions()); err != nil {
+		logger.LogError("Failed to encode sessions response:", err)
+	}
+}
+
+// AbuseHandler returns the most active request fingerprints and their anomaly signals
+func (h *AdminHandler) AbuseHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.current().AbuseDetection {
+		JSONError(w, 404, ReasonFeatureDisabled, "Abuse detection is disabled", "Set ABUSE_DETECTION=true to enable it")
+		return
+	}
+
+	report := abuse.GetGlobalTracker().Report(abuse.Thresholds{
+		PromptsPerMinute:  h.current().AbusePromptRate,
+		RetriesPerSession: h.current().AbuseRetryRate,
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.LogError("Failed to encode abuse report:", err)
+	}
+}
+
+// DailyReportHandler returns the partial report for today, or the stored report for ?date=YYYY-MM-DD
+func (h *AdminHandler) DailyReportHandler(w http.ResponseWriter, r *http.Request) {
+	var body interface{}
+	if date := r.URL.Query().Get("date"); date != "" {
+		daily, err := h.Reports.Load(r.Context(), date)
+		if errors.Is(err, storage.ErrNotFound) {
+			JSONError(w, 404, ReasonNotFound, "No report stored for "+date, "")
+			return
+		}
+		if err != nil {
+			logger.LogError("Failed to load daily report:", err)
+			JSONError(w, 500, ReasonInternal, "Failed to load daily report", err.Error())
+			return
+		}
+		body = daily
+	} else {
+		body = h.Reports.Collector.Current()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.LogError("Failed to encode daily report response:", err)
+	}
+}
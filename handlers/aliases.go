@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// rewriteModels applies MODEL_ALIASES to the model in the request path and to
+// the model fields of a JSON body, such as those of cachedContents and
+// batchEmbedContents requests, so clients using retired or foreign model
+// names keep working. It returns the rewritten request, or served if the
+// request was already answered with an error.
+func (h *ProxyHandler) rewriteModels(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	aliases := h.current().ModelAliases
+	if len(aliases) == 0 {
+		return r, false
+	}
+
+	if model := ModelFromPath(r.URL.Path); model != "" {
+		if target, ok := aliases[model]; ok {
+			logger.LogInfo(fmt.Sprintf("Rewriting model %s to %s", model, target))
+			r = r.Clone(r.Context())
+			r.URL.Path = strings.Replace(r.URL.Path, "/models/"+model, "/models/"+target, 1)
+			r.URL.RawPath = ""
+		}
+	}
+
+	if r.Method != "POST" || r.Body == nil || r.Body == http.NoBody {
+		return r, false
+	}
+	body, served := h.bufferBody(w, r)
+	if served {
+		return r, true
+	}
+	if bytes.Contains(body, []byte(`"model"`)) {
+		body = rewriteBodyModels(body, aliases)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return r, false
+}
+
+// rewriteBodyModels replaces aliased model names, with or without the models/
+// prefix, in every model field of body. A body that is not JSON is left alone.
+func rewriteBodyModels(body []byte, aliases map[string]string) []byte {
+	var request interface{}
+	if json.Unmarshal(body, &request) != nil {
+		return body
+	}
+
+	changed := false
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if name, ok := child.(string); ok && key == "model" {
+					prefix := ""
+					if strings.HasPrefix(name, "models/") {
+						prefix = "models/"
+					}
+					if target, ok := aliases[strings.TrimPrefix(name, prefix)]; ok {
+						v[key] = prefix + target
+						changed = true
+					}
+					continue
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(request)
+	if !changed {
+		return body
+	}
+
+	rewritten, err := json.Marshal(request)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"gemini-antiblock/engine"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// tokensPerMediaPart is what Gemini counts for an image; other media are counted the same
+const tokensPerMediaPart = 258
+
+// estimateHeader marks a countTokens answer computed by the proxy
+const estimateHeader = "X-Proxy-Token-Estimate"
+
+// IsCountTokensPath reports whether path addresses countTokens
+func IsCountTokensPath(path string) bool {
+	return strings.HasSuffix(path, ":countTokens")
+}
+
+// HandleCountTokens passes countTokens through. If upstream cannot be reached,
+// is rate limiting or fails with a server error, and COUNT_TOKENS_FALLBACK is
+// on, it answers with a local estimate flagged by "estimated": true and the
+// X-Proxy-Token-Estimate header, so client budgets keep working.
+func (h *ProxyHandler) HandleCountTokens(w http.ResponseWriter, r *http.Request) {
+	requestBody, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+		return
+	}
+	if err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
+		return
+	}
+
+	upstreamURL := h.current().UpstreamURLBase + r.URL.Path
+	if r.URL.RawQuery != "" {
+		upstreamURL += "?" + r.URL.RawQuery
+	}
+
+	resp, body, err := h.forwardOperation(r, upstreamURL, requestBody)
+	if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		writeOperationResponse(w, resp, body)
+		return
+	}
+
+	if err != nil {
+		errorClass := engine.ClassifyError(err)
+		logger.LogError(fmt.Sprintf("Failed to reach upstream for countTokens (%s): %v", errorClass, err))
+		metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+	}
+
+	var request interface{}
+	if !h.current().CountTokensFallback || json.Unmarshal(requestBody, &request) != nil {
+		if err != nil {
+			JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
+			return
+		}
+		if h.current().MaskUpstreamErrors {
+			body = engine.MaskErrorBody(body, resp.StatusCode)
+		}
+		writeOperationResponse(w, resp, body)
+		return
+	}
+
+	total := EstimateTokens(request)
+	if err == nil {
+		logger.LogWarn(fmt.Sprintf("countTokens returned status %d, answering with an estimate of %d tokens", resp.StatusCode, total))
+	} else {
+		logger.LogWarn(fmt.Sprintf("Answering countTokens with an estimate of %d tokens", total))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set(estimateHeader, "true")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"totalTokens": total,
+		"estimated":   true,
+	})
+}
+
+// EstimateTokens roughly counts the tokens of a request: four characters of
+// Latin script or one CJK character per token, and a fixed amount per inline
+// or file media part. Tool declarations are counted as text.
+func EstimateTokens(request interface{}) int {
+	latin, other, media := 0, 0, 0
+	var walk func(value interface{}, key string)
+	walk = func(value interface{}, key string) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if _, ok := v["inlineData"]; ok {
+				media++
+				return
+			}
+			if _, ok := v["fileData"]; ok {
+				media++
+				return
+			}
+			for k, child := range v {
+				walk(child, k)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child, key)
+			}
+		case string:
+			// Roles, model and cache names and media types are not sent to the tokenizer
+			if key == "role" || key == "model" || key == "mimeType" || key == "cachedContent" {
+				return
+			}
+			for _, c := range v {
+				if c < utf8.RuneSelf {
+					latin++
+				} else {
+					other++
+				}
+			}
+		}
+	}
+	walk(request, "")
+
+	return (latin+3)/4 + other + media*tokensPerMediaPart
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/engine"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// IsEmbedPath reports whether path addresses embedContent or batchEmbedContents
+func IsEmbedPath(path string) bool {
+	return strings.HasSuffix(path, ":embedContent") || strings.HasSuffix(path, ":batchEmbedContents")
+}
+
+// embedBatch is one upstream-sized slice of a batchEmbedContents request
+type embedBatch struct {
+	start    int
+	requests []json.RawMessage
+
+	resp       *http.Response
+	body       []byte
+	err        error
+	embeddings []json.RawMessage
+}
+
+// HandleEmbed serves embedContent and batchEmbedContents, retrying transient
+// upstream failures. Batches larger than EMBED_BATCH_SIZE are split into
+// sub-batches sent EMBED_CONCURRENCY at a time, and their embeddings merged
+// in request order; if a sub-batch fails for good, its error is returned.
+func (h *ProxyHandler) HandleEmbed(w http.ResponseWriter, r *http.Request) {
+	requestBody, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+		return
+	}
+	if err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
+		return
+	}
+
+	upstreamURL := h.current().UpstreamURLBase + r.URL.Path
+	if r.URL.RawQuery != "" {
+		upstreamURL += "?" + r.URL.RawQuery
+	}
+
+	var batch struct {
+		Requests []json.RawMessage `json:"requests"`
+	}
+	size := h.current().EmbedBatchSize
+	if !strings.HasSuffix(r.URL.Path, ":batchEmbedContents") || size <= 0 ||
+		json.Unmarshal(requestBody, &batch) != nil || len(batch.Requests) <= size {
+		resp, body, err := h.forwardEmbed(r, upstreamURL, requestBody)
+		h.writeEmbedResponse(w, resp, body, err)
+		return
+	}
+
+	var batches []*embedBatch
+	for start := 0; start < len(batch.Requests); start += size {
+		end := start + size
+		if end > len(batch.Requests) {
+			end = len(batch.Requests)
+		}
+		batches = append(batches, &embedBatch{start: start, requests: batch.Requests[start:end]})
+	}
+	logger.LogInfo(fmt.Sprintf("Splitting batch of %d embedding requests into %d sub-batches", len(batch.Requests), len(batches)))
+
+	// The first sub-batch to fail for good cancels the rest
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	sub := r.WithContext(ctx)
+
+	concurrency := h.current().EmbedConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		wg.Add(1)
+		go func(b *embedBatch) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				b.err = ctx.Err()
+				return
+			}
+
+			payload, _ := json.Marshal(map[string]interface{}{"requests": b.requests})
+			b.resp, b.body, b.err = h.forwardEmbed(sub, upstreamURL, payload)
+			if b.err == nil && b.resp.StatusCode == http.StatusOK {
+				var result struct {
+					Embeddings []json.RawMessage `json:"embeddings"`
+				}
+				if err := json.Unmarshal(b.body, &result); err != nil || len(result.Embeddings) != len(b.requests) {
+					b.err = fmt.Errorf("sub-batch at %d returned %d embeddings for %d requests", b.start, len(result.Embeddings), len(b.requests))
+				}
+				b.embeddings = result.Embeddings
+			}
+			if b.err != nil || b.resp.StatusCode != http.StatusOK {
+				cancel()
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	// Report the failure that cancelled the others, not a cancellation
+	var failed *embedBatch
+	for _, b := range batches {
+		if (b.err != nil || b.resp.StatusCode != http.StatusOK) && (failed == nil || errors.Is(failed.err, context.Canceled)) {
+			failed = b
+		}
+	}
+	if failed != nil {
+		if r.Context().Err() != nil {
+			logger.LogInfo("Client went away during batch embedding")
+			return
+		}
+		logger.LogError(fmt.Sprintf("Embedding sub-batch of requests %d-%d failed", failed.start, failed.start+len(failed.requests)-1))
+		if failed.err != nil && failed.resp != nil {
+			// Upstream answered, but not with one embedding per request
+			JSONError(w, 502, ReasonUpstreamError, "Bad Gateway", failed.err.Error())
+			return
+		}
+		h.writeEmbedResponse(w, failed.resp, failed.body, failed.err)
+		return
+	}
+
+	merged := make([]json.RawMessage, 0, len(batch.Requests))
+	for _, b := range batches {
+		merged = append(merged, b.embeddings...)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"embeddings": merged})
+}
+
+// forwardEmbed sends one embedding request, retrying network errors, rate
+// limits and server errors up to EMBED_MAX_RETRIES times with backoff
+func (h *ProxyHandler) forwardEmbed(r *http.Request, upstreamURL string, body []byte) (*http.Response, []byte, error) {
+	cfg := h.current()
+	for attempt := 0; ; attempt++ {
+		resp, respBody, err := h.forwardOperation(r, upstreamURL, body)
+		retryable := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retryable || attempt >= cfg.EmbedMaxRetries || r.Context().Err() != nil {
+			return resp, respBody, err
+		}
+
+		delay := cfg.RetryDelayMs << attempt
+		if delay > cfg.RetryMaxDelay || delay <= 0 {
+			delay = cfg.RetryMaxDelay
+		}
+		if err != nil {
+			logger.LogWarn(fmt.Sprintf("Embedding request failed (%s), retry %d/%d in %v: %v", engine.ClassifyError(err), attempt+1, cfg.EmbedMaxRetries, delay, err))
+		} else {
+			logger.LogWarn(fmt.Sprintf("Embedding request returned status %d, retry %d/%d in %v", resp.StatusCode, attempt+1, cfg.EmbedMaxRetries, delay))
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return resp, respBody, err
+		}
+	}
+}
+
+// writeEmbedResponse writes an upstream embedding response, or a 502 if upstream could not be reached
+func (h *ProxyHandler) writeEmbedResponse(w http.ResponseWriter, resp *http.Response, body []byte, err error) {
+	if err != nil {
+		errorClass := engine.ClassifyError(err)
+		logger.LogError(fmt.Sprintf("Failed to reach upstream for embeddings (%s): %v", errorClass, err))
+		metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+		JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
+		return
+	}
+	if resp.StatusCode != http.StatusOK && h.current().MaskUpstreamErrors {
+		logger.LogDebug("Masking upstream error body:", string(body))
+		body = engine.MaskErrorBody(body, resp.StatusCode)
+	}
+	writeOperationResponse(w, resp, body)
+}
@@ -2,7 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
 )
 
 // ErrorResponse represents a standardized error response
@@ -18,32 +27,157 @@ type ErrorDetail struct {
 	Details interface{} `json:"details,omitempty"`
 }
 
+// ErrorDomain identifies errors raised by the proxy itself rather than by the upstream API
+const ErrorDomain = "gemini-antiblock"
+
+// Machine-readable reasons carried in the details of proxy-originated errors
+const (
+	ReasonInvalidRequest      = "INVALID_REQUEST"
+	ReasonInternal            = "PROXY_INTERNAL"
+	ReasonAtCapacity          = "PROXY_AT_CAPACITY"
+	ReasonUpstreamUnreachable = "UPSTREAM_UNREACHABLE"
+	ReasonUpstreamError       = "UPSTREAM_ERROR"
+	ReasonMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	ReasonUnauthorized        = "ADMIN_UNAUTHORIZED"
+	ReasonFeatureDisabled     = "FEATURE_DISABLED"
+	ReasonNotFound            = "NOT_FOUND"
+	ReasonClientRateLimited   = "CLIENT_RATE_LIMITED"
+	ReasonKeyRateLimited      = "KEY_RATE_LIMITED"
+	ReasonKeyQuotaExceeded    = "KEY_QUOTA_EXCEEDED"
+	ReasonUsageQuotaExceeded  = "USAGE_QUOTA_EXCEEDED"
+	ReasonClientKeyInvalid    = "CLIENT_KEY_INVALID"
+	ReasonRequestTooLarge     = "REQUEST_TOO_LARGE"
+)
+
+// ErrorInfo is the google.rpc.ErrorInfo detail attached to proxy-originated errors
+type ErrorInfo struct {
+	Type     string            `json:"@type"`
+	Reason   string            `json:"reason"`
+	Domain   string            `json:"domain"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// RetryInfo is the google.rpc.RetryInfo detail telling a rate-limited client how long to wait
+type RetryInfo struct {
+	Type       string `json:"@type"`
+	RetryDelay string `json:"retryDelay"`
+}
+
+// defaultGoogleStatuses maps HTTP status codes to Google API status strings,
+// including the gateway and edge codes the proxy or a CDN in front of it may produce
+var defaultGoogleStatuses = map[int]string{
+	400: "INVALID_ARGUMENT",
+	401: "UNAUTHENTICATED",
+	403: "PERMISSION_DENIED",
+	404: "NOT_FOUND",
+	405: "UNIMPLEMENTED",
+	408: "DEADLINE_EXCEEDED",
+	409: "ABORTED",
+	412: "FAILED_PRECONDITION",
+	413: "INVALID_ARGUMENT",
+	429: "RESOURCE_EXHAUSTED",
+	499: "CANCELLED",
+	500: "INTERNAL",
+	501: "UNIMPLEMENTED",
+	502: "UNAVAILABLE",
+	503: "UNAVAILABLE",
+	504: "DEADLINE_EXCEEDED",
+	520: "UNKNOWN",
+	521: "UNAVAILABLE",
+	522: "DEADLINE_EXCEEDED",
+	523: "UNAVAILABLE",
+	524: "DEADLINE_EXCEEDED",
+}
+
+var (
+	statusMu        sync.RWMutex
+	statusOverrides map[int]string
+)
+
+// SetStatusOverrides replaces the operator-configured status mapping, keyed
+// by HTTP status code. Entries take precedence over the built-in table.
+func SetStatusOverrides(overrides map[string]string) {
+	parsed := make(map[int]string, len(overrides))
+	for code, status := range overrides {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			logger.LogError("Ignoring error status mapping for invalid HTTP code:", code)
+			continue
+		}
+		parsed[n] = strings.ToUpper(status)
+	}
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	statusOverrides = parsed
+}
+
 // StatusToGoogleStatus converts HTTP status codes to Google API status strings
 func StatusToGoogleStatus(code int) string {
-	switch code {
-	case 400:
-		return "INVALID_ARGUMENT"
-	case 401:
-		return "UNAUTHENTICATED"
-	case 403:
-		return "PERMISSION_DENIED"
-	case 404:
-		return "NOT_FOUND"
-	case 429:
-		return "RESOURCE_EXHAUSTED"
-	case 500:
+	statusMu.RLock()
+	status, ok := statusOverrides[code]
+	statusMu.RUnlock()
+	if ok {
+		return status
+	}
+	if status, ok := defaultGoogleStatuses[code]; ok {
+		return status
+	}
+	if code >= 500 {
 		return "INTERNAL"
-	case 503:
-		return "UNAVAILABLE"
-	case 504:
-		return "DEADLINE_EXCEEDED"
-	default:
-		return "UNKNOWN"
 	}
+	return "UNKNOWN"
+}
+
+// JSONError writes a proxy-originated error in the Google API error format.
+// The details carry an ErrorInfo with reason and, if not empty, the detail text.
+func JSONError(w http.ResponseWriter, status int, reason, message, detail string) {
+	info := ErrorInfo{
+		Type:   "type.googleapis.com/google.rpc.ErrorInfo",
+		Reason: reason,
+		Domain: ErrorDomain,
+	}
+	if detail != "" {
+		info.Metadata = map[string]string{"detail": detail}
+	}
+	writeError(w, status, message, []interface{}{info})
+}
+
+// RateLimitError writes a 429 for a client over its limits and counts the
+// rejection. If retryAfter is known, it is sent in a Retry-After header and a
+// RetryInfo detail.
+func RateLimitError(w http.ResponseWriter, reason, message, detail string, retryAfter time.Duration) {
+	metrics.GetGlobalMetrics().RecordRejection(reason)
+	details := []interface{}{ErrorInfo{
+		Type:     "type.googleapis.com/google.rpc.ErrorInfo",
+		Reason:   reason,
+		Domain:   ErrorDomain,
+		Metadata: map[string]string{"detail": detail},
+	}}
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		details = append(details, RetryInfo{
+			Type:       "type.googleapis.com/google.rpc.RetryInfo",
+			RetryDelay: strconv.Itoa(seconds) + "s",
+		})
+	}
+	writeError(w, 429, message, details)
+}
+
+// RequestTooLargeError writes a 413 for a request body over limit bytes
+func RequestTooLargeError(w http.ResponseWriter, limit int) {
+	JSONError(w, 413, ReasonRequestTooLarge, "Request payload size exceeds the limit.", fmt.Sprintf("limit is %d bytes", limit))
+}
+
+// bodyTooLarge reports whether err comes from reading past the body size limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
 }
 
-// JSONError creates a standardized JSON error response
-func JSONError(w http.ResponseWriter, status int, message string, details interface{}) {
+// writeError writes an error in the Google API error format
+func writeError(w http.ResponseWriter, status int, message string, details interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(status)
@@ -60,10 +194,12 @@ func JSONError(w http.ResponseWriter, status int, message string, details interf
 	json.NewEncoder(w).Encode(errorResp)
 }
 
-// HandleCORS handles CORS preflight requests
+// HandleCORS handles CORS preflight requests, advertising the methods the requested path accepts
 func HandleCORS(w http.ResponseWriter, r *http.Request) {
+	allow := allowHeader(r.URL.Path)
+	w.Header().Set("Allow", allow)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", allow)
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key")
 	w.WriteHeader(http.StatusOK)
 }
@@ -1,35 +1,85 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
+	"gemini-antiblock/config"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/secrets"
+	"gemini-antiblock/storage"
+	"gemini-antiblock/upstream"
 )
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Service   string    `json:"service"`
-	Version   string    `json:"version,omitempty"`
+	Status    string         `json:"status"`
+	Timestamp time.Time      `json:"timestamp"`
+	Service   string         `json:"service"`
+	Version   string         `json:"version,omitempty"`
+	Details   *HealthDetails `json:"details,omitempty"`
 }
 
-// HealthHandler handles health check requests
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
+// HealthDetails is the operational summary included with ?detail=1
+type HealthDetails struct {
+	Uptime         string                              `json:"uptime"`
+	ActiveSessions int64                               `json:"active_sessions"`
+	RecentRetries  int                                 `json:"retries_last_minute"`
+	RetryStorm     bool                                `json:"retry_storm"`
+	Intervention   map[string]metrics.InterventionRate `json:"intervention"`
+	LastProbe      *upstream.ProbeResult               `json:"last_upstream_probe,omitempty"`
+	Upstreams      []upstream.UpstreamStatus           `json:"upstreams,omitempty"`
+}
+
+// HealthChecker serves the health endpoints
+type HealthChecker struct {
+	Config *config.Config
+	// Live, if set, supplies reloaded configuration in place of Config
+	Live   *config.Live
+	Warmer *upstream.Warmer
+	// Upstreams, if set, reports the circuit state of each upstream
+	Upstreams *upstream.Upstreams
+	// Token is the admin token guarding the detail view, which may be rotated while the proxy runs
+	Token *secrets.Value
+	// Shared, if set, is the storage every replica pushes its metrics to
+	Shared storage.Store
+}
+
+// NewHealthChecker creates a health checker; warmer may be nil when connection warm-up is disabled
+func NewHealthChecker(cfg *config.Config, warmer *upstream.Warmer) *HealthChecker {
+	return &HealthChecker{Config: cfg, Warmer: warmer, Token: secrets.NewValue(cfg.AdminToken)}
+}
+
+// HealthHandler handles health check requests. With ?detail=1 it adds an
+// operational summary and reports 503 when the proxy is degraded; if an admin
+// token is configured, the detail view requires it.
+func (h *HealthChecker) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	logger.LogDebug("Health check endpoint accessed")
 
 	response := HealthResponse{
 		Status:    "healthy",
 		Timestamp: time.Now().UTC(),
 		Service:   "gemini-antiblock-proxy",
-		Version:   "0.1.0-alpha",
+		Version:   Version,
+	}
+	status := http.StatusOK
+
+	if h.detailRequested(r) {
+		details := h.details()
+		response.Details = details
+		if details.RetryStorm || (details.LastProbe != nil && details.LastProbe.Error != "") || (h.Upstreams != nil && h.Upstreams.AllOpen()) {
+			response.Status = "degraded"
+			status = http.StatusServiceUnavailable
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logger.LogError("Failed to encode health response:", err)
@@ -39,3 +89,92 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger.LogDebug("Health check response sent successfully")
 }
+
+func (h *HealthChecker) detailRequested(r *http.Request) bool {
+	switch r.URL.Query().Get("detail") {
+	case "1", "true":
+	default:
+		return false
+	}
+	return h.authorized(r)
+}
+
+// authorized reports whether r carries the admin token, or no token is configured
+func (h *HealthChecker) authorized(r *http.Request) bool {
+	expected := h.Token.Get()
+	if expected == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// StatsHandler returns the full metrics snapshot as JSON for dashboards and
+// scripts that do not scrape Prometheus. If an admin token is configured, it
+// is required.
+func (h *HealthChecker) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		JSONError(w, 401, ReasonUnauthorized, "Invalid or missing admin token", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(metrics.GetGlobalMetrics().GetSnapshot()); err != nil {
+		logger.LogError("Failed to encode stats response:", err)
+	}
+}
+
+// SharedStatsHandler returns the metrics every replica pushed to shared
+// storage, added up, as JSON. If an admin token is configured, it is required.
+func (h *HealthChecker) SharedStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		JSONError(w, 401, ReasonUnauthorized, "Invalid or missing admin token", "")
+		return
+	}
+	if h.Shared == nil {
+		JSONError(w, 404, ReasonFeatureDisabled, "Shared metrics are disabled", "Set METRICS_PUSH=redis to enable them")
+		return
+	}
+
+	shared, err := metrics.LoadShared(r.Context(), h.Shared)
+	if err != nil {
+		logger.LogError("Failed to load shared metrics:", err)
+		JSONError(w, 500, ReasonInternal, "Failed to load shared metrics", "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(shared); err != nil {
+		logger.LogError("Failed to encode shared stats response:", err)
+	}
+}
+
+func (h *HealthChecker) details() *HealthDetails {
+	m := metrics.GetGlobalMetrics()
+	snapshot := m.GetSnapshot()
+	recent := m.RecentRetries()
+	threshold := h.Config.RetryStormThreshold
+	if h.Live != nil {
+		threshold = h.Live.Get().RetryStormThreshold
+	}
+
+	details := &HealthDetails{
+		Uptime:         snapshot.Uptime.Round(time.Second).String(),
+		ActiveSessions: snapshot.ActiveSessions,
+		RecentRetries:  recent,
+		RetryStorm:     threshold > 0 && recent >= threshold,
+		Intervention:   snapshot.Intervention,
+	}
+	if h.Warmer != nil {
+		probe := h.Warmer.LastProbe()
+		if !probe.Time.IsZero() {
+			details.LastProbe = &probe
+		}
+	}
+	if h.Upstreams != nil {
+		details.Upstreams = h.Upstreams.Status()
+	}
+	return details
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+const (
+	// honeypotWindow is the period over which rejected requests are counted per client
+	honeypotWindow = time.Minute
+	// honeypotTarpit delays replies to clients over the limit
+	honeypotTarpit = 3 * time.Second
+)
+
+// Honeypot answers unauthenticated requests with responses that look like an
+// ordinary upstream error instead of an authentication challenge, so scanners
+// cannot tell a protected endpoint exists. Clients that keep probing are
+// throttled and slowed down.
+type Honeypot struct {
+	limit int
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+// NewHoneypot creates a honeypot allowing limit rejected requests per client IP per minute
+func NewHoneypot(limit int) *Honeypot {
+	return &Honeypot{
+		limit: limit,
+		hits:  make(map[string][]time.Time),
+	}
+}
+
+// Reject logs an unauthenticated request and serves a decoy error
+func (h *Honeypot) Reject(w http.ResponseWriter, r *http.Request) {
+	ip := ClientIP(r)
+	count := h.record(ip)
+	logger.LogError(fmt.Sprintf("Honeypot: unauthenticated %s %s from %s (%d in the last minute, user agent %q)",
+		r.Method, r.URL.Path, ip, count, r.UserAgent()))
+
+	if h.limit > 0 && count > h.limit {
+		select {
+		case <-time.After(honeypotTarpit):
+		case <-r.Context().Done():
+			return
+		}
+		writeError(w, 429, "Resource has been exhausted (e.g. check quota).", nil)
+		return
+	}
+	writeError(w, 404, "Requested entity was not found.", nil)
+}
+
+// record counts a hit from ip and returns the number of hits within the window
+func (h *Honeypot) record(ip string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-honeypotWindow)
+	for client, times := range h.hits {
+		if len(times) > 0 && times[len(times)-1].Before(cutoff) {
+			delete(h.hits, client)
+		}
+	}
+
+	times := h.hits[ip]
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	times = append(times[i:], now)
+	h.hits[ip] = times
+	return len(times)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// resourceMethods are the methods a Gemini API collection and its items accept
+type resourceMethods struct {
+	collection []string
+	item       []string
+}
+
+var geminiResources = map[string]resourceMethods{
+	"models":         {collection: []string{"GET"}, item: []string{"GET"}},
+	"tunedModels":    {collection: []string{"GET", "POST"}, item: []string{"GET", "PATCH", "DELETE"}},
+	"cachedContents": {collection: []string{"GET", "POST"}, item: []string{"GET", "PATCH", "DELETE"}},
+	"files":          {collection: []string{"GET", "POST"}, item: []string{"GET", "DELETE"}},
+	"operations":     {collection: []string{"GET"}, item: []string{"GET", "DELETE"}},
+}
+
+// AllowedMethods returns the methods the upstream API accepts on path, or nil
+// if the path is not a known Gemini resource. Custom methods such as
+// models/{model}:generateContent are POST only; HEAD is allowed wherever GET is.
+func AllowedMethods(path string) []string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	last := segments[len(segments)-1]
+	if strings.Contains(last, ":") {
+		return []string{"POST"}
+	}
+
+	for i := len(segments) - 1; i >= 0 && i >= len(segments)-2; i-- {
+		resource, ok := geminiResources[segments[i]]
+		if !ok {
+			continue
+		}
+		methods := resource.item
+		if i == len(segments)-1 {
+			methods = resource.collection
+		}
+		if methods[0] == "GET" {
+			methods = append([]string{"GET", "HEAD"}, methods[1:]...)
+		}
+		return methods
+	}
+	return nil
+}
+
+// MethodAllowed reports whether method may be used on path. Unknown paths allow every method.
+func MethodAllowed(path, method string) bool {
+	methods := AllowedMethods(path)
+	if methods == nil || method == "OPTIONS" {
+		return true
+	}
+	for _, allowed := range methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeader formats the Allow header for path, including OPTIONS
+func allowHeader(path string) string {
+	methods := AllowedMethods(path)
+	if methods == nil {
+		methods = []string{"GET", "POST"}
+	}
+	return strings.Join(methods, ", ") + ", OPTIONS"
+}
+
+// Options answers OPTIONS requests for a local route accepting methods
+func Options(methods ...string) http.Handler {
+	allow := strings.Join(methods, ", ") + ", OPTIONS"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"gemini-antiblock/limiter"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/usage"
+)
+
+// Middleware stages of the proxy pipeline
+const (
+	// StageRecovery turns a panic into a 500 response instead of a dropped connection
+	StageRecovery = "recovery"
+	// StageAccessLog logs one line per finished request
+	StageAccessLog = "access_log"
+	// StageRateLimit limits the request rate of each client IP
+	StageRateLimit = "rate_limit"
+	// StageAuth admits only proxy-issued client keys when a client key map is configured
+	StageAuth = "auth"
+	// StageQuota enforces the rate limits and quotas of client API keys
+	StageQuota = "quota"
+	// StageMetrics counts the requests that reach the proxy
+	StageMetrics = "metrics"
+)
+
+// Stages lists the middleware stages in the order a request passes through them
+var Stages = []string{StageRecovery, StageAccessLog, StageRateLimit, StageAuth, StageQuota, StageMetrics}
+
+// Middleware wraps a handler with a cross-cutting concern
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in middleware; a request passes through the first one first
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Pipeline returns the proxy behind its middleware stages, in the order of
+// Stages. Each stage is skipped while MIDDLEWARE_DISABLED names it.
+func (h *ProxyHandler) Pipeline() http.Handler {
+	stages := map[string]Middleware{
+		StageRecovery:  h.recovery,
+		StageAccessLog: h.accessLog,
+		StageRateLimit: h.rateLimit,
+		StageAuth:      h.auth,
+		StageQuota:     h.quota,
+		StageMetrics:   h.countRequests,
+	}
+	middleware := make([]Middleware, 0, len(Stages))
+	for _, name := range Stages {
+		middleware = append(middleware, h.optional(name, stages[name]))
+	}
+	return Chain(h, middleware...)
+}
+
+// optional skips a stage while it is disabled in the current configuration
+func (h *ProxyHandler) optional(name string, stage Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		wrapped := stage(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, disabled := range h.current().MiddlewareDisabled {
+				if strings.EqualFold(disabled, name) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// responseRecorder captures the status and size of a response for the
+// middleware, passing flushes through so streams are not buffered
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// recorder returns w as a responseRecorder, wrapping it if an outer stage has not
+func recorder(w http.ResponseWriter) *responseRecorder {
+	if rec, ok := w.(*responseRecorder); ok {
+		return rec
+	}
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// recovery answers a request whose handler panicked with a 500 error, or
+// ends the response if it had already started
+func (h *ProxyHandler) recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := recorder(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logger.LogError(fmt.Sprintf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack()))
+			if rec.status == 0 {
+				JSONError(rec, 500, ReasonInternal, "The proxy failed to handle the request.", "")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// accessLog logs the method, path, status, size and duration of every request
+func (h *ProxyHandler) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorder(w)
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			logger.With(logger.Fields{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      status,
+				"bytes":       rec.bytes,
+				"duration_ms": time.Since(start).Milliseconds(),
+				"client":      ClientIP(r),
+			}).Infof("%s %s %d %d bytes %v from %s", r.Method, r.URL.Path, status, rec.bytes, time.Since(start).Round(time.Millisecond), ClientIP(r))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// rateLimit keeps a single client from using up the shared upstream quota
+func (h *ProxyHandler) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.ClientLimits != nil && r.Method != "OPTIONS" {
+			client := ClientIP(r)
+			if ok, retryAfter := h.ClientLimits.Allow(client); !ok {
+				logger.LogWarn(fmt.Sprintf("Rate limiting client %s: over %d requests per minute", client, h.Config.ClientRateLimit))
+				RateLimitError(w, ReasonClientRateLimited, "Too many requests from this client. Please retry later.", fmt.Sprintf("limit of %d requests per minute exceeded", h.Config.ClientRateLimit), retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth swaps proxy-issued client keys for the upstream keys they map to
+func (h *ProxyHandler) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.KeyMap != nil && r.Method != "OPTIONS" {
+			credential := ClientCredential(r)
+			pool := h.KeyMap.Lookup(credential)
+			if pool == nil {
+				logger.LogWarn(fmt.Sprintf("Rejecting request from %s with unknown client key %s", ClientIP(r), KeyID(credential)))
+				JSONError(w, 401, ReasonClientKeyInvalid, "API key not valid. Please pass a valid API key.", "")
+				return
+			}
+			r = withMappedKey(r, credential, pool)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quota applies rate limits and quotas to the client's own API key; requests
+// served with pool keys have none
+func (h *ProxyHandler) quota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential := ClientCredential(r)
+		if h.KeyLimits != nil && credential != "" && r.Method != "OPTIONS" {
+			if ok, reason, retryAfter := h.KeyLimits.Allow(credential); !ok {
+				limits := h.KeyLimits.LimitsFor(credential)
+				if reason == limiter.RejectQuota {
+					logger.LogWarn(fmt.Sprintf("Key %s used up its daily quota of %d requests", KeyID(credential), limits.PerDay))
+					RateLimitError(w, ReasonKeyQuotaExceeded, "Daily quota for this API key exceeded.", fmt.Sprintf("quota of %d requests per day used up", limits.PerDay), retryAfter)
+				} else {
+					logger.LogWarn(fmt.Sprintf("Rate limiting key %s: over %d requests per minute", KeyID(credential), limits.PerMinute))
+					RateLimitError(w, ReasonKeyRateLimited, "Too many requests for this API key. Please retry later.", fmt.Sprintf("limit of %d requests per minute exceeded", limits.PerMinute), retryAfter)
+				}
+				return
+			}
+		}
+		if h.UsageQuotas != nil && credential != "" && r.Method != "OPTIONS" {
+			if window, retryAfter := h.UsageQuotas.Exceeded(credential); window != "" {
+				quota := h.UsageQuotas.QuotaFor(credential)
+				allowance := quota.TokensPerDay
+				if window == usage.WindowMonth {
+					allowance = quota.TokensPerMonth
+				}
+				logger.LogWarn(fmt.Sprintf("Key %s used up its allowance of %d tokens per %s", KeyID(credential), allowance, window))
+				RateLimitError(w, ReasonUsageQuotaExceeded, "Token quota for this API key exceeded.", fmt.Sprintf("allowance of %d tokens per %s used up", allowance, window), retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countRequests counts the requests admitted to the proxy, streaming or not,
+// in total and for the client's key
+func (h *ProxyHandler) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			metrics.GetGlobalMetrics().RecordRequest(isStreamRequest(r) && !IsOperationPath(r.URL.Path))
+			recordUsage(r, usage.Counters{Requests: 1})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isStreamRequest reports whether a request asks for a streamed response
+func isStreamRequest(r *http.Request) bool {
+	path := strings.ToLower(r.URL.Path)
+	return strings.Contains(path, "stream") || strings.Contains(path, "sse") || r.URL.Query().Get("alt") == "sse"
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/engine"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// maxModelListEntries bounds the cached lists, one per credential and query
+const maxModelListEntries = 256
+
+// IsModelListPath reports whether path addresses the models list, not a single model
+func IsModelListPath(path string) bool {
+	return strings.HasSuffix(path, "/models")
+}
+
+// ModelListCache keeps upstream answers to the models list for MODELS_CACHE_TTL_MS,
+// so clients polling it neither wait for upstream nor spend its rate limits.
+// Lists are cached per credential, since keys can see different tuned models.
+type ModelListCache struct {
+	mu      sync.Mutex
+	entries map[string]*modelList
+}
+
+// modelList is one cached answer
+type modelList struct {
+	body        []byte
+	contentType string
+	// etag identifies the body to clients revalidating with If-None-Match
+	etag string
+	// upstreamETag and lastModified revalidate an expired list upstream
+	upstreamETag string
+	lastModified string
+	fetched      time.Time
+}
+
+// NewModelListCache creates an empty cache
+func NewModelListCache() *ModelListCache {
+	return &ModelListCache{entries: make(map[string]*modelList)}
+}
+
+func (c *ModelListCache) get(key string) *modelList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+// put stores a list, dropping expired lists, or failing that the oldest, when full
+func (c *ModelListCache) put(key string, list *modelList, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxModelListEntries {
+		oldestKey := ""
+		for k, entry := range c.entries {
+			if time.Since(entry.fetched) >= ttl {
+				delete(c.entries, k)
+			} else if oldestKey == "" || entry.fetched.Before(c.entries[oldestKey].fetched) {
+				oldestKey = k
+			}
+		}
+		if len(c.entries) >= maxModelListEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = list
+}
+
+// modelListKey identifies a list by credential and query without keeping the credential
+func modelListKey(r *http.Request) string {
+	sum := sha256.Sum256([]byte(ClientCredential(r) + "\x00" + r.URL.Path + "?" + r.URL.RawQuery))
+	return hex.EncodeToString(sum[:])
+}
+
+// HandleModelList answers GET and HEAD on the models list from the cache,
+// fetching it, or revalidating an expired list, on a miss. A list upstream
+// cannot be reached for is served stale rather than failing the request.
+func (h *ProxyHandler) HandleModelList(w http.ResponseWriter, r *http.Request) {
+	ttl := h.current().ModelsCacheTTL
+	key := modelListKey(r)
+	cached := h.Models.get(key)
+	if cached != nil && time.Since(cached.fetched) < ttl {
+		logger.LogDebug("Serving models list from cache")
+		serveModelList(w, r, cached, ttl)
+		return
+	}
+
+	upstreamURL := h.current().UpstreamURLBase + r.URL.Path
+	if r.URL.RawQuery != "" {
+		upstreamURL += "?" + r.URL.RawQuery
+	}
+
+	// The client's validators refer to the proxy's ETags, not upstream's
+	fetch := r.Clone(r.Context())
+	fetch.Method = "GET"
+	fetch.Header.Del("If-None-Match")
+	fetch.Header.Del("If-Modified-Since")
+	if cached != nil {
+		if cached.upstreamETag != "" {
+			fetch.Header.Set("If-None-Match", cached.upstreamETag)
+		}
+		if cached.lastModified != "" {
+			fetch.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, body, err := h.forwardOperation(fetch, upstreamURL, nil)
+	if err != nil {
+		errorClass := engine.ClassifyError(err)
+		metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+		if cached != nil {
+			logger.LogWarn(fmt.Sprintf("Failed to refresh models list (%s), serving the cached one: %v", errorClass, err))
+			serveModelList(w, r, cached, 0)
+			return
+		}
+		logger.LogError(fmt.Sprintf("Failed to reach upstream for models list (%s): %v", errorClass, err))
+		JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
+		return
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		logger.LogDebug("Cached models list revalidated upstream")
+		refreshed := *cached
+		refreshed.fetched = time.Now()
+		h.Models.put(key, &refreshed, ttl)
+		serveModelList(w, r, &refreshed, ttl)
+	case resp.StatusCode == http.StatusOK:
+		sum := sha256.Sum256(body)
+		list := &modelList{
+			body:         body,
+			contentType:  resp.Header.Get("Content-Type"),
+			etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+			upstreamETag: resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			fetched:      time.Now(),
+		}
+		h.Models.put(key, list, ttl)
+		serveModelList(w, r, list, ttl)
+	default:
+		if h.current().MaskUpstreamErrors {
+			logger.LogDebug("Masking upstream error body:", string(body))
+			body = engine.MaskErrorBody(body, resp.StatusCode)
+		}
+		writeOperationResponse(w, resp, body)
+	}
+}
+
+// serveModelList writes a cached list, or 304 Not Modified if the client
+// already has it; clients may keep it for the rest of ttl
+func serveModelList(w http.ResponseWriter, r *http.Request, list *modelList, ttl time.Duration) {
+	maxAge := int((ttl - time.Since(list.fetched)).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("ETag", list.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if etagMatches(r.Header.Get("If-None-Match"), list.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if list.contentType != "" {
+		w.Header().Set("Content-Type", list.contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(list.body)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header names etag, comparing weakly
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/engine"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// Long-polling limits for ?wait=N on operation GETs
+const (
+	maxOperationWait      = 5 * time.Minute
+	operationPollInterval = 2 * time.Second
+)
+
+// hopByHopHeaders are connection-specific and never forwarded
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"X-Proxy-Priority":    true,
+	"X-Proxy-Fake-Stream": true,
+	"X-Proxy-Aggregate":   true,
+	"X-Proxy-Profile":     true,
+}
+
+// IsOperationPath reports whether path addresses a long-running operation
+// (batch, tuning and video generation jobs)
+func IsOperationPath(path string) bool {
+	return strings.Contains(path, "/operations/") || strings.HasSuffix(path, "/operations")
+}
+
+// HandleOperation passes operation requests through with their headers intact.
+// A GET with ?wait=N (seconds) polls upstream on the client's behalf until the
+// operation reports done, N seconds pass or the client goes away.
+func (h *ProxyHandler) HandleOperation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	wait := time.Duration(0)
+	if value := query.Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			JSONError(w, 400, ReasonInvalidRequest, "Invalid wait parameter", "wait must be a non-negative number of seconds")
+			return
+		}
+		// Only a single operation has a done flag to wait for
+		if strings.Contains(r.URL.Path, "/operations/") {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > maxOperationWait {
+			wait = maxOperationWait
+		}
+		query.Del("wait")
+	}
+
+	upstreamURL := h.current().UpstreamURLBase + r.URL.Path
+	if encoded := query.Encode(); encoded != "" {
+		upstreamURL += "?" + encoded
+	}
+
+	var requestBody []byte
+	if r.Method != "GET" && r.Method != "HEAD" {
+		var err error
+		requestBody, err = io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+			return
+		}
+		if err != nil {
+			JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
+			return
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		resp, body, err := h.forwardOperation(r, upstreamURL, requestBody)
+		if err != nil {
+			errorClass := engine.ClassifyError(err)
+			logger.LogError(fmt.Sprintf("Failed to reach upstream for operation (%s): %v", errorClass, err))
+			metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+			JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
+			return
+		}
+
+		if r.Method != "GET" || wait == 0 || resp.StatusCode != http.StatusOK || operationDone(body) || !time.Now().Before(deadline) {
+			writeOperationResponse(w, resp, body)
+			return
+		}
+
+		logger.LogDebug(fmt.Sprintf("Operation %s not done yet, polling again in %v", r.URL.Path, operationPollInterval))
+		select {
+		case <-r.Context().Done():
+			logger.LogInfo("Client stopped waiting for operation", r.URL.Path)
+			return
+		case <-time.After(operationPollInterval):
+		}
+	}
+}
+
+// forwardOperation sends one upstream request, forwarding all end-to-end client headers
+func (h *ProxyHandler) forwardOperation(r *http.Request, upstreamURL string, requestBody []byte) (*http.Response, []byte, error) {
+	var body io.Reader
+	if requestBody != nil {
+		body = bytes.NewReader(requestBody)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range r.Header {
+		// Leave compression to the transport so polled bodies can be inspected
+		if hopByHopHeaders[http.CanonicalHeaderKey(name)] || http.CanonicalHeaderKey(name) == "Accept-Encoding" {
+			continue
+		}
+		req.Header[name] = values
+	}
+	h.applyPoolKey(r, req.Header)
+
+	start := time.Now()
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	metrics.GetGlobalMetrics().RecordResponseTime(time.Since(start))
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// operationDone reports whether an operation resource has finished
+func operationDone(body []byte) bool {
+	var operation struct {
+		Done bool `json:"done"`
+	}
+	if err := json.Unmarshal(body, &operation); err != nil {
+		return true
+	}
+	return operation.Done
+}
+
+func writeOperationResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+	for name, values := range resp.Header {
+		if hopByHopHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/contextcache"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/respcache"
+	"gemini-antiblock/upstream"
+)
+
+// profileHeader selects an upstream profile for a request
+const profileHeader = "X-Proxy-Profile"
+
+// profilePathPrefix selects an upstream profile by path, as in /profiles/work/v1beta/models
+const profilePathPrefix = "/profiles/"
+
+// profileConfig is a profile's configuration, derived from the configuration in effect
+type profileConfig struct {
+	base *config.Config
+	cfg  *config.Config
+}
+
+// serveProfile hands a request that selects an upstream profile, by the
+// /profiles/NAME/ path prefix or the X-Proxy-Profile header, to that profile's
+// handler with the prefix removed. It reports whether the request was served.
+func (h *ProxyHandler) serveProfile(w http.ResponseWriter, r *http.Request) bool {
+	if h.profile != "" {
+		return false
+	}
+	name := r.Header.Get(profileHeader)
+	path := r.URL.Path
+	if strings.HasPrefix(path, profilePathPrefix) {
+		name, path, _ = strings.Cut(strings.TrimPrefix(path, profilePathPrefix), "/")
+		path = "/" + path
+	}
+	if name == "" {
+		return false
+	}
+
+	profile := h.profileHandler(name)
+	if profile == nil {
+		JSONError(w, 404, ReasonNotFound, fmt.Sprintf("Unknown profile %q", name), "")
+		return true
+	}
+	logger.LogInfo(fmt.Sprintf("Serving %s with profile %s", path, name))
+	req := r.Clone(r.Context())
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	profile.ServeHTTP(w, req)
+	return true
+}
+
+// profileHandler returns the handler serving the named profile, creating it
+// on first use, or nil if there is no such profile. A profile shares the
+// limits and quotas of the proxy but has its own key pool, if it sets
+// UPSTREAM_API_KEYS, and its own caches, since responses and cached contents
+// belong to the profile's project.
+func (h *ProxyHandler) profileHandler(name string) *ProxyHandler {
+	cfg := h.current()
+	if _, ok := cfg.ProfileSettings[name]; !ok {
+		return nil
+	}
+
+	h.profileMu.Lock()
+	defer h.profileMu.Unlock()
+	if profile, ok := h.profiles[name]; ok {
+		return profile
+	}
+	profileCfg, err := cfg.Profile(name)
+	if err != nil {
+		logger.LogError("Ignoring upstream profile:", err)
+		return nil
+	}
+
+	profile := &ProxyHandler{
+		Config:       h.Config,
+		Live:         h.Live,
+		Client:       h.Client,
+		Limiter:      h.Limiter,
+		ClientLimits: h.ClientLimits,
+		KeyLimits:    h.KeyLimits,
+		UsageQuotas:  h.UsageQuotas,
+		Keys:         h.Keys,
+		KeyMap:       h.KeyMap,
+		Observer:     h.Observer,
+		Models:       NewModelListCache(),
+		Resumes:      h.Resumes,
+		profile:      name,
+	}
+	if profileCfg.UpstreamURLBase == cfg.UpstreamURLBase {
+		profile.Upstreams = h.Upstreams
+	}
+	if len(profileCfg.UpstreamAPIKeys) > 0 {
+		profile.Keys = upstream.NewKeyPool(profileCfg.UpstreamAPIKeys, profileCfg.KeyCooldown)
+		profile.profileKeys = true
+	}
+	if h.Caches != nil {
+		profile.Caches = contextcache.NewManager(h.Client, profileCfg.UpstreamURLBase, profileCfg.AutoCacheMinChars, profileCfg.AutoCacheTTL)
+	}
+	if h.Responses != nil {
+		profile.Responses = respcache.New(profileCfg.ResponseCacheMaxEntries, profileCfg.ResponseCacheTTL)
+	}
+
+	if h.profiles == nil {
+		h.profiles = make(map[string]*ProxyHandler)
+	}
+	h.profiles[name] = profile
+	return profile
+}
@@ -2,53 +2,220 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"gemini-antiblock/abuse"
 	"gemini-antiblock/config"
+	"gemini-antiblock/contextcache"
+	"gemini-antiblock/engine"
+	"gemini-antiblock/limiter"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/modelinfo"
+	"gemini-antiblock/respcache"
 	"gemini-antiblock/streaming"
+	"gemini-antiblock/tracing"
+	"gemini-antiblock/upstream"
+	"gemini-antiblock/usage"
 )
 
 // ProxyHandler handles proxy requests to Gemini API
 type ProxyHandler struct {
 	Config *config.Config
+	// Live, if set, supplies reloaded configuration in place of Config
+	Live    *config.Live
+	Client  *http.Client
+	Limiter *limiter.PriorityLimiter
+	// ClientLimits, if set, limits the request rate and concurrent streams of each client IP
+	ClientLimits *limiter.ClientLimiter
+	// KeyLimits, if set, enforces rate limits and quotas per client API key
+	KeyLimits *limiter.KeyLimiter
+	// UsageQuotas, if set, enforces daily and monthly token allowances per client API key
+	UsageQuotas *usage.Quotas
+	Caches      *contextcache.Manager
+	// Keys holds proxy-owned API keys for requests that bring none of their own
+	Keys *upstream.KeyPool
+	// Upstreams, if set, lets speculative retries race a different upstream base URL
+	Upstreams *upstream.Upstreams
+	// KeyMap, if set, admits only proxy-issued client keys and serves them with the upstream keys they map to
+	KeyMap *upstream.KeyMap
+	// Observer, if set, receives stream engine measurements in addition to the global metrics
+	Observer engine.Observer
+	// Models, if set, caches the models list while MODELS_CACHE_TTL_MS is positive
+	Models *ModelListCache
+	// Responses, if set, caches successful generateContent responses
+	Responses *respcache.Cache
+	// Resumes, if set, buffers stream sessions for clients that reconnect with Last-Event-ID
+	Resumes *streaming.ResumeStore
+
+	// profile names the upstream profile served, "" for the default configuration
+	profile string
+	// profileKeys is set when the profile's own keys serve mapped client keys as well
+	profileKeys bool
+	profileCfg  atomic.Pointer[profileConfig]
+	profileMu   sync.Mutex
+	profiles    map[string]*ProxyHandler
 }
 
-// NewProxyHandler creates a new proxy handler
-func NewProxyHandler(cfg *config.Config) *ProxyHandler {
-	return &ProxyHandler{Config: cfg}
+// NewProxyHandler creates a new proxy handler that sends upstream requests through client
+func NewProxyHandler(cfg *config.Config, client *http.Client) *ProxyHandler {
+	h := &ProxyHandler{Config: cfg, Client: client, Models: NewModelListCache()}
+	SetStatusOverrides(cfg.ErrorStatusMap)
+	SetTrustedProxies(cfg.TrustedProxies)
+	if cfg.MaxConcurrentStreams > 0 {
+		h.Limiter = limiter.NewPriorityLimiter(cfg.MaxConcurrentStreams)
+	}
+	if cfg.ClientRateLimit > 0 || cfg.ClientMaxStreams > 0 {
+		h.ClientLimits = limiter.NewClientLimiter(cfg.ClientRateLimit, cfg.ClientMaxStreams)
+	}
+	if cfg.QuotaPerMinute > 0 || cfg.QuotaPerDay > 0 || cfg.QuotaMaxStreams > 0 || len(cfg.QuotaKeyLimits) > 0 {
+		h.KeyLimits = newKeyLimiter(cfg)
+	}
+	if cfg.UsageQuotaPerDay > 0 || cfg.UsageQuotaPerMonth > 0 || len(cfg.UsageQuotaKeyLimits) > 0 {
+		h.UsageQuotas = newUsageQuotas(cfg)
+	}
+	if cfg.AutoCacheEnabled {
+		h.Caches = contextcache.NewManager(client, cfg.UpstreamURLBase, cfg.AutoCacheMinChars, cfg.AutoCacheTTL)
+	}
+	if len(cfg.UpstreamAPIKeys) > 0 {
+		h.Keys = upstream.NewKeyPool(cfg.UpstreamAPIKeys, cfg.KeyCooldown)
+	}
+	if len(cfg.ClientKeyMap) > 0 {
+		h.KeyMap = upstream.NewKeyMap(cfg.ClientKeyMap, cfg.KeyCooldown)
+	}
+	if cfg.ResponseCacheTTL > 0 {
+		h.Responses = respcache.New(cfg.ResponseCacheMaxEntries, cfg.ResponseCacheTTL)
+	}
+	if cfg.StreamResumeTTL > 0 {
+		h.Resumes = streaming.NewResumeStore(cfg.StreamResumeTTL, cfg.StreamResumeBufferBytes)
+	}
+	return h
 }
 
-// BuildUpstreamHeaders builds headers for upstream requests
-func (h *ProxyHandler) BuildUpstreamHeaders(reqHeaders http.Header) http.Header {
-	headers := make(http.Header)
+// newKeyLimiter builds the per-key limiter, skipping invalid per-key overrides
+func newKeyLimiter(cfg *config.Config) *limiter.KeyLimiter {
+	defaults := limiter.Limits{PerMinute: cfg.QuotaPerMinute, PerDay: cfg.QuotaPerDay, MaxStreams: cfg.QuotaMaxStreams}
+	overrides := make(map[string]limiter.Limits, len(cfg.QuotaKeyLimits))
+	for key, spec := range cfg.QuotaKeyLimits {
+		limits, err := limiter.ParseLimits(spec, defaults)
+		if err != nil {
+			logger.LogError(fmt.Sprintf("Ignoring QUOTA_KEY_LIMITS entry for key %s: %v", KeyID(key), err))
+			continue
+		}
+		overrides[key] = limits
+	}
+	return limiter.NewKeyLimiter(defaults, overrides)
+}
 
-	// Copy specific headers
-	if auth := reqHeaders.Get("Authorization"); auth != "" {
-		headers.Set("Authorization", auth)
+// newUsageQuotas builds the per-key token allowances, skipping invalid per-key overrides
+func newUsageQuotas(cfg *config.Config) *usage.Quotas {
+	defaults := usage.Quota{TokensPerDay: int64(cfg.UsageQuotaPerDay), TokensPerMonth: int64(cfg.UsageQuotaPerMonth)}
+	overrides := make(map[string]usage.Quota, len(cfg.UsageQuotaKeyLimits))
+	for key, spec := range cfg.UsageQuotaKeyLimits {
+		quota, err := usage.ParseQuota(spec, defaults)
+		if err != nil {
+			logger.LogError(fmt.Sprintf("Ignoring USAGE_QUOTA_KEY_LIMITS entry for key %s: %v", KeyID(key), err))
+			continue
+		}
+		overrides[key] = quota
 	}
-	if apiKey := reqHeaders.Get("X-Goog-Api-Key"); apiKey != "" {
-		headers.Set("X-Goog-Api-Key", apiKey)
+	return usage.NewQuotas(usage.GetGlobalTracker(), defaults, overrides)
+}
+
+// current returns the configuration in effect, with the settings of the profile served
+func (h *ProxyHandler) current() *config.Config {
+	cfg := h.Config
+	if h.Live != nil {
+		cfg = h.Live.Get()
+	}
+	if h.profile == "" {
+		return cfg
 	}
-	if contentType := reqHeaders.Get("Content-Type"); contentType != "" {
-		headers.Set("Content-Type", contentType)
+
+	// A profile is derived again only after a reload
+	if derived := h.profileCfg.Load(); derived != nil && derived.base == cfg {
+		return derived.cfg
 	}
-	if accept := reqHeaders.Get("Accept"); accept != "" {
-		headers.Set("Accept", accept)
+	profile, err := cfg.Profile(h.profile)
+	if err != nil {
+		logger.LogError("Serving profile with the default configuration:", err)
+		return cfg
 	}
+	h.profileCfg.Store(&profileConfig{base: cfg, cfg: profile})
+	return profile
+}
 
-	return headers
+// applyPoolKey authenticates a request without client credentials with a pool
+// key, or a request with a mapped client key with its upstream keys. It
+// returns the failover that rotates the key and offers alternatives to
+// speculative retries, or nil if there is neither a pool nor several upstreams.
+func (h *ProxyHandler) applyPoolKey(r *http.Request, header http.Header) engine.Failover {
+	pool := h.Keys
+	if mapped, ok := r.Context().Value(mappedKeyContext{}).(mappedKey); ok {
+		if !h.profileKeys {
+			pool = mapped.pool
+		}
+	} else if ClientCredential(r) != "" {
+		pool = nil
+	}
+	key := ""
+	if pool != nil {
+		key = pool.Acquire()
+	}
+	if key == "" {
+		if h.Upstreams == nil {
+			return nil
+		}
+		return streaming.KeyFailover{Upstreams: h.Upstreams}
+	}
+	header.Set("X-Goog-Api-Key", key)
+	return streaming.KeyFailover{Pool: pool, Upstreams: h.Upstreams}
+}
+
+// fakeStream reports whether a streaming request should be served from
+// non-streaming upstream calls; the X-Proxy-Fake-Stream header overrides FAKE_STREAMING
+func (h *ProxyHandler) fakeStream(r *http.Request) bool {
+	if enabled, err := strconv.ParseBool(r.Header.Get("X-Proxy-Fake-Stream")); err == nil {
+		return enabled
+	}
+	return h.current().FakeStreaming
 }
 
-// InjectSystemPrompt injects system prompt to ensure [done] token
+// acquireStreamSlot waits for a concurrent stream slot. Interactive requests wait
+// as long as the client stays connected; batch requests are shed after BatchQueueTimeout.
+func (h *ProxyHandler) acquireStreamSlot(w http.ResponseWriter, r *http.Request) bool {
+	priority := limiter.ParsePriority(r.Header.Get("X-Proxy-Priority"))
+
+	ctx := r.Context()
+	if priority == limiter.PriorityBatch {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.current().BatchQueueTimeout)
+		defer cancel()
+	}
+
+	if err := h.Limiter.Acquire(ctx, priority); err != nil {
+		active, waitingInteractive, waitingBatch := h.Limiter.Stats()
+		logger.LogError(fmt.Sprintf("Shedding %s request: no stream slot available (active %d, waiting interactive %d, batch %d)", priority, active, waitingInteractive, waitingBatch))
+		JSONError(w, 503, ReasonAtCapacity, "The proxy is at capacity. Please retry later.", fmt.Sprintf("%s request shed while waiting for a stream slot", priority))
+		return false
+	}
+	return true
+}
+
+// InjectSystemPrompt injects system prompt to ensure the done token
 func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
 	newSystemPromptPart := map[string]interface{}{
-		"text": "Your message must end with [done] to signify the end of your output.",
+		"text": fmt.Sprintf("Your message must end with %s to signify the end of your output.", h.current().DoneToken),
 	}
 
 	// Case 1: systemInstruction field is missing or null
@@ -80,81 +247,242 @@ func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
 
 // HandleStreamingPost handles streaming POST requests
 func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
+	h.handleStream(w, r, false)
+}
+
+// HandleAggregatedPost serves a generateContent request from streamGenerateContent,
+// so non-streaming clients get mid-stream retries, and returns one aggregated JSON response
+func (h *ProxyHandler) HandleAggregatedPost(w http.ResponseWriter, r *http.Request) {
+	h.handleStream(w, r, true)
+}
+
+// aggregate reports whether a generateContent request should be served by
+// aggregating a stream; the X-Proxy-Aggregate header overrides STREAM_AGGREGATION
+func (h *ProxyHandler) aggregate(r *http.Request) bool {
+	if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, ":generateContent") {
+		return false
+	}
+	if enabled, err := strconv.ParseBool(r.Header.Get("X-Proxy-Aggregate")); err == nil {
+		return enabled
+	}
+	return h.current().StreamAggregation
+}
+
+func (h *ProxyHandler) handleStream(w http.ResponseWriter, r *http.Request, aggregate bool) {
+	cfg := h.current()
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
+	path := urlObj.Path
+	query := urlObj.Query()
+	if aggregate {
+		path = strings.TrimSuffix(path, ":generateContent") + ":streamGenerateContent"
+		query.Set("alt", "sse")
+		urlObj.RawQuery = query.Encode()
+	}
+	upstreamURL := cfg.UpstreamURLBase + path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
 	}
 
-	logger.LogInfo("=== NEW STREAMING REQUEST ===")
-	logger.LogInfo("Upstream URL:", upstreamURL)
-	logger.LogInfo("Request method:", r.Method)
-	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
+	summary := streaming.NewSessionSummary(RequestID(r), ModelFromPath(urlObj.Path), ClientIP(r))
+	reqLog := logger.With(logger.Fields{"request_id": summary.RequestID, "model": summary.Model})
+	var sessionErr error
+	defer func() { summary.Finish(sessionErr) }()
+	summary.Key = KeyID(ClientCredential(r))
+	w.Header().Set("X-Request-ID", summary.RequestID)
+
+	// The session span continues the caller's trace when it sent a traceparent
+	ctx, span := tracing.GetGlobalTracer().StartSpan(tracing.Extract(r), "antiblock.stream", tracing.KindServer)
+	span.SetAttribute("request_id", summary.RequestID)
+	span.SetAttribute("gemini.model", summary.Model)
+	defer func() {
+		span.SetAttribute("antiblock.attempts", summary.Attempts)
+		span.SetAttribute("antiblock.chars", summary.Chars)
+		span.SetError(sessionErr)
+		span.End()
+	}()
+
+	// A resumable session outlives the client's connection until no client has followed it for the TTL
+	var resume *streaming.ResumableSession
+	if h.Resumes != nil && !aggregate && !isWebSocketSession(r) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		resume = h.Resumes.Start(resumeOwner(r), cancel)
+		defer resume.Close()
+	}
+
+	reqLog.Info("=== NEW STREAMING REQUEST ===")
+	reqLog.Info("Upstream URL:", upstreamURL)
+	reqLog.Info("Request method:", r.Method)
+	reqLog.Info("Content-Type:", r.Header.Get("Content-Type"))
 
 	// Read and parse request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.LogError("Failed to read request body:", err)
-		JSONError(w, 400, "Failed to read request body", err.Error())
+		reqLog.Error("Failed to read request body:", err)
+		sessionErr = fmt.Errorf("failed to read request body: %w", err)
+		if bodyTooLarge(err) {
+			RequestTooLargeError(w, cfg.MaxRequestBodyBytes)
+			return
+		}
+		JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
 		return
 	}
 
 	var requestBody map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
-		logger.LogError("Failed to parse request body:", err)
-		JSONError(w, 400, "Invalid JSON in request body", err.Error())
+		reqLog.Error("Failed to parse request body:", err)
+		sessionErr = fmt.Errorf("invalid JSON in request body: %w", err)
+		JSONError(w, 400, ReasonInvalidRequest, "Invalid JSON in request body", err.Error())
 		return
 	}
 
-	logger.LogDebug(fmt.Sprintf("Request body size: %d bytes", len(bodyBytes)))
+	reqLog.Debug(fmt.Sprintf("Request body size: %d bytes", len(bodyBytes)))
 
 	if contents, ok := requestBody["contents"].([]interface{}); ok {
-		logger.LogDebug(fmt.Sprintf("Parsed request body with %d messages", len(contents)))
+		reqLog.Debug(fmt.Sprintf("Parsed request body with %d messages", len(contents)))
+	}
+
+	// Fingerprint the client's own prompt, before any proxy rewrites
+	if cfg.AbuseDetection {
+		fingerprint := abuse.Compute(requestBody, ClientCredential(r), ClientIP(r))
+		tracker := abuse.GetGlobalTracker()
+		tracker.Observe(fingerprint)
+		defer func() {
+			if summary.Attempts > 0 {
+				tracker.RecordSession(fingerprint, summary.Attempts-1)
+			}
+		}()
 	}
 
+	// Attribute what the session consumed to the client's key
+	defer func() {
+		tokens := sessionTokens(requestBody, summary.Attempts, summary.Chars, summary.Tokens)
+		retries := 0
+		if summary.Attempts > 0 {
+			retries = summary.Attempts - 1
+		}
+		delta := usage.Counters{Chars: int64(summary.Chars), Tokens: int64(tokens), Retries: int64(retries)}
+		if sessionErr != nil && !engine.IsClientWriteError(sessionErr) {
+			delta.Errors = 1
+		}
+		recordUsage(r, delta)
+	}()
+
 	// Inject system prompt
-	h.InjectSystemPrompt(requestBody)
+	// A cached context already fixes the system instruction; adding one would make the request invalid
+	if cacheName := streaming.CachedContentName(requestBody); cacheName != "" {
+		reqLog.Info(fmt.Sprintf("Request references cachedContent %s. Skipping system prompt injection.", cacheName))
+	} else {
+		h.InjectSystemPrompt(requestBody)
+	}
+
+	// Requesting more output than the model can produce is rejected upstream
+	if limit := modelinfo.GetGlobalCatalog().ClampOutputTokens(requestBody, summary.Model); limit > 0 {
+		reqLog.Info(fmt.Sprintf("Lowered maxOutputTokens to the %s output limit of %d", summary.Model, limit))
+	}
+
+	// Replace a repeated long conversation prefix with an automatically created cache
+	autoCacheName := ""
+	if h.Caches != nil {
+		autoCacheName = h.Caches.Rewrite(requestBody, summary.Model, r.Header, urlObj.Query())
+		if autoCacheName != "" {
+			reqLog.Info(fmt.Sprintf("Using automatic context cache %s", autoCacheName))
+		}
+	}
 
 	// Create upstream request
 	modifiedBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
-		logger.LogError("Failed to marshal modified request body:", err)
-		JSONError(w, 500, "Internal server error", "Failed to process request body")
+		reqLog.Error("Failed to marshal modified request body:", err)
+		sessionErr = fmt.Errorf("failed to marshal request body: %w", err)
+		JSONError(w, 500, ReasonInternal, "Internal server error", "Failed to process request body")
 		return
 	}
 
-	logger.LogInfo("=== MAKING INITIAL REQUEST ===")
-	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
+	// Fake streaming calls generateContent upstream and replays the answer as SSE events
+	client := h.Client
+	if h.fakeStream(r) {
+		reqLog.Info("Fake streaming enabled: using non-streaming upstream calls")
+		client = streaming.NewFakeStreamClient(h.Client)
+	}
+
+	reqLog.Info("=== MAKING INITIAL REQUEST ===")
+	upstreamHeaders := streaming.BuildUpstreamHeaders(r.Header, true)
+	failover := h.applyPoolKey(r, upstreamHeaders)
 
-	upstreamReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
+	requestCtx, requestSpan := tracing.GetGlobalTracer().StartSpan(ctx, "upstream.initial_request", tracing.KindClient)
+	upstreamReq, err := http.NewRequestWithContext(requestCtx, "POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
 	if err != nil {
-		logger.LogError("Failed to create upstream request:", err)
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+		requestSpan.SetError(err)
+		requestSpan.End()
+		reqLog.Error("Failed to create upstream request:", err)
+		sessionErr = fmt.Errorf("failed to create upstream request: %w", err)
+		JSONError(w, 500, ReasonInternal, "Internal server error", "Failed to create upstream request")
 		return
 	}
 
 	upstreamReq.Header = upstreamHeaders
 
-	client := &http.Client{}
+	summary.Attempts = 1
+	requestStart := time.Now()
 	initialResponse, err := client.Do(upstreamReq)
+	for err == nil && failover != nil && initialResponse.StatusCode != http.StatusOK {
+		header, ok := failover.Next(upstreamHeaders, initialResponse.StatusCode)
+		if !ok {
+			break
+		}
+		reqLog.Info(fmt.Sprintf("Initial request rejected with status %d. Resending with the next API key.", initialResponse.StatusCode))
+		initialResponse.Body.Close()
+		upstreamHeaders = header
+		upstreamReq, _ = http.NewRequestWithContext(requestCtx, "POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
+		upstreamReq.Header = upstreamHeaders
+		initialResponse, err = client.Do(upstreamReq)
+	}
+	if err != nil {
+		requestSpan.SetError(err)
+	} else {
+		requestSpan.SetAttribute("http.response.status_code", initialResponse.StatusCode)
+	}
+	requestSpan.End()
+	if err != nil && r.Context().Err() != nil {
+		reqLog.Info("Client disconnected before the initial response arrived")
+		sessionErr = &engine.ClientWriteError{Err: err}
+		return
+	}
 	if err != nil {
-		logger.LogError("Failed to make initial request:", err)
-		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
+		errorClass := engine.ClassifyError(err)
+		reqLog.Error(fmt.Sprintf("Failed to make initial request (%s): %v", errorClass, err))
+		metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+		summary.Reasons = append(summary.Reasons, errorClass)
+		sessionErr = fmt.Errorf("initial request failed: %w", err)
+		JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
 		return
 	}
+	metrics.GetGlobalMetrics().RecordResponseTime(time.Since(requestStart))
 
-	logger.LogInfo(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
+	reqLog.Info(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
 
 	// Initial failure: return standardized error
 	if initialResponse.StatusCode != http.StatusOK {
-		logger.LogError("=== INITIAL REQUEST FAILED ===")
-		logger.LogError("Status:", initialResponse.StatusCode)
-		logger.LogError("Status Text:", initialResponse.Status)
+		reqLog.Error("=== INITIAL REQUEST FAILED ===")
+		reqLog.Error("Status:", initialResponse.StatusCode)
+		reqLog.Error("Status Text:", initialResponse.Status)
+		sessionErr = fmt.Errorf("initial request failed with status %d", initialResponse.StatusCode)
 
 		// Read error response
 		errorBody, _ := io.ReadAll(initialResponse.Body)
 		initialResponse.Body.Close()
 
+		// The cache may have been deleted or expired upstream; stop using it
+		if autoCacheName != "" {
+			h.Caches.Invalidate(autoCacheName)
+		}
+		if cfg.MaskUpstreamErrors {
+			reqLog.Debug("Masking upstream error body:", string(errorBody))
+			errorBody = engine.MaskErrorBody(errorBody, initialResponse.StatusCode)
+		}
+
 		// Try to parse as JSON error
 		var errorResp map[string]interface{}
 		if json.Unmarshal(errorBody, &errorResp) == nil {
@@ -177,78 +505,151 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 		if initialResponse.StatusCode == 429 {
 			message = "Resource has been exhausted (e.g. check quota)."
 		}
-		JSONError(w, initialResponse.StatusCode, message, string(errorBody))
+		JSONError(w, initialResponse.StatusCode, ReasonUpstreamError, message, string(errorBody))
 		return
 	}
 
-	logger.LogInfo("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
+	reqLog.Info("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
+
+	if aggregate {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		output := streaming.NewJSONAggregator(w)
+		err = streaming.ProcessStreamAndRetryInternally(
+			ctx,
+			cfg,
+			client,
+			initialResponse.Body,
+			output,
+			requestBody,
+			upstreamURL,
+			upstreamHeaders,
+			summary,
+			h.Observer,
+			failover,
+		)
+		if closeErr := output.Close(); closeErr != nil && err == nil {
+			err = &engine.ClientWriteError{Err: closeErr}
+		}
+		if err != nil {
+			sessionErr = err
+			reqLog.Error("Aggregated stream ended with error:", err)
+		}
+		initialResponse.Body.Close()
+		reqLog.Info("Aggregated response completed")
+		return
+	}
 
 	// Set up streaming response
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// Additional headers to prevent buffering by proxies
-	w.Header().Set("X-Accel-Buffering", "no") // Nginx
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-
+	setSSEHeaders(w)
+	if resume != nil {
+		w.Header().Set(resumeSessionHeader, resume.ID)
+	}
 	w.WriteHeader(http.StatusOK)
 
+	// Deliver output through a buffered writer so a slow client cannot stall upstream reads unnoticed
+	consumer := streaming.NewConsumerWriter(w, cfg.SlowConsumerThreshold, cfg.SlowConsumerBufferBytes, cfg.SlowConsumerPolicy)
+	output := streaming.NewSSEWriter(consumer, cfg.SSEOutputMode)
+	output.KeepAlive(cfg.SSEKeepaliveInterval)
+
+	// A resumable session is written to its buffer, which this client follows like any reconnecting one
+	var writer engine.StreamWriter = output
+	followed := make(chan error, 1)
+	if resume != nil {
+		writer = resume
+		go func() { followed <- resume.Follow(r.Context(), 0, output) }()
+	}
+
 	// Process stream with retry logic
 	err = streaming.ProcessStreamAndRetryInternally(
-		h.Config,
+		ctx,
+		cfg,
+		client,
 		initialResponse.Body,
-		w,
+		writer,
 		requestBody,
 		upstreamURL,
-		r.Header,
+		upstreamHeaders,
+		summary,
+		h.Observer,
+		failover,
 	)
-
-	if err != nil {
-		logger.LogError("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
-		logger.LogError("Exception:", err)
+	if resume != nil {
+		resume.Close()
+		if followErr := <-followed; followErr != nil {
+			reqLog.Info("Client left the resumable session:", followErr)
+		}
+		if err != nil && ctx.Err() != nil {
+			reqLog.Info("No client resumed the session in time, generation cancelled")
+			if !engine.IsClientWriteError(err) {
+				err = &engine.ClientWriteError{Err: err}
+			}
+		}
+	}
+	output.Close()
+	consumer.Close()
+
+	if engine.IsClientWriteError(err) {
+		sessionErr = err
+		reqLog.Info("Client disconnected during streaming:", err)
+	} else if err != nil {
+		sessionErr = err
+		reqLog.Error("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
+		reqLog.Error("Exception:", err)
 	}
 
 	initialResponse.Body.Close()
-	logger.LogInfo("Streaming response completed")
+	reqLog.Info("Streaming response completed")
 }
 
 // HandleNonStreaming handles non-streaming requests
 func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request) {
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
+	upstreamURL := h.current().UpstreamURLBase + urlObj.Path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
 	}
 
-	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
+	upstreamHeaders := streaming.BuildUpstreamHeaders(r.Header, false)
+	h.applyPoolKey(r, upstreamHeaders)
 
 	var body io.Reader
 	if r.Method != "GET" && r.Method != "HEAD" {
 		body = r.Body
 	}
 
-	upstreamReq, err := http.NewRequest(r.Method, upstreamURL, body)
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, body)
 	if err != nil {
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+		JSONError(w, 500, ReasonInternal, "Internal server error", "Failed to create upstream request")
 		return
 	}
 
 	upstreamReq.Header = upstreamHeaders
 
-	client := &http.Client{}
-	resp, err := client.Do(upstreamReq)
+	requestStart := time.Now()
+	resp, err := h.Client.Do(upstreamReq)
 	if err != nil {
-		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
+		if bodyTooLarge(err) {
+			logger.LogWarn("Request body exceeded the size limit while forwarding:", err)
+			RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+			return
+		}
+		errorClass := engine.ClassifyError(err)
+		logger.LogError(fmt.Sprintf("Failed to make upstream request (%s): %v", errorClass, err))
+		metrics.GetGlobalMetrics().RecordNetworkError(errorClass)
+		JSONError(w, 502, ReasonUpstreamUnreachable, "Bad Gateway", "Failed to connect to upstream server")
 		return
 	}
 	defer resp.Body.Close()
+	metrics.GetGlobalMetrics().RecordResponseTime(time.Since(requestStart))
 
 	if resp.StatusCode != http.StatusOK {
 		// Handle error response
+		recordUsage(r, usage.Counters{Errors: 1})
 		errorBody, _ := io.ReadAll(resp.Body)
+		if h.current().MaskUpstreamErrors {
+			logger.LogDebug("Masking upstream error body:", string(errorBody))
+			errorBody = engine.MaskErrorBody(errorBody, resp.StatusCode)
+		}
 
 		var errorResp map[string]interface{}
 		if json.Unmarshal(errorBody, &errorResp) == nil {
@@ -266,7 +667,7 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 			return
 		}
 
-		JSONError(w, resp.StatusCode, resp.Status, string(errorBody))
+		JSONError(w, resp.StatusCode, ReasonUpstreamError, resp.Status, string(errorBody))
 		return
 	}
 
@@ -279,11 +680,23 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if !IsGeneratePath(urlObj.Path) {
+		io.Copy(w, resp.Body)
+		return
+	}
+	// The tokens of a generateContent response are attributed to the client's key
+	var response bytes.Buffer
+	io.Copy(w, io.TeeReader(resp.Body, &response))
+	recordUsage(r, usage.Counters{Tokens: int64(responseTokens(response.Bytes()))})
 }
 
 // ServeHTTP implements the http.Handler interface
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests for an upstream profile are served by the profile's handler
+	if h.serveProfile(w, r) {
+		return
+	}
+
 	logger.LogInfo("=== WORKER REQUEST ===")
 	logger.LogInfo("Method:", r.Method)
 	logger.LogInfo("URL:", r.URL.String())
@@ -296,15 +709,117 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine if this is a streaming request
-	isStream := strings.Contains(strings.ToLower(r.URL.Path), "stream") ||
-		strings.Contains(strings.ToLower(r.URL.Path), "sse") ||
-		r.URL.Query().Get("alt") == "sse"
+	if IsWebSocketRequest(r) {
+		h.HandleWebSocket(w, r)
+		return
+	}
+
+	if !MethodAllowed(r.URL.Path, r.Method) {
+		w.Header().Set("Allow", allowHeader(r.URL.Path))
+		JSONError(w, 405, ReasonMethodNotAllowed, fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path), "")
+		return
+	}
 
+	// Request rates, client keys and quotas are checked by the middleware in Pipeline
+	client := ClientIP(r)
+	credential := ClientCredential(r)
+
+	// Oversized bodies, such as huge inline media, are rejected before they are read into memory
+	if limit := h.current().MaxRequestBodyBytes; limit > 0 {
+		if r.ContentLength > int64(limit) {
+			logger.LogWarn(fmt.Sprintf("Rejecting %d byte request body from %s: limit is %d bytes", r.ContentLength, client, limit))
+			RequestTooLargeError(w, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+
+	// Aliased model names are rewritten and bodies sanitized before anything looks at them
+	var served bool
+	if r, served = h.rewriteModels(w, r); served {
+		return
+	}
+	if r, served = h.sanitizeRequest(w, r); served {
+		return
+	}
+
+	if r.Method == "POST" && IsEmbedPath(r.URL.Path) {
+		h.HandleEmbed(w, r)
+		return
+	}
+	if r.Method == "POST" && IsCountTokensPath(r.URL.Path) {
+		h.HandleCountTokens(w, r)
+		return
+	}
+
+	// Clients polling the models list are answered from the cache
+	if h.Models != nil && h.current().ModelsCacheTTL > 0 && (r.Method == "GET" || r.Method == "HEAD") && IsModelListPath(r.URL.Path) {
+		h.HandleModelList(w, r)
+		return
+	}
+
+	// Long-running operations get header-preserving passthrough and optional long-polling
+	if IsOperationPath(r.URL.Path) {
+		h.HandleOperation(w, r)
+		return
+	}
+
+	// Determine if this is a streaming request
+	isStream := isStreamRequest(r)
 	logger.LogInfo("Detected streaming request:", isStream)
 
-	if r.Method == "POST" && isStream {
-		h.HandleStreamingPost(w, r)
+	// A client that lost its stream picks it up where it dropped
+	if h.Resumes != nil && r.Method == "POST" && isStream && isResumeRequest(r) && !isWebSocketSession(r) {
+		h.HandleResume(w, r)
+		return
+	}
+
+	// Identical generateContent requests are answered from the response cache
+	if h.Responses != nil && r.Method == "POST" && !isStream && IsGeneratePath(r.URL.Path) {
+		var key string
+		if r, key, served = h.lookupResponse(w, r); served {
+			return
+		}
+		capture := &captureWriter{ResponseWriter: w}
+		defer h.storeResponse(key, capture)
+		w = capture
+	}
+
+	aggregate := !isStream && h.aggregate(r)
+	if aggregate {
+		logger.LogInfo("Serving generateContent from an aggregated stream")
+	}
+
+	if r.Method == "POST" && (isStream || aggregate) {
+		if h.ClientLimits != nil {
+			if !h.ClientLimits.AcquireStream(client) {
+				maxStreams := h.ClientLimits.MaxStreams()
+				logger.LogWarn(fmt.Sprintf("Rate limiting client %s: over %d concurrent streams", client, maxStreams))
+				RateLimitError(w, ReasonClientRateLimited, "Too many concurrent streams from this client. Please retry later.", fmt.Sprintf("limit of %d concurrent streams exceeded", maxStreams), 0)
+				return
+			}
+			defer h.ClientLimits.ReleaseStream(client)
+		}
+		if h.KeyLimits != nil && credential != "" {
+			if !h.KeyLimits.AcquireStream(credential) {
+				limits := h.KeyLimits.LimitsFor(credential)
+				logger.LogWarn(fmt.Sprintf("Rate limiting key %s: over %d concurrent streams", KeyID(credential), limits.MaxStreams))
+				RateLimitError(w, ReasonKeyRateLimited, "Too many concurrent streams for this API key. Please retry later.", fmt.Sprintf("limit of %d concurrent streams exceeded", limits.MaxStreams), 0)
+				return
+			}
+			defer h.KeyLimits.ReleaseStream(credential)
+		}
+		if h.Limiter != nil {
+			if !h.acquireStreamSlot(w, r) {
+				return
+			}
+			defer h.Limiter.Release()
+		}
+		if aggregate {
+			h.HandleAggregatedPost(w, r)
+		} else {
+			h.HandleStreamingPost(w, r)
+		}
 		return
 	}
 
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/upstream"
+)
+
+// RequestID returns the client-supplied X-Request-ID or generates a new one
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+var (
+	trustedMu      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// SetTrustedProxies replaces the reverse proxies whose X-Forwarded-For entries
+// are believed, given as CIDRs or single addresses
+func SetTrustedProxies(cidrs []string) {
+	parsed := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.LogError("Ignoring invalid TRUSTED_PROXIES entry:", cidr)
+			continue
+		}
+		parsed = append(parsed, network)
+	}
+
+	trustedMu.Lock()
+	defer trustedMu.Unlock()
+	trustedProxies = parsed
+}
+
+// isTrustedProxy reports whether addr belongs to a configured trusted proxy
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the originating client address. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy; the client is then
+// the rightmost forwarded address that is not itself a trusted proxy, since
+// everything left of it may have been supplied by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// ModelFromPath extracts the model name from paths like /v1beta/models/{model}:method
+func ModelFromPath(path string) string {
+	idx := strings.Index(path, "/models/")
+	if idx == -1 {
+		return ""
+	}
+
+	model := path[idx+len("/models/"):]
+	if end := strings.IndexAny(model, ":/"); end != -1 {
+		model = model[:end]
+	}
+	return model
+}
+
+// ClientCredential returns the API key the client authenticated with, from the
+// x-goog-api-key header, a bearer token or the key query parameter
+func ClientCredential(r *http.Request) string {
+	if mapped, ok := r.Context().Value(mappedKeyContext{}).(mappedKey); ok {
+		return mapped.credential
+	}
+	if key := r.Header.Get("X-Goog-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("key")
+}
+
+// KeyID identifies a client credential in logs and reports without revealing it
+func KeyID(credential string) string {
+	if credential == "" {
+		return ""
+	}
+	if len(credential) > 8 {
+		return "****" + credential[len(credential)-4:]
+	}
+	return "****"
+}
+
+type mappedKeyContext struct{}
+
+// mappedKey is a proxy-issued client key and the upstream keys serving it
+type mappedKey struct {
+	credential string
+	pool       *upstream.KeyPool
+}
+
+// withMappedKey returns a copy of r without the client's credentials, which
+// remembers them and the upstream keys they map to
+func withMappedKey(r *http.Request, credential string, pool *upstream.KeyPool) *http.Request {
+	mapped := r.Clone(context.WithValue(r.Context(), mappedKeyContext{}, mappedKey{credential: credential, pool: pool}))
+	mapped.Header.Del("X-Goog-Api-Key")
+	if strings.HasPrefix(mapped.Header.Get("Authorization"), "Bearer ") {
+		mapped.Header.Del("Authorization")
+	}
+	if query := mapped.URL.Query(); query.Has("key") {
+		query.Del("key")
+		mapped.URL.RawQuery = query.Encode()
+	}
+	return mapped
+}
+
+// bufferBody reads the request body into memory and puts a copy back for the
+// handler that reads it next. It reports served if the body could not be read
+// and the request was answered with an error.
+func (h *ProxyHandler) bufferBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if bodyTooLarge(err) {
+		RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+		return nil, true
+	}
+	if err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
+		return nil, true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, false
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/respcache"
+)
+
+// maxCachedResponseBytes bounds the size of a response the cache keeps
+const maxCachedResponseBytes = 4 << 20
+
+// cacheStatusHeader tells clients whether a response came from the cache
+const cacheStatusHeader = "X-Proxy-Cache"
+
+// IsGeneratePath reports whether path addresses a non-streaming generateContent call
+func IsGeneratePath(path string) bool {
+	return strings.HasSuffix(path, ":generateContent")
+}
+
+// lookupResponse answers a generateContent request from the response cache.
+// It returns the request with its body restored and the cache key to store
+// the response under, or served if the request was already answered, from
+// the cache or with an error. A Cache-Control: no-cache request skips the
+// lookup but still refreshes the cache.
+func (h *ProxyHandler) lookupResponse(w http.ResponseWriter, r *http.Request) (*http.Request, string, bool) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if bodyTooLarge(err) {
+		RequestTooLargeError(w, h.current().MaxRequestBodyBytes)
+		return r, "", true
+	}
+	if err != nil {
+		JSONError(w, 400, ReasonInvalidRequest, "Failed to read request body", err.Error())
+		return r, "", true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	key := respcache.Key(ModelFromPath(r.URL.Path), ClientCredential(r), body)
+	if !strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache") {
+		if entry, ok := h.Responses.Get(key); ok {
+			logger.LogInfo("Serving generateContent response from cache")
+			if entry.ContentType != "" {
+				w.Header().Set("Content-Type", entry.ContentType)
+			}
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set(cacheStatusHeader, "HIT")
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.Body)
+			return r, "", true
+		}
+	}
+	w.Header().Set(cacheStatusHeader, "MISS")
+	return r, key, false
+}
+
+// storeResponse caches a captured response if it succeeded and fits
+func (h *ProxyHandler) storeResponse(key string, capture *captureWriter) {
+	if capture.status != http.StatusOK || capture.overflow || capture.body.Len() == 0 {
+		return
+	}
+	h.Responses.Put(key, respcache.Entry{
+		Body:        capture.body.Bytes(),
+		ContentType: capture.Header().Get("Content-Type"),
+		Stored:      time.Now(),
+	})
+}
+
+// captureWriter keeps a copy of the response it passes on, up to maxCachedResponseBytes
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > maxCachedResponseBytes {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/streaming"
+)
+
+// resumeSessionHeader carries the ID of a resumable stream session
+const resumeSessionHeader = "X-Proxy-Session"
+
+// isResumeRequest reports whether a streaming request reconnects to a session
+func isResumeRequest(r *http.Request) bool {
+	return r.Header.Get("Last-Event-ID") != "" || r.Header.Get(resumeSessionHeader) != ""
+}
+
+// resumeOwner identifies who may resume a session: the holder of the same API
+// key or, for requests without one, the same client address
+func resumeOwner(r *http.Request) string {
+	owner := ClientCredential(r)
+	if owner == "" {
+		owner = "ip:" + ClientIP(r)
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+// setSSEHeaders sets the headers of a streamed response
+func setSSEHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Additional headers to prevent buffering by proxies
+	w.Header().Set("X-Accel-Buffering", "no") // Nginx
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// HandleResume reconnects a client to a stream session it lost. With
+// Last-Event-ID the client gets the events after the last one it received;
+// with only X-Proxy-Session it gets the session from the start. Either way
+// it then follows the session live until the generation completes. The
+// request body is not sent upstream again.
+func (h *ProxyHandler) HandleResume(w http.ResponseWriter, r *http.Request) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	session, next, err := h.Resumes.Lookup(resumeOwner(r), lastEventID, r.Header.Get(resumeSessionHeader))
+	if errors.Is(err, streaming.ErrEventsDropped) {
+		JSONError(w, 410, ReasonNotFound, "Cannot resume stream", err.Error())
+		return
+	}
+	if err != nil {
+		JSONError(w, 404, ReasonNotFound, "Cannot resume stream", err.Error())
+		return
+	}
+	logger.LogInfo(fmt.Sprintf("Client %s resumed stream session %s at event %d", ClientIP(r), session.ID, next))
+
+	cfg := h.current()
+	setSSEHeaders(w)
+	w.Header().Set(resumeSessionHeader, session.ID)
+	w.WriteHeader(http.StatusOK)
+
+	consumer := streaming.NewConsumerWriter(w, cfg.SlowConsumerThreshold, cfg.SlowConsumerBufferBytes, cfg.SlowConsumerPolicy)
+	output := streaming.NewSSEWriter(consumer, cfg.SSEOutputMode)
+	output.KeepAlive(cfg.SSEKeepaliveInterval)
+	err = session.Follow(r.Context(), next, output)
+	output.Close()
+	consumer.Close()
+	if err != nil {
+		logger.LogInfo(fmt.Sprintf("Client left resumed stream session %s: %v", session.ID, err))
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/sanitize"
+)
+
+// sanitizedHeader lists the changes the sanitizer made to a request
+const sanitizedHeader = "X-Proxy-Sanitized"
+
+// sanitizeRequest fixes up the body of a generateContent or
+// streamGenerateContent request when SANITIZE_REQUESTS is on, renaming
+// snake_case fields, translating OpenAI chat fields and dropping fields
+// upstream would reject. The changes are listed in the X-Proxy-Sanitized
+// response header. It returns served if the request was already answered with an error.
+func (h *ProxyHandler) sanitizeRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	cfg := h.current()
+	if !cfg.SanitizeRequests || r.Method != "POST" ||
+		!(IsGeneratePath(r.URL.Path) || strings.HasSuffix(r.URL.Path, ":streamGenerateContent")) {
+		return r, false
+	}
+
+	body, served := h.bufferBody(w, r)
+	if served {
+		return r, true
+	}
+	sanitized, changes := sanitize.Request(body, cfg.UpstreamMode)
+	if len(changes) == 0 {
+		return r, false
+	}
+
+	logger.LogWarn(fmt.Sprintf("Sanitized request from %s: %s", ClientIP(r), strings.Join(changes, "; ")))
+	w.Header().Set(sanitizedHeader, strings.Join(changes, "; "))
+	r.Body = io.NopCloser(bytes.NewReader(sanitized))
+	r.ContentLength = int64(len(sanitized))
+	return r, false
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gemini-antiblock/usage"
+)
+
+// recordUsage attributes consumption to the client's API key, or proxy client
+// key; requests without a key are not attributed
+func recordUsage(r *http.Request, delta usage.Counters) {
+	credential := ClientCredential(r)
+	if credential == "" {
+		return
+	}
+	usage.GetGlobalTracker().Record(usage.ID(credential), KeyID(credential), delta)
+}
+
+// sessionTokens returns the tokens a streaming session consumed: what upstream
+// reported or, if it reported nothing, an estimate of the request sent with
+// every attempt and the text generated
+func sessionTokens(requestBody map[string]interface{}, attempts, chars, reported int) int {
+	if reported > 0 || attempts == 0 {
+		return reported
+	}
+	return attempts*EstimateTokens(requestBody) + chars/4
+}
+
+// responseTokens returns the totalTokenCount of a generateContent response, or 0
+func responseTokens(body []byte) int {
+	var response struct {
+		UsageMetadata struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return 0
+	}
+	return response.UsageMetadata.TotalTokenCount
+}
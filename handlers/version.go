@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gemini-antiblock/logger"
+)
+
+// Version is the proxy version reported by the health and version endpoints
+const Version = "0.1.0-alpha"
+
+// VersionResponse represents the version endpoint response
+type VersionResponse struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+}
+
+// VersionHandler returns the running proxy version
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(VersionResponse{Service: "gemini-antiblock-proxy", Version: Version}); err != nil {
+		logger.LogError("Failed to encode version response:", err)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"gemini-antiblock/logger"
+)
+
+// webSocketPayloadTimeout is how long a client has to send its request after connecting
+const webSocketPayloadTimeout = 30 * time.Second
+
+// IsWebSocketRequest reports whether r asks to upgrade to a WebSocket
+func IsWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// HandleWebSocket serves streamGenerateContent over a WebSocket, for clients
+// behind middleboxes that buffer or break SSE. The client connects to the
+// usual streamGenerateContent path, authenticating with the usual headers or
+// ?key=, and sends the request body as its first message. Each chunk of the
+// response arrives as a text message holding its JSON, an error as the JSON
+// error body; the proxy closes the socket when the response is complete.
+// Closing the socket early cancels the request.
+func (h *ProxyHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, ":streamGenerateContent") {
+		JSONError(w, 400, ReasonInvalidRequest, "WebSocket is only supported for streamGenerateContent", "")
+		return
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		JSONError(w, 500, ReasonInternal, "WebSocket is not supported on this connection", "")
+		return
+	}
+	// Origins are not checked, as the proxy allows every origin for SSE as well
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { h.serveWebSocket(ws, r) },
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (h *ProxyHandler) serveWebSocket(ws *websocket.Conn, r *http.Request) {
+	defer ws.Close()
+	if limit := h.current().MaxRequestBodyBytes; limit > 0 {
+		ws.MaxPayloadBytes = limit
+	}
+
+	var payload string
+	ws.SetReadDeadline(time.Now().Add(webSocketPayloadTimeout))
+	if err := websocket.Message.Receive(ws, &payload); err != nil {
+		logger.LogWarn(fmt.Sprintf("WebSocket client %s sent no request: %v", ClientIP(r), err))
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	// The hijacked connection no longer cancels the request context, so
+	// watch the socket: the client ends the session by closing it
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		var ignored string
+		for websocket.Message.Receive(ws, &ignored) == nil {
+		}
+		cancel()
+	}()
+
+	// Serve the payload as an SSE request, translating the events into messages
+	req := r.Clone(context.WithValue(ctx, webSocketKey{}, true))
+	req.Method = "POST"
+	for _, name := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol"} {
+		req.Header.Del(name)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	query := req.URL.Query()
+	query.Set("alt", "sse")
+	req.URL.RawQuery = query.Encode()
+	req.Body = io.NopCloser(strings.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+
+	logger.LogInfo(fmt.Sprintf("Streaming %s over WebSocket to %s", req.URL.Path, ClientIP(r)))
+	out := &webSocketWriter{ws: ws, header: make(http.Header)}
+	h.ServeHTTP(out, req)
+	out.finish()
+}
+
+// webSocketKey marks the context of a request served over a WebSocket
+type webSocketKey struct{}
+
+// isWebSocketSession reports whether r is the request a WebSocket client sent as its first message
+func isWebSocketSession(r *http.Request) bool {
+	served, _ := r.Context().Value(webSocketKey{}).(bool)
+	return served
+}
+
+// webSocketWriter turns the SSE events of a response into WebSocket messages.
+// An error status sends the whole response body as one message.
+type webSocketWriter struct {
+	ws     *websocket.Conn
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	err    error
+}
+
+func (w *webSocketWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *webSocketWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *webSocketWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	if w.status != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		end := bytes.Index(w.buf.Bytes(), []byte("\n\n"))
+		if end == -1 {
+			break
+		}
+		event := string(w.buf.Next(end + 2))
+		if w.err = w.sendEvent(event); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op: every complete event is sent as soon as it is written
+func (w *webSocketWriter) Flush() {}
+
+// sendEvent sends the data of an SSE event; comments such as keepalives are dropped
+func (w *webSocketWriter) sendEvent(event string) error {
+	var data []string
+	for _, line := range strings.Split(strings.TrimRight(event, "\n"), "\n") {
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return websocket.Message.Send(w.ws, strings.Join(data, "\n"))
+}
+
+// finish sends what is left of the response: the body of an error status
+func (w *webSocketWriter) finish() {
+	if w.err == nil && w.status != http.StatusOK && w.buf.Len() > 0 {
+		w.err = websocket.Message.Send(w.ws, strings.TrimSpace(w.buf.String()))
+	}
+}
@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// clientWindow is the period over which requests are counted per client
+const clientWindow = time.Minute
+
+// ClientLimiter limits each client, identified by IP address, to a number of
+// requests per minute and a number of concurrent streams. A zero limit
+// disables that check.
+type ClientLimiter struct {
+	requestsPerMinute int
+	maxStreams        int
+
+	mu        sync.Mutex
+	requests  map[string][]time.Time
+	streams   map[string]int
+	lastSweep time.Time
+}
+
+// NewClientLimiter creates a limiter with the given per-client limits
+func NewClientLimiter(requestsPerMinute, maxStreams int) *ClientLimiter {
+	return &ClientLimiter{
+		requestsPerMinute: requestsPerMinute,
+		maxStreams:        maxStreams,
+		requests:          make(map[string][]time.Time),
+		streams:           make(map[string]int),
+		lastSweep:         time.Now(),
+	}
+}
+
+// Allow counts a request from client. If the client is over its request
+// rate, the request is not counted and Allow returns false with the time
+// until the oldest request in the window expires.
+func (l *ClientLimiter) Allow(client string) (bool, time.Duration) {
+	if l.requestsPerMinute <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-clientWindow)
+	if now.Sub(l.lastSweep) >= clientWindow {
+		for c, times := range l.requests {
+			if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+				delete(l.requests, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	times := l.requests[client]
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	times = times[i:]
+	if len(times) >= l.requestsPerMinute {
+		l.requests[client] = times
+		return false, times[0].Sub(cutoff)
+	}
+	l.requests[client] = append(times, now)
+	return true, 0
+}
+
+// MaxStreams returns the number of concurrent streams allowed per client, 0 if unlimited
+func (l *ClientLimiter) MaxStreams() int {
+	return l.maxStreams
+}
+
+// AcquireStream takes one of client's stream slots, returning false if all are in use
+func (l *ClientLimiter) AcquireStream(client string) bool {
+	if l.maxStreams <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams[client] >= l.maxStreams {
+		return false
+	}
+	l.streams[client]++
+	return true
+}
+
+// ReleaseStream frees a stream slot taken with AcquireStream
+func (l *ClientLimiter) ReleaseStream(client string) {
+	if l.maxStreams <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams[client] <= 1 {
+		delete(l.streams, client)
+		return
+	}
+	l.streams[client]--
+}
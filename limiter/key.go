@@ -0,0 +1,173 @@
+package limiter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits are the caps applied to one API key. A zero value disables that cap.
+type Limits struct {
+	// PerMinute is the sustained request rate; up to a minute's worth may arrive in a burst
+	PerMinute int
+	// PerDay is the number of requests allowed per UTC day
+	PerDay int
+	// MaxStreams is the number of concurrent streaming sessions
+	MaxStreams int
+}
+
+// ParseLimits parses "perMinute:perDay:maxStreams". Empty fields keep the
+// value from defaults, so "::2" only changes the stream cap.
+func ParseLimits(spec string, defaults Limits) (Limits, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) > 3 {
+		return defaults, fmt.Errorf("limits %q have more than three fields", spec)
+	}
+	limits := defaults
+	targets := []*int{&limits.PerMinute, &limits.PerDay, &limits.MaxStreams}
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return defaults, fmt.Errorf("limits %q: invalid value %q", spec, field)
+		}
+		*targets[i] = n
+	}
+	return limits, nil
+}
+
+// Rejection reasons returned by KeyLimiter.Allow
+const (
+	RejectRate  = "rate"
+	RejectQuota = "quota"
+)
+
+type keyState struct {
+	tokens  float64
+	updated time.Time
+	day     string
+	used    int
+	streams int
+}
+
+// KeyLimiter enforces per-API-key request rates, daily quotas and
+// concurrent-stream caps. Daily counts are kept in memory and start over
+// when the proxy restarts.
+type KeyLimiter struct {
+	defaults  Limits
+	overrides map[string]Limits
+
+	mu        sync.Mutex
+	keys      map[string]*keyState
+	lastSweep time.Time
+}
+
+// NewKeyLimiter creates a limiter applying defaults to every key except those in overrides
+func NewKeyLimiter(defaults Limits, overrides map[string]Limits) *KeyLimiter {
+	return &KeyLimiter{
+		defaults:  defaults,
+		overrides: overrides,
+		keys:      make(map[string]*keyState),
+		lastSweep: time.Now(),
+	}
+}
+
+// LimitsFor returns the limits applied to key
+func (l *KeyLimiter) LimitsFor(key string) Limits {
+	if limits, ok := l.overrides[key]; ok {
+		return limits
+	}
+	return l.defaults
+}
+
+func (l *KeyLimiter) state(key string, limits Limits, now time.Time) *keyState {
+	today := now.UTC().Format("2006-01-02")
+	if now.Sub(l.lastSweep) >= time.Hour {
+		// Keys idle since an earlier day have nothing left to remember
+		for k, s := range l.keys {
+			if s.day != today && s.streams == 0 {
+				delete(l.keys, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	s, ok := l.keys[key]
+	if !ok {
+		s = &keyState{tokens: float64(limits.PerMinute), updated: now}
+		l.keys[key] = s
+	}
+	if s.day != today {
+		s.day = today
+		s.used = 0
+	}
+	return s
+}
+
+// Allow counts a request made with key. A rejected request is not counted;
+// Allow then returns the reason, RejectRate or RejectQuota, and how long the
+// client should wait.
+func (l *KeyLimiter) Allow(key string) (bool, string, time.Duration) {
+	limits := l.LimitsFor(key)
+	if limits.PerMinute <= 0 && limits.PerDay <= 0 {
+		return true, "", 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	s := l.state(key, limits, now)
+
+	if limits.PerDay > 0 && s.used >= limits.PerDay {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return false, RejectQuota, midnight.Sub(now)
+	}
+
+	if limits.PerMinute > 0 {
+		rate := float64(limits.PerMinute) / float64(time.Minute)
+		s.tokens = min(s.tokens+float64(now.Sub(s.updated))*rate, float64(limits.PerMinute))
+		s.updated = now
+		if s.tokens < 1 {
+			return false, RejectRate, time.Duration((1 - s.tokens) / rate)
+		}
+		s.tokens--
+	}
+	s.used++
+	return true, "", 0
+}
+
+// AcquireStream takes one of key's stream slots, returning false if all are in use
+func (l *KeyLimiter) AcquireStream(key string) bool {
+	limits := l.LimitsFor(key)
+	if limits.MaxStreams <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.state(key, limits, time.Now())
+	if s.streams >= limits.MaxStreams {
+		return false
+	}
+	s.streams++
+	return true
+}
+
+// ReleaseStream frees a stream slot taken with AcquireStream
+func (l *KeyLimiter) ReleaseStream(key string) {
+	if l.LimitsFor(key).MaxStreams <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.keys[key]; ok && s.streams > 0 {
+		s.streams--
+	}
+}
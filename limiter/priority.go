@@ -0,0 +1,104 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+)
+
+// Request priority classes
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// ParsePriority normalizes a client-supplied priority, defaulting to interactive
+func ParsePriority(value string) string {
+	if strings.EqualFold(strings.TrimSpace(value), PriorityBatch) {
+		return PriorityBatch
+	}
+	return PriorityInteractive
+}
+
+// PriorityLimiter caps concurrent sessions. When all slots are taken, waiting
+// interactive sessions are always admitted before waiting batch sessions.
+type PriorityLimiter struct {
+	mu          sync.Mutex
+	capacity    int
+	active      int
+	interactive *list.List
+	batch       *list.List
+}
+
+// NewPriorityLimiter creates a limiter allowing capacity concurrent sessions
+func NewPriorityLimiter(capacity int) *PriorityLimiter {
+	return &PriorityLimiter{
+		capacity:    capacity,
+		interactive: list.New(),
+		batch:       list.New(),
+	}
+}
+
+// Acquire blocks until a slot is available or ctx is done
+func (l *PriorityLimiter) Acquire(ctx context.Context, priority string) error {
+	l.mu.Lock()
+	if l.active < l.capacity && l.interactive.Len() == 0 && (priority == PriorityInteractive || l.batch.Len() == 0) {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+
+	queue := l.queueFor(priority)
+	ready := make(chan struct{})
+	elem := queue.PushBack(ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-ready:
+			// The slot was handed over while we were giving up; pass it on
+			l.releaseLocked()
+		default:
+			queue.Remove(elem)
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot, handing it to the next waiter if any
+func (l *PriorityLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// Stats returns the number of active sessions and waiting sessions per class
+func (l *PriorityLimiter) Stats() (active, waitingInteractive, waitingBatch int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active, l.interactive.Len(), l.batch.Len()
+}
+
+func (l *PriorityLimiter) queueFor(priority string) *list.List {
+	if priority == PriorityBatch {
+		return l.batch
+	}
+	return l.interactive
+}
+
+func (l *PriorityLimiter) releaseLocked() {
+	for _, queue := range []*list.List{l.interactive, l.batch} {
+		if front := queue.Front(); front != nil {
+			queue.Remove(front)
+			close(front.Value.(chan struct{}))
+			return
+		}
+	}
+	l.active--
+}
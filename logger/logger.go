@@ -1,31 +1,269 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-var debugMode bool
+// Log formats accepted by SetFormat
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Level is a log severity; messages below the configured level are discarded
+type Level int32
+
+// Log levels, from most to least verbose
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR"}
+
+// String returns the upper-case level name
+func (l Level) String() string {
+	if l < LevelTrace || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "warn", case-insensitively
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	minLevel   atomic.Int32
+	jsonFormat bool
+	jsonLogger = log.New(log.Writer(), "", 0)
+	sink       Sink
+)
+
+func init() {
+	minLevel.Store(int32(LevelInfo))
+}
+
+// Sink receives log output in place of the standard library logger. A sink
+// that also has Warnf and Tracef methods receives those levels; otherwise
+// warnings go to Errorf and traces to Debugf.
+type Sink interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type levelSink interface {
+	Warnf(format string, args ...interface{})
+	Tracef(format string, args ...interface{})
+}
+
+// SetSink routes all log output to s; nil restores the standard library logger.
+// It must be called before logging starts.
+func SetSink(s Sink) {
+	sink = s
+}
+
+// SetFormat selects text lines or one JSON object per line. It must be
+// called before logging starts and has no effect on a sink.
+func SetFormat(format string) {
+	jsonFormat = format == FormatJSON
+}
 
-// SetDebugMode sets whether debug logging is enabled
+// SetLevel sets the least severe level that is logged; it may be called at any time
+func SetLevel(level Level) {
+	minLevel.Store(int32(level))
+}
+
+// SetDebugMode logs from LevelDebug when enabled and from LevelInfo otherwise
 func SetDebugMode(enabled bool) {
-	debugMode = enabled
+	if enabled {
+		SetLevel(LevelDebug)
+	} else {
+		SetLevel(LevelInfo)
+	}
+}
+
+// Enabled reports whether messages at level are logged, to skip building expensive ones
+func Enabled(level Level) bool {
+	return level >= Level(minLevel.Load())
 }
 
-// LogDebug logs debug messages (only if debug mode is enabled)
+// LogTrace logs very verbose diagnostics such as every upstream line
+func LogTrace(args ...interface{}) {
+	output(LevelTrace, nil, fmt.Sprint(args...))
+}
+
+// LogDebug logs debug messages
 func LogDebug(args ...interface{}) {
-	if debugMode {
-		log.Printf("[DEBUG %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
-	}
+	output(LevelDebug, nil, fmt.Sprint(args...))
 }
 
 // LogInfo logs info messages
 func LogInfo(args ...interface{}) {
-	log.Printf("[INFO %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
+	output(LevelInfo, nil, fmt.Sprint(args...))
+}
+
+// LogWarn logs recoverable problems, such as an interrupted stream that will be retried
+func LogWarn(args ...interface{}) {
+	output(LevelWarn, nil, fmt.Sprint(args...))
 }
 
 // LogError logs error messages
 func LogError(args ...interface{}) {
-	log.Printf("[ERROR %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
+	output(LevelError, nil, fmt.Sprint(args...))
+}
+
+// LogSummary logs a machine-readable JSON record on a single line, regardless of debug mode
+func LogSummary(record interface{}) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		LogError("Failed to encode summary record:", err)
+		return
+	}
+	if sink != nil {
+		sink.Infof("[SUMMARY] %s", data)
+		return
+	}
+	if jsonFormat {
+		// The record's own fields are merged into the log entry
+		var fields Fields
+		if err := json.Unmarshal(data, &fields); err != nil {
+			fields = Fields{"summary": json.RawMessage(data)}
+		}
+		fields["kind"] = "summary"
+		writeJSON(LevelInfo, fields, "session summary")
+		return
+	}
+	log.Printf("[SUMMARY %s] %s", time.Now().Format(time.RFC3339), data)
+}
+
+// Fields are structured values attached to log entries, such as a request ID.
+// In text format they are omitted.
+type Fields map[string]interface{}
+
+// Entry logs messages with a fixed set of fields. It implements Sink, so it
+// can be handed to the stream engine as its logger.
+type Entry struct {
+	fields Fields
+}
+
+// With returns an entry that attaches fields to every message
+func With(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// Trace logs a trace message
+func (e *Entry) Trace(args ...interface{}) {
+	output(LevelTrace, e.fields, fmt.Sprint(args...))
+}
+
+// Debug logs a debug message
+func (e *Entry) Debug(args ...interface{}) {
+	output(LevelDebug, e.fields, fmt.Sprint(args...))
+}
+
+// Info logs an info message
+func (e *Entry) Info(args ...interface{}) {
+	output(LevelInfo, e.fields, fmt.Sprint(args...))
+}
+
+// Warn logs a warning
+func (e *Entry) Warn(args ...interface{}) {
+	output(LevelWarn, e.fields, fmt.Sprint(args...))
+}
+
+// Error logs an error message
+func (e *Entry) Error(args ...interface{}) {
+	output(LevelError, e.fields, fmt.Sprint(args...))
+}
+
+// Tracef logs a formatted trace message
+func (e *Entry) Tracef(format string, args ...interface{}) {
+	if Enabled(LevelTrace) {
+		output(LevelTrace, e.fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// Debugf logs a formatted debug message
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	if Enabled(LevelDebug) {
+		output(LevelDebug, e.fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs a formatted info message
+func (e *Entry) Infof(format string, args ...interface{}) {
+	output(LevelInfo, e.fields, fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a formatted warning
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	output(LevelWarn, e.fields, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a formatted error message
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	output(LevelError, e.fields, fmt.Sprintf(format, args...))
+}
+
+func output(level Level, fields Fields, message string) {
+	if !Enabled(level) {
+		return
+	}
+	if sink != nil {
+		leveled, hasLevels := sink.(levelSink)
+		switch {
+		case level == LevelTrace && hasLevels:
+			leveled.Tracef("%s", message)
+		case level <= LevelDebug:
+			sink.Debugf("%s", message)
+		case level == LevelWarn && hasLevels:
+			leveled.Warnf("%s", message)
+		case level >= LevelWarn:
+			sink.Errorf("%s", message)
+		default:
+			sink.Infof("%s", message)
+		}
+		return
+	}
+	if jsonFormat {
+		writeJSON(level, fields, message)
+		return
+	}
+	log.Printf("[%s %s] %s", level, time.Now().Format(time.RFC3339), message)
+}
+
+// writeJSON writes one log entry as a single JSON line
+func writeJSON(level Level, fields Fields, message string) {
+	entry := make(Fields, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = strings.ToLower(level.String())
+	entry["msg"] = message
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(Fields{"time": entry["time"], "level": entry["level"], "msg": message})
+	}
+	jsonLogger.Print(string(data))
 }
@@ -1,58 +1,659 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 
+	"gemini-antiblock/antiblock"
 	"gemini-antiblock/config"
 	"gemini-antiblock/handlers"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/mockserver"
+	"gemini-antiblock/modelinfo"
+	"gemini-antiblock/modelstats"
+	"gemini-antiblock/replay"
+	"gemini-antiblock/report"
+	"gemini-antiblock/secrets"
+	"gemini-antiblock/server"
+	"gemini-antiblock/storage"
+	"gemini-antiblock/tracing"
+	"gemini-antiblock/upstream"
+	"gemini-antiblock/usage"
 )
 
+// flagEnv maps command-line flags to the environment variables they override
+var flagEnv = []struct {
+	name, env, usage string
+}{
+	{"port", "PORT", "server port"},
+	{"upstream", "UPSTREAM_URL_BASE", "upstream Gemini API base URL"},
+	{"max-retries", "MAX_CONSECUTIVE_RETRIES", "maximum consecutive retries per stream"},
+	{"retry-delay", "RETRY_DELAY_MS", "delay between retries in milliseconds"},
+	{"management-prefix", "MANAGEMENT_PREFIX", "path prefix for management endpoints"},
+	{"storage", "STORAGE_BACKEND", "storage backend: memory, sqlite or redis"},
+}
+
+// envFile is the env file read at startup and on every reload
+var envFile = ".env"
+
+// parseFlags applies command-line flags on top of the environment and returns
+// the remaining arguments. Flags take precedence over environment variables,
+// which take precedence over the env file.
+func parseFlags() []string {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	flags.StringVar(&envFile, "config", envFile, "env file to read settings from")
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	flags.Bool("debug", false, "enable debug logging (DEBUG_MODE)")
+	for _, f := range flagEnv {
+		flags.String(f.name, "", f.usage+" ("+f.env+")")
+	}
+	var settings []string
+	flags.Func("set", "set any setting, as `KEY=VALUE`; may be repeated", func(value string) error {
+		if !strings.Contains(value, "=") {
+			return errors.New("expected KEY=VALUE")
+		}
+		settings = append(settings, value)
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] [install|uninstall|replay FILE|mockserver [flags]]\n\nFlags override environment variables, which override the env file.\n\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if *showVersion {
+		fmt.Printf("gemini-antiblock-proxy %s\n", handlers.Version)
+		os.Exit(0)
+	}
+
+	for _, setting := range settings {
+		key, value, _ := strings.Cut(setting, "=")
+		os.Setenv(key, value)
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "debug" {
+			os.Setenv("DEBUG_MODE", f.Value.String())
+		}
+		for _, mapping := range flagEnv {
+			if mapping.name == f.Name {
+				os.Setenv(mapping.env, f.Value.String())
+			}
+		}
+	})
+	return flags.Args()
+}
+
 func main() {
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
+	args := parseFlags()
+
+	// Serve a mock Gemini API for testing instead of the proxy
+	if len(args) > 0 && args[0] == "mockserver" {
+		if err := runMockServer(args[1:]); err != nil {
+			log.Fatalln("Mock server failed:", err)
+		}
+		return
+	}
+
+	// Windows service management commands
+	if handled, err := server.HandleServiceCommand(args); handled {
+		if err != nil {
+			log.Fatalln("Service command failed:", err)
+		}
+		return
+	}
+	if err := server.PrepareService(); err != nil {
+		log.Fatalln("Failed to prepare service:", err)
+	}
+
+	// Load the env file if it exists; one named with -config must exist
+	if err := config.LoadEnvFile(envFile); errors.Is(err, fs.ErrNotExist) && envFile == ".env" {
 		log.Println("No .env file found, using environment variables")
+	} else if err != nil {
+		log.Fatalln("Failed to read env file:", err)
 	}
 
 	// Load configuration
 	cfg := config.LoadConfig()
+	if err := cfg.LoadSecretFiles(); err != nil {
+		log.Fatalln("Failed to load secret files:", err)
+	}
 
 	// Set up logging
-	logger.SetDebugMode(cfg.DebugMode)
+	logger.SetFormat(cfg.LogFormat)
+	setLogLevel(cfg)
+
+	// Replay a session recording instead of serving
+	if len(args) > 0 && args[0] == "replay" {
+		if len(args) != 2 {
+			log.Fatalln("Usage: replay FILE")
+		}
+		if err := replay.Run(context.Background(), cfg, args[1], os.Stdout); err != nil {
+			log.Fatalln("Replay failed:", err)
+		}
+		return
+	}
 
 	logger.LogInfo("=== GEMINI ANTIBLOCK PROXY STARTING ===")
-	logger.LogInfo(fmt.Sprintf("Upstream URL: %s", cfg.UpstreamURLBase))
-	logger.LogInfo(fmt.Sprintf("Max retries: %d", cfg.MaxConsecutiveRetries))
-	logger.LogInfo(fmt.Sprintf("Debug mode: %t", cfg.DebugMode))
-	logger.LogInfo(fmt.Sprintf("Retry delay: %v", cfg.RetryDelayMs))
-	logger.LogInfo(fmt.Sprintf("Swallow thoughts after retry: %t", cfg.SwallowThoughtsAfterRetry))
-	logger.LogInfo(fmt.Sprintf("Server port: %s", cfg.Port))
+	logger.LogInfo("Effective configuration:")
+	for _, entry := range cfg.Entries() {
+		logger.LogInfo(fmt.Sprintf("  %s=%s", entry.Key, entry.Value))
+	}
+
+	// Shared storage backend for persistence features
+	store, err := storage.Open(cfg.StorageBackend, cfg.StorageDSN)
+	if err != nil {
+		logger.LogError("Failed to open storage:", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	logger.LogInfo(fmt.Sprintf("Using %s storage backend", cfg.StorageBackend))
+
+	// Per-model retry statistics, persisted across restarts if a file or persistent storage is configured
+	if cfg.ModelStatsFile != "" {
+		if err := modelstats.GetGlobalStore().Load(cfg.ModelStatsFile); err != nil {
+			logger.LogError("Failed to load model stats:", err)
+		}
+		modelstats.GetGlobalStore().StartPersistence(cfg.ModelStatsFile, 30*time.Second)
+	} else if cfg.StorageBackend != storage.BackendMemory {
+		if err := modelstats.GetGlobalStore().LoadFromStore(store); err != nil {
+			logger.LogError("Failed to load model stats:", err)
+		}
+		modelstats.GetGlobalStore().StartStorePersistence(store, 30*time.Second)
+	}
+
+	// Per-client usage, persisted across restarts if persistent storage is configured
+	if cfg.StorageBackend != storage.BackendMemory {
+		if err := usage.GetGlobalTracker().LoadFromStore(store); err != nil {
+			logger.LogError("Failed to load usage:", err)
+		}
+		usage.GetGlobalTracker().StartStorePersistence(store, 30*time.Second)
+	}
+
+	// Daily activity report, closed at every UTC midnight
+	reporter := report.NewReporter(store, cfg.ReportWebhookURL, cfg.ReportWebhookFormat)
+	reporter.Start()
+	defer reporter.Stop()
+
+	// Metrics pushed to Redis or StatsD, so replicas add up to one combined view
+	var sink metrics.Sink
+	switch cfg.MetricsPush {
+	case "":
+	case metrics.PushRedis:
+		if cfg.StorageBackend != storage.BackendRedis {
+			logger.LogError("Server failed to start: METRICS_PUSH=redis requires STORAGE_BACKEND=redis")
+			os.Exit(1)
+		}
+		sink = metrics.NewStoreSink(store, cfg.MetricsPushInterval)
+	case metrics.PushStatsD:
+		if cfg.MetricsStatsDAddr == "" {
+			logger.LogError("Server failed to start: METRICS_PUSH=statsd requires METRICS_STATSD_ADDR")
+			os.Exit(1)
+		}
+		if sink, err = metrics.NewStatsDSink(cfg.MetricsStatsDAddr); err != nil {
+			logger.LogError("Server failed to start:", err)
+			os.Exit(1)
+		}
+	default:
+		logger.LogError(fmt.Sprintf("Server failed to start: unknown METRICS_PUSH %q, use redis or statsd", cfg.MetricsPush))
+		os.Exit(1)
+	}
+	if sink != nil && cfg.MetricsPushInterval > 0 {
+		pusher := metrics.NewPusher(sink, cfg.MetricsPushInterval)
+		pusher.Start()
+		defer pusher.Stop()
+		logger.LogInfo(fmt.Sprintf("Pushing metrics to %s every %v", cfg.MetricsPush, cfg.MetricsPushInterval))
+	}
+
+	// Trace export to an OpenTelemetry collector
+	if cfg.OTLPEndpoint != "" {
+		tracing.GetGlobalTracer().Enable(tracing.NewExporter(cfg.OTLPEndpoint, cfg.OTLPHeaders, cfg.OTelServiceName))
+		defer tracing.GetGlobalTracer().Stop()
+		logger.LogInfo("Exporting traces to " + cfg.OTLPEndpoint)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
+	if err := cfg.ValidateProfiles(); err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
+	if len(cfg.Profiles) > 0 {
+		logger.LogInfo("Serving upstream profiles " + strings.Join(cfg.Profiles, ", "))
+	}
+
+	// Shared upstream client, optionally kept warm
+	upstreams := upstream.NewUpstreams(cfg.UpstreamURLBases, cfg.UpstreamBreakerThreshold, cfg.UpstreamBreakerCooldown)
+	upstreamClient, err := upstream.NewClientWithUpstreams(cfg, upstreams)
+	if err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
+	if cfg.UpstreamHealthInterval > 0 {
+		upstreams.StartProbes(upstreamClient, cfg.UpstreamHealthInterval)
+		defer upstreams.Stop()
+	}
+	var warmer *upstream.Warmer
+	if cfg.WarmupConnections > 0 {
+		warmer = upstream.NewWarmer(upstreamClient, cfg.UpstreamURLBase, cfg.WarmupConnections, cfg.WarmupInterval)
+		warmer.Start()
+		defer warmer.Stop()
+	}
+
+	// Secrets read from files are re-read periodically so rotation needs no restart
+	adminToken := secrets.NewValue(cfg.AdminToken)
+	if cfg.AdminTokenFile != "" && cfg.SecretRefreshInterval > 0 {
+		watcher := secrets.NewWatcher(cfg.AdminTokenFile, cfg.SecretRefreshInterval, adminToken.Set)
+		watcher.Start()
+		defer watcher.Stop()
+	}
+
+	// Settings read per request can be reloaded with SIGHUP or the admin API
+	live := config.NewLive(cfg)
+
+	// Proxy-owned API keys for requests that bring none of their own
+	handlerOptions := []antiblock.Option{antiblock.WithClient(upstreamClient), antiblock.WithLiveConfig(live)}
+	if cfg.UpstreamMode != upstream.UpstreamModeVertex {
+		handlerOptions = append(handlerOptions, antiblock.WithUpstreams(upstreams))
+	}
+	var keyPool *upstream.KeyPool
+	if len(cfg.UpstreamAPIKeys) > 0 || cfg.UpstreamAPIKeysFile != "" {
+		keyPool = upstream.NewKeyPool(cfg.UpstreamAPIKeys, cfg.KeyCooldown)
+		handlerOptions = append(handlerOptions, antiblock.WithKeyPool(keyPool))
+		if cfg.UpstreamAPIKeysFile != "" && cfg.SecretRefreshInterval > 0 {
+			watcher := secrets.NewWatcher(cfg.UpstreamAPIKeysFile, cfg.SecretRefreshInterval, func(content string) {
+				keyPool.SetKeys(secrets.SplitList(content))
+			})
+			watcher.Start()
+			defer watcher.Stop()
+		}
+	}
+
+	// Proxy-issued client keys and the upstream keys serving them
+	var keyMap *upstream.KeyMap
+	if len(cfg.ClientKeyMap) > 0 || cfg.ClientKeyMapFile != "" {
+		keyMap = upstream.NewKeyMap(cfg.ClientKeyMap, cfg.KeyCooldown)
+		handlerOptions = append(handlerOptions, antiblock.WithKeyMap(keyMap))
+		if cfg.ClientKeyMapFile != "" && cfg.SecretRefreshInterval > 0 {
+			watcher := secrets.NewWatcher(cfg.ClientKeyMapFile, cfg.SecretRefreshInterval, func(content string) {
+				keyMap.Set(secrets.SplitMap(content))
+			})
+			watcher.Start()
+			defer watcher.Stop()
+		}
+	}
+
+	// Model capabilities for per-model defaults; listing models needs a proxy-owned key
+	if keyPool != nil {
+		fetcher := modelinfo.NewFetcher(upstreamClient, cfg.UpstreamURLBase, keyPool.Acquire, cfg.ModelCatalogRefresh, modelinfo.GetGlobalCatalog())
+		fetcher.Start()
+		defer fetcher.Stop()
+	} else {
+		logger.LogInfo("No upstream API keys configured, model catalog disabled")
+	}
+
+	reload := func() (config.Changes, error) {
+		return reloadConfig(live, adminToken, keyPool, keyMap)
+	}
+	go func() {
+		for range server.NotifyReload() {
+			logger.LogInfo("Reload requested")
+			if _, err := reload(); err != nil {
+				logger.LogError("Configuration reload failed:", err)
+			}
+		}
+	}()
 
 	// Create proxy handler
-	proxyHandler := handlers.NewProxyHandler(cfg)
+	proxyHandler, err := antiblock.NewHandler(cfg, handlerOptions...)
+	if err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
 
 	// Set up routes
 	router := mux.NewRouter()
 
+	// Management endpoints, optionally moved under a prefix so they cannot shadow upstream API paths
+	mgmt := cfg.ManagementPrefix
+	manage := func(path string, handler http.Handler) {
+		router.Handle(mgmt+path, handler).Methods("GET", "HEAD")
+		router.Handle(mgmt+path, handlers.Options("GET", "HEAD")).Methods("OPTIONS")
+	}
+
 	// Health check endpoint
-	router.HandleFunc("/health", handlers.HealthHandler).Methods("GET")
-	router.HandleFunc("/healthz", handlers.HealthHandler).Methods("GET")
+	healthChecker := handlers.NewHealthChecker(cfg, warmer)
+	healthChecker.Token = adminToken
+	healthChecker.Live = live
+	healthChecker.Upstreams = upstreams
+	if cfg.MetricsPush == metrics.PushRedis {
+		healthChecker.Shared = store
+	}
+	manage("/health", handlers.NoStore(http.HandlerFunc(healthChecker.HealthHandler)))
+	manage("/healthz", handlers.NoStore(http.HandlerFunc(healthChecker.HealthHandler)))
+	manage("/version", handlers.MaxAge(time.Minute, http.HandlerFunc(handlers.VersionHandler)))
+	manage("/stats", handlers.NoStore(http.HandlerFunc(healthChecker.StatsHandler)))
+	manage("/stats/shared", handlers.NoStore(http.HandlerFunc(healthChecker.SharedStatsHandler)))
+
+	// Standard expvar endpoint for Go-ecosystem scrapers
+	if cfg.ExpvarEnabled {
+		metrics.PublishExpvar()
+		manage("/debug/vars", handlers.NoStore(expvar.Handler()))
+	}
+
+	// Prometheus scrape endpoint
+	if cfg.PrometheusEnabled {
+		manage("/metrics", handlers.NoStore(metrics.PrometheusHandler(usage.GetGlobalTracker().WritePrometheus)))
+	}
+
+	// Admin API, only available when an admin token is configured
+	if cfg.AdminToken != "" {
+		adminHandler := handlers.NewAdminHandler(cfg)
+		adminHandler.Reports = reporter
+		adminHandler.Token = adminToken
+		adminHandler.Live = live
+		adminHandler.Reload = reload
+		adminHandler.Override = func(values map[string]string) (config.Changes, error) {
+			return overrideConfig(live, values)
+		}
+		router.Handle(mgmt+"/admin/config", handlers.NoStore(adminHandler.Authorize(adminHandler.ConfigHandler))).Methods("GET", "HEAD")
+		router.Handle(mgmt+"/admin/config", handlers.NoStore(adminHandler.Authorize(adminHandler.UpdateConfigHandler))).Methods("PATCH")
+		router.Handle(mgmt+"/admin/config", handlers.Options("GET", "HEAD", "PATCH")).Methods("OPTIONS")
+		router.Handle(mgmt+"/admin/config/reload", handlers.NoStore(adminHandler.Authorize(adminHandler.ReloadHandler))).Methods("POST")
+		router.Handle(mgmt+"/admin/config/reload", handlers.Options("POST")).Methods("OPTIONS")
+		manage("/admin/sessions", handlers.NoStore(adminHandler.Authorize(adminHandler.SessionsHandler)))
+		manage("/admin/models/stats", handlers.NoStore(adminHandler.Authorize(adminHandler.ModelStatsHandler)))
+		manage("/admin/usage", handlers.NoStore(adminHandler.Authorize(adminHandler.UsageHandler)))
+		manage("/admin/tenants/{id}/stats", handlers.NoStore(adminHandler.Authorize(adminHandler.TenantStatsHandler)))
+		manage("/admin/models/capabilities", handlers.NoStore(adminHandler.Authorize(adminHandler.ModelCapabilitiesHandler)))
+		manage("/admin/abuse", handlers.NoStore(adminHandler.Authorize(adminHandler.AbuseHandler)))
+		manage("/admin/reports/daily", handlers.NoStore(adminHandler.Authorize(adminHandler.DailyReportHandler)))
+	} else {
+		logger.LogInfo("ADMIN_TOKEN not set, admin API disabled")
+	}
 
 	// Handle all requests with the proxy handler
 	router.PathPrefix("/").Handler(proxyHandler)
 
-	// Start server
-	logger.LogInfo(fmt.Sprintf("Starting server on port %s", cfg.Port))
+	// Start server, reusing the listener handed over by a previous process during an upgrade
+	listener, err := server.Listen(":" + cfg.Port)
+	if err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: router}
+	scheme := "http"
+	selfCheckClient := &http.Client{Timeout: 5 * time.Second}
+	// The self-check connects to the local address, so it skips certificate verification
+	selfCheckTLS := &tls.Config{InsecureSkipVerify: true}
+
+	switch {
+	case len(cfg.TLSDomains) > 0:
+		// Certificates obtained and renewed automatically for a public deployment
+		certManager := server.NewAutocert(cfg.TLSDomains, cfg.ACMECacheDir, cfg.ACMEEmail, cfg.ACMEDirectoryURL)
+		srv.TLSConfig = certManager.TLSConfig()
+		if cfg.ACMEHTTPPort != "" {
+			challenges := server.StartChallengeServer(":"+cfg.ACMEHTTPPort, certManager)
+			defer challenges.Stop()
+		}
+		selfCheckTLS.ServerName = cfg.TLSDomains[0]
+		logger.LogInfo(fmt.Sprintf("Serving HTTPS with ACME certificates for %s", strings.Join(cfg.TLSDomains, ", ")))
+	case cfg.TLSCertFile != "":
+		srv.TLSConfig, err = server.LoadCertificate(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			logger.LogError("Server failed to start:", err)
+			os.Exit(1)
+		}
+		logger.LogInfo("Serving HTTPS with certificate " + cfg.TLSCertFile)
+	}
+
+	// Mutual TLS: only clients holding a certificate from the configured CAs may connect
+	if cfg.TLSClientCAFile != "" {
+		if srv.TLSConfig == nil {
+			logger.LogError("Server failed to start: TLS_CLIENT_CA_FILE requires TLS_DOMAINS or TLS_CERT_FILE")
+			os.Exit(1)
+		}
+		selfCert, err := server.RequireClientCerts(srv.TLSConfig, cfg.TLSClientCAFile)
+		if err != nil {
+			logger.LogError("Server failed to start:", err)
+			os.Exit(1)
+		}
+		selfCheckTLS.Certificates = []tls.Certificate{selfCert}
+		logger.LogInfo("Requiring client certificates issued by " + cfg.TLSClientCAFile)
+	}
+	if srv.TLSConfig != nil {
+		scheme = "https"
+		selfCheckClient.Transport = &http.Transport{TLSClientConfig: selfCheckTLS}
+	}
+
+	// systemd watchdog pings only while the server still answers its own health check
+	selfCheckURL := scheme + "://" + localAddr(listener) + mgmt + "/healthz"
+	watchdog := server.StartWatchdog(func() error {
+		return selfCheck(selfCheckClient, selfCheckURL)
+	})
+
+	// SIGUSR2 starts a new binary on the same socket, then this process drains and exits.
+	// A stop request (SIGTERM, Ctrl+C or the Windows service manager) drains and exits as well.
+	drained := make(chan struct{})
+	go func() {
+		upgrades := server.NotifyUpgrade()
+		stop := server.NotifyStop()
+		for {
+			select {
+			case <-upgrades:
+				logger.LogInfo("Upgrade requested, starting new process")
+				if err := server.Upgrade(listener, cfg.UpgradeReadyTimeout); err != nil {
+					logger.LogError("Upgrade failed, continuing to serve:", err)
+					continue
+				}
+
+				// The new process is now the main PID as far as systemd is concerned
+				watchdog.Stop()
+				server.Notify("STATUS=Draining after upgrade")
+				logger.LogInfo("New process is serving")
+			case <-stop:
+				logger.LogInfo("Stop requested")
+				watchdog.Stop()
+				server.NotifyStopping()
+			}
+
+			drain(srv, cfg.DrainTimeout)
+			close(drained)
+			return
+		}
+	}()
+
+	inherited := server.Inherited()
+	if inherited {
+		logger.LogInfo(fmt.Sprintf("Took over listener on port %s from previous process", cfg.Port))
+	} else {
+		logger.LogInfo(fmt.Sprintf("Starting server on port %s", cfg.Port))
+	}
 	logger.LogInfo("Server ready to accept requests")
+	server.NotifyReady()
+	server.NotifyServing(inherited)
 
-	if err := http.ListenAndServe(":"+cfg.Port, router); err != nil {
-		logger.LogError("Server failed to start:", err)
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		logger.LogError("Server failed:", err)
 		os.Exit(1)
 	}
+	<-drained
+	// Save what was recorded since the last periodic save
+	if cfg.ModelStatsFile != "" {
+		if err := modelstats.GetGlobalStore().Save(cfg.ModelStatsFile); err != nil {
+			logger.LogError("Failed to persist model stats:", err)
+		}
+	} else if cfg.StorageBackend != storage.BackendMemory {
+		if err := modelstats.GetGlobalStore().SaveToStore(store); err != nil {
+			logger.LogError("Failed to persist model stats:", err)
+		}
+	}
+	if cfg.StorageBackend != storage.BackendMemory {
+		if err := usage.GetGlobalTracker().SaveToStore(store); err != nil {
+			logger.LogError("Failed to persist usage:", err)
+		}
+	}
+	logger.LogInfo("Drain complete, exiting")
+	server.Stopped()
+}
+
+// runMockServer serves a mock Gemini API following a script of failures
+func runMockServer(args []string) error {
+	flags := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8090", "address to listen on")
+	script := flags.String("script", "ok", "comma-separated behaviors, one per generation request; the last one repeats")
+	chunks := flags.Int("chunks", 5, "text chunks in a complete answer")
+	delay := flags.Duration("delay", 50*time.Millisecond, "pause before each chunk")
+	doneToken := flags.String("done-token", "[done]", "token ending complete answers")
+	flags.Parse(args)
+
+	steps, err := mockserver.ParseScript(*script)
+	if err != nil {
+		return err
+	}
+	mock := mockserver.New(mockserver.Options{Script: steps, Chunks: *chunks, ChunkDelay: *delay, DoneToken: *doneToken})
+	log.Printf("Mock Gemini API listening on %s, script %v", *addr, steps)
+	return http.ListenAndServe(*addr, mock)
+}
+
+// setLogLevel applies LOG_LEVEL, or DEBUG_MODE when no level is set
+func setLogLevel(cfg *config.Config) {
+	if cfg.LogLevel == "" {
+		logger.SetDebugMode(cfg.DebugMode)
+		return
+	}
+	level, err := logger.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		logger.LogError("Invalid LOG_LEVEL, using info:", err)
+	}
+	logger.SetLevel(level)
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads the .env file, environment and secret files, and applies
+// the settings that can change while the proxy is running
+func reloadConfig(live *config.Live, adminToken *secrets.Value, keyPool *upstream.KeyPool, keyMap *upstream.KeyMap) (config.Changes, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := config.LoadEnvFile(envFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return config.Changes{}, err
+	}
+	fresh := config.LoadConfig()
+	if err := fresh.LoadSecretFiles(); err != nil {
+		return config.Changes{}, err
+	}
+	if err := fresh.Validate(); err != nil {
+		return config.Changes{}, err
+	}
+
+	merged, changes := live.Get().Merge(fresh)
+	if keyPool == nil {
+		// Without a pool at startup, requests are not routed through one
+		changes = requireRestart(changes, "UPSTREAM_API_KEYS")
+	}
+	if keyMap == nil {
+		changes = requireRestart(changes, "CLIENT_KEY_MAP")
+	}
+	live.Set(merged)
+	setLogLevel(merged)
+	adminToken.Set(merged.AdminToken)
+	if keyPool != nil {
+		keyPool.SetKeys(merged.UpstreamAPIKeys)
+	}
+	if keyMap != nil {
+		keyMap.Set(merged.ClientKeyMap)
+	}
+
+	logger.LogInfo(fmt.Sprintf("Configuration reloaded. Applied: %v. Restart required: %v.", changes.Applied, changes.RestartRequired))
+	return changes, nil
+}
+
+// requireRestart moves key from the applied changes to those needing a restart
+func requireRestart(changes config.Changes, key string) config.Changes {
+	for i, applied := range changes.Applied {
+		if applied == key {
+			changes.Applied = append(changes.Applied[:i], changes.Applied[i+1:]...)
+			changes.RestartRequired = append(changes.RestartRequired, key)
+			break
+		}
+	}
+	return changes
+}
+
+// overrideConfig changes settings through the admin API. The change lasts until
+// the next reload, which takes the values from the environment again.
+func overrideConfig(live *config.Live, values map[string]string) (config.Changes, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if level, ok := values["LOG_LEVEL"]; ok && level != "" {
+		if _, err := logger.ParseLevel(level); err != nil {
+			return config.Changes{}, err
+		}
+	}
+	merged, changes, err := live.Get().Override(values)
+	if err != nil {
+		return config.Changes{}, err
+	}
+	live.Set(merged)
+	setLogLevel(merged)
+
+	logger.LogInfo(fmt.Sprintf("Configuration changed through the admin API: %v", changes.Applied))
+	return changes, nil
+}
+
+// drain stops accepting connections and waits for active sessions to finish, up to timeout
+func drain(srv *http.Server, timeout time.Duration) {
+	logger.LogInfo(fmt.Sprintf("Draining active sessions (timeout %v)", timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.LogError("Drain did not complete:", err)
+	}
+}
+
+// localAddr returns a loopback address for the listener's port
+func localAddr(ln net.Listener) string {
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return ln.Addr().String()
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// selfCheck requests the health endpoint through the real listener
+func selfCheck(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
 }
@@ -0,0 +1,11 @@
+package metrics
+
+import "expvar"
+
+// PublishExpvar exposes the global metrics snapshot under the "antiblock" expvar.
+// It must be called at most once.
+func PublishExpvar() {
+	expvar.Publish("antiblock", expvar.Func(func() interface{} {
+		return GetGlobalMetrics().GetSnapshot()
+	}))
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// histogramBase is the upper bound of the first bucket
+	histogramBase = time.Millisecond
+	// histogramGrowth is the ratio between the bounds of neighbouring buckets,
+	// bounding the error of an estimated percentile to about 5%
+	histogramGrowth = 1.1
+	// histogramBuckets reaches about eight hours; longer durations land in the last bucket
+	histogramBuckets = 180
+)
+
+// LatencyPercentiles summarizes a distribution of durations
+type LatencyPercentiles struct {
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+}
+
+// histogram counts durations in exponentially growing buckets, so
+// percentiles keep the same relative precision from milliseconds to hours in
+// a fixed amount of memory
+type histogram struct {
+	counts [histogramBuckets]int64
+	count  int64
+	sum    time.Duration
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[histogramBucket(d)]++
+	h.count++
+	h.sum += d
+}
+
+// mean returns the exact average of the recorded durations
+func (h *histogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// quantile estimates the duration below which a fraction q of the recorded
+// durations fall, interpolating within the bucket it lands in
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var seen float64
+	for i, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		if seen+float64(count) >= rank {
+			lower := time.Duration(0)
+			if i > 0 {
+				lower = histogramBound(i - 1)
+			}
+			fraction := (rank - seen) / float64(count)
+			return lower + time.Duration(float64(histogramBound(i)-lower)*fraction)
+		}
+		seen += float64(count)
+	}
+	return histogramBound(histogramBuckets - 1)
+}
+
+func (h *histogram) percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		Count: h.count,
+		Sum:   h.sum,
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+	}
+}
+
+// histogramBucket returns the first bucket whose bound is at least d
+func histogramBucket(d time.Duration) int {
+	if d <= histogramBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramBase)) / math.Log(histogramGrowth)))
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// histogramBound returns the upper bound of bucket i
+func histogramBound(i int) time.Duration {
+	return time.Duration(float64(histogramBase) * math.Pow(histogramGrowth, float64(i)))
+}
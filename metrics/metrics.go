@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics collects proxy-wide counters and timings
+type Metrics struct {
+	mu sync.RWMutex
+
+	startTime           time.Time
+	totalRequests       int64
+	streamingRequests   int64
+	successfulSessions  int64
+	failedSessions      int64
+	activeSessions      int64
+	clientWriteFailures int64
+	totalRetries        int64
+	recentRetries       []time.Time
+	interruptions       map[string]int64
+	networkErrors       map[string]int64
+	rejections          map[string]int64
+	responseTimes       histogram
+	streamDurations     histogram
+	outcomes            sloRing
+}
+
+// MetricsSnapshot is a point-in-time copy of the collected metrics
+type MetricsSnapshot struct {
+	Uptime              time.Duration    `json:"uptime"`
+	TotalRequests       int64            `json:"total_requests"`
+	StreamingRequests   int64            `json:"streaming_requests"`
+	SuccessfulSessions  int64            `json:"successful_sessions"`
+	FailedSessions      int64            `json:"failed_sessions"`
+	ActiveSessions      int64            `json:"active_sessions"`
+	ClientWriteFailures int64            `json:"client_write_failures"`
+	TotalRetries        int64            `json:"total_retries"`
+	Interruptions       map[string]int64 `json:"interruptions"`
+	NetworkErrors       map[string]int64 `json:"network_errors"`
+	Rejections          map[string]int64 `json:"rejections"`
+	AverageResponseTime time.Duration    `json:"average_response_time"`
+	// ResponseTime is the distribution of the time to the upstream response headers
+	ResponseTime LatencyPercentiles `json:"response_time"`
+	// StreamDuration is the distribution of the duration of finished streaming sessions
+	StreamDuration LatencyPercentiles `json:"stream_duration"`
+
+	// Intervention holds the rolling intervention rate keyed by window ("5m", "1h", "24h")
+	Intervention map[string]InterventionRate `json:"intervention"`
+}
+
+var (
+	globalMetrics *Metrics
+	once          sync.Once
+)
+
+// GetGlobalMetrics returns the process-wide metrics instance
+func GetGlobalMetrics() *Metrics {
+	once.Do(func() {
+		globalMetrics = NewMetrics()
+	})
+	return globalMetrics
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		startTime:     time.Now(),
+		interruptions: make(map[string]int64),
+		networkErrors: make(map[string]int64),
+		rejections:    make(map[string]int64),
+	}
+}
+
+// RecordRequest counts an incoming proxy request
+func (m *Metrics) RecordRequest(streaming bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totalRequests++
+	if streaming {
+		m.streamingRequests++
+	}
+}
+
+// retryWindow is the period over which recent retries are counted
+const retryWindow = time.Minute
+
+// RecordSessionStart counts a streaming session that is now in progress
+func (m *Metrics) RecordSessionStart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeSessions++
+}
+
+// RecordSession counts a finished streaming session, the retries it needed and how long it took
+func (m *Metrics) RecordSession(success bool, retries int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activeSessions > 0 {
+		m.activeSessions--
+	}
+	if success {
+		m.successfulSessions++
+	} else {
+		m.failedSessions++
+	}
+	m.outcomes.record(time.Now(), success, retries)
+	m.streamDurations.record(duration)
+}
+
+// RecordSessionEnd ends a streaming session that never reached upstream, without counting an outcome
+func (m *Metrics) RecordSessionEnd() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activeSessions > 0 {
+		m.activeSessions--
+	}
+}
+
+// RecordClientWriteFailure counts a streaming session that ended because the client could not be written to
+func (m *Metrics) RecordClientWriteFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activeSessions > 0 {
+		m.activeSessions--
+	}
+	m.clientWriteFailures++
+}
+
+// RecordRetry counts a retry attempt
+func (m *Metrics) RecordRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totalRetries++
+	now := time.Now()
+	m.recentRetries = append(pruneBefore(m.recentRetries, now.Add(-retryWindow)), now)
+}
+
+// RecentRetries returns the number of retries in the last minute
+func (m *Metrics) RecentRetries() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recentRetries = pruneBefore(m.recentRetries, time.Now().Add(-retryWindow))
+	return len(m.recentRetries)
+}
+
+// RecordInterruption counts a stream interruption by reason
+func (m *Metrics) RecordInterruption(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.interruptions[reason]++
+}
+
+// RecordNetworkError counts an upstream network error by class
+func (m *Metrics) RecordNetworkError(class string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.networkErrors[class]++
+}
+
+// RecordRejection counts a request refused by a rate limit or quota, by the reason returned to the client
+func (m *Metrics) RecordRejection(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejections[reason]++
+}
+
+// RecordResponseTime records the time an upstream request took to return its response headers
+func (m *Metrics) RecordResponseTime(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responseTimes.record(d)
+}
+
+// GetSnapshot returns a copy of the current metrics
+func (m *Metrics) GetSnapshot() MetricsSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return MetricsSnapshot{
+		Uptime:              time.Since(m.startTime),
+		TotalRequests:       m.totalRequests,
+		StreamingRequests:   m.streamingRequests,
+		SuccessfulSessions:  m.successfulSessions,
+		FailedSessions:      m.failedSessions,
+		ActiveSessions:      m.activeSessions,
+		ClientWriteFailures: m.clientWriteFailures,
+		TotalRetries:        m.totalRetries,
+		Interruptions:       copyCounts(m.interruptions),
+		NetworkErrors:       copyCounts(m.networkErrors),
+		Rejections:          copyCounts(m.rejections),
+		AverageResponseTime: m.responseTimes.mean(),
+		ResponseTime:        m.responseTimes.percentiles(),
+		StreamDuration:      m.streamDurations.percentiles(),
+		Intervention:        m.interventionRatesLocked(time.Now()),
+	}
+}
+
+func copyCounts(src map[string]int64) map[string]int64 {
+	dst := make(map[string]int64, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// pruneBefore drops timestamps older than cutoff from a time-ordered slice
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
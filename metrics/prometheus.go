@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const prometheusNamespace = "gemini_antiblock"
+
+// PrometheusHandler serves the global metrics in the Prometheus text
+// exposition format, followed by the output of each extra writer
+func PrometheusHandler(extra ...func(io.Writer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, GetGlobalMetrics().GetSnapshot())
+		for _, write := range extra {
+			write(w)
+		}
+	})
+}
+
+// WritePrometheus writes a snapshot in the Prometheus text exposition format
+func WritePrometheus(w io.Writer, s MetricsSnapshot) {
+	writeMetric(w, "uptime_seconds", "gauge", "Seconds since the proxy started.", s.Uptime.Seconds())
+	writeMetric(w, "requests_total", "counter", "Proxy requests received.", s.TotalRequests)
+	writeMetric(w, "streaming_requests_total", "counter", "Streaming proxy requests received.", s.StreamingRequests)
+
+	writeHeader(w, "sessions_total", "counter", "Finished streaming sessions by outcome.")
+	writeSample(w, "sessions_total", `outcome="success"`, s.SuccessfulSessions)
+	writeSample(w, "sessions_total", `outcome="failed"`, s.FailedSessions)
+	writeSample(w, "sessions_total", `outcome="client_gone"`, s.ClientWriteFailures)
+
+	writeMetric(w, "active_sessions", "gauge", "Streaming sessions in progress.", s.ActiveSessions)
+	writeMetric(w, "retries_total", "counter", "Upstream retry attempts.", s.TotalRetries)
+	writeLabeled(w, "interruptions_total", "Stream interruptions by reason.", "reason", s.Interruptions)
+	writeLabeled(w, "network_errors_total", "Upstream network errors by class.", "class", s.NetworkErrors)
+	writeLabeled(w, "rejections_total", "Requests refused by a rate limit or quota, by reason.", "reason", s.Rejections)
+	writeMetric(w, "upstream_response_time_seconds", "gauge", "Average time to the upstream response headers.", s.AverageResponseTime.Seconds())
+	writeSummary(w, "time_to_first_byte_seconds", "Time to the upstream response headers.", s.ResponseTime)
+	writeSummary(w, "stream_duration_seconds", "Duration of finished streaming sessions.", s.StreamDuration)
+	writeIntervention(w, s.Intervention)
+}
+
+// writeIntervention writes the rolling intervention rate as ratios per window and outcome
+func writeIntervention(w io.Writer, rates map[string]InterventionRate) {
+	writeHeader(w, "window_sessions", "gauge", "Finished streaming sessions in the rolling window.")
+	for _, window := range sloWindows {
+		writeSample(w, "window_sessions", fmt.Sprintf(`window="%s"`, window.name), rates[window.name].Sessions)
+	}
+	writeHeader(w, "session_outcome_ratio", "gauge", "Share of sessions in the rolling window that finished without retry (clean), after retries (recovered) or failed.")
+	for _, window := range sloWindows {
+		rate := rates[window.name]
+		for _, outcome := range []struct {
+			name string
+			pct  float64
+		}{
+			{outcomeClean, rate.CleanPct},
+			{outcomeRecovered, rate.RecoveredPct},
+			{outcomeFailed, rate.FailedPct},
+		} {
+			writeSample(w, "session_outcome_ratio", fmt.Sprintf(`window="%s",outcome="%s"`, window.name, outcome.name), outcome.pct/100)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", prometheusNamespace, name, help, prometheusNamespace, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, value interface{}) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_%s%s %v\n", prometheusNamespace, name, labels, value)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	writeHeader(w, name, kind, help)
+	writeSample(w, name, "", value)
+}
+
+// writeSummary writes a latency distribution as a summary with its P50, P95 and P99
+func writeSummary(w io.Writer, name, help string, p LatencyPercentiles) {
+	writeHeader(w, name, "summary", help)
+	for _, quantile := range []struct {
+		q     string
+		value float64
+	}{
+		{"0.5", p.P50.Seconds()},
+		{"0.95", p.P95.Seconds()},
+		{"0.99", p.P99.Seconds()},
+	} {
+		writeSample(w, name, fmt.Sprintf(`quantile="%s"`, quantile.q), quantile.value)
+	}
+	writeSample(w, name+"_sum", "", p.Sum.Seconds())
+	writeSample(w, name+"_count", "", p.Count)
+}
+
+// WriteLabeledCounter writes a counter kept outside this package with one
+// sample per map key, in a stable order
+func WriteLabeledCounter(w io.Writer, name, help, label string, counts map[string]int64) {
+	writeLabeled(w, name, help, label, counts)
+}
+
+// writeLabeled writes a counter with one sample per map key, in a stable order
+func writeLabeled(w io.Writer, name, help, label string, counts map[string]int64) {
+	writeHeader(w, name, "counter", help)
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeSample(w, name, fmt.Sprintf(`%s="%s"`, label, escapeLabel(key)), counts[key])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
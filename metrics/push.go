@@ -0,0 +1,321 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/storage"
+)
+
+// Push targets for sharing metrics across replicas
+const (
+	PushRedis  = "redis"
+	PushStatsD = "statsd"
+)
+
+const (
+	// sharedKeyPrefix prefixes the combined counters in the metrics bucket
+	sharedKeyPrefix = "shared:"
+	// instanceKeyPrefix prefixes the gauges each replica reports in the metrics bucket
+	instanceKeyPrefix = "instance:"
+	// pushTimeout bounds a single push
+	pushTimeout = 5 * time.Second
+	// statsdPacketSize keeps StatsD packets within a typical MTU
+	statsdPacketSize = 1432
+)
+
+// Sink receives the metrics of one replica at every push: how much each
+// counter grew since the previous push, and the current value of each gauge.
+// If Push fails, it removes the increments it did deliver from counters, so
+// they are not sent again.
+type Sink interface {
+	Push(ctx context.Context, counters, gauges map[string]int64) error
+	// Retire withdraws the replica's gauges when it shuts down
+	Retire(ctx context.Context, gauges map[string]int64) error
+}
+
+// Pusher periodically pushes the global metrics to a sink, so the replicas of
+// a horizontally scaled deployment add up to one combined view
+type Pusher struct {
+	sink     Sink
+	interval time.Duration
+	last     map[string]int64
+	gauges   map[string]int64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewPusher creates a pusher sending the global metrics to sink every interval
+func NewPusher(sink Sink, interval time.Duration) *Pusher {
+	return &Pusher{
+		sink:     sink,
+		interval: interval,
+		last:     make(map[string]int64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins pushing in the background
+func (p *Pusher) Start() {
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.push()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop pushes what was counted since the last push and withdraws this replica's gauges
+func (p *Pusher) Stop() {
+	close(p.stop)
+	<-p.done
+	p.push()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	if err := p.sink.Retire(ctx, p.gauges); err != nil {
+		logger.LogWarn("Failed to withdraw shared metrics:", err)
+	}
+}
+
+// push sends the counter increments since the last successful push; after a
+// failure they are sent with the next one
+func (p *Pusher) push() {
+	counters, gauges := flatten(GetGlobalMetrics().GetSnapshot())
+	deltas := make(map[string]int64)
+	for name, value := range counters {
+		if delta := value - p.last[name]; delta != 0 {
+			deltas[name] = delta
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	if err := p.sink.Push(ctx, deltas, gauges); err != nil {
+		logger.LogWarn("Failed to push shared metrics:", err)
+		for name, value := range counters {
+			if _, pending := deltas[name]; !pending {
+				p.last[name] = value
+			}
+		}
+		return
+	}
+	p.last = counters
+	p.gauges = gauges
+}
+
+// flatten lists the counters and gauges of a snapshot under their Prometheus
+// names, labelled counters as name.label
+func flatten(s MetricsSnapshot) (counters, gauges map[string]int64) {
+	counters = map[string]int64{
+		"requests_total":             s.TotalRequests,
+		"streaming_requests_total":   s.StreamingRequests,
+		"sessions_total.success":     s.SuccessfulSessions,
+		"sessions_total.failed":      s.FailedSessions,
+		"sessions_total.client_gone": s.ClientWriteFailures,
+		"retries_total":              s.TotalRetries,
+	}
+	for _, labelled := range []struct {
+		name   string
+		counts map[string]int64
+	}{
+		{"interruptions_total", s.Interruptions},
+		{"network_errors_total", s.NetworkErrors},
+		{"rejections_total", s.Rejections},
+	} {
+		for label, count := range labelled.counts {
+			counters[labelled.name+"."+label] = count
+		}
+	}
+	gauges = map[string]int64{"active_sessions": s.ActiveSessions}
+	return counters, gauges
+}
+
+// StoreSink adds the counters of every replica up in shared storage, normally
+// Redis. Each replica also stores its gauges under its own name, expiring
+// unless refreshed, so replicas that die without retiring drop out.
+type StoreSink struct {
+	store    storage.Store
+	instance string
+	ttl      time.Duration
+}
+
+// NewStoreSink creates a sink over store for a replica pushing every interval
+func NewStoreSink(store storage.Store, interval time.Duration) *StoreSink {
+	host, _ := os.Hostname()
+	return &StoreSink{
+		store:    store,
+		instance: fmt.Sprintf("%s-%d", host, os.Getpid()),
+		ttl:      3 * interval,
+	}
+}
+
+// Push adds the counter increments to the shared counters and refreshes this replica's gauges
+func (s *StoreSink) Push(ctx context.Context, counters, gauges map[string]int64) error {
+	for name, delta := range counters {
+		if _, err := s.store.Incr(ctx, storage.BucketMetrics, sharedKeyPrefix+name, delta, 0); err != nil {
+			return err
+		}
+		// Once added, an increment must not be added again after a later failure
+		delete(counters, name)
+	}
+	for name, value := range gauges {
+		key := instanceKeyPrefix + s.instance + ":" + name
+		if err := s.store.Put(ctx, storage.BucketMetrics, key, []byte(strconv.FormatInt(value, 10)), s.ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retire removes this replica's gauges
+func (s *StoreSink) Retire(ctx context.Context, gauges map[string]int64) error {
+	for name := range gauges {
+		if err := s.store.Delete(ctx, storage.BucketMetrics, instanceKeyPrefix+s.instance+":"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SharedSnapshot is the combined view of every replica pushing to shared storage
+type SharedSnapshot struct {
+	// Instances is the number of replicas that pushed recently
+	Instances      int              `json:"instances"`
+	ActiveSessions int64            `json:"active_sessions"`
+	Counters       map[string]int64 `json:"counters"`
+}
+
+// LoadShared reads the combined metrics of every replica from store
+func LoadShared(ctx context.Context, store storage.Store) (SharedSnapshot, error) {
+	keys, err := store.Keys(ctx, storage.BucketMetrics)
+	if err != nil {
+		return SharedSnapshot{}, err
+	}
+	shared := SharedSnapshot{Counters: make(map[string]int64)}
+	instances := make(map[string]bool)
+	for _, key := range keys {
+		var instance, name string
+		switch {
+		case strings.HasPrefix(key, sharedKeyPrefix):
+			name = strings.TrimPrefix(key, sharedKeyPrefix)
+		case strings.HasPrefix(key, instanceKeyPrefix):
+			cut := strings.LastIndex(key, ":")
+			instance, name = key[len(instanceKeyPrefix):cut], key[cut+1:]
+		default:
+			continue
+		}
+		data, err := store.Get(ctx, storage.BucketMetrics, key)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return SharedSnapshot{}, err
+		}
+		value, _ := strconv.ParseInt(string(data), 10, 64)
+		if instance == "" {
+			shared.Counters[name] = value
+			continue
+		}
+		instances[instance] = true
+		if name == "active_sessions" {
+			shared.ActiveSessions += value
+		}
+	}
+	shared.Instances = len(instances)
+	return shared, nil
+}
+
+// StatsDSink sends the metrics to a StatsD server over UDP, which adds up the
+// counters of every replica. The active session gauge is sent as signed
+// changes, so the replicas' sessions add up as well.
+type StatsDSink struct {
+	conn   net.Conn
+	prefix string
+	// sent is what this replica has added to each gauge so far
+	sent map[string]int64
+}
+
+// NewStatsDSink creates a sink sending to the StatsD server at addr (host:port)
+func NewStatsDSink(addr string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid StatsD address: %w", err)
+	}
+	return &StatsDSink{conn: conn, prefix: prometheusNamespace + ".", sent: make(map[string]int64)}, nil
+}
+
+// Push sends the counter increments, and the change in each gauge since the
+// last push. UDP does not report lost packets, so a push fails only if the
+// packets cannot be sent at all.
+func (s *StatsDSink) Push(ctx context.Context, counters, gauges map[string]int64) error {
+	var lines []string
+	for name, delta := range counters {
+		lines = append(lines, fmt.Sprintf("%s%s:%d|c", s.prefix, statsdName(name), delta))
+	}
+	for name, value := range gauges {
+		lines = append(lines, s.gaugeChange(name, value))
+	}
+	return s.send(lines)
+}
+
+// Retire takes this replica's share out of the gauges
+func (s *StatsDSink) Retire(ctx context.Context, gauges map[string]int64) error {
+	var lines []string
+	for name := range gauges {
+		lines = append(lines, s.gaugeChange(name, 0))
+	}
+	return s.send(lines)
+}
+
+// gaugeChange returns the line moving a gauge by this replica's change since its last push
+func (s *StatsDSink) gaugeChange(name string, value int64) string {
+	delta := value - s.sent[name]
+	s.sent[name] = value
+	return fmt.Sprintf("%s%s:%+d|g", s.prefix, statsdName(name), delta)
+}
+
+// send writes lines in as few packets as fit
+func (s *StatsDSink) send(lines []string) error {
+	sort.Strings(lines)
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if _, err := s.conn.Write([]byte(packet.String())); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err := s.conn.Write([]byte(packet.String()))
+		return err
+	}
+	return nil
+}
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+
+// statsdName makes a metric name safe for the StatsD line protocol
+func statsdName(name string) string {
+	return statsdEscaper.Replace(name)
+}
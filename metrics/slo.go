@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"math"
+	"time"
+)
+
+// Session outcomes for the intervention rate: finished without a retry,
+// finished after retrying, or failed
+const (
+	outcomeClean     = "clean"
+	outcomeRecovered = "recovered"
+	outcomeFailed    = "failed"
+)
+
+// sloWindows are the rolling windows the intervention rate is reported over, in minutes
+var sloWindows = []struct {
+	name    string
+	minutes int64
+}{
+	{"5m", 5},
+	{"1h", 60},
+	{"24h", 24 * 60},
+}
+
+// sloBucketCount covers the longest window with one bucket per minute
+const sloBucketCount = 24 * 60
+
+type sloBucket struct {
+	minute    int64
+	clean     int64
+	recovered int64
+	failed    int64
+}
+
+// sloRing counts session outcomes per minute over the last 24 hours
+type sloRing [sloBucketCount]sloBucket
+
+func (r *sloRing) record(now time.Time, success bool, retries int) {
+	minute := now.Unix() / 60
+	b := &r[minute%sloBucketCount]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	switch {
+	case !success:
+		b.failed++
+	case retries > 0:
+		b.recovered++
+	default:
+		b.clean++
+	}
+}
+
+func (r *sloRing) sum(now time.Time, minutes int64) sloBucket {
+	var total sloBucket
+	current := now.Unix() / 60
+	for minute := current - minutes + 1; minute <= current; minute++ {
+		b := r[minute%sloBucketCount]
+		if b.minute != minute {
+			continue
+		}
+		total.clean += b.clean
+		total.recovered += b.recovered
+		total.failed += b.failed
+	}
+	return total
+}
+
+// InterventionRate splits the sessions of one window by how much the proxy had to step in.
+// Percentages are zero when the window has no sessions.
+type InterventionRate struct {
+	Sessions     int64   `json:"sessions"`
+	CleanPct     float64 `json:"clean_pct"`
+	RecoveredPct float64 `json:"recovered_pct"`
+	FailedPct    float64 `json:"failed_pct"`
+}
+
+func (b sloBucket) rate() InterventionRate {
+	sessions := b.clean + b.recovered + b.failed
+	if sessions == 0 {
+		return InterventionRate{}
+	}
+	pct := func(n int64) float64 {
+		return math.Round(float64(n)*10000/float64(sessions)) / 100
+	}
+	return InterventionRate{
+		Sessions:     sessions,
+		CleanPct:     pct(b.clean),
+		RecoveredPct: pct(b.recovered),
+		FailedPct:    pct(b.failed),
+	}
+}
+
+// InterventionRates returns the intervention rate for each rolling window, keyed by window name
+func (m *Metrics) InterventionRates() map[string]InterventionRate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.interventionRatesLocked(time.Now())
+}
+
+func (m *Metrics) interventionRatesLocked(now time.Time) map[string]InterventionRate {
+	rates := make(map[string]InterventionRate, len(sloWindows))
+	for _, window := range sloWindows {
+		rates[window.name] = m.outcomes.sum(now, window.minutes).rate()
+	}
+	return rates
+}
@@ -0,0 +1,393 @@
+// Package mockserver emulates the Gemini API with scriptable failures, so the
+// proxy's configuration can be checked and end-to-end tests written without
+// spending quota.
+package mockserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behavior kinds
+const (
+	// KindOK answers completely, ending with the done token and STOP
+	KindOK = "ok"
+	// KindDrop closes the connection after the chunks without a finish reason
+	KindDrop = "drop"
+	// KindBlock sends a promptFeedback blockReason after the chunks
+	KindBlock = "block"
+	// KindThoughtFinish sends a thought chunk carrying finishReason STOP after the chunks
+	KindThoughtFinish = "thought-finish"
+	// KindFinish ends with the given finish reason, such as SAFETY, after the chunks
+	KindFinish = "finish"
+	// KindIncomplete ends with STOP but without the done token
+	KindIncomplete = "incomplete"
+	// KindEmpty ends with STOP without any text
+	KindEmpty = "empty"
+	// KindHang stops sending after the chunks and keeps the connection open
+	KindHang = "hang"
+	// KindStatus answers with an error status instead of a stream
+	KindStatus = "status"
+)
+
+// Behavior is what the mock does for one generation request
+type Behavior struct {
+	Kind string
+	// After is the number of text chunks sent before the failure
+	After int
+	// Reason is the finish reason of KindFinish
+	Reason string
+	// Status is the HTTP status of KindStatus
+	Status int
+}
+
+// String formats b the way ParseBehavior reads it
+func (b Behavior) String() string {
+	switch b.Kind {
+	case KindOK, KindIncomplete, KindEmpty:
+		return b.Kind
+	case KindFinish:
+		return fmt.Sprintf("%s:%s:%d", b.Kind, b.Reason, b.After)
+	case KindStatus:
+		return fmt.Sprintf("%s:%d", b.Kind, b.Status)
+	default:
+		return fmt.Sprintf("%s:%d", b.Kind, b.After)
+	}
+}
+
+// ParseBehavior parses one step of a script:
+//
+//	ok | incomplete | empty | drop:N | block:N | thought-finish:N | hang:N | finish:REASON:N | status:CODE
+//
+// where N is the number of text chunks sent first, 1 if left out.
+func ParseBehavior(step string) (Behavior, error) {
+	fields := strings.Split(strings.TrimSpace(step), ":")
+	b := Behavior{Kind: strings.ToLower(fields[0]), After: 1}
+	args := fields[1:]
+
+	number := func(raw string) (int, error) {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("step %q: invalid number %q", step, raw)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch b.Kind {
+	case KindOK, KindIncomplete, KindEmpty:
+		if len(args) > 0 {
+			return b, fmt.Errorf("step %q takes no arguments", step)
+		}
+	case KindDrop, KindBlock, KindThoughtFinish, KindHang:
+		if len(args) > 1 {
+			return b, fmt.Errorf("step %q takes one argument", step)
+		}
+		if len(args) == 1 {
+			b.After, err = number(args[0])
+		}
+	case KindFinish:
+		if len(args) < 1 || len(args) > 2 || args[0] == "" {
+			return b, fmt.Errorf("step %q needs a finish reason", step)
+		}
+		b.Reason = strings.ToUpper(args[0])
+		if len(args) == 2 {
+			b.After, err = number(args[1])
+		}
+	case KindStatus:
+		if len(args) != 1 {
+			return b, fmt.Errorf("step %q needs a status code", step)
+		}
+		b.Status, err = number(args[0])
+		if err == nil && (b.Status < 400 || b.Status > 599) {
+			err = fmt.Errorf("step %q: status must be 4xx or 5xx", step)
+		}
+	default:
+		return b, fmt.Errorf("unknown step %q", step)
+	}
+	return b, err
+}
+
+// ParseScript parses comma-separated steps. The mock follows one step per
+// generation request and repeats the last step once the script is used up.
+func ParseScript(script string) ([]Behavior, error) {
+	var steps []Behavior
+	for _, step := range strings.Split(script, ",") {
+		if strings.TrimSpace(step) == "" {
+			continue
+		}
+		b, err := ParseBehavior(step)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, b)
+	}
+	if len(steps) == 0 {
+		steps = []Behavior{{Kind: KindOK}}
+	}
+	return steps, nil
+}
+
+// Options configure a Server
+type Options struct {
+	// Script is followed one step per generation request
+	Script []Behavior
+	// Chunks is the number of text chunks of a complete answer
+	Chunks int
+	// ChunkDelay is the pause before each chunk
+	ChunkDelay time.Duration
+	// DoneToken ends complete answers
+	DoneToken string
+}
+
+// BehaviorHeader selects the behavior of a single request, overriding the script
+const BehaviorHeader = "X-Mock-Behavior"
+
+// MaxEmbedBatch is the largest batchEmbedContents request the mock accepts, as upstream
+const MaxEmbedBatch = 100
+
+// Server is an http.Handler emulating generateContent, streamGenerateContent,
+// embedContent, batchEmbedContents, countTokens and the models list
+type Server struct {
+	opts Options
+
+	mu    sync.Mutex
+	calls int
+}
+
+// New creates a mock server
+func New(opts Options) *Server {
+	if len(opts.Script) == 0 {
+		opts.Script = []Behavior{{Kind: KindOK}}
+	}
+	if opts.Chunks <= 0 {
+		opts.Chunks = 5
+	}
+	if opts.DoneToken == "" {
+		opts.DoneToken = "[done]"
+	}
+	return &Server{opts: opts}
+}
+
+// next returns the behavior for the next generation request
+func (s *Server) next(r *http.Request) (Behavior, int, error) {
+	s.mu.Lock()
+	s.calls++
+	call := s.calls
+	s.mu.Unlock()
+
+	if override := r.Header.Get(BehaviorHeader); override != "" {
+		b, err := ParseBehavior(override)
+		return b, call, err
+	}
+	step := call - 1
+	if step >= len(s.opts.Script) {
+		step = len(s.opts.Script) - 1
+	}
+	return s.opts.Script[step], call, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models"):
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"models": []interface{}{
+				map[string]interface{}{
+					"name":                       "models/mock-model",
+					"inputTokenLimit":            1048576,
+					"outputTokenLimit":           65536,
+					"supportedGenerationMethods": []string{"generateContent", "streamGenerateContent"},
+				},
+			},
+		})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":streamGenerateContent"):
+		s.stream(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":generateContent"):
+		s.generate(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":countTokens"):
+		s.countTokens(w, r, body)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":embedContent"):
+		s.embed(w, r, body, false)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":batchEmbedContents"):
+		s.embed(w, r, body, true)
+	default:
+		writeError(w, http.StatusNotFound, "the mock server does not implement "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// stream answers streamGenerateContent following the script
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	b, call, err := s.next(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if b.Kind == KindStatus {
+		writeError(w, b.Status, fmt.Sprintf("mock status for request %d", call))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(event map[string]interface{}) bool {
+		if s.opts.ChunkDelay > 0 {
+			select {
+			case <-time.After(s.opts.ChunkDelay):
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "data: %s\r\n\r\n", data); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	chunks := b.After
+	if b.Kind == KindOK || b.Kind == KindIncomplete {
+		chunks = s.opts.Chunks
+	}
+	if b.Kind == KindEmpty {
+		chunks = 0
+	}
+	for i := 1; i <= chunks; i++ {
+		text := fmt.Sprintf("Chunk %d of request %d. ", i, call)
+		if !send(candidate(map[string]interface{}{"text": text}, "")) {
+			return
+		}
+	}
+
+	switch b.Kind {
+	case KindOK:
+		send(candidate(map[string]interface{}{"text": s.opts.DoneToken}, "STOP"))
+	case KindIncomplete:
+		send(candidate(map[string]interface{}{"text": "The end."}, "STOP"))
+	case KindEmpty:
+		send(candidate(map[string]interface{}{"text": ""}, "STOP"))
+	case KindBlock:
+		send(map[string]interface{}{"promptFeedback": map[string]interface{}{"blockReason": "OTHER"}})
+	case KindThoughtFinish:
+		send(candidate(map[string]interface{}{"text": "Thinking it over", "thought": true}, "STOP"))
+	case KindFinish:
+		send(candidate(map[string]interface{}{"text": ""}, b.Reason))
+	case KindHang:
+		<-r.Context().Done()
+	case KindDrop:
+		// Returning without a finish reason ends the stream early
+	}
+}
+
+// generate answers generateContent: complete unless the script asks for an error status
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+	b, call, err := s.next(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if b.Kind == KindStatus {
+		writeError(w, b.Status, fmt.Sprintf("mock status for request %d", call))
+		return
+	}
+	var text strings.Builder
+	for i := 1; i <= s.opts.Chunks; i++ {
+		fmt.Fprintf(&text, "Chunk %d of request %d. ", i, call)
+	}
+	text.WriteString(s.opts.DoneToken)
+	writeJSON(w, http.StatusOK, candidate(map[string]interface{}{"text": text.String()}, "STOP"))
+}
+
+// embed answers embedContent and batchEmbedContents with embeddings whose
+// values are the request number and the index within the batch; batches over
+// MaxEmbedBatch are rejected like upstream does
+func (s *Server) embed(w http.ResponseWriter, r *http.Request, body []byte, batch bool) {
+	b, call, err := s.next(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if b.Kind == KindStatus {
+		writeError(w, b.Status, fmt.Sprintf("mock status for request %d", call))
+		return
+	}
+	if !batch {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"embedding": map[string]interface{}{"values": []int{call, 0}},
+		})
+		return
+	}
+
+	var request struct {
+		Requests []json.RawMessage `json:"requests"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid batch: "+err.Error())
+		return
+	}
+	if len(request.Requests) > MaxEmbedBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d requests can be in one batch", MaxEmbedBatch))
+		return
+	}
+	embeddings := make([]interface{}, len(request.Requests))
+	for i := range embeddings {
+		embeddings[i] = map[string]interface{}{"values": []int{call, i}}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"embeddings": embeddings})
+}
+
+// countTokens answers countTokens with a quarter of the body size
+func (s *Server) countTokens(w http.ResponseWriter, r *http.Request, body []byte) {
+	b, call, err := s.next(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if b.Kind == KindStatus {
+		writeError(w, b.Status, fmt.Sprintf("mock status for request %d", call))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"totalTokens": len(body) / 4})
+}
+
+func candidate(part map[string]interface{}, finishReason string) map[string]interface{} {
+	c := map[string]interface{}{
+		"content": map[string]interface{}{"parts": []interface{}{part}, "role": "model"},
+		"index":   0,
+	}
+	if finishReason != "" {
+		c["finishReason"] = finishReason
+	}
+	return map[string]interface{}{
+		"candidates":   []interface{}{c},
+		"modelVersion": "mock-model",
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"status":  strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_")),
+		},
+	})
+}
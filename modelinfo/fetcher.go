@@ -0,0 +1,120 @@
+package modelinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// maxPages bounds how many pages of the models list one refresh reads
+const maxPages = 20
+
+// Fetcher periodically refreshes a catalog from the upstream models list
+type Fetcher struct {
+	client   *http.Client
+	baseURL  string
+	key      func() string
+	interval time.Duration
+	catalog  *Catalog
+	stop     chan struct{}
+}
+
+// NewFetcher creates a fetcher that lists models at baseURL with the API key
+// returned by key. A zero interval fetches only once.
+func NewFetcher(client *http.Client, baseURL string, key func() string, interval time.Duration, catalog *Catalog) *Fetcher {
+	return &Fetcher{
+		client:   client,
+		baseURL:  baseURL,
+		key:      key,
+		interval: interval,
+		catalog:  catalog,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start fetches the models list now and then every interval
+func (f *Fetcher) Start() {
+	go func() {
+		f.refresh()
+		if f.interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.refresh()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic refreshes
+func (f *Fetcher) Stop() {
+	close(f.stop)
+}
+
+func (f *Fetcher) refresh() {
+	models, err := f.fetch()
+	if err != nil {
+		logger.LogError("Failed to refresh model catalog, keeping previous entries:", err)
+		return
+	}
+	f.catalog.Update(models)
+	logger.LogInfo(fmt.Sprintf("Model catalog refreshed with %d models", len(models)))
+}
+
+type listResponse struct {
+	Models        []Capabilities `json:"models"`
+	NextPageToken string         `json:"nextPageToken"`
+}
+
+func (f *Fetcher) fetch() ([]Capabilities, error) {
+	var models []Capabilities
+	pageToken := ""
+	for page := 0; page < maxPages; page++ {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		req, err := http.NewRequest("GET", f.baseURL+"/v1beta/models?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Goog-Api-Key", f.key())
+
+		resp, err := f.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("models list returned status %d", resp.StatusCode)
+		}
+
+		var list listResponse
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("invalid models list: %w", err)
+		}
+		models = append(models, list.Models...)
+		if list.NextPageToken == "" {
+			return models, nil
+		}
+		pageToken = list.NextPageToken
+	}
+	return models, nil
+}
@@ -0,0 +1,125 @@
+// Package modelinfo caches model metadata from the upstream models list, so
+// per-model defaults can follow each model's actual limits.
+package modelinfo
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capabilities describes one model as reported by the upstream models list
+type Capabilities struct {
+	Name                       string   `json:"name"`
+	InputTokenLimit            int      `json:"inputTokenLimit"`
+	OutputTokenLimit           int      `json:"outputTokenLimit"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+	Thinking                   bool     `json:"thinking"`
+}
+
+// Supports reports whether the model supports a generation method such as "streamGenerateContent"
+func (c Capabilities) Supports(method string) bool {
+	for _, m := range c.SupportedGenerationMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Catalog holds the most recently fetched model capabilities
+type Catalog struct {
+	mu        sync.RWMutex
+	models    map[string]Capabilities
+	updatedAt time.Time
+}
+
+var (
+	globalCatalog *Catalog
+	once          sync.Once
+)
+
+// GetGlobalCatalog returns the process-wide model catalog
+func GetGlobalCatalog() *Catalog {
+	once.Do(func() {
+		globalCatalog = NewCatalog()
+	})
+	return globalCatalog
+}
+
+// NewCatalog creates an empty catalog
+func NewCatalog() *Catalog {
+	return &Catalog{models: make(map[string]Capabilities)}
+}
+
+// Update replaces the catalog contents
+func (c *Catalog) Update(models []Capabilities) {
+	byName := make(map[string]Capabilities, len(models))
+	for _, model := range models {
+		byName[baseName(model.Name)] = model
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.models = byName
+	c.updatedAt = time.Now()
+}
+
+// Lookup returns the capabilities of a model, given with or without the "models/" prefix
+func (c *Catalog) Lookup(model string) (Capabilities, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	caps, ok := c.models[baseName(model)]
+	return caps, ok
+}
+
+// Known reports whether a model is in the catalog. Every model is known
+// until the catalog has been fetched.
+func (c *Catalog) Known(model string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.models) == 0 {
+		return true
+	}
+	_, ok := c.models[baseName(model)]
+	return ok
+}
+
+// Snapshot returns every known model sorted by name, and when the catalog was last updated
+func (c *Catalog) Snapshot() ([]Capabilities, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	models := make([]Capabilities, 0, len(c.models))
+	for _, model := range c.models {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return models, c.updatedAt
+}
+
+func baseName(model string) string {
+	return strings.TrimPrefix(model, "models/")
+}
+
+// ClampOutputTokens lowers generationConfig.maxOutputTokens in a request body
+// to the model's output limit, which upstream would otherwise reject. It
+// reports the limit applied, or 0 if the body was left unchanged.
+func (c *Catalog) ClampOutputTokens(body map[string]interface{}, model string) int {
+	caps, ok := c.Lookup(model)
+	if !ok || caps.OutputTokenLimit <= 0 {
+		return 0
+	}
+	generationConfig, ok := body["generationConfig"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	requested, ok := generationConfig["maxOutputTokens"].(float64)
+	if !ok || requested <= float64(caps.OutputTokenLimit) {
+		return 0
+	}
+	generationConfig["maxOutputTokens"] = caps.OutputTokenLimit
+	return caps.OutputTokenLimit
+}
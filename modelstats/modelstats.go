@@ -0,0 +1,288 @@
+package modelstats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/storage"
+)
+
+// storageKey is where the statistics live in the metrics bucket of a shared store
+const storageKey = "modelstats"
+
+// window bounds the effective sample size of the rolling averages
+const window = 50
+
+// maxModels bounds how many models are tracked, so requests naming arbitrary
+// models cannot grow the statistics without limit
+const maxModels = 256
+
+// ModelStats holds rolling retry statistics for one model
+type ModelStats struct {
+	Sessions            int64     `json:"sessions"`
+	Successes           int64     `json:"successes"`
+	BlockRate           float64   `json:"block_rate"`
+	TruncationRate      float64   `json:"truncation_rate"`
+	AvgRetriesToSuccess float64   `json:"avg_retries_to_success"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Bounds limits the values adaptive tuning may choose
+type Bounds struct {
+	MinSamples    int64
+	MinRetries    int
+	MaxRetries    int
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Store keeps per-model statistics and optionally persists them to a JSON file or a shared store
+type Store struct {
+	mu     sync.RWMutex
+	models map[string]*ModelStats
+	// version counts changes; saved is the version last written successfully
+	version uint64
+	saved   uint64
+}
+
+var (
+	globalStore *Store
+	once        sync.Once
+)
+
+// GetGlobalStore returns the process-wide model statistics store
+func GetGlobalStore() *Store {
+	once.Do(func() {
+		globalStore = NewStore()
+	})
+	return globalStore
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{models: make(map[string]*ModelStats)}
+}
+
+// Record folds a finished session into the model's rolling statistics
+func (s *Store) Record(model string, success bool, retries int, reasons []string) {
+	if model == "" {
+		return
+	}
+
+	blocked, truncated := 0.0, 0.0
+	for _, reason := range reasons {
+		switch reason {
+		case "BLOCK":
+			blocked = 1
+		case "FINISH_INCOMPLETE", "DROP", "GOAWAY", "RST_STREAM":
+			truncated = 1
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.models[model]
+	if !ok {
+		if len(s.models) >= maxModels {
+			return
+		}
+		stats = &ModelStats{}
+		s.models[model] = stats
+	}
+
+	stats.Sessions++
+	stats.BlockRate = rollingAverage(stats.BlockRate, blocked, stats.Sessions)
+	stats.TruncationRate = rollingAverage(stats.TruncationRate, truncated, stats.Sessions)
+	if success {
+		stats.Successes++
+		stats.AvgRetriesToSuccess = rollingAverage(stats.AvgRetriesToSuccess, float64(retries), stats.Successes)
+	}
+	stats.UpdatedAt = time.Now().UTC()
+	s.version++
+}
+
+// rollingAverage is a cumulative average for the first samples and an exponential moving average afterwards
+func rollingAverage(current, sample float64, count int64) float64 {
+	weight := float64(count)
+	if weight > window {
+		weight = window
+	}
+	return current + (sample-current)/weight
+}
+
+// Snapshot returns a copy of the statistics for all models
+func (s *Store) Snapshot() map[string]ModelStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]ModelStats, len(s.models))
+	for model, stats := range s.models {
+		result[model] = *stats
+	}
+	return result
+}
+
+// Tune derives max retries and retry delay for a model from its statistics.
+// Models that need more retries to succeed get a higher retry limit, and models
+// with a higher block rate get a longer delay. It returns false until the model
+// has enough samples.
+func (s *Store) Tune(model string, b Bounds) (int, time.Duration, bool) {
+	s.mu.RLock()
+	stats, ok := s.models[model]
+	var snapshot ModelStats
+	if ok {
+		snapshot = *stats
+	}
+	s.mu.RUnlock()
+
+	if !ok || snapshot.Sessions < b.MinSamples {
+		return 0, 0, false
+	}
+
+	maxRetries := int(math.Ceil(snapshot.AvgRetriesToSuccess*3)) + 1
+	if maxRetries < b.MinRetries {
+		maxRetries = b.MinRetries
+	}
+	if maxRetries > b.MaxRetries {
+		maxRetries = b.MaxRetries
+	}
+
+	delay := b.MinRetryDelay + time.Duration(float64(b.MaxRetryDelay-b.MinRetryDelay)*snapshot.BlockRate)
+	return maxRetries, delay, true
+}
+
+// Load reads previously persisted statistics; a missing file is not an error
+func (s *Store) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.restore(data)
+}
+
+// Save writes the statistics to path atomically if they changed since the last save
+func (s *Store) Save(path string) error {
+	data, version, err := s.dirtySnapshot()
+	if data == nil || err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".modelstats-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.markSaved(version)
+	return nil
+}
+
+// StartPersistence saves the statistics to path every interval in the background
+func (s *Store) StartPersistence(path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Save(path); err != nil {
+				logger.LogError("Failed to persist model stats:", err)
+			}
+		}
+	}()
+}
+
+// LoadFromStore reads statistics previously saved to a shared store; missing data is not an error
+func (s *Store) LoadFromStore(store storage.Store) error {
+	data, err := store.Get(context.Background(), storage.BucketMetrics, storageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.restore(data)
+}
+
+// SaveToStore writes the statistics to a shared store if they changed since the last save
+func (s *Store) SaveToStore(store storage.Store) error {
+	data, version, err := s.dirtySnapshot()
+	if data == nil || err != nil {
+		return err
+	}
+	if err := store.Put(context.Background(), storage.BucketMetrics, storageKey, data, 0); err != nil {
+		return err
+	}
+	s.markSaved(version)
+	return nil
+}
+
+// StartStorePersistence saves the statistics to a shared store every interval in the background
+func (s *Store) StartStorePersistence(store storage.Store, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.SaveToStore(store); err != nil {
+				logger.LogError("Failed to persist model stats:", err)
+			}
+		}
+	}()
+}
+
+// restore replaces the statistics with previously persisted data
+func (s *Store) restore(data []byte) error {
+	models := make(map[string]*ModelStats)
+	if err := json.Unmarshal(data, &models); err != nil {
+		return fmt.Errorf("failed to parse model stats: %w", err)
+	}
+
+	s.mu.Lock()
+	s.models = models
+	s.mu.Unlock()
+	return nil
+}
+
+// dirtySnapshot encodes the statistics and the version they are at if they
+// changed since the last successful save, or returns nil
+func (s *Store) dirtySnapshot() ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.version == s.saved {
+		return nil, 0, nil
+	}
+	data, err := json.MarshalIndent(s.models, "", "  ")
+	return data, s.version, err
+}
+
+// markSaved records that the statistics at version were written; changes made
+// since then keep the store dirty
+func (s *Store) markSaved(version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version > s.saved {
+		s.saved = version
+	}
+}
@@ -0,0 +1,301 @@
+// Package recording writes the raw upstream traffic of streaming sessions to
+// files, so retry and block problems can be reported and reproduced offline.
+//
+// A recording is a JSON Lines file of Events: a session event describing the
+// request, the SSE lines of every upstream response, the body of every retry
+// request, the interruptions the engine detected and the session result.
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	// EventSession opens a recording with the original request
+	EventSession = "session"
+	// EventResponse is the status of an upstream response
+	EventResponse = "response"
+	// EventLine is one SSE line of an upstream response
+	EventLine = "line"
+	// EventRetryRequest is the body of a retry request
+	EventRetryRequest = "retry_request"
+	// EventRequestError is a retry request that failed without a response
+	EventRequestError = "request_error"
+	// EventInterruption is an interruption detected by the engine
+	EventInterruption = "interruption"
+	// EventResult closes a recording with the outcome of the session
+	EventResult = "result"
+)
+
+// Event is one entry of a recording. Request numbers the upstream requests of
+// a session; 0 is the initial request made before the engine took over.
+type Event struct {
+	Type    string `json:"type"`
+	Elapsed int64  `json:"elapsed_ms"`
+	Request int    `json:"request"`
+
+	// Session
+	RequestID       string          `json:"request_id,omitempty"`
+	Model           string          `json:"model,omitempty"`
+	URL             string          `json:"url,omitempty"`
+	ExpectDoneToken bool            `json:"expect_done_token,omitempty"`
+	Body            json.RawMessage `json:"body,omitempty"`
+
+	// Response, line, request error and interruption
+	Status int    `json:"status,omitempty"`
+	Line   string `json:"line,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Result
+	Attempts int      `json:"attempts,omitempty"`
+	Reasons  []string `json:"reasons,omitempty"`
+	Chars    int      `json:"chars,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Recorder writes the recording of one session. It is safe for concurrent
+// use, as speculative retries read two responses at once.
+type Recorder struct {
+	path  string
+	start time.Time
+
+	mu       sync.Mutex
+	file     *os.File
+	out      *bufio.Writer
+	requests int
+	current  int
+}
+
+// Create starts a recording in dir, named after the current time and requestID
+func Create(dir, requestID string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.jsonl", now.UTC().Format("20060102T150405.000Z"), requestID)
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %w", err)
+	}
+	return &Recorder{path: path, start: now, file: file, out: bufio.NewWriter(file)}, nil
+}
+
+// Path returns the file the recording is written to
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+func (r *Recorder) write(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(e)
+}
+
+func (r *Recorder) writeLocked(e Event) {
+	if r.file == nil {
+		return
+	}
+	e.Elapsed = time.Since(r.start).Milliseconds()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.out.Write(data)
+	r.out.WriteByte('\n')
+}
+
+// Session records the original request. An API key in the URL is left out.
+func (r *Recorder) Session(requestID, model, upstreamURL string, expectDoneToken bool, body map[string]interface{}) {
+	encoded, _ := json.Marshal(body)
+	r.write(Event{
+		Type:            EventSession,
+		RequestID:       requestID,
+		Model:           model,
+		URL:             redactURL(upstreamURL),
+		ExpectDoneToken: expectDoneToken,
+		Body:            encoded,
+	})
+}
+
+// Initial returns body, the stream of the initial response, recording its lines as it is read
+func (r *Recorder) Initial(body io.Reader) io.Reader {
+	r.write(Event{Type: EventResponse, Status: http.StatusOK})
+	return r.reader(body, 0)
+}
+
+// Interruption records an interruption of the current upstream request
+func (r *Recorder) Interruption(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(Event{Type: EventInterruption, Request: r.current, Reason: reason})
+}
+
+// Finish records the outcome of the session and closes the recording
+func (r *Recorder) Finish(attempts int, reasons []string, chars int, err error) error {
+	event := Event{Type: EventResult, Attempts: attempts, Reasons: reasons, Chars: chars}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(event)
+	if r.file == nil {
+		return nil
+	}
+	flushErr := r.out.Flush()
+	closeErr := r.file.Close()
+	r.file = nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// Client returns a copy of client whose requests, the engine's retries, are recorded
+func (r *Recorder) Client(client *http.Client) *http.Client {
+	recorded := *client
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	recorded.Transport = &transport{base: base, recorder: r}
+	return &recorded
+}
+
+type transport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+// CloseIdleConnections forwards to the base transport
+func (t *transport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := t.recorder
+	var body []byte
+	if req.Body != nil && req.GetBody != nil {
+		if copied, err := req.GetBody(); err == nil {
+			body, _ = io.ReadAll(copied)
+			copied.Close()
+		}
+	}
+
+	r.mu.Lock()
+	r.requests++
+	number := r.requests
+	r.current = number
+	event := Event{Type: EventRetryRequest, Request: number}
+	if json.Valid(body) {
+		event.Body = body
+	}
+	r.writeLocked(event)
+	r.mu.Unlock()
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		r.write(Event{Type: EventRequestError, Request: number, Error: err.Error()})
+		return nil, err
+	}
+	r.write(Event{Type: EventResponse, Request: number, Status: resp.StatusCode})
+	resp.Body = &recordedBody{Reader: r.reader(resp.Body, number), closer: resp.Body}
+	return resp, nil
+}
+
+type recordedBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *recordedBody) Close() error {
+	return b.closer.Close()
+}
+
+// reader returns body, recording each line read from it as a line event of request
+func (r *Recorder) reader(body io.Reader, request int) io.Reader {
+	return &lineReader{body: body, recorder: r, request: request}
+}
+
+type lineReader struct {
+	body     io.Reader
+	recorder *Recorder
+	request  int
+	partial  []byte
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	n, err := l.body.Read(p)
+	l.partial = append(l.partial, p[:n]...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.record(l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	// The last line may end without a line break
+	if err == io.EOF {
+		l.record(l.partial)
+		l.partial = nil
+	}
+	return n, err
+}
+
+func (l *lineReader) record(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(bytes.TrimSpace(line)) > 0 {
+		l.recorder.write(Event{Type: EventLine, Request: l.request, Line: string(line)})
+	}
+}
+
+// redactURL drops an API key passed as a query parameter
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	query := u.Query()
+	if query.Has("key") {
+		query.Set("key", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// Read loads the events of the recording at path
+func Read(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	decoder := json.NewDecoder(file)
+	for {
+		var e Event
+		if err := decoder.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return events, fmt.Errorf("reading recording %s: %w", path, err)
+		}
+		events = append(events, e)
+	}
+}
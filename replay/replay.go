@@ -0,0 +1,232 @@
+// Package replay feeds a session recorded with DEBUG_RECORD_DIR through the
+// stream engine again, printing the decisions it makes, so a reported retry
+// problem can be reproduced without calling the Gemini API.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/recording"
+	"gemini-antiblock/streaming"
+)
+
+// response is the recorded outcome of one upstream request
+type response struct {
+	status int
+	lines  []string
+	err    string
+}
+
+// session is a parsed recording
+type session struct {
+	start     recording.Event
+	result    *recording.Event
+	responses map[int]*response
+}
+
+func load(path string) (*session, error) {
+	events, err := recording.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{responses: make(map[int]*response)}
+	for i := range events {
+		e := events[i]
+		switch e.Type {
+		case recording.EventSession:
+			s.start = e
+		case recording.EventResponse:
+			s.response(e.Request).status = e.Status
+		case recording.EventLine:
+			r := s.response(e.Request)
+			r.lines = append(r.lines, e.Line)
+		case recording.EventRequestError:
+			s.response(e.Request).err = e.Error
+		case recording.EventResult:
+			s.result = &events[i]
+		}
+	}
+	if s.start.Type == "" {
+		return nil, fmt.Errorf("%s is not a session recording", path)
+	}
+	if _, ok := s.responses[0]; !ok {
+		return nil, fmt.Errorf("%s has no initial response", path)
+	}
+	return s, nil
+}
+
+func (s *session) response(request int) *response {
+	r, ok := s.responses[request]
+	if !ok {
+		r = &response{status: http.StatusOK}
+		s.responses[request] = r
+	}
+	return r
+}
+
+// Run replays the recording at path with the settings in cfg and writes what
+// the engine forwards and decides to out. Waits between retries are skipped.
+func Run(ctx context.Context, cfg *config.Config, path string, out io.Writer) error {
+	s, err := load(path)
+	if err != nil {
+		return err
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(s.start.Body, &body); err != nil {
+		return fmt.Errorf("recorded request body: %w", err)
+	}
+
+	replayCfg := *cfg
+	replayCfg.DebugRecordDir = ""
+	replayCfg.AdaptiveRetry = false
+	replayCfg.RetryDelayMs = 0
+	replayCfg.RateLimitDelay = 0
+
+	fmt.Fprintf(out, "Replaying %s: request %s, model %s, %d recorded upstream requests\n", path, s.start.RequestID, s.start.Model, len(s.responses))
+
+	p := &printer{out: out}
+	client := &http.Client{Transport: &transport{session: s, printer: p}}
+	summary := streaming.NewSessionSummary(s.start.RequestID, s.start.Model, "replay")
+	initial := strings.NewReader(joinLines(s.responses[0].lines))
+	err = streaming.ProcessStreamAndRetryInternally(ctx, &replayCfg, client, initial, p, body, s.start.URL, http.Header{}, summary, p, nil)
+
+	p.printf("Result: %d attempts, reasons %v, %d chars, error: %s\n", summary.Attempts, summary.Reasons, summary.Chars, describe(err))
+	if s.result != nil {
+		p.printf("Recorded: %d attempts, reasons %v, %d chars, error: %s\n", s.result.Attempts, s.result.Reasons, s.result.Chars, describeString(s.result.Error))
+		if summary.Attempts == s.result.Attempts && strings.Join(summary.Reasons, ",") == strings.Join(s.result.Reasons, ",") {
+			p.printf("The replay matches the recording\n")
+		} else {
+			p.printf("The replay differs from the recording\n")
+		}
+	}
+	return nil
+}
+
+func joinLines(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+func describe(err error) string {
+	if err == nil {
+		return "none"
+	}
+	return err.Error()
+}
+
+func describeString(err string) string {
+	if err == "" {
+		return "none"
+	}
+	return err
+}
+
+// transport answers the engine's retry requests with the recorded responses, in order
+type transport struct {
+	session *session
+	printer *printer
+
+	mu      sync.Mutex
+	request int
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	t.mu.Lock()
+	t.request++
+	number := t.request
+	t.mu.Unlock()
+
+	recorded, ok := t.session.responses[number]
+	if !ok {
+		t.printer.printf("-> retry request %d: not in the recording\n", number)
+		return errorResponse(req, http.StatusBadRequest, fmt.Sprintf("the recording has no response for upstream request %d", number)), nil
+	}
+	if recorded.err != "" {
+		t.printer.printf("-> retry request %d: recorded error %s\n", number, recorded.err)
+		return nil, errors.New(recorded.err)
+	}
+	t.printer.printf("-> retry request %d: status %d, %d lines\n", number, recorded.status, len(recorded.lines))
+	if recorded.status != http.StatusOK {
+		return errorResponse(req, recorded.status, "replayed status"), nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(joinLines(recorded.lines))),
+		Request:    req,
+	}, nil
+}
+
+func errorResponse(req *http.Request, status int, message string) *http.Response {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(payload))),
+		Request:    req,
+	}
+}
+
+// printer is the replay's stream writer and observer, printing what the engine does
+type printer struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, format, args...)
+}
+
+// WriteData implements engine.StreamWriter
+func (p *printer) WriteData(line string) error {
+	p.printf("<< %s\n", line)
+	return nil
+}
+
+// WriteError implements engine.StreamWriter
+func (p *printer) WriteError(payload []byte) error {
+	p.printf("<< error %s\n", payload)
+	return nil
+}
+
+// Close implements engine.StreamWriter
+func (p *printer) Close() error {
+	return nil
+}
+
+// Interruption implements engine.Observer
+func (p *printer) Interruption(reason string) {
+	p.printf("!! interruption %s\n", reason)
+}
+
+// Retry implements engine.Observer
+func (p *printer) Retry() {}
+
+// NetworkError implements engine.Observer
+func (p *printer) NetworkError(class string) {}
+
+// ResponseTime implements engine.Observer
+func (p *printer) ResponseTime(d time.Duration) {}
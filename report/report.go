@@ -0,0 +1,228 @@
+package report
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gemini-antiblock/metrics"
+)
+
+const (
+	// dateLayout names report days, in UTC
+	dateLayout = "2006-01-02"
+	// topErrorLimit is the number of error messages listed in a report
+	topErrorLimit = 10
+	// maxDistinctErrors bounds the error messages tracked per day; further ones are counted as otherError
+	maxDistinctErrors = 1000
+	otherError        = "(other)"
+)
+
+// ModelReport summarizes a day's streaming sessions for one model
+type ModelReport struct {
+	Sessions  int64   `json:"sessions"`
+	Retries   int64   `json:"retries"`
+	Blocked   int64   `json:"blocked"`
+	BlockRate float64 `json:"block_rate"`
+}
+
+// KeyReport summarizes a day's consumption by one client API key
+type KeyReport struct {
+	Sessions int64 `json:"sessions"`
+	Retries  int64 `json:"retries"`
+	Chars    int64 `json:"chars"`
+}
+
+// ErrorCount is one error message and how often sessions ended with it
+type ErrorCount struct {
+	Message string `json:"message"`
+	Count   int64  `json:"count"`
+}
+
+// Daily is the summary of one UTC day
+type Daily struct {
+	Date            string                  `json:"date"`
+	Partial         bool                    `json:"partial"`
+	Requests        int64                   `json:"requests"`
+	Sessions        int64                   `json:"sessions"`
+	Successful      int64                   `json:"successful"`
+	Failed          int64                   `json:"failed"`
+	ClientGone      int64                   `json:"client_gone"`
+	Retries         int64                   `json:"retries"`
+	RetriesByReason map[string]int64        `json:"retries_by_reason"`
+	Models          map[string]*ModelReport `json:"models"`
+	Keys            map[string]*KeyReport   `json:"keys"`
+	TopErrors       []ErrorCount            `json:"top_errors"`
+}
+
+// Session is a finished streaming session as reported to the collector
+type Session struct {
+	Model   string
+	Key     string
+	Outcome string
+	Reasons []string
+	Chars   int
+	Error   string
+}
+
+// Session outcomes, matching the streaming session summary
+const (
+	outcomeSuccess    = "success"
+	outcomeClientGone = "client_gone"
+)
+
+// Collector accumulates the current day's activity
+type Collector struct {
+	mu sync.Mutex
+
+	day          string
+	baseRequests int64
+	current      *Daily
+	errors       map[string]int64
+}
+
+var (
+	globalCollector *Collector
+	once            sync.Once
+)
+
+// GetGlobalCollector returns the process-wide collector
+func GetGlobalCollector() *Collector {
+	once.Do(func() {
+		globalCollector = NewCollector()
+	})
+	return globalCollector
+}
+
+// NewCollector creates a collector for the current day
+func NewCollector() *Collector {
+	c := &Collector{}
+	c.reset(time.Now())
+	return c
+}
+
+// Record adds a finished streaming session to the current day
+func (c *Collector) Record(s Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d := c.current
+	d.Sessions++
+	switch s.Outcome {
+	case outcomeSuccess:
+		d.Successful++
+	case outcomeClientGone:
+		d.ClientGone++
+	default:
+		d.Failed++
+	}
+
+	blocked := int64(0)
+	for _, reason := range s.Reasons {
+		d.RetriesByReason[reason]++
+		if reason == "BLOCK" {
+			blocked = 1
+		}
+	}
+	retries := int64(len(s.Reasons))
+	d.Retries += retries
+
+	if s.Model != "" {
+		model, ok := d.Models[s.Model]
+		if !ok {
+			model = &ModelReport{}
+			d.Models[s.Model] = model
+		}
+		model.Sessions++
+		model.Retries += retries
+		model.Blocked += blocked
+		model.BlockRate = float64(model.Blocked) / float64(model.Sessions)
+	}
+
+	key := s.Key
+	if key == "" {
+		key = "(none)"
+	}
+	keyReport, ok := d.Keys[key]
+	if !ok {
+		keyReport = &KeyReport{}
+		d.Keys[key] = keyReport
+	}
+	keyReport.Sessions++
+	keyReport.Retries += retries
+	keyReport.Chars += int64(s.Chars)
+
+	if s.Error != "" {
+		message := s.Error
+		if _, seen := c.errors[message]; !seen && len(c.errors) >= maxDistinctErrors {
+			message = otherError
+		}
+		c.errors[message]++
+	}
+}
+
+// Current returns the partial report for the day so far
+func (c *Collector) Current() Daily {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshot(true)
+}
+
+// Rotate closes the current day, starts a new one at now and returns the finished report
+func (c *Collector) Rotate(now time.Time) Daily {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	finished := c.snapshot(false)
+	c.reset(now)
+	return finished
+}
+
+func (c *Collector) reset(now time.Time) {
+	c.day = now.UTC().Format(dateLayout)
+	c.baseRequests = metrics.GetGlobalMetrics().GetSnapshot().TotalRequests
+	c.current = &Daily{
+		Date:            c.day,
+		RetriesByReason: make(map[string]int64),
+		Models:          make(map[string]*ModelReport),
+		Keys:            make(map[string]*KeyReport),
+	}
+	c.errors = make(map[string]int64)
+}
+
+// snapshot returns a deep copy of the current day
+func (c *Collector) snapshot(partial bool) Daily {
+	d := *c.current
+	d.Partial = partial
+	d.Requests = metrics.GetGlobalMetrics().GetSnapshot().TotalRequests - c.baseRequests
+
+	d.RetriesByReason = make(map[string]int64, len(c.current.RetriesByReason))
+	for reason, count := range c.current.RetriesByReason {
+		d.RetriesByReason[reason] = count
+	}
+	d.Models = make(map[string]*ModelReport, len(c.current.Models))
+	for name, model := range c.current.Models {
+		copied := *model
+		d.Models[name] = &copied
+	}
+	d.Keys = make(map[string]*KeyReport, len(c.current.Keys))
+	for key, keyReport := range c.current.Keys {
+		copied := *keyReport
+		d.Keys[key] = &copied
+	}
+
+	d.TopErrors = make([]ErrorCount, 0, len(c.errors))
+	for message, count := range c.errors {
+		d.TopErrors = append(d.TopErrors, ErrorCount{Message: message, Count: count})
+	}
+	sort.Slice(d.TopErrors, func(i, j int) bool {
+		if d.TopErrors[i].Count != d.TopErrors[j].Count {
+			return d.TopErrors[i].Count > d.TopErrors[j].Count
+		}
+		return d.TopErrors[i].Message < d.TopErrors[j].Message
+	})
+	if len(d.TopErrors) > topErrorLimit {
+		d.TopErrors = d.TopErrors[:topErrorLimit]
+	}
+	return d
+}
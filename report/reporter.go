@@ -0,0 +1,172 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/storage"
+)
+
+// Webhook payload formats
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+const (
+	// storageKeyPrefix prefixes the per-day keys in the metrics bucket
+	storageKeyPrefix = "daily-report:"
+	// retention is how long finished reports are kept in storage
+	retention = 90 * 24 * time.Hour
+	// webhookTimeout bounds a single webhook delivery
+	webhookTimeout = 10 * time.Second
+)
+
+// Reporter closes each UTC day at midnight, stores the finished report and
+// optionally pushes it to a webhook
+type Reporter struct {
+	Collector *Collector
+
+	store         storage.Store
+	webhookURL    string
+	webhookFormat string
+	client        *http.Client
+	stop          chan struct{}
+}
+
+// NewReporter creates a reporter over the global collector. An empty
+// webhookURL disables pushing; format is FormatJSON or FormatSlack.
+func NewReporter(store storage.Store, webhookURL, format string) *Reporter {
+	return &Reporter{
+		Collector:     GetGlobalCollector(),
+		store:         store,
+		webhookURL:    webhookURL,
+		webhookFormat: format,
+		client:        &http.Client{Timeout: webhookTimeout},
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start begins closing a report at every UTC midnight
+func (r *Reporter) Start() {
+	go func() {
+		for {
+			now := time.Now().UTC()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			timer := time.NewTimer(midnight.Sub(now))
+			select {
+			case <-timer.C:
+				r.publish(r.Collector.Rotate(time.Now()))
+			case <-r.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the daily schedule
+func (r *Reporter) Stop() {
+	close(r.stop)
+}
+
+// Load returns the stored report for a past day in YYYY-MM-DD form
+func (r *Reporter) Load(ctx context.Context, date string) (*Daily, error) {
+	data, err := r.store.Get(ctx, storage.BucketMetrics, storageKeyPrefix+date)
+	if err != nil {
+		return nil, err
+	}
+	var d Daily
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to decode report for %s: %w", date, err)
+	}
+	return &d, nil
+}
+
+// publish stores a finished report and pushes it to the webhook
+func (r *Reporter) publish(d Daily) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		logger.LogError("Failed to encode daily report:", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	if err := r.store.Put(ctx, storage.BucketMetrics, storageKeyPrefix+d.Date, data, retention); err != nil {
+		logger.LogError(fmt.Sprintf("Failed to store daily report for %s: %v", d.Date, err))
+	}
+	logger.LogInfo(fmt.Sprintf("Daily report for %s: %d requests, %d sessions, %d retries", d.Date, d.Requests, d.Sessions, d.Retries))
+
+	if r.webhookURL == "" {
+		return
+	}
+	payload := data
+	if r.webhookFormat == FormatSlack {
+		payload, _ = json.Marshal(map[string]string{"text": slackText(d)})
+	}
+	if err := r.push(ctx, payload); err != nil {
+		logger.LogError(fmt.Sprintf("Failed to push daily report for %s: %v", d.Date, err))
+	}
+}
+
+func (r *Reporter) push(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", r.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// slackText renders a report as a short plain-text message
+func slackText(d Daily) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Gemini Antiblock daily report for %s*\n", d.Date)
+	fmt.Fprintf(&b, "Requests: %d, streaming sessions: %d (%d successful, %d failed, %d client gone), retries: %d\n",
+		d.Requests, d.Sessions, d.Successful, d.Failed, d.ClientGone, d.Retries)
+
+	if len(d.RetriesByReason) > 0 {
+		reasons := make([]string, 0, len(d.RetriesByReason))
+		for reason := range d.RetriesByReason {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		b.WriteString("Retries by reason:")
+		for _, reason := range reasons {
+			fmt.Fprintf(&b, " %s=%d", reason, d.RetriesByReason[reason])
+		}
+		b.WriteString("\n")
+	}
+
+	models := make([]string, 0, len(d.Models))
+	for model := range d.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		m := d.Models[model]
+		fmt.Fprintf(&b, "• %s: %d sessions, block rate %.1f%%\n", model, m.Sessions, m.BlockRate*100)
+	}
+
+	for _, e := range d.TopErrors {
+		fmt.Fprintf(&b, "• %dx %s\n", e.Count, e.Message)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+// Package respcache keeps recent non-streaming responses in memory, so
+// repeated identical prompts such as health probes and test harness runs are
+// answered without asking the model again.
+package respcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response
+type Entry struct {
+	Body        []byte
+	ContentType string
+	Stored      time.Time
+}
+
+type element struct {
+	key   string
+	entry Entry
+}
+
+// Cache is an LRU cache of responses that expire ttl after they were stored
+type Cache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// New creates a cache of at most maxEntries responses, each kept for ttl
+func New(maxEntries int, ttl time.Duration) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = 1
+	}
+	return &Cache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Key identifies a request by model, credential and body. The credential is
+// part of it so one client's answers are never served to another.
+func Key(model, credential string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write([]byte(credential))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the response stored under key, if it has not expired
+func (c *Cache) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	e := el.Value.(*element)
+	if time.Since(e.entry.Stored) >= c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return Entry{}, false
+	}
+	c.order.MoveToFront(el)
+	return e.entry, true
+}
+
+// Put stores a response, evicting the least recently used one when full
+func (c *Cache) Put(key string, entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*element).entry = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&element{key: key, entry: entry})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*element).key)
+	}
+}
+
+// Len returns the number of cached responses, expired ones included
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
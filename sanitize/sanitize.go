@@ -0,0 +1,294 @@
+// Package sanitize rewrites generateContent requests into the form Gemini
+// accepts: snake_case field names become camelCase, fields borrowed from the
+// OpenAI chat API are translated or removed, and top-level fields the
+// upstream does not know are dropped. Each change is reported, so the client
+// learns what was fixed instead of getting an opaque 400 from upstream.
+package sanitize
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// requestFields are the top-level fields of a generateContent request
+var requestFields = map[string]bool{
+	"contents":          true,
+	"tools":             true,
+	"toolConfig":        true,
+	"safetySettings":    true,
+	"systemInstruction": true,
+	"generationConfig":  true,
+	"cachedContent":     true,
+}
+
+// vertexFields are top-level fields only Vertex AI accepts
+var vertexFields = map[string]bool{
+	"labels": true,
+}
+
+// generationFields are generationConfig fields clients put at the top level,
+// mapped to their name in generationConfig
+var generationFields = map[string]string{
+	"temperature":         "temperature",
+	"topP":                "topP",
+	"topK":                "topK",
+	"maxOutputTokens":     "maxOutputTokens",
+	"maxTokens":           "maxOutputTokens",
+	"maxCompletionTokens": "maxOutputTokens",
+	"stop":                "stopSequences",
+	"stopSequences":       "stopSequences",
+	"seed":                "seed",
+	"presencePenalty":     "presencePenalty",
+	"frequencyPenalty":    "frequencyPenalty",
+	"n":                   "candidateCount",
+	"candidateCount":      "candidateCount",
+	"responseMimeType":    "responseMimeType",
+	"responseSchema":      "responseSchema",
+	"thinkingConfig":      "thinkingConfig",
+}
+
+// freeformFields hold data whose keys belong to the client, such as function
+// arguments and JSON schemas, and are never renamed
+var freeformFields = map[string]bool{
+	"args":                 true,
+	"response":             true,
+	"labels":               true,
+	"responseJsonSchema":   true,
+	"parametersJsonSchema": true,
+}
+
+// Request sanitizes the JSON body of a generateContent request for an
+// upstream in upstreamMode, gemini or vertex. It returns the body, rewritten
+// if anything changed, and a description of each change. A body that is not a
+// JSON object is returned as it is.
+func Request(body []byte, upstreamMode string) ([]byte, []string) {
+	var request map[string]interface{}
+	if json.Unmarshal(body, &request) != nil || request == nil {
+		return body, nil
+	}
+
+	// Top-level renames are reported once the fields have found their place
+	s := &sanitizer{seen: make(map[string]bool), original: make(map[string]string)}
+	for key, value := range request {
+		if name := camelCase(key); name != key {
+			delete(request, key)
+			if _, exists := request[name]; exists {
+				s.note(fmt.Sprintf("removed %s, %s is set", key, name))
+				continue
+			}
+			request[name] = value
+			s.original[name] = key
+		}
+	}
+	for key, value := range request {
+		s.rename(key, value)
+	}
+
+	s.translateMessages(request)
+	s.moveGenerationFields(request)
+	if text, ok := request["systemInstruction"].(string); ok {
+		request["systemInstruction"] = map[string]interface{}{"parts": []interface{}{map[string]interface{}{"text": text}}}
+		s.note("wrapped systemInstruction text in parts")
+	}
+	if text, ok := request["contents"].(string); ok {
+		request["contents"] = []interface{}{userText(text)}
+		s.note("wrapped contents text in a user message")
+	}
+
+	for key := range request {
+		if requestFields[key] || (upstreamMode == "vertex" && vertexFields[key]) {
+			continue
+		}
+		delete(request, key)
+		s.note("removed " + s.name(key))
+	}
+	for key := range request {
+		if original, ok := s.original[key]; ok {
+			s.note(fmt.Sprintf("renamed %s to %s", original, key))
+		}
+	}
+
+	if len(s.changes) == 0 {
+		return body, nil
+	}
+	sanitized, err := json.Marshal(request)
+	if err != nil {
+		return body, nil
+	}
+	return sanitized, s.changes
+}
+
+type sanitizer struct {
+	changes []string
+	seen    map[string]bool
+	// original maps renamed top-level fields to the name the client used
+	original map[string]string
+}
+
+// name returns the name the client gave a top-level field
+func (s *sanitizer) name(key string) string {
+	if original, ok := s.original[key]; ok {
+		return original
+	}
+	return key
+}
+
+// note records a change once, however often it was made
+func (s *sanitizer) note(change string) {
+	if !s.seen[change] {
+		s.seen[change] = true
+		s.changes = append(s.changes, change)
+	}
+}
+
+// rename turns the snake_case keys below value, found under key, into camelCase
+func (s *sanitizer) rename(key string, value interface{}) {
+	if freeformFields[key] {
+		return
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for child, childValue := range v {
+			// The keys of a schema's properties are the client's field names
+			if name := camelCase(child); name != child && key != "properties" {
+				delete(v, child)
+				if _, exists := v[name]; exists {
+					s.note(fmt.Sprintf("removed %s, %s is set", child, name))
+					continue
+				}
+				v[name] = childValue
+				s.note(fmt.Sprintf("renamed %s to %s", child, name))
+				child = name
+			}
+			s.rename(child, childValue)
+		}
+	case []interface{}:
+		for _, item := range v {
+			s.rename(key, item)
+		}
+	}
+}
+
+// moveGenerationFields moves generation settings given at the top level into
+// generationConfig, and translates OpenAI's response_format
+func (s *sanitizer) moveGenerationFields(request map[string]interface{}) {
+	config, _ := request["generationConfig"].(map[string]interface{})
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	keys := make([]string, 0, len(generationFields))
+	for key := range generationFields {
+		keys = append(keys, key)
+	}
+	// Sorted, so the same request always keeps the same duplicate
+	sort.Strings(keys)
+
+	moved := false
+	for _, key := range keys {
+		name := generationFields[key]
+		value, ok := request[key]
+		if !ok {
+			continue
+		}
+		delete(request, key)
+		if _, exists := config[name]; exists {
+			s.note(fmt.Sprintf("removed %s, generationConfig.%s is set", s.name(key), name))
+			continue
+		}
+		if text, ok := value.(string); ok && name == "stopSequences" {
+			value = []interface{}{text}
+		}
+		config[name] = value
+		moved = true
+		s.note(fmt.Sprintf("moved %s to generationConfig.%s", s.name(key), name))
+	}
+
+	if format, ok := request["responseFormat"].(map[string]interface{}); ok {
+		if kind, _ := format["type"].(string); (kind == "json_object" || kind == "json_schema") && config["responseMimeType"] == nil {
+			config["responseMimeType"] = "application/json"
+			delete(request, "responseFormat")
+			moved = true
+			s.note(fmt.Sprintf("translated %s to generationConfig.responseMimeType", s.name("responseFormat")))
+		}
+	}
+	if moved {
+		request["generationConfig"] = config
+	}
+}
+
+// translateMessages turns OpenAI chat messages into contents and a system
+// instruction, keeping their text, if the request has no contents
+func (s *sanitizer) translateMessages(request map[string]interface{}) {
+	messages, ok := request["messages"].([]interface{})
+	if !ok {
+		return
+	}
+	delete(request, "messages")
+	if _, exists := request["contents"]; exists {
+		s.note("removed messages, contents is set")
+		return
+	}
+
+	var contents, system []interface{}
+	for _, item := range messages {
+		message, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var parts []interface{}
+		switch content := message["content"].(type) {
+		case string:
+			parts = append(parts, map[string]interface{}{"text": content})
+		case []interface{}:
+			for _, part := range content {
+				if p, ok := part.(map[string]interface{}); ok && p["type"] == "text" {
+					parts = append(parts, map[string]interface{}{"text": p["text"]})
+				} else {
+					s.note("removed non-text message parts")
+				}
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		switch role, _ := message["role"].(string); role {
+		case "system", "developer":
+			system = append(system, parts...)
+		case "assistant":
+			contents = append(contents, map[string]interface{}{"role": "model", "parts": parts})
+		case "user", "":
+			contents = append(contents, map[string]interface{}{"role": "user", "parts": parts})
+		default:
+			s.note("removed " + role + " messages")
+		}
+	}
+
+	request["contents"] = contents
+	if len(system) > 0 {
+		if _, exists := request["systemInstruction"]; !exists {
+			request["systemInstruction"] = map[string]interface{}{"parts": system}
+		}
+	}
+	s.note("translated messages to contents")
+}
+
+func userText(text string) map[string]interface{} {
+	return map[string]interface{}{"role": "user", "parts": []interface{}{map[string]interface{}{"text": text}}}
+}
+
+// camelCase turns a snake_case name such as system_instruction into
+// systemInstruction; other names are returned as they are
+func camelCase(name string) string {
+	if !strings.Contains(name, "_") || strings.ToLower(name) != name {
+		return name
+	}
+	words := strings.Split(strings.Trim(name, "_"), "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
@@ -0,0 +1,144 @@
+// Package secrets reads credentials mounted as files, such as Docker or
+// Kubernetes secrets, and picks up their rotation while the proxy runs.
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// ReadFile reads a secret file without surrounding whitespace
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SplitList splits a secret holding several values, one per line or comma
+// separated. Blank lines and lines starting with # are skipped.
+func SplitList(content string) []string {
+	var values []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, value := range strings.Split(line, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// SplitMap splits a secret holding name=value pairs, laid out as for
+// SplitList. Items without "=" are skipped.
+func SplitMap(content string) map[string]string {
+	values := make(map[string]string)
+	for _, item := range SplitList(content) {
+		name, value, found := strings.Cut(item, "=")
+		if !found {
+			continue
+		}
+		values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+// Value is a secret that can be replaced while it is in use
+type Value struct {
+	mu    sync.RWMutex
+	value string
+}
+
+// NewValue creates a Value holding value
+func NewValue(value string) *Value {
+	return &Value{value: value}
+}
+
+// Get returns the current secret
+func (v *Value) Get() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.value
+}
+
+// Set replaces the secret
+func (v *Value) Set(value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.value = value
+}
+
+// Watcher re-reads a secret file periodically and reports changed contents.
+// Polling the contents rather than watching for events also catches the
+// symlink swap Kubernetes uses to update mounted secrets.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	onChange func(content string)
+	last     string
+	stop     chan struct{}
+}
+
+// NewWatcher creates a watcher that calls onChange when the contents of path
+// differ from what they are now
+func NewWatcher(path string, interval time.Duration, onChange func(content string)) *Watcher {
+	last, _ := ReadFile(path)
+	return &Watcher{
+		path:     path,
+		interval: interval,
+		onChange: onChange,
+		last:     last,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins polling the file
+func (w *Watcher) Start() {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.check()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends polling
+func (w *Watcher) Stop() {
+	close(w.stop)
+}
+
+// check reports new contents. An unreadable or empty file keeps the previous
+// secret, since it is usually a rotation caught halfway.
+func (w *Watcher) check() {
+	content, err := ReadFile(w.path)
+	if err != nil {
+		logger.LogError("Keeping previous secret:", err)
+		return
+	}
+	if content == "" {
+		logger.LogError(fmt.Sprintf("Keeping previous secret: secret file %s is empty", w.path))
+		return
+	}
+	if content == w.last {
+		return
+	}
+	w.last = content
+	logger.LogInfo(fmt.Sprintf("Secret file %s changed, reloading", w.path))
+	w.onChange(content)
+}
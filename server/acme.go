@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"gemini-antiblock/logger"
+)
+
+// challengeRetryInterval is how often the HTTP-01 listener retries binding its
+// port, which the previous process still holds for a while after an upgrade
+const challengeRetryInterval = 5 * time.Second
+
+// NewAutocert creates a manager that obtains and renews certificates for
+// domains from an ACME CA, Let's Encrypt unless directoryURL is set, and keeps
+// them in cacheDir so restarts do not request new ones
+func NewAutocert(domains []string, cacheDir, email, directoryURL string) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m
+}
+
+// ChallengeServer answers ACME HTTP-01 challenges on a plain HTTP port and
+// redirects every other request to HTTPS
+type ChallengeServer struct {
+	srv  *http.Server
+	stop chan struct{}
+	once sync.Once
+}
+
+// StartChallengeServer starts serving challenges for m on addr, such as ":80".
+// If the port is taken it keeps retrying in the background.
+func StartChallengeServer(addr string, m *autocert.Manager) *ChallengeServer {
+	s := &ChallengeServer{
+		srv:  &http.Server{Addr: addr, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second},
+		stop: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *ChallengeServer) run() {
+	for {
+		ln, err := net.Listen("tcp", s.srv.Addr)
+		if err == nil {
+			logger.LogInfo("Answering ACME HTTP-01 challenges on " + s.srv.Addr)
+			if err := s.srv.Serve(ln); err != http.ErrServerClosed {
+				logger.LogError("ACME challenge server failed:", err)
+			}
+			return
+		}
+		logger.LogWarn("ACME challenge listener not available yet, retrying:", err)
+		select {
+		case <-time.After(challengeRetryInterval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop closes the challenge listener
+func (s *ChallengeServer) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.srv.Shutdown(ctx)
+	})
+}
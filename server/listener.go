@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Environment variables used to hand a listener from an old process to its replacement
+const (
+	envListenerFD = "ANTIBLOCK_LISTENER_FD"
+	envReadyFD    = "ANTIBLOCK_READY_FD"
+)
+
+// Listen returns the listener inherited from a parent process during an
+// upgrade, or a new TCP listener on addr otherwise
+func Listen(addr string) (net.Listener, error) {
+	fd := os.Getenv(envListenerFD)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(envListenerFD)
+
+	num, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envListenerFD, err)
+	}
+
+	file := os.NewFile(uintptr(num), "listener")
+	defer file.Close()
+
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit listener: %w", err)
+	}
+	return ln, nil
+}
+
+// Inherited reports whether this process was started by an upgrade
+func Inherited() bool {
+	return os.Getenv(envReadyFD) != ""
+}
+
+// NotifyReady tells the parent process, if any, that this process is serving
+// so the parent can stop accepting connections and drain
+func NotifyReady() {
+	fd := os.Getenv(envReadyFD)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	num, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+
+	file := os.NewFile(uintptr(num), "ready")
+	file.Write([]byte{1})
+	file.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyReload returns a channel that receives SIGHUP, the signal requesting a configuration reload
+func NotifyReload() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
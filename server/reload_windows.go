@@ -0,0 +1,10 @@
+//go:build windows
+
+package server
+
+import "os"
+
+// NotifyReload returns a channel that never fires; on Windows the configuration is reloaded through the admin API
+func NotifyReload() <-chan os.Signal {
+	return make(chan os.Signal)
+}
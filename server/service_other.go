@@ -0,0 +1,45 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gemini-antiblock/logger"
+)
+
+// HandleServiceCommand handles service management arguments. Service
+// installation is only needed on Windows; elsewhere the proxy runs in the
+// foreground under systemd, launchd or a container runtime.
+func HandleServiceCommand(args []string) (bool, error) {
+	return false, nil
+}
+
+// PrepareService is a no-op outside Windows
+func PrepareService() error {
+	return nil
+}
+
+// NotifyStop returns a channel that is closed when the init system, the
+// container runtime or an interactive Ctrl+C asks the process to stop. A
+// second signal while draining exits immediately.
+func NotifyStop() <-chan struct{} {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+		sig := <-signals
+		logger.LogError(fmt.Sprintf("Received %v while draining, exiting immediately", sig))
+		os.Exit(1)
+	}()
+	return stop
+}
+
+// Stopped is called once draining has finished; it is a no-op outside Windows
+func Stopped() {}
@@ -0,0 +1,175 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"gemini-antiblock/logger"
+)
+
+// ServiceName is the Windows service name used by install and uninstall
+const ServiceName = "GeminiAntiblock"
+
+var (
+	serviceOnce    sync.Once
+	serviceStop    = make(chan struct{})
+	serviceDrained = make(chan struct{})
+	serviceExited  = make(chan struct{})
+	isService      bool
+)
+
+// HandleServiceCommand handles the install and uninstall arguments. It
+// reports whether args contained a service command.
+func HandleServiceCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "install":
+		return true, installService()
+	case "uninstall":
+		return true, uninstallService()
+	}
+	return false, nil
+}
+
+// PrepareService detects whether the process was started by the service
+// control manager. Services start in the system directory, so the working
+// directory is moved next to the executable to find its .env file.
+func PrepareService() error {
+	inService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	isService = inService
+	if !isService {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(filepath.Dir(exe))
+}
+
+// NotifyStop returns a channel that is closed when the service control
+// manager asks the service to stop or the system is shutting down. Run from
+// a console, Ctrl+C stops the proxy instead, and a second Ctrl+C while
+// draining exits immediately.
+func NotifyStop() <-chan struct{} {
+	serviceOnce.Do(func() {
+		if !isService {
+			signals := make(chan os.Signal, 2)
+			signal.Notify(signals, os.Interrupt)
+			go func() {
+				<-signals
+				close(serviceStop)
+				<-signals
+				logger.LogError("Interrupted while draining, exiting immediately")
+				os.Exit(1)
+			}()
+			return
+		}
+		go func() {
+			defer close(serviceExited)
+			if err := svc.Run(ServiceName, &serviceHandler{}); err != nil {
+				logger.LogError("Windows service failed:", err)
+			}
+		}()
+	})
+	return serviceStop
+}
+
+// Stopped reports to the service control manager that draining has finished
+func Stopped() {
+	if !isService {
+		return
+	}
+	close(serviceDrained)
+	<-serviceExited
+}
+
+type serviceHandler struct{}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(serviceStop)
+				<-serviceDrained
+				return false, 0
+			}
+		case <-serviceDrained:
+			return false, 0
+		}
+	}
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(ServiceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", ServiceName)
+	}
+
+	s, err := m.CreateService(ServiceName, exe, mgr.Config{
+		DisplayName: "Gemini Antiblock Proxy",
+		Description: "Gemini API proxy with automatic stream retry",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	fmt.Printf("Service %s installed for %s\n", ServiceName, exe)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ServiceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", ServiceName)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s removed\n", ServiceName)
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Notify sends a state string to systemd over NOTIFY_SOCKET. It is a no-op
+// when the process is not run by systemd with Type=notify.
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// NotifyServing tells systemd the service is ready. A process started by an
+// upgrade also reports its PID so systemd tracks it instead of the old one.
+func NotifyServing(inherited bool) {
+	state := "READY=1"
+	if inherited {
+		state += "\nMAINPID=" + strconv.Itoa(os.Getpid())
+	}
+	if err := Notify(state); err != nil {
+		logger.LogError("Failed to notify systemd:", err)
+	}
+}
+
+// NotifyStopping tells systemd the service is draining before exit
+func NotifyStopping() {
+	if err := Notify("STOPPING=1"); err != nil {
+		logger.LogError("Failed to notify systemd:", err)
+	}
+}
+
+// WatchdogInterval returns the systemd watchdog timeout, or 0 if the watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings the systemd watchdog while a health self-check passes, so
+// a hung instance misses its deadline and is restarted
+type Watchdog struct {
+	interval time.Duration
+	check    func() error
+	stop     chan struct{}
+}
+
+// StartWatchdog starts pinging at half the systemd watchdog timeout. It
+// returns nil when the watchdog is not enabled.
+func StartWatchdog(check func() error) *Watchdog {
+	timeout := WatchdogInterval()
+	if timeout == 0 {
+		return nil
+	}
+
+	w := &Watchdog{
+		interval: timeout / 2,
+		check:    check,
+		stop:     make(chan struct{}),
+	}
+	logger.LogInfo(fmt.Sprintf("systemd watchdog enabled, pinging every %v", w.interval))
+	go w.run()
+	return w
+}
+
+// Stop stops pinging the watchdog
+func (w *Watchdog) Stop() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+}
+
+func (w *Watchdog) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.check(); err != nil {
+				logger.LogError("Health self-check failed, skipping watchdog ping:", err)
+				continue
+			}
+			if err := Notify("WATCHDOG=1"); err != nil {
+				logger.LogError("Failed to ping systemd watchdog:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LoadCertificate creates a TLS configuration serving the certificate and key
+// in the given PEM files
+func LoadCertificate(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// RequireClientCerts makes cfg reject connections that do not present a client
+// certificate signed by one of the CAs in the PEM bundle caFile. The returned
+// certificate is issued by a throwaway CA trusted only by this process, so the
+// proxy can still reach its own health endpoint.
+func RequireClientCerts(cfg *tls.Config, caFile string) (tls.Certificate, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.Certificate{}, fmt.Errorf("no certificates found in client CA bundle %s", caFile)
+	}
+
+	self, err := selfCheckCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pool.AddCert(self.Leaf)
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// The CA's TLS-ALPN-01 validation cannot present a client certificate
+	base := cfg.Clone()
+	challenge := cfg.Clone()
+	challenge.ClientAuth = tls.NoClientCert
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return challenge, nil
+			}
+		}
+		return base, nil
+	}
+	return self, nil
+}
+
+// selfCheckCertificate creates a self-signed client certificate that lives
+// only in memory
+func selfCheckCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating self-check key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generating self-check serial: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "gemini-antiblock self-check"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("creating self-check certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
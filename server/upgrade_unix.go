@@ -0,0 +1,97 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NotifyUpgrade returns a channel that receives SIGUSR2, the signal requesting a binary upgrade
+func NotifyUpgrade() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	return ch
+}
+
+// Upgrade starts a new copy of the current executable that inherits ln, and
+// waits until it reports that it is serving. On success the caller should
+// stop accepting connections and drain its active sessions.
+func Upgrade(ln net.Listener, timeout time.Duration) error {
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener does not support file handoff")
+	}
+
+	listenerFile, err := tcpListener.File()
+	if err != nil {
+		return fmt.Errorf("failed to duplicate listener: %w", err)
+	}
+	defer listenerFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at fd 3 in the child
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter}
+	cmd.Env = append(filteredEnv(), envListenerFD+"=3", envReadyFD+"=4")
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("new process exited before becoming ready: %w", err)
+		}
+		// The new process now owns the listener and outlives us
+		cmd.Process.Release()
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process did not become ready within %v", timeout)
+	}
+}
+
+func filteredEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		// The new process becomes the main PID, so it must not inherit our watchdog identity
+		if strings.HasPrefix(kv, envListenerFD+"=") || strings.HasPrefix(kv, envReadyFD+"=") || strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// NotifyUpgrade returns a channel that never fires; binary upgrades need Unix file descriptor passing
+func NotifyUpgrade() <-chan os.Signal {
+	return make(chan os.Signal)
+}
+
+// Upgrade is not supported on Windows
+func Upgrade(ln net.Listener, timeout time.Duration) error {
+	return errors.New("binary upgrades are not supported on Windows")
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxMemoryRecords bounds each append-only bucket kept in memory
+const maxMemoryRecords = 10000
+
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+func (i memoryItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && now.After(i.expires)
+}
+
+// MemoryStore keeps everything in process memory; data is lost on restart
+type MemoryStore struct {
+	mu      sync.Mutex
+	items   map[string]map[string]memoryItem
+	records map[string][][]byte
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items:   make(map[string]map[string]memoryItem),
+		records: make(map[string][][]byte),
+	}
+}
+
+// Get returns the value stored under key
+func (s *MemoryStore) Get(ctx context.Context, bucket, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[bucket][key]
+	if !ok || item.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), item.value...), nil
+}
+
+// Put stores value under key
+func (s *MemoryStore) Put(ctx context.Context, bucket, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bucket(bucket)[key] = memoryItem{value: append([]byte(nil), value...), expires: expiry(ttl)}
+	return nil
+}
+
+// Delete removes key
+func (s *MemoryStore) Delete(ctx context.Context, bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items[bucket], key)
+	return nil
+}
+
+// Keys lists the unexpired keys of a bucket in sorted order
+func (s *MemoryStore) Keys(ctx context.Context, bucket string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, item := range s.items[bucket] {
+		if item.expired(now) {
+			delete(s.items[bucket], key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Incr adds delta to the counter under key
+func (s *MemoryStore) Incr(ctx context.Context, bucket, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := s.bucket(bucket)
+	item, ok := items[key]
+	var current int64
+	if ok && !item.expired(time.Now()) {
+		current, _ = strconv.ParseInt(string(item.value), 10, 64)
+	} else {
+		item = memoryItem{expires: expiry(ttl)}
+	}
+
+	current += delta
+	item.value = []byte(strconv.FormatInt(current, 10))
+	items[key] = item
+	return current, nil
+}
+
+// Append adds a record, dropping the oldest once the bucket is full
+func (s *MemoryStore) Append(ctx context.Context, bucket string, record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := append(s.records[bucket], append([]byte(nil), record...))
+	if len(records) > maxMemoryRecords {
+		records = records[len(records)-maxMemoryRecords:]
+	}
+	s.records[bucket] = records
+	return nil
+}
+
+// Records returns up to limit of the most recent records
+func (s *MemoryStore) Records(ctx context.Context, bucket string, limit int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := s.records[bucket]
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	result := make([][]byte, len(records))
+	copy(result, records)
+	return result, nil
+}
+
+// Close is a no-op for the memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) bucket(name string) map[string]memoryItem {
+	items, ok := s.items[name]
+	if !ok {
+		items = make(map[string]memoryItem)
+		s.items[name] = items
+	}
+	return items
+}
+
+// expiry converts a ttl to an absolute expiry time; zero means never
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// sqliteMigrations are applied in order; migration i brings the schema to
+// version i+1. Released migrations must never change, only be appended to.
+var sqliteMigrations = []string{
+	// 1: key/value items and append-only records
+	`
+CREATE TABLE IF NOT EXISTS kv (
+	bucket     TEXT    NOT NULL,
+	key        TEXT    NOT NULL,
+	value      BLOB    NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (bucket, key)
+);
+CREATE TABLE IF NOT EXISTS records (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	bucket     TEXT    NOT NULL,
+	created_at INTEGER NOT NULL,
+	value      BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_bucket ON records (bucket, id);
+`,
+}
+
+// migrateSQLite brings the database at path up to the latest schema version.
+// An existing database is backed up before the first migration is applied.
+func migrateSQLite(db *sql.DB, path string) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	latest := len(sqliteMigrations)
+	if version > latest {
+		return fmt.Errorf("database schema version %d is newer than this proxy supports (%d); refusing to use it", version, latest)
+	}
+	if version == latest {
+		return nil
+	}
+
+	if hasData(path) {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().UTC().Format("20060102T150405Z"))
+		if _, err := db.Exec(`VACUUM INTO ?`, backup); err != nil {
+			return fmt.Errorf("failed to back up database before migration: %w", err)
+		}
+		logger.LogInfo(fmt.Sprintf("Backed up database to %s before migrating", backup))
+	}
+
+	for next := version + 1; next <= latest; next++ {
+		if err := applyMigration(db, next); err != nil {
+			return fmt.Errorf("migration to schema version %d failed: %w", next, err)
+		}
+		logger.LogInfo(fmt.Sprintf("Migrated database schema to version %d", next))
+	}
+	return nil
+}
+
+// applyMigration runs one migration and records its version in the same transaction
+func applyMigration(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(sqliteMigrations[version-1]); err != nil {
+		return err
+	}
+	// PRAGMA does not accept bound parameters
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hasData reports whether path is an existing, non-empty database file
+func hasData(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > 0
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces every key the proxy writes
+const redisKeyPrefix = "antiblock:"
+
+// maxRedisRecords bounds each append-only list
+const maxRedisRecords = 100000
+
+// RedisStore persists data in Redis, so several proxy instances can share it
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore connects to the Redis server at url (redis://[user:password@]host:port/db)
+func NewRedisStore(url string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return &RedisStore{client: client}, nil
+}
+
+// Get returns the value stored under key
+func (s *RedisStore) Get(ctx context.Context, bucket, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, redisKey(bucket, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// Put stores value under key
+func (s *RedisStore) Put(ctx context.Context, bucket, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, redisKey(bucket, key), value, ttl).Err()
+}
+
+// Delete removes key
+func (s *RedisStore) Delete(ctx context.Context, bucket, key string) error {
+	return s.client.Del(ctx, redisKey(bucket, key)).Err()
+}
+
+// Keys lists the keys of a bucket in sorted order
+func (s *RedisStore) Keys(ctx context.Context, bucket string) ([]string, error) {
+	prefix := redisKey(bucket, "")
+	var keys []string
+	iter := s.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Incr adds delta to the counter under key
+func (s *RedisStore) Incr(ctx context.Context, bucket, key string, delta int64, ttl time.Duration) (int64, error) {
+	fullKey := redisKey(bucket, key)
+	value, err := s.client.IncrBy(ctx, fullKey, delta).Result()
+	if err != nil {
+		return 0, err
+	}
+	// A counter equal to delta was just created by this call
+	if ttl > 0 && value == delta {
+		if err := s.client.Expire(ctx, fullKey, ttl).Err(); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
+}
+
+// Append adds a record, trimming the oldest once the list is full
+func (s *RedisStore) Append(ctx context.Context, bucket string, record []byte) error {
+	listKey := redisKey(bucket, "records")
+	pipe := s.client.TxPipeline()
+	pipe.RPush(ctx, listKey, record)
+	pipe.LTrim(ctx, listKey, -maxRedisRecords, -1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Records returns up to limit of the most recent records
+func (s *RedisStore) Records(ctx context.Context, bucket string, limit int) ([][]byte, error) {
+	start := int64(0)
+	if limit > 0 {
+		start = int64(-limit)
+	}
+	values, err := s.client.LRange(ctx, redisKey(bucket, "records"), start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([][]byte, len(values))
+	for i, value := range values {
+		records[i] = []byte(value)
+	}
+	return records, nil
+}
+
+// Close closes the connection pool
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func redisKey(bucket, key string) string {
+	return redisKeyPrefix + bucket + ":" + key
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore persists data in a local SQLite database file
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (creating if needed) the database at path
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite allows a single writer; serializing avoids SQLITE_BUSY errors
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db, path); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Get returns the value stored under key
+func (s *SQLiteStore) Get(ctx context.Context, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx,
+		`SELECT value FROM kv WHERE bucket = ? AND key = ? AND (expires_at = 0 OR expires_at > ?)`,
+		bucket, key, time.Now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// Put stores value under key
+func (s *SQLiteStore) Put(ctx context.Context, bucket, key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO kv (bucket, key, value, expires_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		bucket, key, value, expiresAtMillis(ttl))
+	return err
+}
+
+// Delete removes key
+func (s *SQLiteStore) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM kv WHERE bucket = ? AND key = ?`, bucket, key)
+	return err
+}
+
+// Keys lists the unexpired keys of a bucket in sorted order
+func (s *SQLiteStore) Keys(ctx context.Context, bucket string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT key FROM kv WHERE bucket = ? AND (expires_at = 0 OR expires_at > ?) ORDER BY key`,
+		bucket, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Incr adds delta to the counter under key
+func (s *SQLiteStore) Incr(ctx context.Context, bucket, key string, delta int64, ttl time.Duration) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var value []byte
+	var expiresAt int64
+	err = tx.QueryRowContext(ctx, `SELECT value, expires_at FROM kv WHERE bucket = ? AND key = ?`, bucket, key).Scan(&value, &expiresAt)
+	var current int64
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		expiresAt = expiresAtMillis(ttl)
+	case err != nil:
+		return 0, err
+	case expiresAt != 0 && expiresAt <= time.Now().UnixMilli():
+		expiresAt = expiresAtMillis(ttl)
+	default:
+		current, _ = strconv.ParseInt(string(value), 10, 64)
+	}
+
+	current += delta
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO kv (bucket, key, value, expires_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		bucket, key, []byte(strconv.FormatInt(current, 10)), expiresAt); err != nil {
+		return 0, err
+	}
+	return current, tx.Commit()
+}
+
+// Append adds a record
+func (s *SQLiteStore) Append(ctx context.Context, bucket string, record []byte) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO records (bucket, created_at, value) VALUES (?, ?, ?)`,
+		bucket, time.Now().UnixMilli(), record)
+	return err
+}
+
+// Records returns up to limit of the most recent records
+func (s *SQLiteStore) Records(ctx context.Context, bucket string, limit int) ([][]byte, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT value FROM (SELECT id, value FROM records WHERE bucket = ? ORDER BY id DESC LIMIT ?) ORDER BY id`,
+		bucket, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records [][]byte
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		records = append(records, value)
+	}
+	return records, rows.Err()
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// expiresAtMillis converts a ttl to a Unix millisecond expiry; zero means never
+func expiresAtMillis(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixMilli()
+}
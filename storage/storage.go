@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Buckets group the data of each persistence feature
+const (
+	BucketSessions = "sessions"
+	BucketAudit    = "audit"
+	BucketQuotas   = "quotas"
+	BucketMetrics  = "metrics"
+)
+
+// Supported storage backends
+const (
+	BackendMemory = "memory"
+	BackendSQLite = "sqlite"
+	BackendRedis  = "redis"
+)
+
+// defaultSQLitePath is used when the sqlite backend is selected without a DSN
+const defaultSQLitePath = "antiblock.db"
+
+// ErrNotFound is returned when a key does not exist or has expired
+var ErrNotFound = errors.New("storage: key not found")
+
+// Store is the single persistence interface shared by sessions, audit
+// records, quotas and metrics. Values are opaque bytes; features encode their
+// own data.
+type Store interface {
+	// Get returns the value stored under key, or ErrNotFound
+	Get(ctx context.Context, bucket, key string) ([]byte, error)
+	// Put stores value under key; a zero ttl keeps it until deleted
+	Put(ctx context.Context, bucket, key string, value []byte, ttl time.Duration) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, bucket, key string) error
+	// Keys lists the unexpired keys of a bucket
+	Keys(ctx context.Context, bucket string) ([]string, error)
+	// Incr atomically adds delta to the counter under key and returns the new
+	// value. A counter created by this call expires after ttl if non-zero.
+	Incr(ctx context.Context, bucket, key string, delta int64, ttl time.Duration) (int64, error)
+	// Append adds a record to an append-only bucket such as the audit log
+	Append(ctx context.Context, bucket string, record []byte) error
+	// Records returns up to limit of the most recent records of a bucket, oldest first
+	Records(ctx context.Context, bucket string, limit int) ([][]byte, error)
+	// Close releases the backend's resources
+	Close() error
+}
+
+// Open creates the store for backend. dsn is the SQLite file path or the Redis URL.
+func Open(backend, dsn string) (Store, error) {
+	switch strings.ToLower(backend) {
+	case "", BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendSQLite:
+		if dsn == "" {
+			dsn = defaultSQLitePath
+		}
+		return NewSQLiteStore(dsn)
+	case BackendRedis:
+		if dsn == "" {
+			return nil, errors.New("redis storage requires STORAGE_DSN")
+		}
+		return NewRedisStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
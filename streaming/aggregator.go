@@ -0,0 +1,187 @@
+package streaming
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"gemini-antiblock/engine"
+)
+
+// geminiPart is the subset of a Gemini content part the writers understand.
+// Parts other than text are kept verbatim in Raw.
+type geminiPart struct {
+	Text    string `json:"text,omitempty"`
+	Thought bool   `json:"thought,omitempty"`
+	Raw     map[string]interface{}
+}
+
+func (p *geminiPart) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Raw); err != nil {
+		return err
+	}
+	p.Text, _ = p.Raw["text"].(string)
+	p.Thought, _ = p.Raw["thought"].(bool)
+	return nil
+}
+
+type geminiChunk struct {
+	Candidates []struct {
+		Content struct {
+			Parts []geminiPart `json:"parts"`
+		} `json:"content"`
+		FinishReason  string        `json:"finishReason"`
+		SafetyRatings []interface{} `json:"safetyRatings"`
+	} `json:"candidates"`
+	PromptFeedback map[string]interface{} `json:"promptFeedback"`
+	UsageMetadata  map[string]interface{} `json:"usageMetadata"`
+	ModelVersion   string                 `json:"modelVersion"`
+}
+
+// decodeChunk parses a Gemini SSE data line
+func decodeChunk(line string) (geminiChunk, bool) {
+	var chunk geminiChunk
+	if !engine.IsDataLine(line) {
+		return chunk, false
+	}
+	if err := json.Unmarshal([]byte(line[len("data: "):]), &chunk); err != nil {
+		return chunk, false
+	}
+	return chunk, true
+}
+
+// JSONAggregator collects a whole stream and writes it as a single
+// generateContent response when closed
+type JSONAggregator struct {
+	dst io.Writer
+
+	parts          []interface{}
+	text           string
+	finishReason   string
+	safetyRatings  []interface{}
+	promptFeedback map[string]interface{}
+	usageMetadata  map[string]interface{}
+	modelVersion   string
+	errPayload     []byte
+}
+
+// NewJSONAggregator creates an aggregator that writes the final response to dst
+func NewJSONAggregator(dst io.Writer) *JSONAggregator {
+	return &JSONAggregator{dst: dst}
+}
+
+// WriteData merges a Gemini chunk into the aggregated response
+func (a *JSONAggregator) WriteData(line string) error {
+	chunk, ok := decodeChunk(line)
+	if !ok {
+		return nil
+	}
+
+	if chunk.PromptFeedback != nil {
+		a.promptFeedback = chunk.PromptFeedback
+	}
+	if chunk.UsageMetadata != nil {
+		a.usageMetadata = chunk.UsageMetadata
+	}
+	if chunk.ModelVersion != "" {
+		a.modelVersion = chunk.ModelVersion
+	}
+	if len(chunk.Candidates) == 0 {
+		return nil
+	}
+
+	candidate := chunk.Candidates[0]
+	for _, part := range candidate.Content.Parts {
+		if part.Thought {
+			continue
+		}
+		if _, isText := part.Raw["text"]; isText {
+			a.text += part.Text
+			continue
+		}
+		a.flushText()
+		a.parts = append(a.parts, part.Raw)
+	}
+	if candidate.FinishReason != "" {
+		a.finishReason = candidate.FinishReason
+	}
+	if candidate.SafetyRatings != nil {
+		a.safetyRatings = candidate.SafetyRatings
+	}
+	return nil
+}
+
+// WriteError records a terminal error; it replaces the aggregated response
+func (a *JSONAggregator) WriteError(payload []byte) error {
+	a.errPayload = payload
+	return nil
+}
+
+// Close writes the aggregated response, or the error if one was reported
+func (a *JSONAggregator) Close() error {
+	rw, isResponseWriter := a.dst.(http.ResponseWriter)
+
+	if a.errPayload != nil {
+		if isResponseWriter {
+			var upstreamErr struct {
+				Error struct {
+					Code int `json:"code"`
+				} `json:"error"`
+			}
+			json.Unmarshal(a.errPayload, &upstreamErr)
+			status := upstreamErr.Error.Code
+			if status < 400 || status > 599 {
+				status = http.StatusBadGateway
+			}
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(status)
+		}
+		_, err := a.dst.Write(a.errPayload)
+		return err
+	}
+
+	a.flushText()
+	if a.parts == nil {
+		a.parts = []interface{}{}
+	}
+	candidate := map[string]interface{}{
+		"content": map[string]interface{}{
+			"parts": a.parts,
+			"role":  "model",
+		},
+		"index": 0,
+	}
+	if a.finishReason != "" {
+		candidate["finishReason"] = a.finishReason
+	}
+	if a.safetyRatings != nil {
+		candidate["safetyRatings"] = a.safetyRatings
+	}
+
+	response := map[string]interface{}{
+		"candidates": []interface{}{candidate},
+	}
+	if a.promptFeedback != nil {
+		response["promptFeedback"] = a.promptFeedback
+	}
+	if a.usageMetadata != nil {
+		response["usageMetadata"] = a.usageMetadata
+	}
+	if a.modelVersion != "" {
+		response["modelVersion"] = a.modelVersion
+	}
+
+	if isResponseWriter {
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+	}
+	return json.NewEncoder(a.dst).Encode(response)
+}
+
+func (a *JSONAggregator) flushText() {
+	if a.text == "" {
+		return
+	}
+	a.parts = append(a.parts, map[string]interface{}{"text": a.text})
+	a.text = ""
+}
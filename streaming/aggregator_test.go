@@ -0,0 +1,110 @@
+package streaming
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONAggregator(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{
+			name: "text parts joined",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"Hello, "}]}}]}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"world"}]},"finishReason":"STOP"}]}`,
+			},
+			want: `{"candidates":[{"content":{"parts":[{"text":"Hello, world"}],"role":"model"},"finishReason":"STOP","index":0}]}`,
+		},
+		{
+			name: "thoughts dropped and function calls kept in order",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"plan","thought":true},{"text":"Looking "}]}}]}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"it up."},{"functionCall":{"name":"lookup"}}]}}]}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"Done"}]},"finishReason":"STOP"}]}`,
+			},
+			want: `{"candidates":[{"content":{"parts":[{"text":"Looking it up."},{"functionCall":{"name":"lookup"}},{"text":"Done"}],"role":"model"},"finishReason":"STOP","index":0}]}`,
+		},
+		{
+			name: "latest usage, safety ratings and model version kept",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"a"}]},"safetyRatings":[{"category":"X"}]}],"usageMetadata":{"totalTokenCount":3},"modelVersion":"v1"}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"b"}]},"finishReason":"STOP"}],"usageMetadata":{"totalTokenCount":5}}`,
+			},
+			want: `{"candidates":[{"content":{"parts":[{"text":"ab"}],"role":"model"},"finishReason":"STOP","index":0,"safetyRatings":[{"category":"X"}]}],"modelVersion":"v1","usageMetadata":{"totalTokenCount":5}}`,
+		},
+		{
+			name:  "prompt feedback without candidates",
+			lines: []string{`data: {"promptFeedback":{"blockReason":"OTHER"}}`, ": keepalive"},
+			want:  `{"candidates":[{"content":{"parts":[],"role":"model"},"index":0}],"promptFeedback":{"blockReason":"OTHER"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			a := NewJSONAggregator(recorder)
+			for _, line := range tt.lines {
+				if err := a.WriteData(line); err != nil {
+					t.Fatalf("WriteData error = %v", err)
+				}
+			}
+			if err := a.Close(); err != nil {
+				t.Fatalf("Close error = %v", err)
+			}
+
+			if recorder.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", recorder.Code)
+			}
+			if got := compactJSON(t, recorder.Body.Bytes()); got != tt.want {
+				t.Errorf("response = %s\nwant       %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONAggregatorError(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		wantStatus int
+	}{
+		{"status from error code", `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED"}}`, http.StatusTooManyRequests},
+		{"non-error code becomes bad gateway", `{"error":{"code":200}}`, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			a := NewJSONAggregator(recorder)
+			a.WriteData(`data: {"candidates":[{"content":{"parts":[{"text":"partial"}]}}]}`)
+			a.WriteError([]byte(tt.payload))
+			if err := a.Close(); err != nil {
+				t.Fatalf("Close error = %v", err)
+			}
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if recorder.Body.String() != tt.payload {
+				t.Errorf("body = %q, want the error payload", recorder.Body.String())
+			}
+		})
+	}
+}
+
+// compactJSON re-encodes a JSON document with sorted keys for comparison
+func compactJSON(t *testing.T, data []byte) string {
+	t.Helper()
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("response is not JSON: %v (%q)", err, data)
+	}
+	out, _ := json.Marshal(decoded)
+	return string(out)
+}
@@ -0,0 +1,35 @@
+package streaming
+
+import "sync"
+
+// doneTokenCaches holds cachedContent names whose system instruction includes the done token prompt
+var doneTokenCaches sync.Map
+
+// CachedContentName returns the cachedContent reference of a request body, or "" if it has none.
+// Gemini rejects systemInstruction, tools and toolConfig alongside a cache reference,
+// so such requests must not be mutated beyond their contents.
+func CachedContentName(body map[string]interface{}) string {
+	name, _ := body["cachedContent"].(string)
+	return name
+}
+
+// RegisterDoneTokenCache records a cache created by the proxy whose system instruction asks for the done token
+func RegisterDoneTokenCache(name string) {
+	doneTokenCaches.Store(name, struct{}{})
+}
+
+// UnregisterDoneTokenCache forgets a cache registered with RegisterDoneTokenCache
+func UnregisterDoneTokenCache(name string) {
+	doneTokenCaches.Delete(name)
+}
+
+// ExpectsDoneToken reports whether the model was instructed to end its output
+// with the done token: always for uncached requests, and for caches the proxy created itself
+func ExpectsDoneToken(body map[string]interface{}) bool {
+	name := CachedContentName(body)
+	if name == "" {
+		return true
+	}
+	_, ok := doneTokenCaches.Load(name)
+	return ok
+}
@@ -0,0 +1,249 @@
+package streaming
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Slow consumer policies
+const (
+	SlowConsumerPolicyPause = "pause"
+	SlowConsumerPolicyDrop  = "drop"
+)
+
+// ErrSlowConsumer is returned when a client falls too far behind the upstream stream
+var ErrSlowConsumer = errors.New("client dropped as slow consumer")
+
+// stallFactor bounds the pause policy: a client whose pending write has made
+// no progress for this many thresholds is dropped, as it has stopped reading
+const stallFactor = 6
+
+type queuedChunk struct {
+	data     []byte
+	queuedAt time.Time
+}
+
+// ConsumerWriter buffers output for the client in a background goroutine so a
+// slow reader does not silently back-pressure the retry loop. Once the buffer
+// limit is reached it either pauses the caller or drops the client.
+type ConsumerWriter struct {
+	dst       io.Writer
+	threshold time.Duration
+	maxBuffer int
+	policy    string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []queuedChunk
+	buffered int
+	slow     bool
+	closed   bool
+	// deliveredAt is when the last chunk reached the client
+	deliveredAt time.Time
+	err         error
+	done        chan struct{}
+}
+
+// NewConsumerWriter creates a ConsumerWriter and starts its delivery goroutine
+func NewConsumerWriter(dst io.Writer, threshold time.Duration, maxBuffer int, policy string) *ConsumerWriter {
+	c := &ConsumerWriter{
+		dst:       dst,
+		threshold: threshold,
+		maxBuffer: maxBuffer,
+		policy:    policy,
+		done:      make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// Write queues p for delivery to the client
+func (c *ConsumerWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pausedAt time.Time
+	for c.err == nil && c.buffered > 0 && c.buffered+len(p) > c.maxBuffer {
+		c.markSlowLocked()
+		if c.slow && c.policy == SlowConsumerPolicyDrop {
+			logger.LogError(fmt.Sprintf("Slow consumer exceeded buffer limit (%d bytes buffered, limit %d). Dropping client.", c.buffered, c.maxBuffer))
+			c.err = ErrSlowConsumer
+			c.abortLocked()
+			return 0, c.err
+		}
+		if stalled := c.stalledLocked(); stalled > c.stallLimit() {
+			logger.LogError(fmt.Sprintf("Paused client made no progress for %v. Dropping client.", stalled))
+			c.err = ErrSlowConsumer
+			c.abortLocked()
+			return 0, c.err
+		}
+		if pausedAt.IsZero() {
+			pausedAt = time.Now()
+			logger.LogDebug(fmt.Sprintf("Client buffer full (%d bytes). Pausing upstream read until the client catches up.", c.buffered))
+		}
+		c.waitLocked()
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if !pausedAt.IsZero() {
+		logger.LogDebug(fmt.Sprintf("Resuming upstream read after pausing for %v", time.Since(pausedAt)))
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.queue = append(c.queue, queuedChunk{data: data, queuedAt: time.Now()})
+	c.buffered += len(data)
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+// Flush is a no-op; every chunk is flushed as soon as it is delivered
+func (c *ConsumerWriter) Flush() {}
+
+// Close waits until all queued output has been delivered and returns the first
+// delivery error. A client that stops reading is dropped once it has made no
+// progress for the stall limit, so Close does not wait on it forever.
+func (c *ConsumerWriter) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	interval := c.threshold
+	if interval <= 0 {
+		interval = time.Second
+	}
+	check := time.NewTicker(interval)
+	defer check.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		case <-check.C:
+			c.mu.Lock()
+			if stalled := c.stalledLocked(); stalled > c.stallLimit() {
+				logger.LogError(fmt.Sprintf("Client made no progress for %v while the stream was closing. Dropping client.", stalled))
+				if c.err == nil {
+					c.err = ErrSlowConsumer
+				}
+				c.abortLocked()
+				err := c.err
+				c.mu.Unlock()
+				return err
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *ConsumerWriter) run() {
+	defer close(c.done)
+
+	flusher, _ := c.dst.(http.Flusher)
+
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closed && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil || len(c.queue) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		chunk := c.queue[0]
+		c.mu.Unlock()
+
+		start := time.Now()
+		_, err := c.dst.Write(chunk.data)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		elapsed := time.Since(start)
+
+		c.mu.Lock()
+		c.queue = c.queue[1:]
+		c.buffered -= len(chunk.data)
+		c.deliveredAt = time.Now()
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		if elapsed > c.threshold && !c.slow {
+			c.slow = true
+			logger.LogError(fmt.Sprintf("Slow consumer detected: client write took %v (threshold %v)", elapsed, c.threshold))
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// waitLocked waits for the delivery goroutine to make progress. A client that
+// stopped reading blocks delivery without ever signalling, so the wait also
+// ends when the oldest queued chunk crosses the threshold, or once flagged
+// slow when delivery has stalled past the stall limit, letting Write re-check.
+func (c *ConsumerWriter) waitLocked() {
+	if len(c.queue) == 0 {
+		c.cond.Wait()
+		return
+	}
+	wait := c.threshold - time.Since(c.queue[0].queuedAt)
+	if c.slow {
+		wait = c.stallLimit() - c.stalledLocked()
+	}
+	recheck := time.AfterFunc(wait, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	c.cond.Wait()
+	recheck.Stop()
+}
+
+// markSlowLocked flags the consumer as slow if the oldest queued chunk has waited past the threshold
+func (c *ConsumerWriter) markSlowLocked() {
+	if c.slow || len(c.queue) == 0 {
+		return
+	}
+	if lag := time.Since(c.queue[0].queuedAt); lag > c.threshold {
+		c.slow = true
+		logger.LogError(fmt.Sprintf("Slow consumer detected: oldest buffered chunk waiting %v (threshold %v)", lag, c.threshold))
+	}
+}
+
+// stallLimit is how long a client may go without progress before it is dropped
+func (c *ConsumerWriter) stallLimit() time.Duration {
+	return stallFactor * c.threshold
+}
+
+// stalledLocked returns how long the chunk at the head of the queue has been
+// waiting for delivery, counted from when the previous chunk was delivered
+func (c *ConsumerWriter) stalledLocked() time.Duration {
+	if len(c.queue) == 0 {
+		return 0
+	}
+	since := c.queue[0].queuedAt
+	if c.deliveredAt.After(since) {
+		since = c.deliveredAt
+	}
+	return time.Since(since)
+}
+
+// abortLocked unblocks a pending client write so the delivery goroutine can exit
+func (c *ConsumerWriter) abortLocked() {
+	c.cond.Broadcast()
+	if rw, ok := c.dst.(http.ResponseWriter); ok {
+		if err := http.NewResponseController(rw).SetWriteDeadline(time.Now()); err != nil {
+			logger.LogDebug("Failed to set write deadline on dropped client:", err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package streaming
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter never returns from Write, like a client that stopped reading
+type blockingWriter struct {
+	block chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.block
+	return len(p), nil
+}
+
+// syncBuffer is a bytes.Buffer safe for the delivery goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConsumerWriterDelivers(t *testing.T) {
+	dst := &syncBuffer{}
+	c := NewConsumerWriter(dst, time.Second, 1<<10, SlowConsumerPolicyPause)
+	for _, chunk := range []string{"one ", "two ", "three"} {
+		if _, err := c.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write(%q) error = %v", chunk, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if dst.String() != "one two three" {
+		t.Errorf("delivered %q", dst.String())
+	}
+}
+
+func TestConsumerWriterDropsStalledClient(t *testing.T) {
+	for _, policy := range []string{SlowConsumerPolicyPause, SlowConsumerPolicyDrop} {
+		t.Run(policy, func(t *testing.T) {
+			dst := &blockingWriter{block: make(chan struct{})}
+			defer close(dst.block)
+			c := NewConsumerWriter(dst, 10*time.Millisecond, 8, policy)
+
+			writeErr := make(chan error, 1)
+			go func() {
+				for {
+					if _, err := c.Write([]byte("chunk")); err != nil {
+						writeErr <- err
+						return
+					}
+				}
+			}()
+			select {
+			case err := <-writeErr:
+				if !errors.Is(err, ErrSlowConsumer) {
+					t.Errorf("Write() error = %v, want ErrSlowConsumer", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Write blocked on a client that stopped reading")
+			}
+
+			closed := make(chan error, 1)
+			go func() { closed <- c.Close() }()
+			select {
+			case err := <-closed:
+				if !errors.Is(err, ErrSlowConsumer) {
+					t.Errorf("Close() error = %v, want ErrSlowConsumer", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close blocked on a client that stopped reading")
+			}
+		})
+	}
+}
+
+func TestConsumerWriterCloseReturnsOnStalledClient(t *testing.T) {
+	dst := &blockingWriter{block: make(chan struct{})}
+	defer close(dst.block)
+	c := NewConsumerWriter(dst, 10*time.Millisecond, 1<<10, SlowConsumerPolicyPause)
+	if _, err := c.Write([]byte("never read")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, ErrSlowConsumer) {
+			t.Errorf("Close() error = %v, want ErrSlowConsumer", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on a client that stopped reading")
+	}
+}
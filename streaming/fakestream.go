@@ -0,0 +1,180 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// fakeStreamChunkRunes is the size of the synthetic text chunks sent to the client
+const fakeStreamChunkRunes = 100
+
+// NewFakeStreamClient returns a client that answers streamGenerateContent
+// requests by calling generateContent upstream and converting the response
+// into SSE events, for upstreams that filter streaming endpoints harder.
+// Everything built on top, including retries, sees an ordinary stream.
+func NewFakeStreamClient(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	fake := *client
+	fake.Transport = &fakeStreamTransport{base: base}
+	return &fake
+}
+
+type fakeStreamTransport struct {
+	base http.RoundTripper
+}
+
+func (t *fakeStreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, ":streamGenerateContent") {
+		return t.base.RoundTrip(req)
+	}
+
+	rewritten := req.Clone(req.Context())
+	u := *req.URL
+	u.Path = strings.Replace(u.Path, ":streamGenerateContent", ":generateContent", 1)
+	query := u.Query()
+	query.Del("alt")
+	u.RawQuery = query.Encode()
+	rewritten.URL = &u
+	rewritten.Header.Set("Accept", "application/json")
+
+	resp, err := t.base.RoundTrip(rewritten)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	events, err := fakeStreamEvents(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(events))
+	resp.ContentLength = int64(len(events))
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "text/event-stream")
+	return resp, nil
+}
+
+// fakeStreamEvents splits a generateContent response into SSE events: one per
+// part, with text parts cut into chunks. The finish reason, safety ratings and
+// usage metadata go on the last event only, as in a real stream.
+func fakeStreamEvents(body []byte) ([]byte, error) {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("invalid generateContent response: %w", err)
+	}
+
+	candidates, _ := response["candidates"].([]interface{})
+	if len(candidates) != 1 {
+		return singleEvent(response)
+	}
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return singleEvent(response)
+	}
+	content, _ := candidate["content"].(map[string]interface{})
+	parts, _ := content["parts"].([]interface{})
+	if len(parts) == 0 {
+		return singleEvent(response)
+	}
+
+	var chunks []interface{}
+	for _, p := range parts {
+		part, ok := p.(map[string]interface{})
+		text, isText := part["text"].(string)
+		if !ok || !isText {
+			chunks = append(chunks, p)
+			continue
+		}
+		for _, piece := range splitFromEnd(text, fakeStreamChunkRunes) {
+			chunk := make(map[string]interface{}, len(part))
+			for k, v := range part {
+				chunk[k] = v
+			}
+			chunk["text"] = piece
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	var out bytes.Buffer
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+
+		eventContent := map[string]interface{}{"parts": []interface{}{chunk}}
+		copyField(eventContent, content, "role")
+		eventCandidate := map[string]interface{}{"content": eventContent}
+		copyField(eventCandidate, candidate, "index")
+		event := map[string]interface{}{"candidates": []interface{}{eventCandidate}}
+		copyField(event, response, "modelVersion")
+		if last {
+			for k, v := range candidate {
+				if k != "content" {
+					eventCandidate[k] = v
+				}
+			}
+			for k, v := range response {
+				if k != "candidates" {
+					event[k] = v
+				}
+			}
+		}
+		if err := writeEvent(&out, event); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func copyField(dst, src map[string]interface{}, key string) {
+	if v, ok := src[key]; ok {
+		dst[key] = v
+	}
+}
+
+func singleEvent(response map[string]interface{}) ([]byte, error) {
+	var out bytes.Buffer
+	if err := writeEvent(&out, response); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func writeEvent(out *bytes.Buffer, event map[string]interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	out.WriteString("data: ")
+	out.Write(data)
+	out.WriteString("\n\n")
+	return nil
+}
+
+// splitFromEnd cuts text into chunks of size runes, counting from the end so
+// the last chunk is whole and a completion marker at the end is never split
+func splitFromEnd(text string, size int) []string {
+	runes := []rune(text)
+	if len(runes) <= size {
+		return []string{text}
+	}
+	first := len(runes) % size
+	var pieces []string
+	if first > 0 {
+		pieces = append(pieces, string(runes[:first]))
+	}
+	for i := first; i < len(runes); i += size {
+		pieces = append(pieces, string(runes[i:i+size]))
+	}
+	return pieces
+}
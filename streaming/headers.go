@@ -0,0 +1,35 @@
+package streaming
+
+import "net/http"
+
+// BuildUpstreamHeaders builds the headers for an upstream request. Streaming
+// requests always carry a JSON body and expect SSE, so their Content-Type and
+// Accept are normalized instead of copied from the client; this is shared by
+// the initial request and every retry.
+func BuildUpstreamHeaders(reqHeaders http.Header, stream bool) http.Header {
+	headers := make(http.Header)
+
+	// Copy credentials
+	if auth := reqHeaders.Get("Authorization"); auth != "" {
+		headers.Set("Authorization", auth)
+	}
+	if apiKey := reqHeaders.Get("X-Goog-Api-Key"); apiKey != "" {
+		headers.Set("X-Goog-Api-Key", apiKey)
+	}
+
+	if stream {
+		headers.Set("Content-Type", "application/json")
+		headers.Set("Accept", "text/event-stream")
+		return headers
+	}
+
+	// Non-streaming requests may carry arbitrary payloads (e.g. file uploads)
+	if contentType := reqHeaders.Get("Content-Type"); contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+	if accept := reqHeaders.Get("Accept"); accept != "" {
+		headers.Set("Accept", accept)
+	}
+
+	return headers
+}
@@ -0,0 +1,126 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// OpenAIChunkWriter converts Gemini SSE events into OpenAI chat.completion.chunk events
+type OpenAIChunkWriter struct {
+	dst     io.Writer
+	id      string
+	model   string
+	created int64
+	started bool
+}
+
+// NewOpenAIChunkWriter creates a writer that emits OpenAI-compatible streaming chunks to dst
+func NewOpenAIChunkWriter(dst io.Writer, id, model string) *OpenAIChunkWriter {
+	return &OpenAIChunkWriter{
+		dst:     dst,
+		id:      id,
+		model:   model,
+		created: time.Now().Unix(),
+	}
+}
+
+// WriteData converts the non-thought text and finish reason of a Gemini chunk into an OpenAI chunk
+func (o *OpenAIChunkWriter) WriteData(line string) error {
+	chunk, ok := decodeChunk(line)
+	if !ok {
+		return nil
+	}
+
+	var text strings.Builder
+	var finishReason string
+	if len(chunk.Candidates) > 0 {
+		candidate := chunk.Candidates[0]
+		for _, part := range candidate.Content.Parts {
+			if !part.Thought {
+				text.WriteString(part.Text)
+			}
+		}
+		finishReason = openAIFinishReason(candidate.FinishReason)
+	}
+	if text.Len() == 0 && finishReason == "" {
+		return nil
+	}
+
+	delta := map[string]interface{}{}
+	if !o.started {
+		delta["role"] = "assistant"
+		o.started = true
+	}
+	if text.Len() > 0 {
+		delta["content"] = text.String()
+	}
+
+	choice := map[string]interface{}{
+		"index":         0,
+		"delta":         delta,
+		"finish_reason": nil,
+	}
+	if finishReason != "" {
+		choice["finish_reason"] = finishReason
+	}
+
+	return o.writeEvent(map[string]interface{}{
+		"id":      o.id,
+		"object":  "chat.completion.chunk",
+		"created": o.created,
+		"model":   o.model,
+		"choices": []interface{}{choice},
+	})
+}
+
+// WriteError emits the Gemini error payload as an OpenAI error event
+func (o *OpenAIChunkWriter) WriteError(payload []byte) error {
+	var upstreamErr struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	json.Unmarshal(payload, &upstreamErr)
+
+	return o.writeEvent(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": upstreamErr.Error.Message,
+			"type":    upstreamErr.Error.Status,
+			"code":    upstreamErr.Error.Code,
+		},
+	})
+}
+
+// Close terminates the stream with the OpenAI [DONE] sentinel
+func (o *OpenAIChunkWriter) Close() error {
+	_, err := io.WriteString(o.dst, "data: [DONE]\n\n")
+	return err
+}
+
+func (o *OpenAIChunkWriter) writeEvent(event interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(o.dst, "data: %s\n\n", data)
+	return err
+}
+
+// openAIFinishReason maps a Gemini finish reason to its OpenAI equivalent
+func openAIFinishReason(reason string) string {
+	switch reason {
+	case "":
+		return ""
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	default:
+		return "content_filter"
+	}
+}
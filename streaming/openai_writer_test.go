@@ -0,0 +1,115 @@
+package streaming
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// openAIEvents decodes the data events written by an OpenAIChunkWriter
+func openAIEvents(t *testing.T, output string) []map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	for _, event := range strings.Split(strings.TrimSuffix(output, "\n\n"), "\n\n") {
+		payload := strings.TrimPrefix(event, "data: ")
+		if payload == "[DONE]" {
+			events = append(events, nil)
+			continue
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+			t.Fatalf("event %q is not JSON: %v", event, err)
+		}
+		events = append(events, decoded)
+	}
+	return events
+}
+
+func TestOpenAIChunkWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		// deltas are the expected delta and finish_reason of each chunk
+		deltas []map[string]interface{}
+		finish []interface{}
+	}{
+		{
+			name: "role on first chunk only",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"Hel"}]}}]}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"lo"}]}}]}`,
+			},
+			deltas: []map[string]interface{}{{"role": "assistant", "content": "Hel"}, {"content": "lo"}},
+			finish: []interface{}{nil, nil},
+		},
+		{
+			name: "thoughts dropped",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"hmm","thought":true}]}}]}`,
+				`data: {"candidates":[{"content":{"parts":[{"text":"hmm","thought":true},{"text":"Hi"}]}}]}`,
+			},
+			deltas: []map[string]interface{}{{"role": "assistant", "content": "Hi"}},
+			finish: []interface{}{nil},
+		},
+		{
+			name: "finish reasons mapped",
+			lines: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"a"}]},"finishReason":"MAX_TOKENS"}]}`,
+				`data: {"candidates":[{"finishReason":"STOP"}]}`,
+				`data: {"candidates":[{"finishReason":"SAFETY"}]}`,
+			},
+			deltas: []map[string]interface{}{{"role": "assistant", "content": "a"}, {}, {}},
+			finish: []interface{}{"length", "stop", "content_filter"},
+		},
+		{
+			name:  "non-data lines ignored",
+			lines: []string{": keepalive", "data: not json"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := NewOpenAIChunkWriter(&out, "chatcmpl-1", "gemini-test")
+			for _, line := range tt.lines {
+				if err := w.WriteData(line); err != nil {
+					t.Fatalf("WriteData error = %v", err)
+				}
+			}
+			w.Close()
+
+			events := openAIEvents(t, out.String())
+			if len(events) != len(tt.deltas)+1 || events[len(events)-1] != nil {
+				t.Fatalf("got %d events ending %v, want %d chunks and [DONE]", len(events), events[len(events)-1], len(tt.deltas))
+			}
+			for i, want := range tt.deltas {
+				event := events[i]
+				if event["object"] != "chat.completion.chunk" || event["id"] != "chatcmpl-1" || event["model"] != "gemini-test" {
+					t.Errorf("chunk %d header = %v", i, event)
+				}
+				choice := event["choices"].([]interface{})[0].(map[string]interface{})
+				delta, _ := json.Marshal(choice["delta"])
+				wantDelta, _ := json.Marshal(want)
+				if string(delta) != string(wantDelta) {
+					t.Errorf("chunk %d delta = %s, want %s", i, delta, wantDelta)
+				}
+				if choice["finish_reason"] != tt.finish[i] {
+					t.Errorf("chunk %d finish_reason = %v, want %v", i, choice["finish_reason"], tt.finish[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAIChunkWriterError(t *testing.T) {
+	var out strings.Builder
+	w := NewOpenAIChunkWriter(&out, "chatcmpl-1", "gemini-test")
+	if err := w.WriteError([]byte(`{"error":{"code":502,"message":"Retry limit exceeded","status":"UNAVAILABLE"}}`)); err != nil {
+		t.Fatalf("WriteError error = %v", err)
+	}
+
+	want := "data: {\"error\":{\"code\":502,\"message\":\"Retry limit exceeded\",\"type\":\"UNAVAILABLE\"}}\n\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
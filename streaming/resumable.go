@@ -0,0 +1,244 @@
+package streaming
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEventsDropped is returned when a client resumes from an event the
+// session no longer buffers
+var ErrEventsDropped = errors.New("the events to resume from are no longer buffered")
+
+type resumableEvent struct {
+	payload []byte
+	isError bool
+}
+
+// ResumableSession buffers the output of a streaming session, so a client
+// that loses the connection can reconnect and pick up where it dropped. The
+// engine writes to the session, never to the client; clients follow it. When
+// no client has followed the session for the store's TTL, it is abandoned
+// and its generation cancelled.
+type ResumableSession struct {
+	ID    string
+	owner string
+	store *ResumeStore
+
+	mu       sync.Mutex
+	events   []resumableEvent
+	base     int // number of events dropped from the front of events
+	bytes    int
+	done     bool
+	finished time.Time
+	changed  chan struct{}
+	clients  int
+	abandon  *time.Timer
+	cancel   context.CancelFunc
+}
+
+// WriteData buffers an SSE data line
+func (s *ResumableSession) WriteData(line string) error {
+	s.append(resumableEvent{payload: []byte(line)})
+	return nil
+}
+
+// WriteError buffers a terminal error payload
+func (s *ResumableSession) WriteError(payload []byte) error {
+	s.append(resumableEvent{payload: payload, isError: true})
+	return nil
+}
+
+// Close marks the session complete; followers return once they have sent every event
+func (s *ResumableSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		s.done = true
+		s.finished = time.Now()
+		if s.abandon != nil {
+			s.abandon.Stop()
+		}
+		close(s.changed)
+	}
+	return nil
+}
+
+// append adds an event, dropping the oldest ones while the buffer is over its limit
+func (s *ResumableSession) append(event resumableEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	s.bytes += len(event.payload)
+	for s.bytes > s.store.maxBytes && len(s.events) > 1 {
+		s.bytes -= len(s.events[0].payload)
+		s.events[0] = resumableEvent{}
+		s.events = s.events[1:]
+		s.base++
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// EventID returns the SSE id of the event at index
+func (s *ResumableSession) EventID(index int) string {
+	return s.ID + "-" + strconv.Itoa(index+1)
+}
+
+// Follow sends the events from index next on to out, giving each its SSE id,
+// and keeps sending new ones until the session is complete or ctx ends
+func (s *ResumableSession) Follow(ctx context.Context, next int, out *SSEWriter) error {
+	s.attach()
+	defer s.detach()
+	for {
+		s.mu.Lock()
+		if next < s.base {
+			s.mu.Unlock()
+			return ErrEventsDropped
+		}
+		pending := append([]resumableEvent(nil), s.events[next-s.base:]...)
+		done, changed := s.done, s.changed
+		s.mu.Unlock()
+
+		for _, event := range pending {
+			var err error
+			if event.isError {
+				err = out.WriteErrorID(s.EventID(next), event.payload)
+			} else {
+				err = out.WriteDataID(s.EventID(next), string(event.payload))
+			}
+			if err != nil {
+				return err
+			}
+			next++
+		}
+		if len(pending) > 0 {
+			continue
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *ResumableSession) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients++
+	if s.abandon != nil {
+		s.abandon.Stop()
+	}
+}
+
+// detach starts the abandonment timer once the last client has gone
+func (s *ResumableSession) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients--
+	if s.clients > 0 || s.done {
+		return
+	}
+	s.abandon = time.AfterFunc(s.store.ttl, func() {
+		s.mu.Lock()
+		abandoned := s.clients == 0 && !s.done
+		s.mu.Unlock()
+		if abandoned {
+			s.cancel()
+		}
+	})
+}
+
+// expired reports whether the session is complete and has been kept for the TTL
+func (s *ResumableSession) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done && s.clients == 0 && now.Sub(s.finished) > s.store.ttl
+}
+
+// ResumeStore holds the resumable sessions in progress and, for ttl after
+// they end, those completed
+type ResumeStore struct {
+	ttl      time.Duration
+	maxBytes int
+
+	mu       sync.Mutex
+	sessions map[string]*ResumableSession
+}
+
+// NewResumeStore creates a store keeping sessions for ttl after they end or
+// lose their last client, buffering at most maxBytes of events for each
+func NewResumeStore(ttl time.Duration, maxBytes int) *ResumeStore {
+	if maxBytes <= 0 {
+		maxBytes = 1 << 20
+	}
+	return &ResumeStore{ttl: ttl, maxBytes: maxBytes, sessions: make(map[string]*ResumableSession)}
+}
+
+// Start creates a session for owner. Abandoning the session calls cancel.
+func (st *ResumeStore) Start(owner string, cancel context.CancelFunc) *ResumableSession {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	s := &ResumableSession{
+		ID:      hex.EncodeToString(buf),
+		owner:   owner,
+		store:   st,
+		changed: make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+	st.sessions[s.ID] = s
+	return s
+}
+
+// Lookup finds the session a reconnecting client asks for, given the
+// Last-Event-ID it received last or, for a replay from the start, the session
+// ID. It returns the session and the index of the first event to send.
+func (st *ResumeStore) Lookup(owner, lastEventID, sessionID string) (*ResumableSession, int, error) {
+	next := 0
+	if lastEventID != "" {
+		cut := strings.LastIndex(lastEventID, "-")
+		seq, err := strconv.Atoi(lastEventID[cut+1:])
+		if cut == -1 || err != nil || seq < 1 {
+			return nil, 0, fmt.Errorf("invalid Last-Event-ID %q", lastEventID)
+		}
+		sessionID, next = lastEventID[:cut], seq
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+	s, ok := st.sessions[sessionID]
+	if !ok || s.owner != owner {
+		return nil, 0, fmt.Errorf("stream session %s is unknown or has expired", sessionID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if next < s.base {
+		return nil, 0, fmt.Errorf("%w: event %d of session %s", ErrEventsDropped, next, sessionID)
+	}
+	return s, next, nil
+}
+
+// sweep removes expired sessions; the caller holds st.mu
+func (st *ResumeStore) sweep() {
+	now := time.Now()
+	for id, s := range st.sessions {
+		if s.expired(now) {
+			delete(st.sessions, id)
+		}
+	}
+}
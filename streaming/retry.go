@@ -1,342 +1,266 @@
 package streaming
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"gemini-antiblock/config"
+	"gemini-antiblock/engine"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/modelstats"
+	"gemini-antiblock/recording"
+	"gemini-antiblock/tracing"
+	"gemini-antiblock/upstream"
 )
 
-var nonRetryableStatuses = map[int]bool{
-	400: true, 401: true, 403: true, 404: true, 429: true,
+// EngineSettings maps the proxy configuration onto stream engine settings
+func EngineSettings(cfg *config.Config) engine.Settings {
+	return engine.Settings{
+		MaxRetries:                 cfg.MaxConsecutiveRetries,
+		RetryDelay:                 cfg.RetryDelayMs,
+		MaxRetryDelay:              cfg.RetryMaxDelay,
+		RetryJitter:                cfg.RetryJitter,
+		RateLimitRetries:           cfg.RateLimitRetries,
+		RateLimitDelay:             cfg.RateLimitDelay,
+		MaxRateLimitDelay:          cfg.MaxRateLimitDelay,
+		SwallowThoughtsAfterRetry:  cfg.SwallowThoughtsAfterRetry,
+		MaxAttemptDuration:         cfg.MaxAttemptDuration,
+		MaxSessionDuration:         cfg.MaxSessionDuration,
+		SpeculativeRetryAfter:      cfg.SpeculativeRetryAfter,
+		NetworkErrorBackoff:        cfg.NetworkErrorBackoff,
+		MaskUpstreamErrors:         cfg.MaskUpstreamErrors,
+		DoneToken:                  cfg.DoneToken,
+		ContinuationPrompt:         engine.ContinuationPrompt(cfg.ContinuationPrompt),
+		DedupWindow:                cfg.RetryDedupWindow,
+		MaxRetryContext:            cfg.MaxRetryContextChars,
+		RetryContextOverflow:       cfg.RetryContextOverflow,
+		LineBufferSize:             cfg.SSEBufferSize,
+		MaxLineSize:                cfg.SSEMaxLineSize,
+		RetryOnBlock:               cfg.RetryOnBlock,
+		RetryOnDrop:                cfg.RetryOnDrop,
+		RetryOnFinishDuringThought: cfg.RetryOnFinishDuringThought,
+		RetryOnIncomplete:          cfg.RetryOnIncomplete,
+		RetryOnEmpty:               cfg.RetryOnEmpty,
+		FinishReasonPolicy:         cfg.FinishReasonPolicy,
+	}
 }
 
-// BuildRetryRequestBody builds a new request body for retry with accumulated context
-func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText string) map[string]interface{} {
-	logger.LogDebug(fmt.Sprintf("Building retry request body. Accumulated text length: %d", len(accumulatedText)))
-	logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", func() string {
-		if len(accumulatedText) > 200 {
-			return accumulatedText[:200] + "..."
-		}
-		return accumulatedText
-	}()))
-
-	retryBody := make(map[string]interface{})
-	for k, v := range originalBody {
-		retryBody[k] = v
+// adaptiveBounds returns the operator-set limits for adaptive retry tuning
+func adaptiveBounds(cfg *config.Config) modelstats.Bounds {
+	return modelstats.Bounds{
+		MinSamples:    int64(cfg.AdaptiveMinSamples),
+		MinRetries:    cfg.AdaptiveMinRetries,
+		MaxRetries:    cfg.AdaptiveMaxRetries,
+		MinRetryDelay: cfg.AdaptiveMinRetryDelay,
+		MaxRetryDelay: cfg.AdaptiveMaxRetryDelay,
 	}
+}
 
-	contents, ok := retryBody["contents"].([]interface{})
-	if !ok {
-		contents = []interface{}{}
+// ProcessStreamAndRetryInternally runs the stream engine for a proxied session,
+// with the proxy's logger, metrics and adaptive retry tuning. Retries are sent
+// with upstreamHeaders. An extra observer and a key failover, if not nil, are
+// handed to the engine as well. Cancelling ctx, normally the client request's
+// context, aborts the session without further retries.
+func ProcessStreamAndRetryInternally(ctx context.Context, cfg *config.Config, client *http.Client, initialReader io.Reader, writer engine.StreamWriter, originalRequestBody map[string]interface{}, upstreamURL string, upstreamHeaders http.Header, summary *SessionSummary, extra engine.Observer, failover engine.Failover) error {
+	settings := EngineSettings(cfg)
+	if cfg.AdaptiveRetry {
+		if tunedRetries, tunedDelay, ok := modelstats.GetGlobalStore().Tune(summary.Model, adaptiveBounds(cfg)); ok {
+			settings.MaxRetries, settings.RetryDelay = tunedRetries, tunedDelay
+			logger.LogInfo(fmt.Sprintf("Adaptive retry tuning for model %s: max retries %d, retry delay %v", summary.Model, tunedRetries, tunedDelay))
+		}
 	}
 
-	// Find last user message index
-	lastUserIndex := -1
-	for i := len(contents) - 1; i >= 0; i-- {
-		if content, ok := contents[i].(map[string]interface{}); ok {
-			if role, ok := content["role"].(string); ok && role == "user" {
-				lastUserIndex = i
-				break
-			}
+	// Without the injected system prompt (client-supplied caches) the model never emits [done]
+	expectDoneToken := ExpectsDoneToken(originalRequestBody)
+
+	var recorder *recording.Recorder
+	if cfg.DebugRecordDir != "" {
+		var err error
+		if recorder, err = recording.Create(cfg.DebugRecordDir, summary.RequestID); err != nil {
+			logger.LogWarn("Not recording session:", err)
+		} else {
+			recorder.Session(summary.RequestID, summary.Model, upstreamURL, expectDoneToken, originalRequestBody)
+			initialReader = recorder.Initial(initialReader)
+			client = recorder.Client(client)
 		}
 	}
 
-	// Build retry context
-	history := []interface{}{
-		map[string]interface{}{
-			"role": "model",
-			"parts": []interface{}{
-				map[string]interface{}{"text": accumulatedText},
-			},
-		},
-		map[string]interface{}{
-			"role": "user",
-			"parts": []interface{}{
-				map[string]interface{}{"text": "Continue exactly where you left off without any preamble or repetition."},
-			},
-		},
+	sessionLogger := logger.With(logger.Fields{"request_id": summary.RequestID, "model": summary.Model})
+	attempts := &attemptSpans{ctx: ctx}
+	attempts.start()
+	options := []engine.Option{engine.WithLogger(sessionLogger), engine.WithObserver(engineObserver{extra: extra, attempts: attempts, summary: summary, recorder: recorder})}
+	if len(cfg.RefusalPhrases) > 0 {
+		options = append(options, engine.WithDetector(engine.PhraseDetector{Phrases: cfg.RefusalPhrases}))
 	}
-
-	// Insert history after last user message
-	if lastUserIndex != -1 {
-		newContents := make([]interface{}, 0, len(contents)+2)
-		newContents = append(newContents, contents[:lastUserIndex+1]...)
-		newContents = append(newContents, history...)
-		newContents = append(newContents, contents[lastUserIndex+1:]...)
-		retryBody["contents"] = newContents
-		logger.LogDebug(fmt.Sprintf("Inserted retry context after user message at index %d", lastUserIndex))
-	} else {
-		newContents := append(contents, history...)
-		retryBody["contents"] = newContents
-		logger.LogDebug("Appended retry context to end of conversation")
+	eng := engine.New(client, settings, options...)
+	result, err := eng.Stream(initialReader, writer, engine.Request{
+		URL:             upstreamURL,
+		Header:          upstreamHeaders,
+		Body:            originalRequestBody,
+		ExpectDoneToken: expectDoneToken,
+		Failover:        failover,
+		Context:         ctx,
+	})
+
+	attempts.finish(err)
+	if recorder != nil {
+		if recordErr := recorder.Finish(result.Attempts, result.Reasons, result.Chars, err); recordErr != nil {
+			logger.LogWarn("Failed to write session recording:", recordErr)
+		} else {
+			sessionLogger.Debugf("Session recorded to %s", recorder.Path())
+		}
 	}
 
-	logger.LogDebug(fmt.Sprintf("Final retry request has %d messages", len(retryBody["contents"].([]interface{}))))
-	return retryBody
+	summary.Attempts = result.Attempts
+	summary.Reasons = append(summary.Reasons, result.Reasons...)
+	summary.Chars = result.Chars
+	summary.Tokens = totalTokens(result.Usage)
+	return err
 }
 
-// ProcessStreamAndRetryInternally handles streaming with internal retry logic
-func ProcessStreamAndRetryInternally(cfg *config.Config, initialReader io.Reader, writer io.Writer, originalRequestBody map[string]interface{}, upstreamURL string, originalHeaders http.Header) error {
-	var accumulatedText string
-	consecutiveRetryCount := 0
-	currentReader := initialReader
-	totalLinesProcessed := 0
-	sessionStartTime := time.Now()
-
-	isOutputtingFormalText := false
-	swallowModeActive := false
-
-	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d", cfg.MaxConsecutiveRetries))
-
-	for {
-		interruptionReason := ""
-		cleanExit := false
-		streamStartTime := time.Now()
-		linesInThisStream := 0
-		textInThisStream := ""
-
-		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", consecutiveRetryCount+1, cfg.MaxConsecutiveRetries+1))
-
-		// Create channel for SSE lines
-		lineCh := make(chan string, 100)
-		go SSELineIterator(currentReader, lineCh)
-
-		// Process lines
-		for line := range lineCh {
-			totalLinesProcessed++
-			linesInThisStream++
-
-			var textChunk string
-			var isThought bool
-
-			if IsDataLine(line) {
-				content := ParseLineContent(line)
-				textChunk = content.Text
-				isThought = content.IsThought
-			}
-
-			// Thought swallowing logic
-			if swallowModeActive {
-				if isThought {
-					logger.LogDebug("Swallowing thought chunk due to post-retry filter:", line)
-					finishReason := ExtractFinishReason(line)
-					if finishReason != "" {
-						logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
-						interruptionReason = "FINISH_DURING_THOUGHT"
-						break
-					}
-					continue
-				} else {
-					logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
-					swallowModeActive = false
-				}
-			}
-
-			// Retry decision logic
-			finishReason := ExtractFinishReason(line)
-			needsRetry := false
-
-			if finishReason != "" && isThought {
-				logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_DURING_THOUGHT"
-				needsRetry = true
-			} else if IsBlockedLine(line) {
-				logger.LogError(fmt.Sprintf("Content blocked detected in line: %s", line))
-				interruptionReason = "BLOCK"
-				needsRetry = true
-			} else if finishReason == "STOP" {
-				tempAccumulatedText := accumulatedText + textChunk
-				trimmedText := strings.TrimSpace(tempAccumulatedText)
-
-				// Check for empty response - if we have STOP but no accumulated text at all, it's incomplete
-				if len(trimmedText) == 0 {
-					logger.LogError("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
-					interruptionReason = "FINISH_EMPTY_RESPONSE"
-					needsRetry = true
-				} else if !strings.HasSuffix(trimmedText, "[done]") {
-					lastChar := trimmedText[len(trimmedText)-1:]
-					logger.LogError(fmt.Sprintf("Finish reason 'STOP' treated as incomplete because text ends with '%s'. Triggering retry.", lastChar))
-					interruptionReason = "FINISH_INCOMPLETE"
-					needsRetry = true
-				}
-			} else if finishReason != "" && finishReason != "MAX_TOKENS" && finishReason != "STOP" {
-				logger.LogError(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_ABNORMAL"
-				needsRetry = true
-			}
-
-			if needsRetry {
-				break
-			}
-
-			// Line is good: forward and update state
-			isEndOfResponse := finishReason == "STOP" || finishReason == "MAX_TOKENS"
-			processedLine := RemoveDoneTokenFromLine(line, isEndOfResponse)
-
-			if _, err := writer.Write([]byte(processedLine + "\n\n")); err != nil {
-				return fmt.Errorf("failed to write to output stream: %w", err)
-			}
-
-			// Flush the response to ensure data is sent immediately to the client
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
-			}
-
-			if textChunk != "" && !isThought {
-				isOutputtingFormalText = true
-				accumulatedText += textChunk
-				textInThisStream += textChunk
-			}
-
-			if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
-				logger.LogInfo(fmt.Sprintf("Finish reason '%s' accepted as final. Stream complete.", finishReason))
-				cleanExit = true
-				break
-			}
-		}
-
-		if !cleanExit && interruptionReason == "" {
-			logger.LogError("Stream ended without finish reason - detected as DROP")
-			interruptionReason = "DROP"
-		}
-
-		streamDuration := time.Since(streamStartTime)
-		logger.LogDebug("Stream attempt summary:")
-		logger.LogDebug(fmt.Sprintf("  Duration: %v", streamDuration))
-		logger.LogDebug(fmt.Sprintf("  Lines processed: %d", linesInThisStream))
-		logger.LogDebug(fmt.Sprintf("  Text generated this stream: %d chars", len(textInThisStream)))
-		logger.LogDebug(fmt.Sprintf("  Total accumulated text: %d chars", len(accumulatedText)))
-
-		if cleanExit {
-			sessionDuration := time.Since(sessionStartTime)
-			logger.LogInfo("=== STREAM COMPLETED SUCCESSFULLY ===")
-			logger.LogInfo(fmt.Sprintf("Total session duration: %v", sessionDuration))
-			logger.LogInfo(fmt.Sprintf("Total lines processed: %d", totalLinesProcessed))
-			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", len(accumulatedText)))
-			logger.LogInfo(fmt.Sprintf("Total retries needed: %d", consecutiveRetryCount))
-			return nil
-		}
-
-		// Interruption & Retry Activation
-		logger.LogError("=== STREAM INTERRUPTED ===")
-		logger.LogError(fmt.Sprintf("Reason: %s", interruptionReason))
-
-		if cfg.SwallowThoughtsAfterRetry && isOutputtingFormalText {
-			logger.LogInfo("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
-			swallowModeActive = true
-		}
-
-		logger.LogError(fmt.Sprintf("Current retry count: %d", consecutiveRetryCount))
-		logger.LogError(fmt.Sprintf("Max retries allowed: %d", cfg.MaxConsecutiveRetries))
-		logger.LogError(fmt.Sprintf("Text accumulated so far: %d characters", len(accumulatedText)))
-
-		if consecutiveRetryCount >= cfg.MaxConsecutiveRetries {
-			errorPayload := map[string]interface{}{
-				"error": map[string]interface{}{
-					"code":    504,
-					"status":  "DEADLINE_EXCEEDED",
-					"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", cfg.MaxConsecutiveRetries, interruptionReason),
-					"details": []interface{}{
-						map[string]interface{}{
-							"@type":                  "proxy.debug",
-							"accumulated_text_chars": len(accumulatedText),
-						},
-					},
-				},
-			}
-
-			errorBytes, _ := json.Marshal(errorPayload)
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
-
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
-			}
-
-			return fmt.Errorf("retry limit exceeded")
-		}
-
-		consecutiveRetryCount++
-		logger.LogInfo(fmt.Sprintf("=== STARTING RETRY %d/%d ===", consecutiveRetryCount, cfg.MaxConsecutiveRetries))
+// totalTokens returns the totalTokenCount of a usageMetadata, or 0 if there is none
+func totalTokens(usage map[string]interface{}) int {
+	count, _ := usage["totalTokenCount"].(float64)
+	return int(count)
+}
 
-		// Build retry request
-		retryBody := BuildRetryRequestBody(originalRequestBody, accumulatedText)
-		retryBodyBytes, err := json.Marshal(retryBody)
-		if err != nil {
-			logger.LogError("Failed to marshal retry body:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+// KeyFailover switches to the next pool key when upstream rejects the
+// current one. For speculative retries it offers another pool key and, when
+// Upstreams is set, another upstream base URL. Pool may be nil when requests
+// carry the client's own key.
+type KeyFailover struct {
+	Pool      *upstream.KeyPool
+	Upstreams *upstream.Upstreams
+}
 
-		// Create retry request
-		retryReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(retryBodyBytes))
-		if err != nil {
-			logger.LogError("Failed to create retry request:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+// Next implements engine.Failover
+func (f KeyFailover) Next(header http.Header, status int) (http.Header, bool) {
+	if f.Pool == nil || !upstream.IsKeyExhaustedStatus(status) {
+		return nil, false
+	}
+	key, ok := f.Pool.Failover(header.Get("X-Goog-Api-Key"))
+	if !ok {
+		return nil, false
+	}
+	next := header.Clone()
+	next.Set("X-Goog-Api-Key", key)
+	return next, true
+}
 
-		// Copy headers
-		for name, values := range originalHeaders {
-			if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
-				for _, value := range values {
-					retryReq.Header.Add(name, value)
-				}
-			}
+// Alternate implements engine.Alternates
+func (f KeyFailover) Alternate(ctx context.Context, header http.Header) (context.Context, http.Header, bool) {
+	changed := false
+	if f.Upstreams != nil && f.Upstreams.HasAlternate() {
+		ctx = upstream.WithAlternate(ctx)
+		changed = true
+	}
+	if f.Pool != nil {
+		if key, ok := f.Pool.Alternate(header.Get("X-Goog-Api-Key")); ok {
+			header = header.Clone()
+			header.Set("X-Goog-Api-Key", key)
+			changed = true
 		}
+	}
+	return ctx, header, changed
+}
 
-		logger.LogDebug(fmt.Sprintf("Making retry request to: %s", upstreamURL))
-		logger.LogDebug(fmt.Sprintf("Retry request body size: %d bytes", len(retryBodyBytes)))
+// attemptSpans traces each upstream attempt of a session as a child span of the session
+type attemptSpans struct {
+	ctx context.Context
 
-		// Make retry request
-		client := &http.Client{}
-		retryResponse, err := client.Do(retryReq)
-		if err != nil {
-			logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", consecutiveRetryCount))
-			logger.LogError("Exception during retry:", err)
-			logger.LogError(fmt.Sprintf("Will wait %v before next attempt (if any)", cfg.RetryDelayMs))
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+	mu          sync.Mutex
+	current     *tracing.Span
+	number      int
+	rateLimited int
+}
 
-		logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+// start opens the span for the next attempt
+func (a *attemptSpans) start() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.number++
+	a.rateLimited = 0
+	_, a.current = tracing.GetGlobalTracer().StartSpan(a.ctx, "antiblock.attempt", tracing.KindInternal)
+	a.current.SetAttribute("antiblock.attempt", a.number)
+}
 
-		if nonRetryableStatuses[retryResponse.StatusCode] {
-			logger.LogError("=== FATAL ERROR DURING RETRY ===")
-			logger.LogError(fmt.Sprintf("Received non-retryable status %d during retry attempt %d", retryResponse.StatusCode, consecutiveRetryCount))
+// interrupted closes the current attempt's span with the interruption reason.
+// Rate limits are waited out within the same attempt and only counted.
+func (a *attemptSpans) interrupted(reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current == nil {
+		return
+	}
+	if reason == "RATE_LIMITED" {
+		a.rateLimited++
+		a.current.SetAttribute("antiblock.rate_limited", a.rateLimited)
+		return
+	}
+	a.current.SetAttribute("antiblock.interruption", reason)
+	a.current.End()
+	a.current = nil
+}
 
-			// Write SSE error from upstream
-			errorBytes, _ := io.ReadAll(retryResponse.Body)
-			retryResponse.Body.Close()
+// finish closes the last attempt's span when the session ends
+func (a *attemptSpans) finish(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.current.SetError(err)
+	a.current.End()
+	a.current = nil
+}
 
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+// engineObserver records engine measurements in the global metrics and forwards them to extra
+type engineObserver struct {
+	extra    engine.Observer
+	attempts *attemptSpans
+	summary  *SessionSummary
+	recorder *recording.Recorder
+}
 
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
-			}
+func (o engineObserver) Interruption(reason string) {
+	metrics.GetGlobalMetrics().RecordInterruption(reason)
+	o.attempts.interrupted(reason)
+	if o.recorder != nil {
+		o.recorder.Interruption(reason)
+	}
+	if o.extra != nil {
+		o.extra.Interruption(reason)
+	}
+}
 
-			return fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
-		}
+func (o engineObserver) Retry() {
+	metrics.GetGlobalMetrics().RecordRetry()
+	o.attempts.start()
+	o.summary.liveRetries.Add(1)
+	if o.extra != nil {
+		o.extra.Retry()
+	}
+}
 
-		if retryResponse.StatusCode != http.StatusOK {
-			logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d", consecutiveRetryCount, retryResponse.StatusCode))
-			logger.LogError("This is considered a retryable error - will try again if retries remain")
-			retryResponse.Body.Close()
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+func (o engineObserver) NetworkError(class string) {
+	metrics.GetGlobalMetrics().RecordNetworkError(class)
+	if o.extra != nil {
+		o.extra.NetworkError(class)
+	}
+}
 
-		logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", consecutiveRetryCount))
-		logger.LogInfo(fmt.Sprintf("Continuing with accumulated context (%d chars)", len(accumulatedText)))
+func (o engineObserver) ResponseTime(d time.Duration) {
+	metrics.GetGlobalMetrics().RecordResponseTime(d)
+	if o.extra != nil {
+		o.extra.ResponseTime(d)
+	}
+}
 
-		currentReader = retryResponse.Body
+func (o engineObserver) Progress(chars int) {
+	o.summary.liveChars.Store(int64(chars))
+	if progress, ok := o.extra.(engine.ProgressObserver); ok {
+		progress.Progress(chars)
 	}
 }
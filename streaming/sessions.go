@@ -0,0 +1,65 @@
+package streaming
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ActiveSession describes a streaming session in progress
+type ActiveSession struct {
+	RequestID  string    `json:"request_id"`
+	Model      string    `json:"model"`
+	Client     string    `json:"client"`
+	Key        string    `json:"key,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Retries    int64     `json:"retries"`
+	Chars      int64     `json:"chars"`
+}
+
+var (
+	activeMu       sync.Mutex
+	activeSessions = make(map[*SessionSummary]struct{})
+)
+
+// ActiveSessions lists the sessions in progress, oldest first
+func ActiveSessions() []ActiveSession {
+	activeMu.Lock()
+	summaries := make([]*SessionSummary, 0, len(activeSessions))
+	for s := range activeSessions {
+		summaries = append(summaries, s)
+	}
+	activeMu.Unlock()
+
+	now := time.Now()
+	sessions := make([]ActiveSession, len(summaries))
+	for i, s := range summaries {
+		sessions[i] = ActiveSession{
+			RequestID:  s.RequestID,
+			Model:      s.Model,
+			Client:     s.Client,
+			Key:        s.Key,
+			StartedAt:  s.startTime.UTC(),
+			DurationMs: now.Sub(s.startTime).Milliseconds(),
+			Retries:    s.liveRetries.Load(),
+			Chars:      s.liveChars.Load(),
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions
+}
+
+func registerSession(s *SessionSummary) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	activeSessions[s] = struct{}{}
+}
+
+func unregisterSession(s *SessionSummary) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	delete(activeSessions, s)
+}
@@ -0,0 +1,101 @@
+package streaming
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gemini-antiblock/engine"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/modelinfo"
+	"gemini-antiblock/modelstats"
+	"gemini-antiblock/report"
+)
+
+// Session outcomes reported in the summary record
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+	// OutcomeClientGone means the client stopped accepting output; it is not an upstream failure
+	OutcomeClientGone = "client_gone"
+)
+
+// SessionSummary is the machine-readable record logged exactly once per streaming session.
+// Its field names are a stable interface for external log-based alerting.
+type SessionSummary struct {
+	RequestID  string   `json:"request_id"`
+	Model      string   `json:"model"`
+	Client     string   `json:"client"`
+	Key        string   `json:"key,omitempty"`
+	Outcome    string   `json:"outcome"`
+	DurationMs int64    `json:"duration_ms"`
+	Attempts   int      `json:"attempts"`
+	Reasons    []string `json:"reasons"`
+	Chars      int      `json:"chars"`
+	Tokens     int      `json:"tokens"`
+	Error      string   `json:"error,omitempty"`
+
+	startTime time.Time
+	// Progress of the running session, read by the admin API
+	liveRetries atomic.Int64
+	liveChars   atomic.Int64
+}
+
+// NewSessionSummary starts a summary for a session beginning now
+func NewSessionSummary(requestID, model, client string) *SessionSummary {
+	metrics.GetGlobalMetrics().RecordSessionStart()
+	s := &SessionSummary{
+		RequestID: requestID,
+		Model:     model,
+		Client:    client,
+		Reasons:   []string{},
+		startTime: time.Now(),
+	}
+	registerSession(s)
+	return s
+}
+
+// Finish records the session outcome and logs the summary
+func (s *SessionSummary) Finish(err error) {
+	unregisterSession(s)
+	duration := time.Since(s.startTime)
+	s.DurationMs = duration.Milliseconds()
+	if engine.IsClientWriteError(err) {
+		s.Outcome = OutcomeClientGone
+		s.Error = err.Error()
+		metrics.GetGlobalMetrics().RecordClientWriteFailure()
+		s.report()
+		logger.LogSummary(s)
+		return
+	}
+
+	if err != nil {
+		s.Outcome = OutcomeFailed
+		s.Error = err.Error()
+	} else {
+		s.Outcome = OutcomeSuccess
+	}
+	// A session that never reached upstream has no retries or interventions to count
+	if s.Attempts > 0 {
+		metrics.GetGlobalMetrics().RecordSession(err == nil, s.Attempts-1, duration)
+		// Only catalog models are tracked, so arbitrary model names cannot grow the statistics
+		if modelinfo.GetGlobalCatalog().Known(s.Model) {
+			modelstats.GetGlobalStore().Record(s.Model, err == nil, s.Attempts-1, s.Reasons)
+		}
+	} else {
+		metrics.GetGlobalMetrics().RecordSessionEnd()
+	}
+	s.report()
+	logger.LogSummary(s)
+}
+
+func (s *SessionSummary) report() {
+	report.GetGlobalCollector().Record(report.Session{
+		Model:   s.Model,
+		Key:     s.Key,
+		Outcome: s.Outcome,
+		Reasons: s.Reasons,
+		Chars:   s.Chars,
+		Error:   s.Error,
+	})
+}
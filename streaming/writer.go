@@ -0,0 +1,156 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// SSE output modes
+const (
+	// SSEModeLenient relays upstream lines as received, one event per line
+	SSEModeLenient = "lenient"
+	// SSEModeStrict emits exactly one "data: " line per event, drops comments
+	// and other fields, and puts every payload on a single LF-terminated line
+	SSEModeStrict = "strict"
+)
+
+// keepaliveComment is the SSE comment sent while the stream is idle
+const keepaliveComment = ": keepalive\n\n"
+
+// SSEWriter relays Gemini SSE events
+type SSEWriter struct {
+	dst    io.Writer
+	strict bool
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	stop      chan struct{}
+}
+
+// NewSSEWriter creates a writer that emits Gemini SSE events to dst in the given mode
+func NewSSEWriter(dst io.Writer, mode string) *SSEWriter {
+	return &SSEWriter{dst: dst, strict: mode == SSEModeStrict}
+}
+
+// WriteData writes the line as an SSE event
+func (s *SSEWriter) WriteData(line string) error {
+	return s.WriteDataID("", line)
+}
+
+// WriteDataID writes the line as an SSE event with the given id, which a
+// reconnecting client sends back as Last-Event-ID
+func (s *SSEWriter) WriteDataID(id, line string) error {
+	if s.strict {
+		payload, ok := strictPayload(line)
+		if !ok {
+			logger.LogTrace("Strict SSE mode dropped non-data line:", line)
+			return nil
+		}
+		line = "data: " + payload
+	}
+	return s.write(eventID(id) + line + "\n\n")
+}
+
+// WriteError writes the payload as an SSE error event
+func (s *SSEWriter) WriteError(payload []byte) error {
+	return s.WriteErrorID("", payload)
+}
+
+// WriteErrorID writes the payload as an SSE error event with the given id
+func (s *SSEWriter) WriteErrorID(id string, payload []byte) error {
+	if s.strict {
+		payload = singleLine(payload)
+	}
+	return s.write(fmt.Sprintf("%sevent: error\ndata: %s\n\n", eventID(id), payload))
+}
+
+// eventID returns the id field of an event, or nothing for no id
+func eventID(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "id: " + id + "\n"
+}
+
+func (s *SSEWriter) write(event string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWrite = time.Now()
+	_, err := io.WriteString(s.dst, event)
+	return err
+}
+
+// KeepAlive sends an SSE comment whenever nothing has been written for
+// interval, so proxies and browsers do not drop the connection while the
+// proxy waits between retries or on a slow upstream. Strict mode never emits
+// comments, so there it does nothing.
+func (s *SSEWriter) KeepAlive(interval time.Duration) {
+	if s.strict || interval <= 0 || s.stop != nil {
+		return
+	}
+	s.mu.Lock()
+	s.lastWrite = time.Now()
+	s.mu.Unlock()
+	stop := make(chan struct{})
+	s.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			s.mu.Lock()
+			if time.Since(s.lastWrite) >= interval {
+				s.lastWrite = time.Now()
+				if _, err := io.WriteString(s.dst, keepaliveComment); err != nil {
+					s.mu.Unlock()
+					return
+				}
+				logger.LogTrace("Sent SSE keepalive")
+			}
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Close stops keepalives; the SSE stream ends when the response does
+func (s *SSEWriter) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	return nil
+}
+
+// strictPayload returns the single-line payload of a data line, or false for
+// comments and other SSE fields
+func strictPayload(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasPrefix(line, "data:") {
+		return "", false
+	}
+	payload := strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+	return string(singleLine([]byte(payload))), true
+}
+
+// singleLine compacts a JSON payload, or strips line breaks from anything else,
+// so it fits on one data line
+func singleLine(payload []byte) []byte {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, payload); err == nil {
+		return compacted.Bytes()
+	}
+	payload = bytes.ReplaceAll(payload, []byte("\r"), nil)
+	return bytes.ReplaceAll(payload, []byte("\n"), []byte(" "))
+}
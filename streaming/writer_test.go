@@ -0,0 +1,123 @@
+package streaming
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEWriterFraming(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		write func(*SSEWriter) error
+		want  string
+	}{
+		{
+			name:  "data line",
+			mode:  SSEModeLenient,
+			write: func(w *SSEWriter) error { return w.WriteData(`data: {"a":1}`) },
+			want:  "data: {\"a\":1}\n\n",
+		},
+		{
+			name:  "event id",
+			mode:  SSEModeLenient,
+			write: func(w *SSEWriter) error { return w.WriteDataID("7", `data: {"a":1}`) },
+			want:  "id: 7\ndata: {\"a\":1}\n\n",
+		},
+		{
+			name:  "lenient keeps comments",
+			mode:  SSEModeLenient,
+			write: func(w *SSEWriter) error { return w.WriteData(": ping") },
+			want:  ": ping\n\n",
+		},
+		{
+			name:  "error event",
+			mode:  SSEModeLenient,
+			write: func(w *SSEWriter) error { return w.WriteError([]byte(`{"error":{"code":502}}`)) },
+			want:  "event: error\ndata: {\"error\":{\"code\":502}}\n\n",
+		},
+		{
+			name:  "strict drops comments",
+			mode:  SSEModeStrict,
+			write: func(w *SSEWriter) error { return w.WriteData(": ping") },
+			want:  "",
+		},
+		{
+			name:  "strict normalizes data prefix and line endings",
+			mode:  SSEModeStrict,
+			write: func(w *SSEWriter) error { return w.WriteData("data:{\"a\": 1}\r") },
+			want:  "data: {\"a\":1}\n\n",
+		},
+		{
+			name: "strict compacts error payload",
+			mode: SSEModeStrict,
+			write: func(w *SSEWriter) error {
+				return w.WriteErrorID("3", []byte("{\n  \"error\": {\"code\": 502}\n}"))
+			},
+			want: "id: 3\nevent: error\ndata: {\"error\":{\"code\":502}}\n\n",
+		},
+		{
+			name:  "strict joins non-JSON lines",
+			mode:  SSEModeStrict,
+			write: func(w *SSEWriter) error { return w.WriteError([]byte("bad\r\ngateway")) },
+			want:  "event: error\ndata: bad gateway\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := NewSSEWriter(&out, tt.mode)
+			if err := tt.write(w); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEWriterKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want bool
+	}{
+		{SSEModeLenient, true},
+		{SSEModeStrict, false},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			out := &syncBuffer{}
+			w := NewSSEWriter(out, tt.mode)
+			w.KeepAlive(10 * time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			w.Close()
+
+			if got := strings.Contains(out.String(), keepaliveComment); got != tt.want {
+				t.Errorf("keepalive sent = %v, want %v (output %q)", got, tt.want, out.String())
+			}
+		})
+	}
+}
+
+func TestSSEWriterFlushesEachEvent(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	consumer := NewConsumerWriter(recorder, time.Second, 1<<10, SlowConsumerPolicyPause)
+	w := NewSSEWriter(consumer, SSEModeLenient)
+	if err := w.WriteData(`data: {"a":1}`); err != nil {
+		t.Fatalf("WriteData error = %v", err)
+	}
+	w.Close()
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+
+	if !recorder.Flushed {
+		t.Error("event was not flushed to the client")
+	}
+	if recorder.Body.String() != "data: {\"a\":1}\n\n" {
+		t.Errorf("body = %q", recorder.Body.String())
+	}
+}
@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+type finishedSpan struct {
+	name       string
+	kind       int
+	sc         SpanContext
+	parent     [8]byte
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	failed     bool
+	errMessage string
+}
+
+// Exporter sends spans to an OpenTelemetry collector using OTLP over HTTP with JSON encoding
+type Exporter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+	service string
+}
+
+// NewExporter creates an exporter posting to endpoint, the collector's base
+// URL such as http://localhost:4318, with extra headers for authentication
+func NewExporter(endpoint string, headers map[string]string, service string) *Exporter {
+	return &Exporter{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: headers,
+		service: service,
+	}
+}
+
+// Export sends a batch of spans; failures are logged and the batch is dropped
+func (e *Exporter) Export(spans []*finishedSpan) {
+	body, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		logger.LogError("Failed to encode trace spans:", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		logger.LogError("Failed to create trace export request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		logger.LogWarn("Trace export failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		logger.LogWarn(fmt.Sprintf("Trace export rejected with status %d, %d spans dropped", resp.StatusCode, len(spans)))
+	}
+}
+
+// payload builds an OTLP ExportTraceServiceRequest
+func (e *Exporter) payload(spans []*finishedSpan) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.sc.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.SpanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes(s.attributes),
+		}
+		if s.parent != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.failed {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.errMessage}
+		}
+		encoded[i] = span
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]interface{}{"service.name": e.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "gemini-antiblock"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+// attributes encodes a map as OTLP key-value pairs
+func attributes(values map[string]interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(values))
+	for key, value := range values {
+		var v map[string]interface{}
+		switch typed := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": typed}
+		case bool:
+			v = map[string]interface{}{"boolValue": typed}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(typed)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": typed}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(typed)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": v})
+	}
+	return encoded
+}
@@ -0,0 +1,190 @@
+// Package tracing records request traces compatible with OpenTelemetry. It
+// continues traces from incoming W3C traceparent headers, propagates them
+// upstream, and exports finished spans to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is a timed operation within a trace. A nil span ignores all calls, so
+// callers need not check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   int
+	sc     SpanContext
+	parent [8]byte
+	start  time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	errMessage string
+	failed     bool
+	ended      bool
+}
+
+// SetAttribute records a string, bool, integer or float attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed with err's message
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errMessage = err.Error()
+}
+
+// End finishes the span and queues it for export; later calls are ignored
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	s.tracer.export(s, time.Now())
+}
+
+// Context returns the span's identifiers
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span as the current span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span in ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Extract returns r's context carrying the caller's span from its traceparent
+// header, so spans started from it continue the caller's trace
+func Extract(r *http.Request) context.Context {
+	sc, ok := ParseTraceparent(r.Header.Get("traceparent"))
+	if !ok {
+		return r.Context()
+	}
+	return context.WithValue(r.Context(), remoteKey{}, sc)
+}
+
+func randomID(b []byte) {
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic("tracing: reading random bytes: " + err.Error())
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// Transport returns a RoundTripper that sends the traceparent of the current
+// span in each request's context, so upstream calls join the trace
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if span := SpanFromContext(req.Context()); span != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("traceparent", span.sc.Traceparent())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections forwards to the base transport
+func (t *transport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
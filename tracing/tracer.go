@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+// Tracer starts spans and hands finished ones to an exporter. Until an
+// exporter is set with Enable, StartSpan returns nil spans that cost nothing.
+type Tracer struct {
+	mu       sync.RWMutex
+	exporter *Exporter
+	queue    chan *finishedSpan
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var (
+	globalTracer *Tracer
+	tracerOnce   sync.Once
+)
+
+// GetGlobalTracer returns the process-wide tracer
+func GetGlobalTracer() *Tracer {
+	tracerOnce.Do(func() {
+		globalTracer = &Tracer{}
+	})
+	return globalTracer
+}
+
+// Enable starts exporting spans through exporter in the background
+func (t *Tracer) Enable(exporter *Exporter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exporter != nil {
+		return
+	}
+	t.exporter = exporter
+	t.queue = make(chan *finishedSpan, queueSize)
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run()
+}
+
+// Stop exports the spans still queued and stops the background exporter
+func (t *Tracer) Stop() {
+	t.mu.Lock()
+	if t.exporter == nil {
+		t.mu.Unlock()
+		return
+	}
+	close(t.stop)
+	t.mu.Unlock()
+	<-t.done
+}
+
+// Enabled reports whether spans are recorded
+func (t *Tracer) Enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.exporter != nil
+}
+
+// StartSpan starts a span as a child of the current span in ctx, or of the
+// remote caller extracted into ctx, or as a new trace. It returns a context
+// carrying the new span. If tracing is disabled the span is nil.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !t.Enabled() {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.sc.TraceID = parent.sc.TraceID
+		span.sc.Sampled = parent.sc.Sampled
+		span.parent = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.sc.TraceID = remote.TraceID
+		span.sc.Sampled = remote.Sampled
+		span.parent = remote.SpanID
+	} else {
+		randomID(span.sc.TraceID[:])
+		span.sc.Sampled = true
+	}
+	randomID(span.sc.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+// export queues a finished span, dropping it if the exporter is falling behind
+func (t *Tracer) export(s *Span, end time.Time) {
+	if !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	finished := &finishedSpan{
+		name:       s.name,
+		kind:       s.kind,
+		sc:         s.sc,
+		parent:     s.parent,
+		start:      s.start,
+		end:        end,
+		attributes: s.attributes,
+		failed:     s.failed,
+		errMessage: s.errMessage,
+	}
+	s.mu.Unlock()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	select {
+	case <-t.stop:
+	case t.queue <- finished:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*finishedSpan, 0, batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			t.exporter.Export(batch)
+			batch = make([]*finishedSpan, 0, batchSize)
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// decompressingTransport decodes gzip and deflate response bodies that the
+// standard transport leaves encoded, which happens when a mirror compresses
+// without being asked or uses deflate. The SSE scanner and every heuristic
+// downstream need plain text, and clients must not see a stale Content-Encoding.
+type decompressingTransport struct {
+	base http.RoundTripper
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the pooled transport
+func (t *decompressingTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *decompressingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := Decompress(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Decompress replaces a gzip or deflate encoded response body with its
+// decoded stream and removes the encoding headers. Other encodings, and
+// responses without a body, are left untouched.
+func Decompress(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+
+	// An empty body, such as the answer to a HEAD request, has nothing to decode
+	buffered := bufio.NewReader(resp.Body)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		stripEncoding(resp)
+		resp.ContentLength = 0
+		return nil
+	}
+
+	var decoded io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("failed to decode gzip response: %w", err)
+		}
+		decoded = reader
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but some servers send raw deflate
+		if isZlibHeader(buffered) {
+			reader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return fmt.Errorf("failed to decode deflate response: %w", err)
+			}
+			decoded = reader
+		} else {
+			decoded = flate.NewReader(buffered)
+		}
+	default:
+		logger.LogDebug("Leaving unsupported upstream Content-Encoding as is:", encoding)
+		return nil
+	}
+
+	logger.LogDebug("Decompressing upstream response with Content-Encoding:", encoding)
+	resp.Body = &decodedBody{Reader: decoded, decoder: decoded, body: resp.Body}
+	stripEncoding(resp)
+	return nil
+}
+
+// isZlibHeader reports, without consuming anything, whether r starts with a
+// zlib header: deflate compression (CM 8) with a check value that makes the
+// first two bytes a multiple of 31
+func isZlibHeader(r *bufio.Reader) bool {
+	header, err := r.Peek(2)
+	if err != nil {
+		return false
+	}
+	cmf, flg := header[0], header[1]
+	return cmf&0x0f == 8 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+// stripEncoding removes the headers describing the encoded body
+func stripEncoding(resp *http.Response) {
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodedBody closes both the decoder and the underlying response body
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.decoder.Close()
+	return b.body.Close()
+}
@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"testing"
+)
+
+const plainBody = `data: {"candidates":[{"content":{"parts":[{"text":"Hello"}]}}]}` + "\n\n"
+
+func compress(t *testing.T, encoding string, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.WriteString(w, data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func encodedResponse(status int, encoding string, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Encoding": {encoding}, "Content-Length": {"0"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"gzip", "gzip", compress(t, "gzip", plainBody)},
+		{"x-gzip", "x-gzip", compress(t, "gzip", plainBody)},
+		{"zlib-wrapped deflate", "deflate", compress(t, "zlib", plainBody)},
+		{"raw deflate", "deflate", compress(t, "flate", plainBody)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := encodedResponse(http.StatusOK, tt.encoding, tt.body)
+			if err := Decompress(resp); err != nil {
+				t.Fatalf("Decompress() error = %v", err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading decoded body: %v", err)
+			}
+			if string(got) != plainBody {
+				t.Errorf("decoded body = %q, want %q", got, plainBody)
+			}
+			if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" {
+				t.Errorf("encoding headers left in place: %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestDecompressEmptyBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"HEAD answer", http.StatusOK},
+		{"empty error body", http.StatusServiceUnavailable},
+		{"no content", http.StatusNoContent},
+		{"not modified", http.StatusNotModified},
+	}
+
+	for _, tt := range tests {
+		for _, encoding := range []string{"gzip", "deflate"} {
+			t.Run(tt.name+" "+encoding, func(t *testing.T) {
+				resp := encodedResponse(tt.status, encoding, nil)
+				if err := Decompress(resp); err != nil {
+					t.Fatalf("Decompress() error = %v", err)
+				}
+				got, err := io.ReadAll(resp.Body)
+				if err != nil || len(got) != 0 {
+					t.Errorf("body = %q, %v, want empty", got, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecompressLeavesUnknownEncoding(t *testing.T) {
+	resp := encodedResponse(http.StatusOK, "br", []byte("opaque"))
+	if err := Decompress(resp); err != nil {
+		t.Fatalf("Decompress() error = %v", err)
+	}
+	if resp.Header.Get("Content-Encoding") != "br" {
+		t.Error("Content-Encoding removed from an undecoded body")
+	}
+}
+
+func TestDecompressingTransportEmptyGzip(t *testing.T) {
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return encodedResponse(http.StatusOK, "gzip", nil), nil
+	})
+	req, _ := http.NewRequest(http.MethodHead, "http://upstream.test/", nil)
+	resp, err := (&decompressingTransport{base: base}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
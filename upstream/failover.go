@@ -0,0 +1,318 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// ErrCircuitOpen is returned instead of sending a request while the circuit
+// of every upstream is open
+var ErrCircuitOpen = errors.New("circuit open for every upstream")
+
+// Circuit states reported by Upstreams.Status
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// UpstreamStatus describes the health of one upstream base URL
+type UpstreamStatus struct {
+	URL       string     `json:"url"`
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"`
+	LastError string     `json:"last_error,omitempty"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+type upstreamState struct {
+	failures   int
+	retryAfter time.Time
+	lastError  string
+}
+
+// Upstreams tracks the health of the configured upstream base URLs. An
+// upstream that fails is tried after the healthy ones for the cool-down
+// period; after threshold consecutive failures its circuit opens and no
+// requests are sent to it until the cool-down has passed. The next request
+// then goes through as a trial and either closes the circuit or opens it again.
+type Upstreams struct {
+	bases     []string
+	threshold int
+	cooldown  time.Duration
+
+	mu     sync.Mutex
+	states map[string]*upstreamState
+	stop   chan struct{}
+}
+
+// NewUpstreams tracks bases in order of preference. A zero threshold never opens a circuit.
+func NewUpstreams(bases []string, threshold int, cooldown time.Duration) *Upstreams {
+	u := &Upstreams{
+		bases:     make([]string, len(bases)),
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*upstreamState),
+		stop:      make(chan struct{}),
+	}
+	for i, b := range bases {
+		u.bases[i] = strings.TrimSuffix(b, "/")
+		u.states[u.bases[i]] = &upstreamState{}
+	}
+	return u
+}
+
+// Status reports the state of every upstream in order of preference
+func (u *Upstreams) Status() []UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]UpstreamStatus, len(u.bases))
+	for i, b := range u.bases {
+		s := u.states[b]
+		statuses[i] = UpstreamStatus{URL: b, State: CircuitClosed, Failures: s.failures, LastError: s.lastError}
+		if u.tripped(s) {
+			statuses[i].State = CircuitHalfOpen
+			if now.Before(s.retryAfter) {
+				statuses[i].State = CircuitOpen
+				until := s.retryAfter.UTC()
+				statuses[i].OpenUntil = &until
+			}
+		}
+	}
+	return statuses
+}
+
+// HasAlternate reports whether more than one upstream can currently take
+// requests, so a request marked with WithAlternate avoids the preferred one
+func (u *Upstreams) HasAlternate() bool {
+	return len(u.order()) > 1
+}
+
+// AllOpen reports whether no upstream can currently take requests
+func (u *Upstreams) AllOpen() bool {
+	return len(u.order()) == 0
+}
+
+func (u *Upstreams) tripped(s *upstreamState) bool {
+	return u.threshold > 0 && s.failures >= u.threshold
+}
+
+// order lists the upstreams to try: healthy ones in configured order, then
+// those that failed recently, leaving out those whose circuit is open
+func (u *Upstreams) order() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	healthy := make([]string, 0, len(u.bases))
+	var failing []string
+	for _, b := range u.bases {
+		s := u.states[b]
+		switch {
+		case !now.Before(s.retryAfter):
+			healthy = append(healthy, b)
+		case !u.tripped(s):
+			failing = append(failing, b)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+func (u *Upstreams) recordFailure(base string, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := u.states[base]
+	s.failures++
+	s.lastError = reason
+	s.retryAfter = time.Now().Add(u.cooldown)
+	if s.failures == u.threshold {
+		logger.LogWarn(fmt.Sprintf("Circuit opened for upstream %s after %d consecutive failures", base, s.failures))
+	}
+}
+
+func (u *Upstreams) recordSuccess(base string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	s := u.states[base]
+	if u.tripped(s) {
+		logger.LogInfo(fmt.Sprintf("Circuit closed for upstream %s", base))
+	}
+	*s = upstreamState{}
+}
+
+// StartProbes checks every upstream through client each interval, so an
+// upstream's state is known before requests depend on it and a recovered
+// upstream is taken back without waiting for a trial request
+func (u *Upstreams) StartProbes(client *http.Client, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			u.probe(client, interval)
+			select {
+			case <-ticker.C:
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background probes
+func (u *Upstreams) Stop() {
+	close(u.stop)
+}
+
+// probe requests the models list of each upstream. Any answer below 500,
+// including 401 or 403 for the missing key, shows the upstream is serving.
+func (u *Upstreams) probe(client *http.Client, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, base := range u.bases {
+		wg.Add(1)
+		go func(base string) {
+			defer wg.Done()
+
+			// The probe goes straight to this upstream, bypassing failover
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeKey{}, base), timeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v1beta/models?pageSize=1", nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				logger.LogDebug(fmt.Sprintf("Health probe of upstream %s failed: %v", base, err))
+				return
+			}
+			resp.Body.Close()
+			logger.LogDebug(fmt.Sprintf("Health probe of upstream %s returned %d", base, resp.StatusCode))
+		}(base)
+	}
+	wg.Wait()
+}
+
+type probeKey struct{}
+
+type alternateKey struct{}
+
+// WithAlternate marks requests made with ctx to skip the upstream that would
+// be tried first, so they take a different route than unmarked requests
+func WithAlternate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, alternateKey{}, true)
+}
+
+// failoverTransport sends requests for the first upstream base URL to the
+// healthiest upstream, moving on to the next one when an upstream cannot be
+// reached or answers with a 5xx. Since initial requests and retries share the
+// client, a mid-stream retry after a connection failure goes to a healthy
+// upstream as well.
+type failoverTransport struct {
+	base      http.RoundTripper
+	upstreams *Upstreams
+}
+
+// CloseIdleConnections forwards to the base transport
+func (t *failoverTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if base, ok := req.Context().Value(probeKey{}).(string); ok {
+		resp, err := t.base.RoundTrip(req)
+		t.record(req, base, resp, err)
+		return resp, err
+	}
+
+	target := req.URL.String()
+	primary := t.upstreams.bases[0]
+	if !strings.HasPrefix(target, primary) {
+		return t.base.RoundTrip(req)
+	}
+	rest := strings.TrimPrefix(target, primary)
+	// A body that cannot be re-read allows only one try
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	bases := t.upstreams.order()
+	if len(bases) == 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrCircuitOpen
+	}
+	if alternate, _ := req.Context().Value(alternateKey{}).(bool); alternate && len(bases) > 1 {
+		bases = bases[1:]
+	}
+	for i, base := range bases {
+		attempt, err := rewrite(req, base+rest, i > 0)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(attempt)
+		t.record(req, base, resp, err)
+		last := i == len(bases)-1 || !replayable
+		if err != nil {
+			if last || req.Context().Err() != nil {
+				return nil, err
+			}
+			logger.LogWarn(fmt.Sprintf("Upstream %s unreachable (%v), trying %s", base, err, bases[i+1]))
+			continue
+		}
+		if resp.StatusCode >= 500 && !last {
+			resp.Body.Close()
+			logger.LogWarn(fmt.Sprintf("Upstream %s returned %d, trying %s", base, resp.StatusCode, bases[i+1]))
+			continue
+		}
+		return resp, nil
+	}
+	return nil, errors.New("no upstream configured")
+}
+
+// record counts the outcome of one request against base. Requests the
+// client gave up on say nothing about the upstream.
+func (t *failoverTransport) record(req *http.Request, base string, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		if req.Context().Err() == nil {
+			t.upstreams.recordFailure(base, err.Error())
+		}
+	case resp.StatusCode >= 500:
+		t.upstreams.recordFailure(base, resp.Status)
+	default:
+		t.upstreams.recordSuccess(base)
+	}
+}
+
+// rewrite returns req sent to target, with a fresh body when it is a repeat
+func rewrite(req *http.Request, target string, repeat bool) (*http.Request, error) {
+	if target == req.URL.String() && !repeat {
+		return req, nil
+	}
+	attempt := req.Clone(req.Context())
+	u, err := req.URL.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %s: %w", target, err)
+	}
+	attempt.URL = u
+	attempt.Host = ""
+	if repeat && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt.Body = body
+	}
+	return attempt, nil
+}
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	defaultTokenURI    = "https://oauth2.googleapis.com/token"
+	metadataURL        = "http://metadata.google.internal/computeMetadata/v1"
+	// tokenRefreshMargin renews a token this long before it expires
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// googleCredentials is a service account key or gcloud user credentials file
+type googleCredentials struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenSource mints OAuth access tokens for Google Cloud APIs from a
+// credentials file, or from the metadata server when there is none, as on
+// GCE or with GKE workload identity. A token is reused until shortly before
+// it expires.
+type tokenSource struct {
+	client *http.Client
+	creds  *googleCredentials
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newTokenSource reads the credentials file at path; an empty path uses the metadata server
+func newTokenSource(path string, client *http.Client) (*tokenSource, error) {
+	s := &tokenSource{client: client}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	var creds googleCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = defaultTokenURI
+	}
+	switch creds.Type {
+	case "service_account":
+		if creds.ClientEmail == "" {
+			return nil, fmt.Errorf("service account key %s has no client_email", path)
+		}
+		if s.key, err = parsePrivateKey(creds.PrivateKey); err != nil {
+			return nil, fmt.Errorf("service account key %s: %w", path, err)
+		}
+	case "authorized_user":
+		if creds.RefreshToken == "" {
+			return nil, fmt.Errorf("user credentials %s have no refresh_token", path)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q in %s, use a service account key or gcloud user credentials", creds.Type, path)
+	}
+	s.creds = &creds
+	return s, nil
+}
+
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	return key, nil
+}
+
+// Token returns a valid access token, minting a new one when needed
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expiry) > tokenRefreshMargin {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case s.creds == nil:
+		req, err = http.NewRequestWithContext(ctx, "GET", metadataURL+"/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	case s.key != nil:
+		var assertion string
+		if assertion, err = s.assertion(time.Now()); err == nil {
+			req, err = tokenRequest(ctx, s.creds.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		req, err = tokenRequest(ctx, s.creds.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {s.creds.ClientID},
+			"client_secret": {s.creds.ClientSecret},
+			"refresh_token": {s.creds.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch access token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("unexpected token response: %s", body)
+	}
+
+	s.token = token.AccessToken
+	s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+func tokenRequest(ctx context.Context, tokenURI string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// assertion signs the JWT a service account exchanges for an access token
+func (s *tokenSource) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.creds.ClientEmail,
+		"scope": cloudPlatformScope,
+		"aud":   s.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token request: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Project returns the project of the credentials, asking the metadata server when there is no file
+func (s *tokenSource) Project(ctx context.Context) (string, error) {
+	if s.creds != nil {
+		if s.creds.ProjectID == "" {
+			return "", errors.New("the credentials file names no project")
+		}
+		return s.creds.ProjectID, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL+"/project/project-id", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to ask the metadata server for the project: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status %d for the project", resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// KeyMap maps keys the proxy hands out to clients onto the upstream keys
+// they are served with, so users never see the real keys and can be revoked
+// one by one. Each distinct group of upstream keys is a KeyPool of its own,
+// shared by every client key mapped to it.
+type KeyMap struct {
+	cooldown time.Duration
+
+	mu      sync.RWMutex
+	clients map[string]*KeyPool
+	groups  map[string]*KeyPool
+}
+
+// NewKeyMap creates a map from entries, keyed by client key, whose values
+// list one or more upstream keys separated by "|"
+func NewKeyMap(entries map[string]string, cooldown time.Duration) *KeyMap {
+	m := &KeyMap{cooldown: cooldown, groups: make(map[string]*KeyPool)}
+	m.Set(entries)
+	return m
+}
+
+// Set replaces the mapping. Groups that remain keep their cooldown state.
+func (m *KeyMap) Set(entries map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clients := make(map[string]*KeyPool, len(entries))
+	groups := make(map[string]*KeyPool)
+	for client, value := range entries {
+		var keys []string
+		for _, key := range strings.Split(value, "|") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if client == "" || len(keys) == 0 {
+			logger.LogError(fmt.Sprintf("Ignoring client key mapping for %s without upstream keys", maskKey(client)))
+			continue
+		}
+
+		sort.Strings(keys)
+		id := strings.Join(keys, "|")
+		pool, ok := groups[id]
+		if !ok {
+			if pool, ok = m.groups[id]; !ok {
+				pool = NewKeyPool(keys, m.cooldown)
+			}
+			groups[id] = pool
+		}
+		clients[client] = pool
+	}
+	m.clients = clients
+	m.groups = groups
+	logger.LogInfo(fmt.Sprintf("Client key map now holds %d client keys in %d upstream key groups", len(clients), len(groups)))
+}
+
+// Lookup returns the upstream keys for clientKey, or nil if it is not mapped
+func (m *KeyMap) Lookup(clientKey string) *KeyPool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.clients[clientKey]
+}
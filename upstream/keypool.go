@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// KeyPool hands out proxy-owned API keys round-robin and takes keys that hit
+// a quota or permission error out of rotation for a cooldown period
+type KeyPool struct {
+	mu           sync.Mutex
+	keys         []string
+	next         int
+	cooldown     time.Duration
+	coolingUntil map[string]time.Time
+}
+
+// NewKeyPool creates a pool over keys; exhausted keys rest for cooldown
+func NewKeyPool(keys []string, cooldown time.Duration) *KeyPool {
+	return &KeyPool{
+		keys:         keys,
+		cooldown:     cooldown,
+		coolingUntil: make(map[string]time.Time),
+	}
+}
+
+// SetKeys replaces the keys in the pool, keeping the cooldown of keys that remain
+func (p *KeyPool) SetKeys(keys []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := make(map[string]time.Time)
+	for _, key := range keys {
+		if until, cooling := p.coolingUntil[key]; cooling {
+			kept[key] = until
+		}
+	}
+	p.keys = keys
+	p.next = 0
+	p.coolingUntil = kept
+	logger.LogInfo(fmt.Sprintf("API key pool now holds %d keys", len(keys)))
+}
+
+// Acquire returns the next key that is not cooling down. If every key is
+// cooling down, the one that recovers first is returned. An empty pool returns "".
+func (p *KeyPool) Acquire() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, _ := p.acquireLocked("")
+	return key
+}
+
+// Failover puts key into cooldown and returns another key that is not cooling
+// down, or false if there is none
+func (p *KeyPool) Failover(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.coolingUntil[key] = time.Now().Add(p.cooldown)
+	logger.LogError(fmt.Sprintf("API key %s exhausted, cooling down for %v", maskKey(key), p.cooldown))
+
+	next, available := p.acquireLocked(key)
+	if !available || next == key {
+		return "", false
+	}
+	return next, true
+}
+
+// Alternate returns a key other than key that is not cooling down, without
+// taking key out of rotation, or false if there is none
+func (p *KeyPool) Alternate(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next, available := p.acquireLocked(key)
+	if !available || next == key {
+		return "", false
+	}
+	return next, true
+}
+
+// acquireLocked picks the next available key other than skip. It reports
+// false, and the soonest-recovering key, if every key is cooling down.
+func (p *KeyPool) acquireLocked(skip string) (string, bool) {
+	now := time.Now()
+	soonest := ""
+	for i := 0; i < len(p.keys); i++ {
+		key := p.keys[(p.next+i)%len(p.keys)]
+		if key == skip {
+			continue
+		}
+		until, cooling := p.coolingUntil[key]
+		if !cooling || now.After(until) {
+			delete(p.coolingUntil, key)
+			p.next = (p.next + i + 1) % len(p.keys)
+			return key, true
+		}
+		if soonest == "" || until.Before(p.coolingUntil[soonest]) {
+			soonest = key
+		}
+	}
+	if soonest == "" && len(p.keys) > 0 {
+		soonest = p.keys[0]
+	}
+	return soonest, false
+}
+
+// IsKeyExhaustedStatus reports whether an upstream status means the key in
+// use hit its quota or lacks permission, so another key may succeed
+func IsKeyExhaustedStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusForbidden
+}
+
+func maskKey(key string) string {
+	if len(key) > 8 {
+		return "****" + key[len(key)-4:]
+	}
+	return "****"
+}
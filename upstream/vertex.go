@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gemini-antiblock/config"
+)
+
+// Upstream modes
+const (
+	// UpstreamModeGemini sends requests to the Generative Language API with API keys
+	UpstreamModeGemini = "gemini"
+	// UpstreamModeVertex sends requests to Vertex AI with OAuth tokens
+	UpstreamModeVertex = "vertex"
+)
+
+// apiVersions are the Generative Language API path prefixes Vertex AI requests are translated from
+var apiVersions = []string{"/v1beta/", "/v1alpha/", "/v1/"}
+
+// Vertex translates Generative Language API requests into Vertex AI requests
+// for a project and location, authenticating them with OAuth tokens
+type Vertex struct {
+	location string
+	baseURL  string
+	tokens   *tokenSource
+
+	mu      sync.Mutex
+	project string
+}
+
+// NewVertex sets up Vertex AI access from VERTEX_PROJECT, VERTEX_LOCATION and
+// VERTEX_CREDENTIALS_FILE, and VERTEX_URL_BASE for a private endpoint, falling back to GOOGLE_APPLICATION_CREDENTIALS and
+// then to the metadata server. Token requests go through transport.
+func NewVertex(cfg *config.Config, transport http.RoundTripper) (*Vertex, error) {
+	path := cfg.VertexCredentialsFile
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	tokens, err := newTokenSource(path, &http.Client{Transport: transport})
+	if err != nil {
+		return nil, err
+	}
+	location := cfg.VertexLocation
+	if location == "" {
+		location = "us-central1"
+	}
+	return &Vertex{location: location, baseURL: strings.TrimSuffix(cfg.VertexURLBase, "/"), tokens: tokens, project: cfg.VertexProject}, nil
+}
+
+// BaseURL returns the Vertex AI endpoint serving the location, or VERTEX_URL_BASE if set
+func (v *Vertex) BaseURL() string {
+	if v.baseURL != "" {
+		return v.baseURL
+	}
+	if v.location == "global" {
+		return "https://aiplatform.googleapis.com"
+	}
+	return "https://" + v.location + "-aiplatform.googleapis.com"
+}
+
+// projectID returns the configured project, or the credentials' own project
+func (v *Vertex) projectID(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.project == "" {
+		project, err := v.tokens.Project(ctx)
+		if err != nil {
+			return "", fmt.Errorf("VERTEX_PROJECT is not set: %w", err)
+		}
+		v.project = project
+	}
+	return v.project, nil
+}
+
+// TranslatePath maps a Generative Language API path such as
+// /v1beta/models/gemini-2.5-pro:streamGenerateContent to its Vertex AI
+// equivalent, /v1/projects/P/locations/L/publishers/google/models/gemini-2.5-pro:streamGenerateContent.
+// Other resources, such as cachedContents, are placed under the project and
+// location. Paths of no API version are left alone.
+func (v *Vertex) TranslatePath(path, project string) string {
+	for _, version := range apiVersions {
+		if !strings.HasPrefix(path, version) {
+			continue
+		}
+		rest := strings.TrimPrefix(path, version)
+		if strings.HasPrefix(rest, "projects/") {
+			return "/v1/" + rest
+		}
+		if rest == "models" || strings.HasPrefix(rest, "models/") {
+			rest = "publishers/google/" + rest
+		}
+		return "/v1/projects/" + project + "/locations/" + v.location + "/" + rest
+	}
+	return path
+}
+
+// isAPIPath reports whether path is versioned like the Generative Language API
+func isAPIPath(path string) bool {
+	for _, version := range apiVersions {
+		if strings.HasPrefix(path, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// vertexTransport sends requests written for the Generative Language API to
+// Vertex AI: it translates the path, replaces API keys with an OAuth token
+// and gives every message of the conversation the role Vertex AI requires
+type vertexTransport struct {
+	base   http.RoundTripper
+	vertex *Vertex
+}
+
+// CloseIdleConnections forwards to the base transport
+func (t *vertexTransport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (t *vertexTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fail := func(err error) (*http.Response, error) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	if !isAPIPath(req.URL.Path) {
+		return t.base.RoundTrip(req)
+	}
+	project, err := t.vertex.projectID(req.Context())
+	if err != nil {
+		return fail(err)
+	}
+	path := t.vertex.TranslatePath(req.URL.Path, project)
+	token, err := t.vertex.tokens.Token(req.Context())
+	if err != nil {
+		return fail(fmt.Errorf("vertex AI authentication failed: %w", err))
+	}
+
+	target, err := req.URL.Parse(t.vertex.BaseURL() + path)
+	if err != nil {
+		return fail(err)
+	}
+	query := req.URL.Query()
+	query.Del("key")
+	target.RawQuery = query.Encode()
+
+	attempt := req.Clone(req.Context())
+	attempt.URL = target
+	attempt.Host = ""
+	attempt.Header.Del("X-Goog-Api-Key")
+	attempt.Header.Set("Authorization", "Bearer "+token)
+
+	if req.Method == "POST" && req.Body != nil && req.Body != http.NoBody && strings.Contains(path, "/models/") {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = fillRoles(body)
+		attempt.Body = io.NopCloser(bytes.NewReader(body))
+		attempt.ContentLength = int64(len(body))
+		attempt.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return t.base.RoundTrip(attempt)
+}
+
+// fillRoles gives the messages of a request that have no role the user role;
+// the Generative Language API assumes it, Vertex AI rejects the request
+func fillRoles(body []byte) []byte {
+	var request map[string]interface{}
+	if json.Unmarshal(body, &request) != nil {
+		return body
+	}
+	contents, ok := request["contents"].([]interface{})
+	if !ok {
+		return body
+	}
+	changed := false
+	for _, content := range contents {
+		if message, ok := content.(map[string]interface{}); ok {
+			if role, _ := message["role"].(string); role == "" {
+				message["role"] = "user"
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return body
+	}
+	filled, err := json.Marshal(request)
+	if err != nil {
+		return body
+	}
+	return filled
+}
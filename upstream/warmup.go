@@ -0,0 +1,140 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// ProbeResult describes the outcome of the most recent warm-up probe
+type ProbeResult struct {
+	Time       time.Time     `json:"time"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Latency    time.Duration `json:"latency"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Warmer keeps a small number of established connections to the upstream host
+// so requests after idle periods don't pay the full DNS+TCP+TLS setup cost.
+// Over HTTP/2 concurrent probes share one multiplexed connection, so only one
+// connection is kept however many are asked for; each warm-up logs how many
+// connections it actually opened.
+type Warmer struct {
+	client      *http.Client
+	target      string
+	connections int
+	interval    time.Duration
+
+	mu       sync.Mutex
+	last     ProbeResult
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewWarmer creates a warmer that opens connections to baseURL through client.
+// A zero interval warms up once at start; otherwise probes repeat periodically.
+func NewWarmer(client *http.Client, baseURL string, connections int, interval time.Duration) *Warmer {
+	return &Warmer{
+		client:      client,
+		target:      baseURL + "/",
+		connections: connections,
+		interval:    interval,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start warms the pool and, if an interval is set, keeps it warm in the background
+func (w *Warmer) Start() {
+	go func() {
+		w.warm()
+		if w.interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.warm()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic warm-up; calling it again has no effect
+func (w *Warmer) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+// LastProbe returns the result of the most recent warm-up probe
+func (w *Warmer) LastProbe() ProbeResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// warm issues concurrent no-op requests so each one establishes (or reuses) a pooled connection
+func (w *Warmer) warm() {
+	var (
+		wg     sync.WaitGroup
+		connMu sync.Mutex
+		conns  = make(map[net.Conn]bool)
+	)
+	for i := 0; i < w.connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.probe(func(info httptrace.GotConnInfo) {
+				connMu.Lock()
+				conns[info.Conn] = conns[info.Conn] || !info.Reused
+				connMu.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+
+	opened := 0
+	for _, fresh := range conns {
+		if fresh {
+			opened++
+		}
+	}
+	logger.LogDebug(fmt.Sprintf("Upstream warm-up completed: %d probes used %d connections, %d newly opened", w.connections, len(conns), opened))
+}
+
+// probe sends one no-op request, reporting the connection it used to gotConn
+func (w *Warmer) probe(gotConn func(httptrace.GotConnInfo)) {
+	result := ProbeResult{Time: time.Now()}
+
+	var resp *http.Response
+	req, err := http.NewRequest(http.MethodHead, w.target, nil)
+	if err == nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{GotConn: gotConn}))
+		resp, err = w.client.Do(req)
+	}
+	result.Latency = time.Since(result.Time)
+	if err != nil {
+		result.Error = err.Error()
+		logger.LogDebug("Upstream warm-up probe failed:", err)
+	} else {
+		// Drain so the connection goes back to the idle pool
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+	}
+
+	w.mu.Lock()
+	w.last = result
+	w.mu.Unlock()
+}
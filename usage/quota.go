@@ -0,0 +1,109 @@
+package usage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Windows a quota is enforced over, reported by Quotas.Exceeded
+const (
+	WindowDay   = "day"
+	WindowMonth = "month"
+)
+
+// Quota is the allowance of one client key in tokens. A zero value disables that cap.
+type Quota struct {
+	// TokensPerDay is the number of tokens allowed per UTC day
+	TokensPerDay int64
+	// TokensPerMonth is the number of tokens allowed per UTC month
+	TokensPerMonth int64
+}
+
+// ParseQuota parses "tokensPerDay:tokensPerMonth". Empty fields keep the
+// value from defaults, so ":5000000" only changes the monthly allowance.
+func ParseQuota(spec string, defaults Quota) (Quota, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) > 2 {
+		return defaults, fmt.Errorf("quota %q has more than two fields", spec)
+	}
+	quota := defaults
+	targets := []*int64{&quota.TokensPerDay, &quota.TokensPerMonth}
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || n < 0 {
+			return defaults, fmt.Errorf("quota %q: invalid value %q", spec, field)
+		}
+		*targets[i] = n
+	}
+	return quota, nil
+}
+
+// Quotas enforces the token allowances of client keys against the usage a
+// tracker records. When the tracker persists to a shared store, usage is
+// checked against the store's counters, so replicas enforce one allowance. A key is admitted while it is under its allowance, so the
+// request that crosses it completes; later ones are rejected until the
+// window resets at the next UTC midnight or start of month.
+type Quotas struct {
+	tracker   *Tracker
+	defaults  Quota
+	overrides map[string]Quota
+}
+
+// NewQuotas creates quotas over tracker, applying defaults to every key
+// except those in overrides, which are keyed by credential
+func NewQuotas(tracker *Tracker, defaults Quota, overrides map[string]Quota) *Quotas {
+	return &Quotas{tracker: tracker, defaults: defaults, overrides: overrides}
+}
+
+// QuotaFor returns the allowance of credential
+func (q *Quotas) QuotaFor(credential string) Quota {
+	if quota, ok := q.overrides[credential]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+// Exceeded reports whether credential has used up its allowance: the window
+// used up, WindowDay or WindowMonth, and how long until it resets, or "" if
+// the key is under its allowance
+func (q *Quotas) Exceeded(credential string) (string, time.Duration) {
+	quota := q.QuotaFor(credential)
+	if quota.TokensPerDay <= 0 && quota.TokensPerMonth <= 0 {
+		return "", 0
+	}
+
+	today, month := q.usedTokens(ID(credential))
+	now := time.Now().UTC()
+	if quota.TokensPerMonth > 0 && month >= quota.TokensPerMonth {
+		nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return WindowMonth, nextMonth.Sub(now)
+	}
+	if quota.TokensPerDay > 0 && today >= quota.TokensPerDay {
+		midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return WindowDay, midnight.Sub(now)
+	}
+	return "", 0
+}
+
+// usedTokens returns the tokens the key with the given ID used today and this
+// month, from the shared store if the tracker persists to one and it can be
+// read, or else from this process alone
+func (q *Quotas) usedTokens(id string) (today, month int64) {
+	today, month, shared, err := q.tracker.SharedTokens(id)
+	if shared && err == nil {
+		return today, month
+	}
+	if err != nil {
+		logger.LogDebug("Checking quota against local usage, shared usage unavailable:", err)
+	}
+	u := q.tracker.Get(id)
+	return u.Today.Tokens, u.ThisMonth.Tokens
+}
@@ -0,0 +1,465 @@
+// Package usage attributes what the proxy consumes upstream to the client API
+// keys, or proxy-issued client keys, it serves: requests, streamed characters,
+// tokens, retries and errors, for the current UTC day, the current UTC month
+// and in total. Keys are tracked under a hash, so raw credentials are never
+// stored; the hash identifies the key as a tenant in metrics and the admin API.
+package usage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/storage"
+)
+
+// Usage lives in the quotas bucket of a shared store as one counter per key,
+// window and field, "usage:<id>:<window>:<field>", which replicas add to
+// atomically, plus the label and last activity of each key in "usage:<id>:meta".
+// The window is "total", "day:<YYYY-MM-DD>" or "month:<YYYY-MM>".
+const storagePrefix = "usage:"
+
+// Day and month counters are kept a little past the end of their window
+const (
+	dayCounterTTL   = 48 * time.Hour
+	monthCounterTTL = 32 * 24 * time.Hour
+)
+
+// Counters is the consumption of a key over some period
+type Counters struct {
+	Requests int64 `json:"requests"`
+	Chars    int64 `json:"chars"`
+	Tokens   int64 `json:"tokens"`
+	Retries  int64 `json:"retries"`
+	Errors   int64 `json:"errors"`
+}
+
+// counterFields names the fields of Counters in a shared store
+var counterFields = []struct {
+	name  string
+	field func(*Counters) *int64
+}{
+	{"requests", func(c *Counters) *int64 { return &c.Requests }},
+	{"chars", func(c *Counters) *int64 { return &c.Chars }},
+	{"tokens", func(c *Counters) *int64 { return &c.Tokens }},
+	{"retries", func(c *Counters) *int64 { return &c.Retries }},
+	{"errors", func(c *Counters) *int64 { return &c.Errors }},
+}
+
+func (c *Counters) add(delta Counters) {
+	c.Requests += delta.Requests
+	c.Chars += delta.Chars
+	c.Tokens += delta.Tokens
+	c.Retries += delta.Retries
+	c.Errors += delta.Errors
+}
+
+// KeyUsage is the consumption of one client key
+type KeyUsage struct {
+	// Key identifies the key without revealing it, as in logs and reports
+	Key       string    `json:"key"`
+	Day       string    `json:"day"`
+	Today     Counters  `json:"today"`
+	Month     string    `json:"month"`
+	ThisMonth Counters  `json:"this_month"`
+	Total     Counters  `json:"total"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// roll starts new day and month windows once now is past the current ones
+func (u *KeyUsage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.Today = Counters{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.ThisMonth = Counters{}
+	}
+}
+
+// Tracker keeps the usage of every client key and optionally persists it to a shared store
+type Tracker struct {
+	mu   sync.Mutex
+	keys map[string]*KeyUsage
+	// store is where usage is saved once persistence starts; nil keeps it in memory only
+	store storage.Store
+	// pendingCounts are the deltas not yet added to the store's counters, by counter key
+	pendingCounts map[string]int64
+	// pendingMeta are the key labels and activity not yet written to the store, by ID
+	pendingMeta map[string]keyMeta
+}
+
+// keyMeta is what a shared store keeps about a key besides its counters
+type keyMeta struct {
+	Key      string    `json:"key"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var (
+	globalTracker *Tracker
+	once          sync.Once
+)
+
+// GetGlobalTracker returns the process-wide usage tracker
+func GetGlobalTracker() *Tracker {
+	once.Do(func() {
+		globalTracker = NewTracker()
+	})
+	return globalTracker
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		keys:          make(map[string]*KeyUsage),
+		pendingCounts: make(map[string]int64),
+		pendingMeta:   make(map[string]keyMeta),
+	}
+}
+
+// ID returns the identifier a credential's usage is tracked under
+func ID(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Record adds delta to the usage of the key with the given ID, labelled key
+func (t *Tracker) Record(id, key string, delta Counters) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.keys[id]
+	if !ok {
+		u = &KeyUsage{}
+		t.keys[id] = u
+	}
+	u.Key = key
+	u.roll(now)
+	u.Today.add(delta)
+	u.ThisMonth.add(delta)
+	u.Total.add(delta)
+	u.LastSeen = now
+	if t.store != nil {
+		for _, window := range []string{"total", "day:" + u.Day, "month:" + u.Month} {
+			for _, f := range counterFields {
+				if value := *f.field(&delta); value != 0 {
+					t.pendingCounts[counterKey(id, window, f.name)] += value
+				}
+			}
+		}
+		t.pendingMeta[id] = keyMeta{Key: key, LastSeen: now}
+	}
+}
+
+// Get returns the usage of the key with the given ID, with the day and month
+// windows current
+func (t *Tracker) Get(id string) KeyUsage {
+	u, _ := t.Find(id)
+	return u
+}
+
+// Find is like Get, also reporting whether the key was ever seen
+func (t *Tracker) Find(id string) (KeyUsage, bool) {
+	t.mu.Lock()
+	current, ok := t.keys[id]
+	var u KeyUsage
+	if ok {
+		u = *current
+	}
+	t.mu.Unlock()
+	u.roll(time.Now())
+	return u, ok
+}
+
+// Snapshot returns a copy of the usage of every key by ID, with the day and
+// month windows current
+func (t *Tracker) Snapshot() map[string]KeyUsage {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]KeyUsage, len(t.keys))
+	for id, current := range t.keys {
+		u := *current
+		u.roll(now)
+		snapshot[id] = u
+	}
+	return snapshot
+}
+
+// SharedTokens returns the tokens the key with the given ID used today and
+// this month across every replica: the counters in the shared store plus the
+// usage not yet saved to it. ok is false if usage is not persisted to a store.
+func (t *Tracker) SharedTokens(id string) (today, month int64, ok bool, err error) {
+	now := time.Now().UTC()
+	dayKey := counterKey(id, "day:"+now.Format("2006-01-02"), "tokens")
+	monthKey := counterKey(id, "month:"+now.Format("2006-01"), "tokens")
+
+	t.mu.Lock()
+	store := t.store
+	today, month = t.pendingCounts[dayKey], t.pendingCounts[monthKey]
+	t.mu.Unlock()
+	if store == nil {
+		return 0, 0, false, nil
+	}
+
+	for _, counter := range []struct {
+		key   string
+		total *int64
+	}{{dayKey, &today}, {monthKey, &month}} {
+		value, err := store.Get(context.Background(), storage.BucketQuotas, counter.key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, true, err
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, 0, true, err
+		}
+		*counter.total += n
+	}
+	return today, month, true, nil
+}
+
+// LoadFromStore replaces the usage with the counters in a shared store, which
+// every replica adds to, plus any usage not yet saved to it
+func (t *Tracker) LoadFromStore(store storage.Store) error {
+	ctx := context.Background()
+	storeKeys, err := store.Keys(ctx, storage.BucketQuotas)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*KeyUsage)
+	for _, storeKey := range storeKeys {
+		if !strings.HasPrefix(storeKey, storagePrefix) {
+			continue
+		}
+		value, err := store.Get(ctx, storage.BucketQuotas, storeKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyStored(keys, storeKey, value); err != nil {
+			logger.LogError(fmt.Sprintf("Ignoring stored usage %s:", storeKey), err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for counterKey, delta := range t.pendingCounts {
+		applyCounter(keys, counterKey, delta)
+	}
+	for id, meta := range t.pendingMeta {
+		applyMeta(keys, id, meta)
+	}
+	t.keys = keys
+	return nil
+}
+
+// SaveToStore adds the usage recorded since the last save to the counters in
+// a shared store. Usage that fails to save is kept for the next attempt.
+func (t *Tracker) SaveToStore(store storage.Store) error {
+	t.mu.Lock()
+	counts, metas := t.pendingCounts, t.pendingMeta
+	t.pendingCounts, t.pendingMeta = make(map[string]int64), make(map[string]keyMeta)
+	t.mu.Unlock()
+
+	ctx := context.Background()
+	var err error
+	for counterKey, delta := range counts {
+		if _, err = store.Incr(ctx, storage.BucketQuotas, counterKey, delta, counterTTL(counterKey)); err != nil {
+			break
+		}
+		delete(counts, counterKey)
+	}
+	if err == nil {
+		for id, meta := range metas {
+			data, marshalErr := json.Marshal(meta)
+			if marshalErr != nil {
+				delete(metas, id)
+				continue
+			}
+			if err = store.Put(ctx, storage.BucketQuotas, metaKey(id), data, 0); err != nil {
+				break
+			}
+			delete(metas, id)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	for counterKey, delta := range counts {
+		t.pendingCounts[counterKey] += delta
+	}
+	for id, meta := range metas {
+		if _, newer := t.pendingMeta[id]; !newer {
+			t.pendingMeta[id] = meta
+		}
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// StartStorePersistence saves the usage to a shared store every interval in
+// the background, then reloads it so the usage of other replicas shows too
+func (t *Tracker) StartStorePersistence(store storage.Store, interval time.Duration) {
+	t.mu.Lock()
+	t.store = store
+	t.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := t.SaveToStore(store); err != nil {
+				logger.LogError("Failed to persist usage:", err)
+				continue
+			}
+			if err := t.LoadFromStore(store); err != nil {
+				logger.LogError("Failed to reload usage:", err)
+			}
+		}
+	}()
+}
+
+// WritePrometheus writes the total usage of every key as counters labelled
+// with the key's ID, so a shared deployment can be charged back per tenant
+func (t *Tracker) WritePrometheus(w io.Writer) {
+	snapshot := t.Snapshot()
+	series := []struct {
+		name, help string
+		value      func(Counters) int64
+	}{
+		{"tenant_requests_total", "Proxy requests received, by tenant.", func(c Counters) int64 { return c.Requests }},
+		{"tenant_retries_total", "Upstream retry attempts, by tenant.", func(c Counters) int64 { return c.Retries }},
+		{"tenant_errors_total", "Failed streaming sessions and upstream error responses, by tenant.", func(c Counters) int64 { return c.Errors }},
+		{"tenant_tokens_total", "Tokens consumed upstream, by tenant.", func(c Counters) int64 { return c.Tokens }},
+		{"tenant_chars_total", "Characters streamed to clients, by tenant.", func(c Counters) int64 { return c.Chars }},
+	}
+	for _, s := range series {
+		counts := make(map[string]int64, len(snapshot))
+		for id, u := range snapshot {
+			counts[id] = s.value(u.Total)
+		}
+		metrics.WriteLabeledCounter(w, s.name, s.help, "tenant", counts)
+	}
+}
+
+// counterKey is the store key of one field of a key's usage in window
+func counterKey(id, window, field string) string {
+	return storagePrefix + id + ":" + window + ":" + field
+}
+
+// metaKey is the store key of a key's label and last activity
+func metaKey(id string) string {
+	return storagePrefix + id + ":meta"
+}
+
+// counterTTL is how long a counter created under counterKey is kept
+func counterTTL(counterKey string) time.Duration {
+	parts := strings.Split(counterKey, ":")
+	if len(parts) == 5 {
+		switch parts[2] {
+		case "day":
+			return dayCounterTTL
+		case "month":
+			return monthCounterTTL
+		}
+	}
+	return 0
+}
+
+// applyStored adds a value read from a shared store to keys
+func applyStored(keys map[string]*KeyUsage, storeKey string, value []byte) error {
+	if id, ok := strings.CutSuffix(strings.TrimPrefix(storeKey, storagePrefix), ":meta"); ok {
+		var meta keyMeta
+		if err := json.Unmarshal(value, &meta); err != nil {
+			return err
+		}
+		applyMeta(keys, id, meta)
+		return nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return err
+	}
+	applyCounter(keys, storeKey, n)
+	return nil
+}
+
+// applyCounter adds n to the field and window of keys that counterKey names.
+// Only the latest day and month seen for a key are kept.
+func applyCounter(keys map[string]*KeyUsage, counterKey string, n int64) {
+	parts := strings.Split(counterKey, ":")
+	if len(parts) != 4 && len(parts) != 5 {
+		return
+	}
+	var target *Counters
+	u := keyUsage(keys, parts[1])
+	switch {
+	case len(parts) == 4 && parts[2] == "total":
+		target = &u.Total
+	case len(parts) == 5 && parts[2] == "day":
+		if parts[3] > u.Day {
+			u.Day, u.Today = parts[3], Counters{}
+		}
+		if parts[3] == u.Day {
+			target = &u.Today
+		}
+	case len(parts) == 5 && parts[2] == "month":
+		if parts[3] > u.Month {
+			u.Month, u.ThisMonth = parts[3], Counters{}
+		}
+		if parts[3] == u.Month {
+			target = &u.ThisMonth
+		}
+	}
+	if target == nil {
+		return
+	}
+	field := parts[len(parts)-1]
+	for _, f := range counterFields {
+		if f.name == field {
+			*f.field(target) += n
+			return
+		}
+	}
+}
+
+// applyMeta records a key's label and keeps its latest activity
+func applyMeta(keys map[string]*KeyUsage, id string, meta keyMeta) {
+	u := keyUsage(keys, id)
+	if meta.LastSeen.After(u.LastSeen) || u.Key == "" {
+		u.Key = meta.Key
+	}
+	if meta.LastSeen.After(u.LastSeen) {
+		u.LastSeen = meta.LastSeen
+	}
+}
+
+// keyUsage returns the usage of id in keys, adding it if missing
+func keyUsage(keys map[string]*KeyUsage, id string) *KeyUsage {
+	u, ok := keys[id]
+	if !ok {
+		u = &KeyUsage{}
+		keys[id] = u
+	}
+	return u
+}